@@ -0,0 +1,201 @@
+package epubconv
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Anchor is a position in the converted text that a location in the book
+// maps to: the start of a chapter, or of an element with an id. It is
+// passed to Options.Anchors, for tools that map between places in the book
+// and places in its text, such as highlights.
+type Anchor struct {
+	// Path is the archive path of the content document
+	Path string `json:"href"`
+	// ID is the id of the element, or "" for the start of the chapter
+	ID string `json:"id,omitempty"`
+	// Offset is the position of the anchor in the text in characters
+	// (runes), and ByteOffset in bytes of its UTF-8
+	Offset     int `json:"offset"`
+	ByteOffset int `json:"byteOffset"`
+}
+
+// Anchors are marked in the extracted text by a pair of runes from the
+// Supplementary Private Use Areas, the first from Area-A and the second
+// from Area-B, encoding the index of the anchor in the book's anchorTable,
+// until they are taken out of the finished text. Not being spaces, a
+// marker stays with the word it is put before.
+const (
+	anchorHigh = 0xF0000
+	anchorLow  = 0x100000
+	// anchorBase is the number of runes of each area used
+	anchorBase = 0xFFFE
+)
+
+// anchorTable holds the anchors of a book as it is converted, by index.
+// Content documents converted at once add to it in any order, which only
+// changes the markers, not where the anchors end up.
+type anchorTable struct {
+	mu      sync.Mutex
+	anchors []Anchor
+}
+
+// marker adds an anchor for the element with the given id in the content
+// document at path, returning its marker
+func (t *anchorTable) marker(path, id string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := len(t.anchors)
+	t.anchors = append(t.anchors, Anchor{Path: path, ID: id})
+	return string([]rune{anchorHigh + rune(i/anchorBase), anchorLow + rune(i%anchorBase)})
+}
+
+// get returns the anchor with index i, if there is one
+func (t *anchorTable) get(i int) (Anchor, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i >= len(t.anchors) {
+		return Anchor{}, false
+	}
+	return t.anchors[i], true
+}
+
+// isAnchorRune reports whether r can be part of an anchor marker
+func isAnchorRune(r rune) bool {
+	return r >= anchorHigh
+}
+
+// hasAnchors reports whether the anchors of o are marked in the text
+func (o Options) hasAnchors() bool {
+	return o.Anchors != nil && o.Format != FormatPandoc
+}
+
+// markedAnchor is an element with an id, at the position in the extracted
+// text its content starts
+type markedAnchor struct {
+	id  string
+	pos int
+}
+
+// insertAnchors puts the markers of anchors, and of the start of the
+// chapter, into the extracted text of the content document at docPath.
+// Each goes before the first character at or after its position, past any
+// other markers, so that it stays with the text it points to.
+func insertAnchors(text []byte, docPath string, anchors []markedAnchor, table *anchorTable) string {
+	var out strings.Builder
+	last := 0
+	anchors = append([]markedAnchor{{pos: 0}}, anchors...)
+	for _, anchor := range anchors {
+		pos := anchorPos(text, max(min(anchor.pos, len(text)), last))
+		out.Write(text[last:pos])
+		out.WriteString(table.marker(docPath, anchor.id))
+		last = pos
+	}
+	out.Write(text[last:])
+	return out.String()
+}
+
+// anchorPos returns the position of the first character of text at or
+// after pos, skipping whitespace and the heading, table, class and
+// aria-describedby markers. It is the end of text if there is none.
+func anchorPos(text []byte, pos int) int {
+	for pos < len(text) {
+		switch c := text[pos]; c {
+		case ' ', '\t', '\r', '\n', tableMarker[0]:
+			pos++
+		case headingMarker[0]:
+			pos += 2
+		case classMarker[0], describedByMarker[0]:
+			end := strings.IndexByte(string(text[pos+1:]), c)
+			if end < 0 {
+				return len(text)
+			}
+			pos += end + 2
+		default:
+			return pos
+		}
+	}
+	return len(text)
+}
+
+// withoutAnchors returns text without its anchor markers
+func withoutAnchors(text string) string {
+	if !strings.ContainsFunc(text, isAnchorRune) {
+		return text
+	}
+	return strings.Map(func(r rune) rune {
+		if isAnchorRune(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// keepAnchors calls transform with text without its anchor markers. If it
+// returns the text unchanged the markers stay where they were, and
+// otherwise they move to the start of the result, so that a rewritten
+// paragraph or chapter keeps its anchors.
+func keepAnchors(text string, transform func(string) (string, error)) (string, error) {
+	plain := withoutAnchors(text)
+	if plain == text {
+		return transform(text)
+	}
+	out, err := transform(plain)
+	if err != nil {
+		return "", err
+	}
+	if out == plain {
+		return text, nil
+	}
+	var markers strings.Builder
+	for _, r := range text {
+		if isAnchorRune(r) {
+			markers.WriteRune(r)
+		}
+	}
+	return markers.String() + out, nil
+}
+
+// takeAnchors removes the anchor markers from text, which starts at the
+// given rune and byte offsets of the converted text, and reports each
+// anchor to the Anchors option
+func (b *Book) takeAnchors(text string, runes, bytes int) string {
+	if b.anchors == nil || !strings.ContainsFunc(text, isAnchorRune) {
+		return text
+	}
+	var out strings.Builder
+	high := rune(-1)
+	for _, r := range text {
+		if high >= 0 && r >= anchorLow {
+			if anchor, ok := b.anchors.get(int(high)*anchorBase + int(r-anchorLow)); ok {
+				anchor.Offset, anchor.ByteOffset = runes, bytes+out.Len()
+				b.opts.Anchors(anchor)
+			}
+			high = -1
+			continue
+		}
+		if high >= 0 {
+			// Not a marker after all
+			out.WriteRune(anchorHigh + high)
+			runes++
+			high = -1
+		}
+		if r >= anchorHigh && r < anchorLow {
+			high = r - anchorHigh
+			continue
+		}
+		out.WriteRune(r)
+		runes++
+	}
+	if high >= 0 {
+		out.WriteRune(anchorHigh + high)
+	}
+	return out.String()
+}
+
+// textLength returns the length of text in characters, leaving out
+// surrounding whitespace and anchor markers
+func textLength(text string) int {
+	return utf8.RuneCountInString(strings.TrimSpace(withoutAnchors(text)))
+}
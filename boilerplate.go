@@ -0,0 +1,59 @@
+package epubconv
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Project Gutenberg books wrap the text in "*** START OF THE PROJECT
+// GUTENBERG EBOOK <TITLE> ***" and "*** END OF ... ***" marker lines, with
+// the producer credits before the start and the license after the end.
+var (
+	gutenbergStart = regexp.MustCompile(`(?im)^.*?\*{3}\s*START OF (THE|THIS) PROJECT GUTENBERG E-?BOOK.*$`)
+	gutenbergEnd   = regexp.MustCompile(`(?im)^.*?\*{3}\s*END OF (THE|THIS) PROJECT GUTENBERG E-?BOOK.*$`)
+)
+
+// stripGutenbergBoilerplate removes everything up to and including the
+// Project Gutenberg start marker and everything from the end marker on. It
+// reports whether either marker was found.
+func stripGutenbergBoilerplate(text string) (string, bool) {
+	found := false
+	if loc := gutenbergStart.FindStringIndex(text); loc != nil {
+		text = text[loc[1]:]
+		found = true
+	}
+	if loc := gutenbergEnd.FindStringIndex(text); loc != nil {
+		text = text[:loc[0]]
+		found = true
+	}
+	if !found {
+		return text, false
+	}
+	return strings.TrimSpace(text) + "\n", true
+}
+
+// stripGutenbergChapters removes the Project Gutenberg boilerplate from a
+// book converted chapter by chapter: the chapters before the one with the
+// start marker and after the one with the end marker are dropped along with
+// the text around the markers. It reports whether either marker was found.
+func stripGutenbergChapters(chapters []Chapter) ([]Chapter, bool) {
+	found := false
+	for i, chapter := range chapters {
+		if loc := gutenbergStart.FindStringIndex(chapter.Text); loc != nil {
+			chapters = slices.Clone(chapters[i:])
+			chapters[0].Text = strings.TrimSpace(chapter.Text[loc[1]:])
+			found = true
+			break
+		}
+	}
+	for i, chapter := range chapters {
+		if loc := gutenbergEnd.FindStringIndex(chapter.Text); loc != nil {
+			chapters = slices.Clone(chapters[:i+1])
+			chapters[i].Text = strings.TrimSpace(chapter.Text[:loc[0]])
+			found = true
+			break
+		}
+	}
+	return slices.DeleteFunc(chapters, func(c Chapter) bool { return c.Text == "" }), found
+}
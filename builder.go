@@ -0,0 +1,405 @@
+package epubconv
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Builder assembles an EPUB 3 book from chapters of Markdown or plain text,
+// the reverse of converting one. Set the metadata fields, add the chapters
+// in reading order and call Write.
+type Builder struct {
+	Title   string
+	Authors []string
+	// Language is the book's language as a BCP 47 code, "en" if empty
+	Language string
+	// Identifier is the book's unique identifier. If empty, a UUID derived
+	// from the book's metadata and chapters is used, so building the same
+	// book again gives it the same identifier.
+	Identifier string
+	// Modified is when the book was last modified, now if zero
+	Modified time.Time
+
+	chapters []builderChapter
+	images   []builderImage
+	cover    *builderImage
+}
+
+// builderChapter is a chapter added to a Builder
+type builderChapter struct {
+	title    string
+	source   string
+	markdown bool
+	// images holds the srcs of the images a Markdown chapter refers to
+	images []string
+}
+
+// builderImage is an image added to a Builder, with the src chapters refer
+// to it by and its archive path
+type builderImage struct {
+	src       string
+	path      string
+	mediaType string
+	data      []byte
+}
+
+// AddMarkdown adds a chapter written in Markdown. If title is empty, the
+// text of the chapter's first heading is used. Images it refers to by a
+// relative src are included if added with AddImage, and otherwise replaced
+// with their alt text.
+func (b *Builder) AddMarkdown(title, source string) {
+	r := &markdownRenderer{}
+	r.render(source)
+	if title == "" {
+		title = r.heading
+	}
+	b.chapters = append(b.chapters, builderChapter{title: title, source: source, markdown: true, images: r.images})
+}
+
+// AddText adds a chapter of plain text. Paragraphs are separated by blank
+// lines, and a paragraph's lines are joined; text without blank lines, such
+// as epubconv's own output, has a paragraph to a line.
+func (b *Builder) AddText(title, text string) {
+	b.chapters = append(b.chapters, builderChapter{title: title, source: text})
+}
+
+// MissingImages returns the relative srcs of the images the Markdown
+// chapters refer to that haven't been added with AddImage, in order. Read
+// each from where the chapter's file is and add it.
+func (b *Builder) MissingImages() []string {
+	var missing []string
+	seen := make(map[string]bool)
+	for _, chapter := range b.chapters {
+		for _, src := range chapter.images {
+			if !isLocalSrc(src) || seen[src] || b.image(src) != nil {
+				continue
+			}
+			seen[src] = true
+			missing = append(missing, src)
+		}
+	}
+	return missing
+}
+
+// AddImage adds the image the Markdown chapters refer to by src
+func (b *Builder) AddImage(src string, data []byte) error {
+	mediaType, err := imageMediaType(src, data)
+	if err != nil {
+		return err
+	}
+	if b.image(src) != nil {
+		return nil
+	}
+	b.images = append(b.images, builderImage{src: src, path: b.imagePath(path.Base(src)), mediaType: mediaType, data: data})
+	return nil
+}
+
+// SetCover sets the book's cover image, named name, which gets a page of
+// its own before the chapters
+func (b *Builder) SetCover(name string, data []byte) error {
+	mediaType, err := imageMediaType(name, data)
+	if err != nil {
+		return err
+	}
+	b.cover = &builderImage{path: b.imagePath("cover" + path.Ext(name)), mediaType: mediaType, data: data}
+	return nil
+}
+
+// image returns the image added with src, or nil
+func (b *Builder) image(src string) *builderImage {
+	for i := range b.images {
+		if b.images[i].src == src {
+			return &b.images[i]
+		}
+	}
+	return nil
+}
+
+// imagePath returns an archive path for an image named name that no other
+// image has
+func (b *Builder) imagePath(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '#' || r == '?' || r == '%' || r <= ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	taken := func(p string) bool {
+		if b.cover != nil && b.cover.path == p {
+			return true
+		}
+		for _, image := range b.images {
+			if image.path == p {
+				return true
+			}
+		}
+		return false
+	}
+	p := "images/" + name
+	for n := 2; taken(p); n++ {
+		p = fmt.Sprintf("images/%s-%d%s", stem, n, ext)
+	}
+	return p
+}
+
+// isLocalSrc reports whether src refers to a file alongside the chapter
+// rather than a URL
+func isLocalSrc(src string) bool {
+	return src != "" && !strings.Contains(src, ":") && !strings.HasPrefix(src, "/") && !strings.HasPrefix(src, "#")
+}
+
+// imageMediaType returns the media type of the image data named name,
+// failing if it isn't an image
+func imageMediaType(name string, data []byte) (string, error) {
+	mediaType := http.DetectContentType(data)
+	if !strings.HasPrefix(mediaType, "image/") {
+		// SVG is detected as text
+		mediaType, _, _ = strings.Cut(mime.TypeByExtension(strings.ToLower(path.Ext(name))), ";")
+	}
+	if !strings.HasPrefix(mediaType, "image/") {
+		return "", fmt.Errorf(msg("ErrNotImage", "%s isn't an image"), name)
+	}
+	return mediaType, nil
+}
+
+// builderRoot is the directory of the package document in a built book
+const builderRoot = "OEBPS/"
+
+// Write writes the book to w as an EPUB 3 archive, with a navigation
+// document and, for older reading systems, an NCX
+func (b *Builder) Write(w io.Writer) error {
+	if strings.TrimSpace(b.Title) == "" {
+		return errors.New(msg("ErrBuildTitle", "the book needs a title"))
+	}
+	if len(b.chapters) == 0 {
+		return errors.New(msg("ErrBuildChapters", "the book has no chapters"))
+	}
+	language := b.Language
+	if language == "" {
+		language = "en"
+	}
+	modified := b.Modified
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	modified = modified.UTC().Truncate(time.Second)
+	identifier := b.Identifier
+	if identifier == "" {
+		identifier = b.uuid()
+	}
+
+	zw := zip.NewWriter(w)
+	add := func(name string, method uint16, data []byte) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modified})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+	// The mimetype file must come first and be stored uncompressed
+	if err := add("mimetype", zip.Store, []byte("application/epub+zip")); err != nil {
+		return err
+	}
+	container := `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="` + builderRoot + `content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+	if err := add("META-INF/container.xml", zip.Deflate, []byte(container)); err != nil {
+		return err
+	}
+
+	var manifest, spine, nav, ncx strings.Builder
+	item := func(id, href, mediaType, properties string) {
+		fmt.Fprintf(&manifest, `    <item id="%s" href="%s" media-type="%s"`, id, html.EscapeString(href), mediaType)
+		if properties != "" {
+			fmt.Fprintf(&manifest, ` properties="%s"`, properties)
+		}
+		manifest.WriteString("/>\n")
+	}
+	item("nav", "nav.xhtml", "application/xhtml+xml", "nav")
+	item("ncx", "toc.ncx", "application/x-dtbncx+xml", "")
+
+	if b.cover != nil {
+		item("cover-image", b.cover.path, b.cover.mediaType, "cover-image")
+		item("cover", "cover.xhtml", "application/xhtml+xml", "")
+		spine.WriteString(`    <itemref idref="cover" linear="no"/>` + "\n")
+		body := `<div class="cover"><img src="` + html.EscapeString(b.cover.path) + `" alt="` + html.EscapeString(b.Title) + `"/></div>`
+		if err := add(builderRoot+"cover.xhtml", zip.Deflate, xhtmlDocument(b.Title, language, body)); err != nil {
+			return err
+		}
+		if err := add(builderRoot+b.cover.path, zip.Deflate, b.cover.data); err != nil {
+			return err
+		}
+	}
+	for i, image := range b.images {
+		item(fmt.Sprintf("image%d", i+1), image.path, image.mediaType, "")
+		if err := add(builderRoot+image.path, zip.Deflate, image.data); err != nil {
+			return err
+		}
+	}
+
+	for i, chapter := range b.chapters {
+		id := fmt.Sprintf("chapter%03d", i+1)
+		href := id + ".xhtml"
+		title := strings.TrimSpace(chapter.title)
+		if title == "" {
+			title = fmt.Sprintf(msg("BuildChapterTitle", "Chapter %d"), i+1)
+		}
+		var body string
+		if chapter.markdown {
+			r := &markdownRenderer{image: func(src string) (string, bool) {
+				if image := b.image(src); image != nil {
+					return image.path, true
+				}
+				return src, !isLocalSrc(src)
+			}}
+			body = r.render(chapter.source)
+		} else {
+			body = textBody(chapter.source)
+		}
+		item(id, href, "application/xhtml+xml", "")
+		fmt.Fprintf(&spine, `    <itemref idref="%s"/>`+"\n", id)
+		fmt.Fprintf(&nav, `      <li><a href="%s">%s</a></li>`+"\n", href, html.EscapeString(title))
+		fmt.Fprintf(&ncx, `    <navPoint id="nav%d" playOrder="%d"><navLabel><text>%s</text></navLabel><content src="%s"/></navPoint>`+"\n",
+			i+1, i+1, html.EscapeString(title), href)
+		if err := add(builderRoot+href, zip.Deflate, xhtmlDocument(title, language, body)); err != nil {
+			return err
+		}
+	}
+
+	navBody := `<nav epub:type="toc" id="toc">
+    <h1>` + html.EscapeString(msg("BuildContents", "Contents")) + `</h1>
+    <ol>
+` + nav.String() + `    </ol>
+  </nav>`
+	if err := add(builderRoot+"nav.xhtml", zip.Deflate, xhtmlDocument(b.Title, language, navBody)); err != nil {
+		return err
+	}
+	ncxDoc := `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head>
+    <meta name="dtb:uid" content="` + html.EscapeString(identifier) + `"/>
+  </head>
+  <docTitle><text>` + html.EscapeString(b.Title) + `</text></docTitle>
+  <navMap>
+` + ncx.String() + `  </navMap>
+</ncx>
+`
+	if err := add(builderRoot+"toc.ncx", zip.Deflate, []byte(ncxDoc)); err != nil {
+		return err
+	}
+
+	var metadata strings.Builder
+	fmt.Fprintf(&metadata, "    <dc:identifier id=\"bookid\">%s</dc:identifier>\n", html.EscapeString(identifier))
+	fmt.Fprintf(&metadata, "    <dc:title>%s</dc:title>\n", html.EscapeString(strings.TrimSpace(b.Title)))
+	for i, author := range trimAll(b.Authors) {
+		fmt.Fprintf(&metadata, "    <dc:creator id=\"creator%d\">%s</dc:creator>\n", i+1, html.EscapeString(author))
+		fmt.Fprintf(&metadata, "    <meta refines=\"#creator%d\" property=\"role\" scheme=\"marc:relators\">aut</meta>\n", i+1)
+	}
+	fmt.Fprintf(&metadata, "    <dc:language>%s</dc:language>\n", html.EscapeString(language))
+	fmt.Fprintf(&metadata, "    <meta property=\"dcterms:modified\">%s</meta>\n", modified.Format("2006-01-02T15:04:05Z"))
+	if b.cover != nil {
+		metadata.WriteString("    <meta name=\"cover\" content=\"cover-image\"/>\n")
+	}
+	opf := `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid" xml:lang="` + html.EscapeString(language) + `">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+` + metadata.String() + `  </metadata>
+  <manifest>
+` + manifest.String() + `  </manifest>
+  <spine toc="ncx">
+` + spine.String() + `  </spine>
+</package>
+`
+	if err := add(builderRoot+"content.opf", zip.Deflate, []byte(opf)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// uuid returns a name-based (version 5 style) UUID URN for the book, from
+// its metadata and chapters
+func (b *Builder) uuid() string {
+	h := sha1.New()
+	for _, s := range append([]string{b.Title, b.Language}, b.Authors...) {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	for _, chapter := range b.chapters {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(chapter.title), chapter.title, len(chapter.source), chapter.source)
+	}
+	sum := h.Sum(nil)
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// xhtmlDocument returns an XHTML content document with the given title and
+// body content
+func xhtmlDocument(title, language, body string) []byte {
+	lang := html.EscapeString(language)
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="` + lang + `" lang="` + lang + `">
+<head>
+  <title>` + html.EscapeString(title) + `</title>
+</head>
+<body>
+  ` + body + `
+</body>
+</html>
+`)
+}
+
+// textBody returns the XHTML paragraphs of a plain text chapter
+func textBody(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	var paragraphs [][]string
+	var paragraph []string
+	blankLines := false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			blankLines = true
+			if len(paragraph) > 0 {
+				paragraphs = append(paragraphs, paragraph)
+				paragraph = nil
+			}
+			continue
+		}
+		paragraph = append(paragraph, line)
+	}
+	if len(paragraph) > 0 {
+		paragraphs = append(paragraphs, paragraph)
+	}
+	if !blankLines && len(paragraphs) == 1 {
+		// A line to a paragraph
+		paragraphs = nil
+		for _, line := range paragraph {
+			paragraphs = append(paragraphs, []string{line})
+		}
+	}
+
+	var body bytes.Buffer
+	for _, p := range paragraphs {
+		body.WriteString("<p>" + html.EscapeString(strings.Join(p, " ")) + "</p>\n")
+	}
+	return body.String()
+}
@@ -0,0 +1,33 @@
+package epubconv
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// canonicalText normalizes text for diffing conversions made by different
+// versions of the tool: NFC, Unix line endings, runs of whitespace collapsed
+// to single spaces, lines trimmed, exactly one blank line between blocks and
+// a single trailing newline
+func canonicalText(text string) string {
+	text = norm.NFC.String(text)
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	var out strings.Builder
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			blank = out.Len() > 0
+			continue
+		}
+		if blank {
+			out.WriteString("\n")
+			blank = false
+		}
+		out.WriteString(line + "\n")
+	}
+	return out.String()
+}
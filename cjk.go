@@ -0,0 +1,138 @@
+package epubconv
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+)
+
+// Ruby styles for Options.Ruby
+const (
+	RubyKeep         = "keep"
+	RubyStrip        = "strip"
+	RubyParenthesize = "parenthesize"
+)
+
+var RubyStyles = []string{RubyKeep, RubyStrip, RubyParenthesize}
+
+// Page progression directions of Spine.PageProgressionDirection
+const (
+	DirectionLTR = "ltr"
+	DirectionRTL = "rtl"
+)
+
+// rubyTag handles the annotations of a <ruby> element for RubyStrip and
+// RubyParenthesize: the ruby text of its <rt> and <rtc> elements, such as
+// the furigana giving the reading of kanji, and the <rp> parentheses that
+// browsers without ruby support show around it. An annotation ends at its
+// end tag, the start of the next one or the end of the <ruby>.
+func (e *textExtractor) rubyTag(t htmlTag) {
+	switch t.name {
+	case "rt", "rtc", "rp":
+		if t.closing {
+			if e.ruby == t.name {
+				e.endRuby()
+			}
+			return
+		}
+		if t.selfClosing || e.ruby == "rtc" && t.name == "rt" {
+			return
+		}
+		e.endRuby()
+		e.ruby = t.name
+		if t.name != "rp" && e.opts.Ruby == RubyParenthesize {
+			e.text.WriteByte('(')
+		}
+	case "ruby":
+		if t.closing {
+			e.endRuby()
+		}
+	}
+}
+
+// endRuby ends the ruby annotation being read, if any
+func (e *textExtractor) endRuby() {
+	if e.ruby != "" && e.ruby != "rp" && e.opts.Ruby == RubyParenthesize {
+		e.text.Truncate(len(bytes.TrimRight(e.text.Bytes(), " ")))
+		e.text.WriteByte(')')
+	}
+	e.ruby = ""
+}
+
+// inRubyText reports whether text read now is ruby text left out
+func (e *textExtractor) inRubyText() bool {
+	return e.ruby == "rp" || e.ruby != "" && e.opts.Ruby == RubyStrip
+}
+
+// isVerticalForm reports whether r is one of the presentation forms of
+// punctuation for vertical writing, such as U+FE12 (︒) for 。
+func isVerticalForm(r rune) bool {
+	return r >= 0xFE10 && r <= 0xFE19 || r >= 0xFE30 && r <= 0xFE4F
+}
+
+// foldVerticalForms replaces the punctuation forms for vertical writing
+// that books typeset vertically sometimes use with the ordinary characters,
+// which are shown upright in horizontal text
+func foldVerticalForms(text string) string {
+	if !strings.ContainsFunc(text, isVerticalForm) {
+		return text
+	}
+	var out strings.Builder
+	for _, r := range text {
+		if isVerticalForm(r) {
+			out.WriteString(norm.NFKC.String(string(r)))
+		} else {
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+// isWide reports whether r is a wide East Asian character, taking two
+// columns
+func isWide(r rune) bool {
+	kind := width.LookupRune(r).Kind()
+	return kind == width.EastAsianWide || kind == width.EastAsianFullwidth
+}
+
+// Characters that Chinese and Japanese line breaking (kinsoku shori) keeps
+// from starting a line, such as closing brackets, stops and small kana, and
+// from ending one, the opening brackets
+const (
+	noLineStart = ")]}〕〉》」』】〙〗〟’”｠»、。，．・：；！？‼⁇⁈⁉…‥ーヽヾゝゞ々〻ぁぃぅぇぉっゃゅょゎゕゖァィゥェォッャュョヮヵヶㇰㇱㇲㇳㇴㇵㇶㇷㇸㇹㇺㇻㇼㇽㇾㇿ゠〜～）］｝＞％"
+	noLineEnd   = "([{〔〈《「『【〘〖〝‘“｟«（［｛＜"
+)
+
+// breakWord splits word where a line may break within it: between two
+// characters either of which is a wide East Asian one, as Chinese and
+// Japanese text isn't broken into words by spaces, but not before a
+// character that can't start a line or after one that can't end a line.
+// Anchor markers stay with the character after them.
+func breakWord(word string) []string {
+	var parts []string
+	start, marks := 0, -1
+	prev := rune(-1)
+	for i, r := range word {
+		if isAnchorRune(r) {
+			if marks < 0 {
+				marks = i
+			}
+			continue
+		}
+		at := i
+		if marks >= 0 {
+			at, marks = marks, -1
+		}
+		if prev >= 0 && at > start && (isWide(prev) || isWide(r)) &&
+			!strings.ContainsRune(noLineStart, r) && !strings.ContainsRune(noLineEnd, prev) &&
+			!unicode.In(r, unicode.Mn, unicode.Me) {
+			parts = append(parts, word[start:at])
+			start = at
+		}
+		prev = r
+	}
+	return append(parts, word[start:])
+}
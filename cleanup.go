@@ -0,0 +1,174 @@
+package epubconv
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Quote styles for Options.Quotes
+const (
+	QuotesKeep     = "keep"
+	QuotesStraight = "straight"
+	QuotesCurly    = "curly"
+)
+
+var QuoteStyles = []string{QuotesKeep, QuotesStraight, QuotesCurly}
+
+// softHyphen marks where a word may be hyphenated, and is invisible unless
+// it is
+const softHyphen = "\u00ad"
+
+// sentenceEnds are the characters a line ends with at the end of a
+// paragraph, rather than where a scanned page's line broke
+const sentenceEnds = ".!?:;…\"'”’»)]」』。！？"
+
+// joinLines joins each line of the extracted text of a chapter to the next
+// where it looks like the paragraph went on: with JoinLines, a line that
+// doesn't end a sentence before a line starting in lower case, and with
+// Dehyphenate, a line ending in a hyphenated word before one starting in
+// lower case, without the hyphen. Blank lines, headings and tables aren't
+// joined.
+func joinLines(text string, opts Options) string {
+	lines := strings.Split(text, "\n")
+	minLength := joinLength(lines)
+	out := lines[:1]
+	for _, line := range lines[1:] {
+		prev := &out[len(out)-1]
+		if join, hyphen := continues(*prev, line, minLength, opts); join {
+			next := strings.TrimLeft(line, " ")
+			if hyphen != "" {
+				*prev = strings.TrimSuffix(strings.TrimRight(*prev, " "), hyphen) + next
+			} else {
+				*prev = strings.TrimRight(*prev, " ") + " " + next
+			}
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+// minJoinLength is the shortest line, in characters, JoinLines joins to the
+// next. A printed page's lines are longer.
+const minJoinLength = 30
+
+// joinLength is how long a line of lines must be, in characters, for
+// JoinLines to join it to the next: three fifths of the median length of
+// the lines, and at least minJoinLength. The lines of a scanned page run
+// almost to its width, so this leaves alone the short lines of lists,
+// verse and code.
+func joinLength(lines []string) int {
+	var lengths []int
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" && !isMarked(line) {
+			lengths = append(lengths, utf8.RuneCountInString(line))
+		}
+	}
+	if len(lengths) == 0 {
+		return minJoinLength
+	}
+	slices.Sort(lengths)
+	return max(lengths[len(lengths)/2]*3/5, minJoinLength)
+}
+
+// continues reports whether next goes on with the paragraph of line, and
+// the hyphen ending line to remove if it breaks a word between them
+func continues(line, next string, minLength int, opts Options) (bool, string) {
+	line, next = strings.TrimRight(line, " "), strings.TrimLeft(next, " ")
+	// Anchor markers don't count
+	line, next = strings.TrimRightFunc(line, isAnchorRune), strings.TrimLeftFunc(next, isAnchorRune)
+	if line == "" || next == "" || isMarked(line) || isMarked(next) {
+		return false, ""
+	}
+	first, _ := utf8.DecodeRuneInString(next)
+	if !unicode.IsLower(first) {
+		return false, ""
+	}
+	last, size := utf8.DecodeLastRuneInString(line)
+	if opts.Dehyphenate && (last == '-' || last == '\u2010' || last == '\u00ad') {
+		// Only a hyphen after a letter breaks a word; " -" is a dash
+		if before, _ := utf8.DecodeLastRuneInString(line[:len(line)-size]); unicode.IsLetter(before) {
+			return true, string(last)
+		}
+	}
+	if opts.JoinLines && !strings.ContainsRune(sentenceEnds, last) && utf8.RuneCountInString(line) >= minLength {
+		return true, ""
+	}
+	return false, ""
+}
+
+// isMarked reports whether a line of extracted text is a heading or a line
+// of a table
+func isMarked(line string) bool {
+	return strings.HasPrefix(line, headingMarker) || strings.HasPrefix(line, tableMarker)
+}
+
+// spaceReplacer turns the fixed-width and no-break spaces into plain spaces
+var spaceReplacer = strings.NewReplacer(
+	"\u00a0", " ", "\u2000", " ", "\u2001", " ", "\u2002", " ", "\u2003", " ",
+	"\u2004", " ", "\u2005", " ", "\u2006", " ", "\u2007", " ", "\u2008", " ",
+	"\u2009", " ", "\u200a", " ", "\u202f", " ", "\u205f", " ",
+)
+
+// straightReplacer straightens curly quotes and apostrophes
+var straightReplacer = strings.NewReplacer(
+	"“", `"`, "”", `"`, "„", `"`, "‟", `"`,
+	"‘", "'", "’", "'", "‚", "'", "‛", "'",
+)
+
+// curlQuotes turns the straight quotes of s into curly ones: a quote
+// opens at the start of s or after a space, dash or opening bracket, and
+// closes otherwise, as an apostrophe does within a word
+func curlQuotes(s string) string {
+	if !strings.ContainsAny(s, `"'`) {
+		return s
+	}
+	var out strings.Builder
+	prev := ' '
+	for _, r := range s {
+		opening := unicode.IsSpace(prev) || strings.ContainsRune("([{<—–-“‘", prev)
+		switch {
+		case r == '"' && opening:
+			out.WriteString("“")
+		case r == '"':
+			out.WriteString("”")
+		case r == '\'' && opening:
+			out.WriteString("‘")
+		case r == '\'':
+			out.WriteString("’")
+		case isAnchorRune(r):
+			// An anchor marker doesn't change what the next quote does
+			out.WriteRune(r)
+			continue
+		default:
+			out.WriteRune(r)
+		}
+		prev = r
+	}
+	return out.String()
+}
+
+// applyCleanups applies the Dehyphenate, PlainSpaces, Quotes and NFC
+// clean-ups of opts to text
+func applyCleanups(text string, opts Options) string {
+	if opts.Dehyphenate {
+		text = strings.ReplaceAll(text, softHyphen, "")
+	}
+	if opts.PlainSpaces {
+		text = spaceReplacer.Replace(text)
+	}
+	switch opts.Quotes {
+	case QuotesStraight:
+		text = straightReplacer.Replace(text)
+	case QuotesCurly:
+		text = curlQuotes(text)
+	}
+	if opts.NFC {
+		text = norm.NFC.String(text)
+	}
+	return text
+}
@@ -0,0 +1,486 @@
+//go:build !minimal
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// Parallel corpus formats written by the align subcommand
+const (
+	corpusTMX   = "tmx"
+	corpusMoses = "moses"
+)
+
+func init() {
+	subcommands["align"] = runAlign
+	features["align"] = true
+}
+
+// runAlign implements the align subcommand, aligning the sentences of a
+// book with those of its translation and writing the pairs as a parallel
+// corpus. Either book can be an EPUB, converted with the given options, or
+// an already converted text file.
+func runAlign(args []string) {
+	fs := flag.NewFlagSet("align", flag.ExitOnError)
+	cf := defineConvertFlags(fs)
+	corpusFormat := fs.String("corpus-format", corpusTMX, msg("FlagCorpusFormat", "write the aligned sentences as `format` (tmx or moses)"))
+	sourceLang := fs.String("source-lang", "", msg("FlagSourceLang", "language `code` of the source book (default: from its EPUB metadata)"))
+	targetLang := fs.String("target-lang", "", msg("FlagTargetLang", "language `code` of the target book (default: from its EPUB metadata)"))
+	if err := applyDefaults(fs, "align"); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		printUsage("align [options] <source.epub|source.txt> <target.epub|target.txt> [output]")
+		os.Exit(1)
+	}
+
+	if err := alignBooks(cf, *corpusFormat, *sourceLang, *targetLang, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+}
+
+// alignBooks aligns the source and target books named by args and writes
+// the corpus to the output named by args, or "aligned" if there's none. A
+// Moses corpus is two files named by adding each language as the extension.
+func alignBooks(cf *convertFlags, corpusFormat, sourceLang, targetLang string, args []string) error {
+	if corpusFormat != corpusTMX && corpusFormat != corpusMoses {
+		return fmt.Errorf(msg("ErrCorpusFormat", "unknown corpus format %q (valid: %s, %s)"), corpusFormat, corpusTMX, corpusMoses)
+	}
+	opts, err := cf.options(epubconv.NewChapterIndex())
+	if err != nil {
+		return err
+	}
+	opts.Format = epubconv.FormatText
+
+	source, lang, err := readAlignInput(args[0], opts)
+	if err != nil {
+		return err
+	}
+	if sourceLang == "" {
+		sourceLang = lang
+	}
+	target, lang, err := readAlignInput(args[1], opts)
+	if err != nil {
+		return err
+	}
+	if targetLang == "" {
+		targetLang = lang
+	}
+	if sourceLang == "" || targetLang == "" {
+		return errors.New(msg("ErrAlignLang", "the language of each book is needed; use --source-lang and --target-lang"))
+	}
+
+	pairs := alignText(source, target)
+
+	output := "aligned"
+	if len(args) == 3 {
+		output = args[2]
+	}
+	if corpusFormat == corpusTMX {
+		if filepath.Ext(output) == "" {
+			output += ".tmx"
+		}
+		err = writeTMX(output, sourceLang, targetLang, pairs)
+	} else {
+		err = writeMoses(output, sourceLang, targetLang, pairs)
+		output += ".{" + sourceLang + "," + targetLang + "}"
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf(msg("Aligned", "Aligned %d sentence pairs to %s")+"\n", len(pairs), output)
+	return nil
+}
+
+// readAlignInput returns the text of a book to align and its language, or
+// "" if it isn't known. Ebooks are converted first.
+func readAlignInput(path string, opts epubconv.Options) (string, string, error) {
+	if !isBook(path) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read text file: %w", err)
+		}
+		return string(data), "", nil
+	}
+
+	defer flushWarnings()
+	book, err := epubconv.OpenFile(path, opts)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", path, err)
+	}
+	defer book.Close()
+	text, err := book.Text()
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", path, err)
+	}
+	lang := ""
+	if languages := book.Info().Languages; len(languages) > 0 {
+		lang = languages[0]
+	}
+	return text, lang, nil
+}
+
+// alignText aligns the sentences of a text with those of its translation,
+// returning the pairs of source and target sentences. Chapters (blocks
+// separated by blank lines) are aligned first, then the paragraphs of each
+// pair of chapters and finally the sentences of each pair of paragraphs,
+// which keeps every alignment small and stops an error in one chapter from
+// spreading to the rest of the book. Sentences without a counterpart are
+// left out.
+func alignText(source, target string) [][2]string {
+	sourceChapters, targetChapters := splitChapters(source), splitChapters(target)
+
+	// Translations run longer or shorter than the original by a roughly
+	// constant factor, which depends on the pair of languages
+	ratio := 1.0
+	if n := totalLength(sourceChapters); n > 0 {
+		if r := float64(totalLength(targetChapters)) / float64(n); r > 0 {
+			ratio = r
+		}
+	}
+	return alignSegments(sourceChapters, targetChapters, ratio, splitParagraphs, splitSentences)
+}
+
+// alignSegments aligns the source and target segments, then, while there
+// are finer levels to split them into, the segments of each aligned bead
+func alignSegments(source, target []string, ratio float64, split ...func(string) []string) [][2]string {
+	var pairs [][2]string
+	i, j := 0, 0
+	for _, b := range galeChurch(segmentLengths(source), segmentLengths(target), ratio) {
+		s, t := source[i:i+b.source], target[j:j+b.target]
+		i, j = i+b.source, j+b.target
+		if len(s) == 0 || len(t) == 0 {
+			continue
+		}
+		if len(split) == 0 {
+			pairs = append(pairs, [2]string{strings.Join(s, " "), strings.Join(t, " ")})
+			continue
+		}
+		var subSource, subTarget []string
+		for _, segment := range s {
+			subSource = append(subSource, split[0](segment)...)
+		}
+		for _, segment := range t {
+			subTarget = append(subTarget, split[0](segment)...)
+		}
+		pairs = append(pairs, alignSegments(subSource, subTarget, ratio, split[1:]...)...)
+	}
+	return pairs
+}
+
+// splitChapters splits text into its blocks, separated by blank lines
+func splitChapters(text string) []string {
+	var chapters []string
+	for _, block := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		if block = strings.TrimSpace(block); block != "" {
+			chapters = append(chapters, block)
+		}
+	}
+	return chapters
+}
+
+// splitParagraphs splits a chapter into its non-empty lines
+func splitParagraphs(chapter string) []string {
+	var paragraphs []string
+	for _, line := range strings.Split(chapter, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paragraphs = append(paragraphs, line)
+		}
+	}
+	return paragraphs
+}
+
+// splitSentences splits a paragraph after each run of sentence-ending
+// punctuation and any closing quotes or brackets following it, including
+// French-style ones set off by a space. Western punctuation must also be
+// followed by a space, so "3.5" or "e.g." inside a word don't end a
+// sentence; CJK punctuation needn't be, unless it ends a quotation. Nor
+// does a sentence end before a lower-case letter, as in
+// `"Are you there?" she asked.`
+func splitSentences(paragraph string) []string {
+	var sentences []string
+	runes := []rune(paragraph)
+	start := 0
+	for i := 0; i < len(runes); i++ {
+		if !isSentenceEnd(runes[i]) {
+			continue
+		}
+		cjk := isCJKSentenceEnd(runes[i])
+		end := i + 1
+		for end < len(runes) {
+			next := end
+			for next < len(runes) && unicode.IsSpace(runes[next]) {
+				next++
+			}
+			if next == len(runes) || !(isSentenceEnd(runes[next]) || isClosingPunct(runes[next])) || next > end && !isClosingPunct(runes[next]) {
+				break
+			}
+			cjk = cjk || isCJKSentenceEnd(runes[next])
+			end = next + 1
+		}
+		next := end
+		for next < len(runes) && unicode.IsSpace(runes[next]) {
+			next++
+		}
+		if next < len(runes) {
+			spaced := next > end
+			quoted := isClosingPunct(runes[end-1])
+			// A CJK quotation runs straight on into the rest of the
+			// sentence, as in 「はい！」と言った。
+			if !spaced && (!cjk || quoted) || unicode.IsLower(runes[next]) {
+				i = end - 1
+				continue
+			}
+		}
+		if sentence := strings.TrimSpace(string(runes[start:end])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start, i = end, end-1
+	}
+	if sentence := strings.TrimSpace(string(runes[start:])); sentence != "" {
+		sentences = append(sentences, sentence)
+	}
+	return sentences
+}
+
+func isSentenceEnd(r rune) bool {
+	return r == '.' || r == '!' || r == '?' || r == '…' || isCJKSentenceEnd(r)
+}
+
+func isCJKSentenceEnd(r rune) bool {
+	return r == '。' || r == '！' || r == '？' || r == '｡'
+}
+
+func isClosingPunct(r rune) bool {
+	return unicode.Is(unicode.Pe, r) || unicode.Is(unicode.Pf, r) || r == '"' || r == '\''
+}
+
+// segmentLengths returns the length of each segment in characters
+func segmentLengths(segments []string) []int {
+	lengths := make([]int, len(segments))
+	for i, segment := range segments {
+		lengths[i] = utf8.RuneCountInString(segment)
+	}
+	return lengths
+}
+
+func totalLength(segments []string) int {
+	n := 0
+	for _, length := range segmentLengths(segments) {
+		n += length
+	}
+	return n
+}
+
+// bead is a group of consecutive source and target segments aligned with
+// each other
+type bead struct {
+	source, target int
+}
+
+// The bead shapes galeChurch considers and the negative log of how often
+// they occur in translations, from Gale and Church (1993)
+var beadPriors = []struct {
+	bead
+	prior float64
+}{
+	{bead{1, 1}, -math.Log(0.89)},
+	{bead{1, 0}, -math.Log(0.0099)},
+	{bead{0, 1}, -math.Log(0.0099)},
+	{bead{2, 1}, -math.Log(0.089)},
+	{bead{1, 2}, -math.Log(0.089)},
+	{bead{2, 2}, -math.Log(0.011)},
+}
+
+// lengthVariance is the variance of the target length per source character
+// in the Gale-Church model
+const lengthVariance = 6.8
+
+// alignBand is the minimum distance from the diagonal, in segments, that
+// galeChurch searches. Very long inputs are only aligned within a band
+// around the diagonal, which bounds the memory the search needs.
+const alignBand = 100
+
+// galeChurch aligns source and target segments of the given lengths with
+// the Gale-Church algorithm, returning the beads covering both in order.
+// ratio is the expected number of target characters per source character.
+func galeChurch(source, target []int, ratio float64) []bead {
+	n, m := len(source), len(target)
+	band := alignBand
+	if d := n - m; d > band || -d > band {
+		band = max(d, -d) + alignBand
+	}
+
+	sourceEnd, targetEnd := cumulative(source), cumulative(target)
+
+	// cost[i][j-lo[i]] is the cost of the best alignment of the first i
+	// source and j target segments, and step the bead shape it ends with
+	lo := make([]int, n+1)
+	cost := make([][]float64, n+1)
+	step := make([][]int8, n+1)
+	at := func(i, j int) float64 {
+		if i < 0 || j < lo[i] || j-lo[i] >= len(cost[i]) {
+			return math.Inf(1)
+		}
+		return cost[i][j-lo[i]]
+	}
+	for i := 0; i <= n; i++ {
+		center := m / 2
+		if n > 0 {
+			center = i * m / n
+		}
+		lo[i] = max(center-band, 0)
+		hi := min(center+band, m)
+		cost[i] = make([]float64, hi-lo[i]+1)
+		step[i] = make([]int8, hi-lo[i]+1)
+		for j := lo[i]; j <= hi; j++ {
+			best, bestStep := math.Inf(1), int8(-1)
+			if i == 0 && j == 0 {
+				best = 0
+			}
+			for k, p := range beadPriors {
+				if p.source > i || p.target > j {
+					continue
+				}
+				prev := at(i-p.source, j-p.target)
+				if math.IsInf(prev, 1) {
+					continue
+				}
+				ls := sourceEnd[i] - sourceEnd[i-p.source]
+				lt := targetEnd[j] - targetEnd[j-p.target]
+				if c := prev + beadCost(ls, lt, ratio, p.prior); c < best {
+					best, bestStep = c, int8(k)
+				}
+			}
+			cost[i][j-lo[i]] = best
+			step[i][j-lo[i]] = bestStep
+		}
+	}
+
+	var beads []bead
+	for i, j := n, m; i > 0 || j > 0; {
+		k := step[i][j-lo[i]]
+		if k < 0 {
+			// Unreachable within the band; give up on the rest
+			beads = append(beads, bead{i, j})
+			break
+		}
+		b := beadPriors[k].bead
+		beads = append(beads, b)
+		i, j = i-b.source, j-b.target
+	}
+	for a, b := 0, len(beads)-1; a < b; a, b = a+1, b-1 {
+		beads[a], beads[b] = beads[b], beads[a]
+	}
+	return beads
+}
+
+// cumulative returns the total of the first n lengths for each n
+func cumulative(lengths []int) []int {
+	totals := make([]int, len(lengths)+1)
+	for i, l := range lengths {
+		totals[i+1] = totals[i] + l
+	}
+	return totals
+}
+
+// beadCost is the negative log probability of aligning source and target
+// segments of the given total lengths as a bead with the given prior cost
+// (the negative log of its prior probability)
+func beadCost(sourceLength, targetLength int, ratio, prior float64) float64 {
+	delta := 0.0
+	if mean := (float64(sourceLength) + float64(targetLength)/ratio) / 2; mean > 0 {
+		delta = (float64(sourceLength)*ratio - float64(targetLength)) / math.Sqrt(mean*lengthVariance)
+	}
+	// Two-tailed probability of a length difference at least this large
+	p := math.Erfc(math.Abs(delta) / math.Sqrt2)
+	return -math.Log(math.Max(p, math.SmallestNonzeroFloat64)) + prior
+}
+
+// tmxDocument is a TMX 1.4 translation memory
+type tmxDocument struct {
+	XMLName xml.Name `xml:"tmx"`
+	Version string   `xml:"version,attr"`
+	Header  struct {
+		CreationTool        string `xml:"creationtool,attr"`
+		CreationToolVersion string `xml:"creationtoolversion,attr"`
+		SegType             string `xml:"segtype,attr"`
+		OTMF                string `xml:"o-tmf,attr"`
+		AdminLang           string `xml:"adminlang,attr"`
+		SrcLang             string `xml:"srclang,attr"`
+		DataType            string `xml:"datatype,attr"`
+	} `xml:"header"`
+	Units []tmxUnit `xml:"body>tu"`
+}
+
+type tmxUnit struct {
+	Variants []tmxVariant `xml:"tuv"`
+}
+
+type tmxVariant struct {
+	Lang    string `xml:"xml:lang,attr"`
+	Segment string `xml:"seg"`
+}
+
+// writeTMX writes the sentence pairs to path as a TMX document
+func writeTMX(path, sourceLang, targetLang string, pairs [][2]string) error {
+	doc := tmxDocument{Version: "1.4"}
+	doc.Header.CreationTool = "epubconv"
+	doc.Header.CreationToolVersion = epubconv.Version
+	doc.Header.SegType = "sentence"
+	doc.Header.OTMF = "epubconv"
+	doc.Header.AdminLang = "en"
+	doc.Header.SrcLang = sourceLang
+	doc.Header.DataType = "plaintext"
+	for _, pair := range pairs {
+		doc.Units = append(doc.Units, tmxUnit{Variants: []tmxVariant{
+			{Lang: sourceLang, Segment: pair[0]},
+			{Lang: targetLang, Segment: pair[1]},
+		}})
+	}
+
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode TMX: %w", err)
+	}
+	data = append([]byte(xml.Header), append(data, '\n')...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	return nil
+}
+
+// writeMoses writes the sentence pairs as a Moses parallel corpus: the
+// source sentences to prefix.<sourceLang> and the target sentences to
+// prefix.<targetLang>, one per line, so line n of each file is a pair
+func writeMoses(prefix, sourceLang, targetLang string, pairs [][2]string) error {
+	if sourceLang == targetLang {
+		return errors.New(msg("ErrMosesLang", "a Moses corpus needs different source and target languages"))
+	}
+	for side, lang := range []string{sourceLang, targetLang} {
+		var b strings.Builder
+		for _, pair := range pairs {
+			b.WriteString(pair[side])
+			b.WriteByte('\n')
+		}
+		if err := os.WriteFile(prefix+"."+lang, []byte(b.String()), 0644); err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+	}
+	return nil
+}
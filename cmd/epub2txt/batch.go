@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// convertDirectory converts every EPUB under dir, using --workers books at
+// once, and reports failures at the end. Each book is written under
+// outputDir, or failing that --out-dir, at the same relative path as in
+// dir; with neither, it is written next to the book. It returns the number
+// of books that failed.
+func convertDirectory(cf *convertFlags, dir, outputDir string) (int, error) {
+	if *cf.toc {
+		return 0, errors.New(msg("ErrDirectoryTOC", "--toc can't be used with a directory"))
+	}
+	if *cf.extractCover != "" {
+		return 0, errors.New(msg("ErrDirectoryCover", "--extract-cover can't be used with a directory"))
+	}
+	if *cf.offsets != "" {
+		return 0, errors.New(msg("ErrDirectoryOffsets", "--offsets can't be used with a directory"))
+	}
+	if *cf.workers < 1 {
+		return 0, fmt.Errorf(msg("ErrWorkers", "--workers must be at least 1, got %d"), *cf.workers)
+	}
+	opts, err := cf.options(epubconv.NewChapterIndex())
+	if err != nil {
+		return 0, err
+	}
+	defer flushWarnings()
+
+	books, err := findBooks(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(books) == 0 {
+		return 0, fmt.Errorf(msg("ErrNoBooks", "no EPUB files found in %s"), dir)
+	}
+	if outputDir == "" {
+		outputDir = *cf.outDir
+	}
+	// The bar counts books, as several are converted at once
+	opts.Progress = nil
+	progress := func(done int) {
+		if *cf.progress {
+			bookProgress(dir, done, len(books))
+		}
+	}
+	progress(0)
+
+	jobs := make(chan string)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+		done   int
+	)
+	for i := 0; i < min(*cf.workers, len(books)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for epubPath := range jobs {
+				err := convertDirectoryBook(cf, opts, dir, epubPath, outputDir)
+				mu.Lock()
+				if err != nil {
+					failed++
+					eraseProgress()
+					fmt.Fprintf(os.Stderr, msg("ErrorForFile", "Error: %s: %v")+"\n", epubPath, err)
+				}
+				done++
+				progress(done)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, epubPath := range books {
+		jobs <- epubPath
+	}
+	close(jobs)
+	wg.Wait()
+
+	fmt.Printf(msg("ManifestSummary", "Converted %d of %d books")+"\n", len(books)-failed, len(books))
+	return failed, nil
+}
+
+// convertDirectoryBook converts epubPath, found in dir, to the same
+// relative path under outputDir, or next to it if outputDir is empty
+func convertDirectoryBook(cf *convertFlags, opts epubconv.Options, dir, epubPath, outputDir string) error {
+	outputPath := ""
+	if outputDir != "" {
+		rel, err := filepath.Rel(dir, epubPath)
+		if err != nil {
+			return err
+		}
+		outputPath = filepath.Join(outputDir, trimExt(rel))
+		if !*cf.splitChapters {
+			outputPath += outputExt(opts)
+		}
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+	_, err := convertBook(cf, opts, epubPath, outputPath)
+	return err
+}
+
+// bookExtensions are the file extensions findBooks looks for. Open tells the
+// formats apart by their content, not these.
+var bookExtensions = []string{".epub", ".mobi", ".azw", ".azw3", ".prc", ".fb2", ".fb2.zip"}
+
+// isBook reports whether path has the extension of an ebook format Open reads
+func isBook(path string) bool {
+	for _, ext := range bookExtensions {
+		if len(path) > len(ext) && strings.EqualFold(path[len(path)-len(ext):], ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// findBooks returns the paths of the ebook files under dir, sorted
+func findBooks(dir string) ([]string, error) {
+	var books []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && isBook(path) {
+			books = append(books, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	sort.Strings(books)
+	return books, nil
+}
+
+// listBooks returns the books named by args, those under each directory
+// among them in place of the directory
+func listBooks(args []string) ([]string, error) {
+	var books []string
+	for _, arg := range args {
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			found, err := findBooks(arg)
+			if err != nil {
+				return nil, err
+			}
+			books = append(books, found...)
+		} else {
+			books = append(books, arg)
+		}
+	}
+	return books, nil
+}
@@ -0,0 +1,120 @@
+//go:build !minimal
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+func init() {
+	subcommands["build"] = runBuild
+	features["build"] = true
+}
+
+// markdownExtensions are the extensions of chapter files read as Markdown;
+// any other chapter file is plain text
+var markdownExtensions = map[string]bool{".md": true, ".markdown": true, ".mdown": true, ".mkd": true}
+
+// stringsFlag is a flag that can be given more than once, collecting its
+// values
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ", ") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runBuild implements the build subcommand, making an EPUB from Markdown or
+// plain text chapter files
+func runBuild(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	var authors stringsFlag
+	title := fs.String("title", "", msg("FlagBuildTitle", "`title` of the book (default: from the output file name)"))
+	fs.Var(&authors, "author", msg("FlagBuildAuthor", "`name` of an author of the book; give it once per author"))
+	language := fs.String("language", "en", msg("FlagBuildLanguage", "language `code` of the book"))
+	identifier := fs.String("identifier", "", msg("FlagBuildIdentifier", "unique `id` of the book, such as an ISBN URN (default: a UUID derived from its content)"))
+	cover := fs.String("cover", "", msg("FlagBuildCover", "cover image `file`"))
+	output := fs.String("output", "", msg("FlagBuildOutput", "EPUB `file` to write (default: the title with .epub extension)"))
+	if err := applyDefaults(fs, "build"); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		printUsage("build [options] <chapter.md|chapter.txt>...")
+		os.Exit(1)
+	}
+
+	if *title == "" && *output != "" {
+		*title = strings.TrimSuffix(filepath.Base(*output), filepath.Ext(*output))
+	}
+	b := &epubconv.Builder{Title: *title, Authors: authors, Language: *language, Identifier: *identifier}
+	outputPath, err := buildBook(b, *cover, *output, fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", fmt.Errorf(msg("ErrBuild", "failed to build EPUB: %w"), err))
+		os.Exit(1)
+	}
+	fmt.Printf(msg("Built", "Built %s from %d chapters")+"\n", outputPath, fs.NArg())
+}
+
+// buildBook adds the chapter files and cover to b and writes the book to
+// outputPath, or a file named after its title, which it returns. A Markdown
+// chapter's images are read relative to its file.
+func buildBook(b *epubconv.Builder, coverPath, outputPath string, chapterPaths []string) (string, error) {
+	tried := make(map[string]bool)
+	for _, chapterPath := range chapterPaths {
+		data, err := os.ReadFile(chapterPath)
+		if err != nil {
+			return "", err
+		}
+		if !markdownExtensions[strings.ToLower(filepath.Ext(chapterPath))] {
+			b.AddText(strings.TrimSuffix(filepath.Base(chapterPath), filepath.Ext(chapterPath)), string(data))
+			continue
+		}
+		b.AddMarkdown("", string(data))
+		for _, src := range b.MissingImages() {
+			if tried[src] {
+				continue
+			}
+			tried[src] = true
+			image, err := os.ReadFile(filepath.Join(filepath.Dir(chapterPath), filepath.FromSlash(src)))
+			if err != nil {
+				warnf(epubconv.WarnMissingFile, "WarnBuildImage", "%s: failed to read image %s: %v", chapterPath, src, err)
+				continue
+			}
+			if err := b.AddImage(src, image); err != nil {
+				return "", fmt.Errorf("%s: %w", chapterPath, err)
+			}
+		}
+	}
+	if coverPath != "" {
+		data, err := os.ReadFile(coverPath)
+		if err != nil {
+			return "", err
+		}
+		if err := b.SetCover(filepath.Base(coverPath), data); err != nil {
+			return "", err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		return "", err
+	}
+	if outputPath == "" {
+		outputPath = safeFileName(sanitizeFileName(b.Title)) + ".epub"
+	}
+	if err := os.WriteFile(outputPath, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return outputPath, nil
+}
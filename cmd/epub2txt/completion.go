@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The completion subcommand is added from init, as it lists the others
+func init() {
+	subcommands["completion"] = runCompletion
+}
+
+// Shells the completion subcommand writes scripts for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// fishQuoter escapes text for a single-quoted fish string
+var fishQuoter = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// runCompletion implements the completion subcommand, writing a script
+// that completes the subcommands and conversion options of epub2txt in a
+// shell, e.g. source <(epub2txt completion bash)
+func runCompletion(args []string) {
+	if len(args) != 1 {
+		printUsage("completion " + strings.Join(completionShells, "|"))
+		os.Exit(1)
+	}
+	if err := writeCompletion(os.Stdout, args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+}
+
+// writeCompletion writes the completion script for shell to w
+func writeCompletion(w io.Writer, shell string) error {
+	commands := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		commands = append(commands, name)
+	}
+	sort.Strings(commands)
+
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	defineConvertFlags(fs)
+	var options []string
+	fs.VisitAll(func(f *flag.Flag) {
+		options = append(options, "--"+f.Name)
+	})
+
+	switch shell {
+	case "bash":
+		_, err := fmt.Fprintf(w, `# bash completion for epub2txt
+_epub2txt() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	elif [[ $COMP_CWORD -eq 1 ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur") $(compgen -f -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+complete -o filenames -F _epub2txt epub2txt
+`, strings.Join(options, " "), strings.Join(commands, " "))
+		return err
+	case "zsh":
+		_, err := fmt.Fprintf(w, `#compdef epub2txt
+_epub2txt() {
+	if [[ $words[CURRENT] == -* ]]; then
+		compadd -- %s
+	elif (( CURRENT == 2 )); then
+		compadd -- %s
+		_files
+	else
+		_files
+	fi
+}
+compdef _epub2txt epub2txt
+`, strings.Join(options, " "), strings.Join(commands, " "))
+		return err
+	case "fish":
+		var script strings.Builder
+		script.WriteString("# fish completion for epub2txt\n")
+		fmt.Fprintf(&script, "complete -c epub2txt -n __fish_use_subcommand -a '%s'\n", strings.Join(commands, " "))
+		fs.VisitAll(func(f *flag.Flag) {
+			_, usage := flag.UnquoteUsage(f)
+			usage, _, _ = strings.Cut(usage, "\n")
+			line := fmt.Sprintf("complete -c epub2txt -l %s -d '%s'", f.Name, fishQuoter.Replace(usage))
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				line += " -r"
+			}
+			script.WriteString(line + "\n")
+		})
+		_, err := io.WriteString(w, script.String())
+		return err
+	}
+	return fmt.Errorf(msg("ErrCompletionShell", "unknown shell %q (valid: %s)"), shell, strings.Join(completionShells, ", "))
+}
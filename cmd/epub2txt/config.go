@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configEnv names the environment variable that overrides the path of the
+// config file
+const configEnv = "EPUBCONV_CONFIG"
+
+// A config is the config file of default options: a YAML mapping of the
+// names of conversion options to values, along with mappings named after
+// subcommands holding options for those alone, e.g.
+//
+//	footnotes: inline
+//	no-warn: short-text,binary
+//	metadata:
+//	  format: yaml
+type config map[string]interface{}
+
+// convertCommands are the commands that take the conversion options, and
+// so those at the top level of the config file
+var convertCommands = map[string]bool{
+	"convert":  true,
+	"align":    true,
+	"demo":     true,
+	"manifest": true,
+	"serve":    true,
+}
+
+// configPath returns the path of the config file, $EPUBCONV_CONFIG or
+// <config dir>/epubconv/config.yaml
+func configPath() (string, error) {
+	if path, ok := os.LookupEnv(configEnv); ok {
+		return path, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate config directory: %w", err)
+	}
+	return filepath.Join(configDir, "epubconv", "config.yaml"), nil
+}
+
+// loadConfig reads the config file at path. It returns nil if there is
+// none.
+func loadConfig(path string) (config, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var c config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf(msg("ErrConfigParse", "failed to parse config file %s: %w"), path, err)
+	}
+	return c, nil
+}
+
+// applyConfig sets the flags of fs, those of command, from the config file:
+// the conversion options at its top level if command takes them, and then
+// the options in the section for command. Options fs doesn't have are left
+// for the commands that do. It must be called before the environment and
+// fs.Parse, which take precedence.
+func applyConfig(fs *flag.FlagSet, command string) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if convertCommands[command] {
+		if err := c.apply(fs, path); err != nil {
+			return err
+		}
+	}
+	if section, ok := c[command].(map[string]interface{}); ok {
+		return config(section).apply(fs, path)
+	}
+	return nil
+}
+
+// apply sets the flags of fs that c gives a value for. A list of values
+// sets an option that can be repeated once for each.
+func (c config) apply(fs *flag.FlagSet, path string) error {
+	for name, value := range c {
+		if _, ok := value.(map[string]interface{}); ok || fs.Lookup(name) == nil {
+			continue
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			s := ""
+			if v != nil {
+				s = fmt.Sprint(v)
+			}
+			if err := fs.Set(name, s); err != nil {
+				return fmt.Errorf(msg("ErrConfigValue", "config file %s: invalid value %q for %s: %w"), path, s, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// applyDefaults sets the flags of fs from the config file and then the
+// environment, before fs.Parse sets those on the command line
+func applyDefaults(fs *flag.FlagSet, command string) error {
+	if err := applyConfig(fs, command); err != nil {
+		return err
+	}
+	return applyEnvFlags(fs)
+}
@@ -0,0 +1,106 @@
+//go:build !minimal
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// demoFiles is a small public-domain EPUB, stored unpacked so it can be
+// reviewed and edited like any other source file
+//
+//go:embed demo
+var demoFiles embed.FS
+
+// demoEPUB packs the embedded demo book into an EPUB archive
+func demoEPUB() ([]byte, error) {
+	root, err := fs.Sub(demoFiles, "demo")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	// The mimetype file must come first and be stored uncompressed
+	mimetype, err := fs.ReadFile(root, "mimetype")
+	if err != nil {
+		return nil, err
+	}
+	f, err := w.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(mimetype); err != nil {
+		return nil, err
+	}
+
+	err = fs.WalkDir(root, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path == "mimetype" {
+			return err
+		}
+		data, err := fs.ReadFile(root, path)
+		if err != nil {
+			return err
+		}
+		f, err := w.Create(path)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func init() {
+	subcommands["demo"] = runDemo
+	features["demo"] = true
+}
+
+// runDemo implements the demo subcommand, converting the embedded demo book
+// with the given options and printing the result
+func runDemo(args []string) {
+	fs := flag.NewFlagSet("demo", flag.ExitOnError)
+	cf := defineConvertFlags(fs)
+	if err := applyDefaults(fs, "demo"); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	fs.Parse(args)
+
+	opts, err := cf.options(epubconv.NewChapterIndex())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+
+	data, err := demoEPUB()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", fmt.Sprintf(msg("ErrDemoBuild", "failed to build demo EPUB: %v"), err))
+		os.Exit(1)
+	}
+
+	opts.Name = "demo.epub"
+	text, err := epubconv.Convert(bytes.NewReader(data), int64(len(data)), opts)
+	flushWarnings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", fmt.Errorf(msg("ErrConvert", "failed to convert EPUB: %w"), err))
+		os.Exit(1)
+	}
+	fmt.Print(text)
+}
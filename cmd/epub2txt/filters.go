@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// runFilter runs a --filter or --html-filter command through the shell,
+// with input on its stdin and the chapter described by EPUBCONV_FILTER_*
+// environment variables, and returns what it writes to stdout. Its stderr
+// is passed on, or made part of the error if it fails.
+func runFilter(command, input string, chapter epubconv.FilterChapter) (string, error) {
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(),
+		"EPUBCONV_FILTER_BOOK="+chapter.Book,
+		"EPUBCONV_FILTER_PATH="+chapter.Path,
+		"EPUBCONV_FILTER_TITLE="+chapter.Title,
+	)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if text := strings.TrimSpace(stderr.String()); text != "" {
+			return "", fmt.Errorf("%s: %w: %s", command, err, text)
+		}
+		return "", fmt.Errorf("%s: %w", command, err)
+	}
+	if stderr.Len() > 0 {
+		eraseProgress()
+		os.Stderr.Write(stderr.Bytes())
+	}
+	return stdout.String(), nil
+}
+
+// textFilter returns the filter running the --filter command on the text of
+// each chapter
+func textFilter(command string) epubconv.Filter {
+	return epubconv.Filter{Text: func(text string, chapter epubconv.FilterChapter) (string, error) {
+		return runFilter(command, text, chapter)
+	}}
+}
+
+// htmlFilter returns the filter running the --html-filter command on each
+// content document, which replaces the document with the HTML it writes
+func htmlFilter(command string) epubconv.Filter {
+	return epubconv.Filter{HTML: func(doc *html.Node, chapter epubconv.FilterChapter) error {
+		var buf bytes.Buffer
+		if err := html.Render(&buf, doc); err != nil {
+			return err
+		}
+		out, err := runFilter(command, buf.String(), chapter)
+		if err != nil {
+			return err
+		}
+		filtered, err := html.Parse(strings.NewReader(out))
+		if err != nil {
+			return fmt.Errorf("%s: %w", command, err)
+		}
+		for doc.FirstChild != nil {
+			doc.RemoveChild(doc.FirstChild)
+		}
+		for filtered.FirstChild != nil {
+			n := filtered.FirstChild
+			filtered.RemoveChild(n)
+			doc.AppendChild(n)
+		}
+		return nil
+	}}
+}
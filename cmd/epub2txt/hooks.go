@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+)
+
+// hookEvent describes a book to a --pre-cmd or --post-cmd hook. It is passed
+// to the command as EPUBCONV_HOOK_* environment variables.
+type hookEvent struct {
+	name   string // "pre" or "post"
+	input  string
+	output string
+
+	// Only set for post hooks
+	err   error
+	stats bookStats
+}
+
+func (e hookEvent) environ() []string {
+	env := []string{
+		"EPUBCONV_HOOK_EVENT=" + e.name,
+		"EPUBCONV_HOOK_INPUT=" + e.input,
+		"EPUBCONV_HOOK_OUTPUT=" + e.output,
+	}
+	if e.name != "post" {
+		return env
+	}
+	if e.err != nil {
+		return append(env, "EPUBCONV_HOOK_STATUS=failed", "EPUBCONV_HOOK_ERROR="+e.err.Error())
+	}
+	return append(env,
+		"EPUBCONV_HOOK_STATUS=ok",
+		"EPUBCONV_HOOK_WORDS="+strconv.Itoa(e.stats.words),
+		"EPUBCONV_HOOK_CHARACTERS="+strconv.Itoa(e.stats.characters),
+	)
+}
+
+// runHook runs command through the shell with the event in its environment.
+// An empty command does nothing. Its output goes to stderr when the book is
+// written to stdout, so it doesn't end up in the text.
+func runHook(command string, event hookEvent) error {
+	if command == "" {
+		return nil
+	}
+
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(), event.environ()...)
+	cmd.Stdout = os.Stdout
+	if event.output == stdinPath {
+		cmd.Stdout = os.Stderr
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", command, err)
+	}
+	return nil
+}
+
+// shellCommand returns a command running command through the shell
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// extractedFile is an image or font file written to an --extract-images or
+// --extract-fonts directory, by its content
+type extractedFile struct {
+	dir string
+	sum [sha256.Size]byte
+}
+
+var (
+	// extractedFiles holds the files written so far, so books sharing an
+	// image or font only write it once
+	extractedFiles = make(map[extractedFile]string)
+	// extractMu guards extractedFiles and the files in the images and fonts
+	// directories, which several books can write to at once in a directory
+	// run
+	extractMu sync.Mutex
+)
+
+// extractImages writes the images in the manifest of book to dir. Images
+// with the same content are written once, and a file already in dir with
+// the same content as an image is used instead of writing another. If links
+// isn't nil, it is given the path of each image's file relative to the
+// directory of outputPath, for epubconv.Options.ImageLinks. It returns the
+// number of images extracted.
+func extractImages(book *epubconv.Book, dir, outputPath string, links map[string]string) (int, error) {
+	images := book.Images()
+	if len(images) == 0 {
+		return 0, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create images directory: %w", err)
+	}
+	base := "."
+	if outputPath != stdinPath {
+		base = filepath.Dir(outputPath)
+	}
+
+	extractMu.Lock()
+	defer extractMu.Unlock()
+	extracted := 0
+	for _, image := range images {
+		data, err := readImage(book, image.Path)
+		if errors.Is(err, epubconv.ErrDRMProtected) || errors.Is(err, epubconv.ErrArchiveLimit) {
+			return extracted, err
+		} else if err != nil {
+			warnf(epubconv.WarnMissingFile, "WarnImageUnreadable", "failed to read image %s: %v", image.Path, err)
+			continue
+		}
+		file, err := writeResource(dir, image.Path, data)
+		if err != nil {
+			return extracted, err
+		}
+		extracted++
+		if links != nil {
+			links[image.Path] = imageRef(base, file)
+		}
+	}
+	return extracted, nil
+}
+
+// writeImages extracts the images of book, read from epubPath, to
+// imagesDir as extractImages does and reports how many there were, or does
+// nothing if imagesDir is empty
+func writeImages(book *epubconv.Book, epubPath, imagesDir, outputPath string, links map[string]string) error {
+	if imagesDir == "" {
+		return nil
+	}
+	n, err := extractImages(book, imagesDir, outputPath, links)
+	if err != nil {
+		return fmt.Errorf(msg("ErrExtractImages", "failed to extract images: %w"), err)
+	}
+	if n > 0 && outputPath != stdinPath {
+		fmt.Printf(msg("ExtractedImages", "Extracted %d images from %s to %s")+"\n", n, epubPath, imagesDir)
+	}
+	return nil
+}
+
+// extractPaths are where the --extract-images, --extract-cover and
+// --extract-fonts options write a book's files, "" for those not given
+type extractPaths struct {
+	images string
+	cover  string
+	fonts  string
+}
+
+func (cf *convertFlags) extractPaths() extractPaths {
+	return extractPaths{images: *cf.extractImages, cover: *cf.extractCover, fonts: *cf.extractFonts}
+}
+
+// writeExtracted writes the images, cover and fonts of book, read from
+// epubPath, where extract says, as writeImages, writeCover and writeFonts do
+func writeExtracted(book *epubconv.Book, epubPath string, extract extractPaths, outputPath string, links map[string]string) error {
+	if err := writeImages(book, epubPath, extract.images, outputPath, links); err != nil {
+		return err
+	}
+	if err := writeCover(book, epubPath, extract.cover, outputPath); err != nil {
+		return err
+	}
+	return writeFonts(book, epubPath, extract.fonts, outputPath)
+}
+
+// writeCover writes the cover image of book, read from epubPath, to
+// coverPath, warning if it has none, or does nothing if coverPath is empty
+func writeCover(book *epubconv.Book, epubPath, coverPath, outputPath string) error {
+	if coverPath == "" {
+		return nil
+	}
+	rc, mediaType, err := book.Cover()
+	if errors.Is(err, epubconv.ErrNoCover) {
+		warnf(epubconv.WarnMissingFile, "WarnNoCover", "%s has no cover image", epubPath)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf(msg("ErrExtractCover", "failed to extract cover image: %w"), err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err == nil {
+		err = os.WriteFile(coverPath, data, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf(msg("ErrExtractCover", "failed to extract cover image: %w"), err)
+	}
+	if outputPath != stdinPath {
+		fmt.Printf(msg("ExtractedCover", "Extracted cover image (%s) from %s to %s")+"\n", mediaType, epubPath, coverPath)
+	}
+	return nil
+}
+
+// writeFonts writes the fonts of book, read from epubPath, to fontsDir,
+// deobfuscated and each once, or does nothing if fontsDir is empty
+func writeFonts(book *epubconv.Book, epubPath, fontsDir, outputPath string) error {
+	fonts := book.Fonts()
+	if fontsDir == "" || len(fonts) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(fontsDir, 0755); err != nil {
+		return fmt.Errorf(msg("ErrExtractFonts", "failed to extract fonts: %w"), err)
+	}
+
+	extractMu.Lock()
+	defer extractMu.Unlock()
+	extracted := 0
+	for _, font := range fonts {
+		data, err := readFont(book, font.Path)
+		if errors.Is(err, epubconv.ErrDRMProtected) || errors.Is(err, epubconv.ErrArchiveLimit) {
+			return fmt.Errorf(msg("ErrExtractFonts", "failed to extract fonts: %w"), err)
+		} else if err != nil {
+			warnf(epubconv.WarnMissingFile, "WarnFontUnreadable", "failed to read font %s: %v", font.Path, err)
+			continue
+		}
+		if _, err := writeResource(fontsDir, font.Path, data); err != nil {
+			return fmt.Errorf(msg("ErrExtractFonts", "failed to extract fonts: %w"), err)
+		}
+		extracted++
+	}
+	if extracted > 0 && outputPath != stdinPath {
+		fmt.Printf(msg("ExtractedFonts", "Extracted %d fonts from %s to %s")+"\n", extracted, epubPath, fontsDir)
+	}
+	return nil
+}
+
+// readFont returns the deobfuscated contents of the font at the archive
+// path name
+func readFont(book *epubconv.Book, name string) ([]byte, error) {
+	rc, err := book.OpenFont(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// readImage returns the contents of the image at the archive path name
+func readImage(book *epubconv.Book, name string) ([]byte, error) {
+	rc, err := book.OpenImage(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// writeResource writes data, the image or font at the archive path name, to
+// dir unless it is already there, and returns the path of its file. The file
+// is named after the archive file, with a number added if another file has
+// that name.
+func writeResource(dir, name string, data []byte) (string, error) {
+	key := extractedFile{dir: dir, sum: sha256.Sum256(data)}
+	if file, ok := extractedFiles[key]; ok {
+		return file, nil
+	}
+
+	fileName := safeFileName(sanitizeFileName(path.Base(name)))
+	if fileName == "" {
+		fileName = "image"
+	}
+	ext := filepath.Ext(fileName)
+	stem := strings.TrimSuffix(fileName, ext)
+	for n := 1; ; n++ {
+		file := filepath.Join(dir, fileName)
+		if n > 1 {
+			file = filepath.Join(dir, fmt.Sprintf("%s-%d%s", stem, n, ext))
+		}
+		existing, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			err = os.WriteFile(file, data, 0644)
+		} else if err == nil && !bytes.Equal(existing, data) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		extractedFiles[key] = file
+		return file, nil
+	}
+}
+
+// imageRef returns the URL of file relative to the directory base, or its
+// absolute path if it has no relative path
+func imageRef(base, file string) string {
+	ref := file
+	absBase, errBase := filepath.Abs(base)
+	absFile, errFile := filepath.Abs(file)
+	if errBase == nil && errFile == nil {
+		if rel, err := filepath.Rel(absBase, absFile); err == nil {
+			ref = rel
+		} else {
+			ref = absFile
+		}
+	}
+	return (&url.URL{Path: filepath.ToSlash(ref)}).String()
+}
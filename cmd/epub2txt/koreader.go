@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// koreaderSidecarPath returns where KOReader looks for the metadata of the
+// document at path: custom_metadata.lua in a .sdr directory named after it
+func koreaderSidecarPath(path string) string {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	return filepath.Join(base+".sdr", "custom_metadata.lua")
+}
+
+// writeKOReaderSidecar writes the book's title, authors, series and language
+// as KOReader custom metadata for the converted document at outputPath, so it
+// gets a proper library entry on the e-reader
+func writeKOReaderSidecar(outputPath string, pkg *epubconv.Package) error {
+	info := pkg.Info()
+	props := [][2]string{
+		{"title", strings.Join(info.Titles, " - ")},
+		// KOReader lists one author per line
+		{"authors", strings.Join(pkg.Metadata.CreatorNames(), "\n")},
+	}
+	var seriesIndex string
+	if series, index := pkg.Series(); series != "" {
+		props = append(props, [2]string{"series", series})
+		seriesIndex = index
+	}
+	if len(info.Languages) > 0 {
+		props = append(props, [2]string{"language", info.Languages[0]})
+	}
+
+	var table strings.Builder
+	for _, prop := range props {
+		if prop[1] != "" {
+			fmt.Fprintf(&table, "        [%s] = %s,\n", luaString(prop[0]), luaString(prop[1]))
+		}
+	}
+	if n, err := strconv.ParseFloat(seriesIndex, 64); err == nil {
+		fmt.Fprintf(&table, "        [\"series_index\"] = %s,\n", strconv.FormatFloat(n, 'f', -1, 64))
+	}
+
+	var lua strings.Builder
+	lua.WriteString("-- we can read Lua syntax here!\nreturn {\n")
+	for _, section := range []string{"custom_props", "doc_props"} {
+		fmt.Fprintf(&lua, "    [%s] = {\n%s    },\n", luaString(section), table.String())
+	}
+	lua.WriteString("}\n")
+
+	path := koreaderSidecarPath(outputPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(lua.String()), 0644)
+}
+
+// luaString quotes s as a Lua string literal
+func luaString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
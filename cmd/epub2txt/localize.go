@@ -0,0 +1,9 @@
+package main
+
+import "github.com/fletcharoo/epubconv/internal/i18n"
+
+// msg returns the message with the given ID in the user's language, or the
+// English default if it hasn't been translated
+func msg(id, english string) string {
+	return i18n.Msg(id, english)
+}
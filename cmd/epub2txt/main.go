@@ -0,0 +1,662 @@
+// Command epub2txt converts EPUB books to plain text.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// warnPreset is the category of warnings about presets, which can be silenced
+// with --no-warn along with the converter's warning categories
+const warnPreset = "preset"
+
+var warningCategories = append(slices.Clone(epubconv.WarningCategories), warnPreset)
+
+// suppressedWarnings holds the warning categories silenced with --no-warn
+var suppressedWarnings = make(map[string]bool)
+
+// sortWarnings holds warnings back until flushWarnings prints them in sorted
+// order, so that the warnings of a conversion can be diffed (--canonical)
+var (
+	sortWarnings bool
+	heldWarnings []string
+	// warningsMu guards heldWarnings and the printing of warnings, which
+	// come from several books at once in a directory run
+	warningsMu sync.Mutex
+)
+
+// convertFlags holds the command-line options of a conversion
+type convertFlags struct {
+	header         *bool
+	maxMemory      *epubconv.ByteSize
+	maxFileSize    *epubconv.ByteSize
+	maxTotalSize   *epubconv.ByteSize
+	maxEntries     *int
+	strictPaths    *bool
+	lenient        *bool
+	stripGutenberg *bool
+	skipDuplicates *bool
+	fixMojibake    *bool
+	linkFootnotes  *bool
+	expandAbbr     *bool
+	captions       *bool
+	ariaLabels     *bool
+	minText        *int
+	failShortText  *bool
+	koreader       *bool
+	offsets        *string
+	splitChapters  *bool
+	outDir         *string
+	extractImages  *string
+	extractCover   *string
+	extractFonts   *string
+	nameTemplate   *string
+	toc            *bool
+	tocFormat      *string
+	workers        *int
+	parallelism    *int
+	progress       *bool
+	canonical      *bool
+	wrap           *int
+	paraSpacing    *int
+	headingStyle   *string
+	tables         *string
+	joinLines      *bool
+	dehyphenate    *bool
+	plainSpaces    *bool
+	quotes         *string
+	nfc            *bool
+	ruby           *string
+	preview        *int
+	chapterRange   *string
+	from           *string
+	skipFront      *bool
+	nonlinear      *bool
+	format         *string
+	rules          *string
+	filter         *string
+	htmlFilter     *string
+	maxDepth       *int
+	maxAttrs       *int
+	emoji          *string
+	footnotes      *string
+	order          *string
+	preCmd         *string
+	postCmd        *string
+	noWarn         *string
+	quiet          *bool
+	verbose        *bool
+}
+
+// defineConvertFlags registers the conversion options on fs. They are
+// shared by the plain conversion command and presets.
+func defineConvertFlags(fs *flag.FlagSet) *convertFlags {
+	cf := &convertFlags{
+		maxMemory:    new(epubconv.ByteSize),
+		maxFileSize:  new(epubconv.ByteSize),
+		maxTotalSize: new(epubconv.ByteSize),
+	}
+	fs.Var(cf.maxMemory, "max-memory", msg("FlagMaxMemory", "abort the conversion if it needs more than `size` bytes of memory, e.g. 512M (0 for no limit)"))
+	fs.Var(cf.maxFileSize, "max-file-size", msg("FlagMaxFileSize", "fail if a file in the book decompresses to more than `size` bytes, e.g. 64M (0 for no limit)"))
+	fs.Var(cf.maxTotalSize, "max-total-size", msg("FlagMaxTotalSize", "fail if the files read from the book decompress to more than `size` bytes in all, e.g. 1G (0 for no limit)"))
+	cf.maxEntries = fs.Int("max-entries", 0, msg("FlagMaxEntries", "fail if the book's archive has more than `n` files, or its manifest or spine more than n items (0 for no limit)"))
+	cf.strictPaths = fs.Bool("strict-paths", false, msg("FlagStrictPaths", "fail instead of warning if the book names files outside its archive or package directory"))
+	cf.lenient = fs.Bool("lenient", true, msg("FlagLenient", "recover what can be read of a book with a malformed container.xml or package document, with a recovered warning for each repair, instead of failing (--lenient=false to fail)"))
+	cf.header = fs.Bool("header", false, msg("FlagHeader", "prefix the output with a metadata header (title, author, source, conversion time, version)"))
+	cf.stripGutenberg = fs.Bool("strip-gutenberg", false, msg("FlagStripGutenberg", "strip the Project Gutenberg license header and footer"))
+	cf.skipDuplicates = fs.Bool("skip-duplicate-chapters", false, msg("FlagSkipDuplicateChapters", "omit chapters repeated verbatim from an earlier chapter or, in a manifest run, an earlier book"))
+	cf.fixMojibake = fs.Bool("fix-mojibake", false, msg("FlagFixMojibake", "repair double-encoded text such as \"â€™\" (UTF-8 misread as Windows-1252)"))
+	cf.linkFootnotes = fs.Bool("link-footnotes", false, msg("FlagLinkFootnotes", "turn external links into numbered footnotes with a URL list at the end of each chapter"))
+	cf.expandAbbr = fs.Bool("expand-abbr", false, msg("FlagExpandAbbr", "follow the first use of each <abbr title=\"...\"> with its expansion, e.g. \"WHO (World Health Organization)\""))
+	cf.captions = fs.Bool("captions", false, msg("FlagCaptions", "include table captions as bracketed annotations"))
+	cf.ariaLabels = fs.Bool("aria-labels", false, msg("FlagAriaLabels", "include aria-label and aria-describedby text as bracketed annotations"))
+	cf.minText = fs.Int("min-text", 100, msg("FlagMinText", "warn with diagnostics when a book yields fewer than `n` characters of text (0 to disable)"))
+	cf.rules = fs.String("rules", "", msg("FlagRules", "apply the redaction and transform rules in the YAML `file` to every paragraph"))
+	cf.filter = fs.String("filter", "", msg("FlagFilter", "shell `command` to rewrite the text of each chapter, which it reads from stdin and writes to stdout, with EPUBCONV_FILTER_BOOK, EPUBCONV_FILTER_PATH and EPUBCONV_FILTER_TITLE set"))
+	cf.htmlFilter = fs.String("html-filter", "", msg("FlagHTMLFilter", "shell `command` to rewrite the HTML of each content document before its text is extracted, as --filter does the text"))
+	cf.format = fs.String("format", epubconv.FormatText, fmt.Sprintf(msg("FlagFormat", "output format: %s"), strings.Join(epubconv.Formats, ", ")))
+	cf.preview = fs.Int("preview", 0, msg("FlagPreview", "only convert the first `percent` of the book, rounded up to a whole chapter, for store-style previews (0 for the whole book)"))
+	cf.chapterRange = fs.String("chapters", "", msg("FlagChapters", "only convert the chapters in `range`, by their position in the reading order counting from 1, e.g. 3-7, -2, 10- or 1,4-6"))
+	cf.from = fs.String("from", "", msg("FlagFrom", "start the conversion at the chapter with this `title` in the table of contents or its first heading, e.g. \"Chapter 12\""))
+	cf.nonlinear = fs.Bool("include-nonlinear", false, msg("FlagIncludeNonlinear", "append the spine items marked linear=\"no\", such as notes or answers, after the rest of the book, each after a [Non-linear content] line, instead of leaving them out"))
+	cf.skipFront = fs.Bool("skip-front-matter", false, msg("FlagSkipFrontMatter", "leave out the cover, title, copyright and dedication pages, tables of contents, indexes and the like"))
+	cf.canonical = fs.Bool("canonical", false, msg("FlagCanonical", "normalize the output for diffing conversions across versions: NFC, single spaces, one blank line between blocks, sorted warnings and no conversion time"))
+	cf.wrap = fs.Int("wrap", 0, msg("FlagWrap", "wrap paragraphs of plain text at `n` columns (0 to keep each paragraph on one line)"))
+	cf.paraSpacing = fs.Int("paragraph-spacing", 0, fmt.Sprintf(msg("FlagParagraphSpacing", "put `n` blank lines between paragraphs of plain text (0 to %d)"), epubconv.MaxParagraphSpacing))
+	cf.headingStyle = fs.String("heading-style", epubconv.HeadingPlain, fmt.Sprintf(msg("FlagHeadingStyle", "how to set headings apart in plain text: %s, %s (a line of = or - below) or %s (# marks by level)"), epubconv.HeadingPlain, epubconv.HeadingUnderline, epubconv.HeadingHash))
+	cf.tables = fs.String("tables", epubconv.TablesFlatten, fmt.Sprintf(msg("FlagTables", "how to render tables in plain text: %s (a line per row, for tables used for layout), %s (aligned columns) or %s (GitHub Flavored Markdown tables)"), epubconv.TablesFlatten, epubconv.TablesASCII, epubconv.TablesMarkdown))
+	cf.joinLines = fs.Bool("join-lines", false, msg("FlagJoinLines", "join the lines of paragraphs broken where a scanned page's lines ended: a line not ending a sentence goes on with the next if it starts in lower case"))
+	cf.dehyphenate = fs.Bool("dehyphenate", false, msg("FlagDehyphenate", "remove soft hyphens and rejoin words hyphenated across the end of a line"))
+	cf.plainSpaces = fs.Bool("plain-spaces", false, msg("FlagPlainSpaces", "turn no-break, thin and other fixed-width spaces into plain spaces"))
+	cf.ruby = fs.String("ruby", epubconv.RubyKeep, fmt.Sprintf(msg("FlagRuby", "what to do with ruby text such as furigana: %s (after its base text, as the book has it), %s or %s (in parentheses after its base)"), epubconv.RubyKeep, epubconv.RubyStrip, epubconv.RubyParenthesize))
+	cf.quotes = fs.String("quotes", epubconv.QuotesKeep, fmt.Sprintf(msg("FlagQuotes", "what to do with quotation marks and apostrophes: %s, %s (\"') or %s (“”‘’)"), epubconv.QuotesKeep, epubconv.QuotesStraight, epubconv.QuotesCurly))
+	cf.nfc = fs.Bool("nfc", false, msg("FlagNFC", "normalize the text to Unicode NFC, composing accented letters"))
+	cf.offsets = fs.String("offsets", "", msg("FlagOffsets", "write where each chapter and each element with an id starts in the output, in characters and bytes, to `file` as JSON"))
+	cf.koreader = fs.Bool("koreader", false, msg("FlagKOReader", "write KOReader sidecar metadata (title, authors, series, language) to <output>.sdr/custom_metadata.lua"))
+	cf.splitChapters = fs.Bool("split-chapters", false, msg("FlagSplitChapters", "write each chapter to its own file in --out-dir instead of one output file"))
+	cf.outDir = fs.String("out-dir", "", msg("FlagOutDir", "`directory` for the output files (default: next to the input; for --split-chapters, the input file name without its extension)"))
+	cf.extractImages = fs.String("extract-images", "", msg("FlagExtractImages", "write the book's images to `directory`, each once; --format pandoc-json output refers to them there"))
+	cf.extractCover = fs.String("extract-cover", "", msg("FlagExtractCover", "write the book's cover image to `file`"))
+	cf.extractFonts = fs.String("extract-fonts", "", msg("FlagExtractFonts", "write the book's embedded fonts to `directory`, undoing their obfuscation"))
+	cf.nameTemplate = fs.String("name-template", defaultNameTemplate, msg("FlagNameTemplate", "name of each chapter file of --split-chapters, from the fields {index}, {title}, {book} and {file}; {index:03d} pads the index to 3 digits"))
+	cf.toc = fs.Bool("toc", false, msg("FlagTOC", "print the table of contents (from the NCX or EPUB 3 navigation document) instead of converting the book"))
+	cf.tocFormat = fs.String("toc-format", tocText, fmt.Sprintf(msg("FlagTOCFormat", "format of --toc: %s (an indented outline) or %s (nested entries)"), tocText, tocJSON))
+	cf.parallelism = fs.Int("parallelism", 1, msg("FlagParallelism", "number of chapters of a book to convert at once; the output is the same as converting one at a time"))
+	cf.workers = fs.Int("workers", runtime.NumCPU(), msg("FlagWorkers", "number of books to convert at once when the input is a directory"))
+	cf.progress = fs.Bool("progress", false, msg("FlagProgress", "show a progress bar on stderr, through the chapters of a book or the books of a directory"))
+	cf.failShortText = fs.Bool("fail-short-text", false, msg("FlagFailShortText", "fail instead of warning when a book yields less text than --min-text"))
+	cf.maxDepth = fs.Int("max-depth", 256, msg("FlagMaxDepth", "fail if a document nests elements more than `n` deep (0 for no limit)"))
+	cf.maxAttrs = fs.Int("max-attrs", 128, msg("FlagMaxAttrs", "fail if an element has more than `n` attributes (0 for no limit)"))
+	cf.emoji = fs.String("emoji", epubconv.EmojiKeep, fmt.Sprintf(msg("FlagEmoji", "how to handle emoji and pictographs: %s"), strings.Join(epubconv.EmojiPolicies, ", ")))
+	cf.footnotes = fs.String("footnotes", epubconv.FootnotesKeep, fmt.Sprintf(msg("FlagFootnotes", "what to do with the notes noterefs point to: %s (leave them where they are), %s (in brackets at the noteref), %s (listed at the end of the chapter) or %s"), epubconv.FootnotesKeep, epubconv.FootnotesInline, epubconv.FootnotesEnd, epubconv.FootnotesStrip))
+	cf.order = fs.String("order", epubconv.OrderSpine, fmt.Sprintf(msg("FlagOrder", "reading order to convert in: %s (the NCX or navigation document's order)"), strings.Join(epubconv.ReadingOrders, ", ")))
+	cf.preCmd = fs.String("pre-cmd", "", msg("FlagPreCmd", "shell `command` to run before converting each book, with EPUBCONV_HOOK_INPUT and EPUBCONV_HOOK_OUTPUT set; the book is skipped if it fails"))
+	cf.postCmd = fs.String("post-cmd", "", msg("FlagPostCmd", "shell `command` to run after converting each book, with EPUBCONV_HOOK_INPUT, EPUBCONV_HOOK_OUTPUT and EPUBCONV_HOOK_STATUS set"))
+	cf.noWarn = fs.String("no-warn", "", fmt.Sprintf(msg("FlagNoWarn", "comma-separated warning categories to suppress (%s, or all)"), strings.Join(warningCategories, ", ")))
+	cf.quiet = fs.Bool("quiet", false, msg("FlagQuiet", "print no warnings, only errors"))
+	cf.verbose = fs.Bool("verbose", false, msg("FlagVerbose", "also log each content document as it is converted, on stderr"))
+	return cf
+}
+
+// envFlagName returns the environment variable that sets the named flag
+func envFlagName(name string) string {
+	return "EPUBCONV_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvFlags sets every flag in fs that has a matching EPUBCONV_*
+// environment variable. It must be called before fs.Parse so that options on
+// the command line take precedence.
+func applyEnvFlags(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envFlagName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf(msg("ErrEnvValue", "invalid value %q for %s: %w"), value, envFlagName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// subcommands maps a first argument to the subcommand it runs. Optional
+// subcommands add themselves from init, so builds can leave them out.
+var subcommands = map[string]func(args []string){
+	"convert":  runConvertCommand,
+	"toc":      runTOC,
+	"validate": runValidate,
+	"version":  runVersion,
+	"preset":   runPreset,
+	"metadata": runMetadata,
+	"stats":    runStats,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
+		}
+	}
+	// Without a subcommand, the arguments are those of convert
+	runConvertCommand(os.Args[1:])
+}
+
+// runConvertCommand implements the convert subcommand, converting a book or
+// a directory of books
+func runConvertCommand(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	cf := defineConvertFlags(fs)
+	if err := applyDefaults(fs, "convert"); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	fs.Usage = func() {
+		synopses := []string{
+			"[convert] [options] <input.epub> [output.txt]",
+			"toc [--format text|json] <input.epub> [output]",
+			"validate [--json] <input.epub|directory>...",
+			"preset save <name> [options]",
+			"preset list",
+			"preset use <name> [options] <input.epub> [output.txt]",
+			"metadata [--format json|yaml] <input.epub>",
+			"stats [--strip-gutenberg] <input.epub|directory>...",
+		}
+		if features["manifest"] {
+			synopses = append(synopses, "manifest [options] <books.csv|books.json>")
+		}
+		if features["demo"] {
+			synopses = append(synopses, "demo [options]")
+		}
+		if features["align"] {
+			synopses = append(synopses, "align [options] <source.epub|source.txt> <target.epub|target.txt> [output]")
+		}
+		if features["build"] {
+			synopses = append(synopses, "build [options] <chapter.md|chapter.txt>...")
+		}
+		if features["serve"] {
+			synopses = append(synopses, "serve [--addr address] [--max-upload size] [--max-concurrent n] [options]")
+		}
+		printUsage(append(synopses, "completion bash|zsh|fish", "version [--json]")...)
+		fmt.Println(msg("UsageOutput", "If no output file is specified, it will use the input filename with .txt extension"))
+		fmt.Println(msg("UsageStdin", "An input of - reads the EPUB from stdin, and the text then goes to stdout unless an\n"+
+			"output file is given. An output file of - writes to stdout."))
+		fmt.Println(msg("UsageDirectory", "If the input is a directory, every ebook (EPUB, MOBI, AZW3, FB2) under it is\n"+
+			"converted, into the output directory (or --out-dir) if one is given."))
+		fmt.Println()
+		fmt.Println(msg("UsageOptions", "Options:"))
+		fs.PrintDefaults()
+		fmt.Println()
+		fmt.Println(msg("UsageEnvironment", "Every option can also be set with an EPUBCONV_<OPTION> environment variable,\n"+
+			"e.g. EPUBCONV_NO_WARN=binary. Command-line options take precedence over the\n"+
+			"environment, which takes precedence over presets."))
+		if path, err := configPath(); err == nil {
+			fmt.Printf(msg("UsageConfig", "Default options can be given in %s\n"+
+				"(or the file named by EPUBCONV_CONFIG), as lines like \"footnotes: inline\",\n"+
+				"which presets, the environment and the command line override.")+"\n", path)
+		}
+	}
+	args = parseArgs(fs, args)
+
+	if len(args) < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	runConvert(cf, args)
+}
+
+// parseArgs parses the flags of fs from args, where options can also follow
+// the positional arguments (e.g. "library/ --out-dir texts"), and returns the
+// positional arguments. Arguments after "--" are all positional.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if parsed := len(args) - len(rest); parsed > 0 && args[parsed-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// printUsage prints the synopsis of each given epub2txt command line
+func printUsage(synopses ...string) {
+	fmt.Println(msg("Usage", "Usage:"))
+	for _, synopsis := range synopses {
+		fmt.Println("  epub2txt " + synopsis)
+	}
+}
+
+// runConvert converts the EPUB, or directory of EPUBs, named by args,
+// exiting the process on failure
+func runConvert(cf *convertFlags, args []string) {
+	outputPath := ""
+	if len(args) >= 2 {
+		outputPath = args[1]
+	}
+	if info, err := os.Stat(args[0]); err == nil && info.IsDir() {
+		failed, err := convertDirectory(cf, args[0], outputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		}
+		if err != nil || failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if _, err := convertFile(cf, args[0], outputPath, epubconv.NewChapterIndex()); err != nil {
+		eraseProgress()
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+}
+
+// bookStats describes a converted book, for the corpus report of a
+// manifest run
+type bookStats struct {
+	inputSize  int64
+	words      int
+	characters int
+	language   string
+}
+
+// describe sets the input size and language of the stats of book, read
+// from epubPath
+func (s *bookStats) describe(epubPath string, book *epubconv.Book) {
+	if info, err := os.Stat(epubPath); err == nil {
+		s.inputSize = info.Size()
+	}
+	if languages := book.Info().Languages; len(languages) > 0 {
+		s.language = strings.ToLower(languages[0])
+	}
+}
+
+// options validates the parsed flags and turns them into conversion
+// options. Chapters are checked for duplicates against, and added to,
+// chapters.
+func (cf *convertFlags) options(chapters *epubconv.ChapterIndex) (epubconv.Options, error) {
+	if err := setSuppressedWarnings(*cf.noWarn); err != nil {
+		return epubconv.Options{}, err
+	}
+	if *cf.quiet && *cf.verbose {
+		return epubconv.Options{}, errors.New(msg("ErrQuietVerbose", "--quiet and --verbose can't be used together"))
+	}
+	if *cf.quiet {
+		setSuppressedWarnings("all")
+	}
+	sortWarnings = *cf.canonical
+
+	opts := epubconv.Options{
+		Header:                *cf.header,
+		MaxMemory:             *cf.maxMemory,
+		MaxFileSize:           *cf.maxFileSize,
+		MaxTotalSize:          *cf.maxTotalSize,
+		MaxEntries:            *cf.maxEntries,
+		StrictPaths:           *cf.strictPaths,
+		Lenient:               *cf.lenient,
+		StripGutenberg:        *cf.stripGutenberg,
+		Chapters:              chapters,
+		SkipDuplicateChapters: *cf.skipDuplicates,
+		LinkFootnotes:         *cf.linkFootnotes,
+		ExpandAbbreviations:   *cf.expandAbbr,
+		Captions:              *cf.captions,
+		AriaLabels:            *cf.ariaLabels,
+		MinText:               *cf.minText,
+		FailShortText:         *cf.failShortText,
+		MaxDepth:              *cf.maxDepth,
+		MaxAttrs:              *cf.maxAttrs,
+		FixMojibake:           *cf.fixMojibake,
+		Emoji:                 *cf.emoji,
+		Footnotes:             *cf.footnotes,
+		Order:                 *cf.order,
+		Canonical:             *cf.canonical,
+		Wrap:                  *cf.wrap,
+		ParagraphSpacing:      *cf.paraSpacing,
+		HeadingStyle:          *cf.headingStyle,
+		Tables:                *cf.tables,
+		JoinLines:             *cf.joinLines,
+		Dehyphenate:           *cf.dehyphenate,
+		PlainSpaces:           *cf.plainSpaces,
+		Quotes:                *cf.quotes,
+		NFC:                   *cf.nfc,
+		Ruby:                  *cf.ruby,
+		ChapterRange:          *cf.chapterRange,
+		From:                  *cf.from,
+		SkipFrontMatter:       *cf.skipFront,
+		IncludeNonlinear:      *cf.nonlinear,
+		Parallelism:           *cf.parallelism,
+		PreviewPercent:        *cf.preview,
+		Format:                *cf.format,
+		Warn:                  printWarning,
+	}
+	if *cf.progress {
+		opts.Progress = chapterProgress
+	}
+	if *cf.verbose {
+		opts.Logger = slog.New(debugOnly{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})})
+	}
+	if err := opts.Validate(); err != nil {
+		return epubconv.Options{}, err
+	}
+	if *cf.rules != "" {
+		if opts.Format == epubconv.FormatPandoc {
+			return epubconv.Options{}, errors.New(msg("ErrRulesFormat", "--rules only applies to text output"))
+		}
+		var err error
+		if opts.Policy, err = epubconv.LoadPolicy(*cf.rules); err != nil {
+			return epubconv.Options{}, err
+		}
+	}
+	if *cf.htmlFilter != "" {
+		opts.Filters = append(opts.Filters, htmlFilter(*cf.htmlFilter))
+	}
+	if *cf.filter != "" {
+		if opts.Format == epubconv.FormatPandoc {
+			return epubconv.Options{}, errors.New(msg("ErrFilterFormat", "--filter only applies to text output; use --html-filter"))
+		}
+		opts.Filters = append(opts.Filters, textFilter(*cf.filter))
+	}
+	return opts, nil
+}
+
+// convertFile validates the parsed options and converts epubPath to
+// outputPath, running the pre and post commands around it. An empty
+// outputPath is derived from epubPath. Chapters are checked for duplicates
+// against, and added to, chapters.
+func convertFile(cf *convertFlags, epubPath, outputPath string, chapters *epubconv.ChapterIndex) (bookStats, error) {
+	opts, err := cf.options(chapters)
+	if err != nil {
+		return bookStats{}, err
+	}
+	defer flushWarnings()
+	return convertBook(cf, opts, epubPath, outputPath)
+}
+
+// convertBook converts epubPath to outputPath with opts, which were made
+// from cf, running the pre and post commands around it. An empty outputPath
+// is derived from epubPath and --out-dir.
+func convertBook(cf *convertFlags, opts epubconv.Options, epubPath, outputPath string) (bookStats, error) {
+	if *cf.toc {
+		return bookStats{}, writeTOC(epubPath, outputPath, *cf.tocFormat, opts)
+	}
+	if *cf.splitChapters {
+		return convertChapters(cf, epubPath, outputPath, opts)
+	}
+
+	if outputPath == "" && epubPath == stdinPath && *cf.outDir == "" {
+		// A book read from stdin is written to stdout, for pipelines
+		outputPath = stdinPath
+	}
+	if outputPath == "" {
+		// Generate output filename from input filename
+		outputPath = inputStem(epubPath) + outputExt(opts)
+		if *cf.outDir != "" {
+			outputPath = filepath.Join(*cf.outDir, filepath.Base(outputPath))
+		}
+	}
+
+	if err := runHook(*cf.preCmd, hookEvent{name: "pre", input: epubPath, output: outputPath}); err != nil {
+		return bookStats{}, fmt.Errorf(msg("ErrPreCmd", "pre-command failed: %w"), err)
+	}
+
+	stats, err := writeText(epubPath, outputPath, cf.extractPaths(), opts, *cf.koreader, *cf.offsets)
+	post := hookEvent{name: "post", input: epubPath, output: outputPath, err: err, stats: stats}
+	if hookErr := runHook(*cf.postCmd, post); hookErr != nil {
+		err = errors.Join(err, fmt.Errorf(msg("ErrPostCmd", "post-command failed: %w"), hookErr))
+	}
+	return stats, err
+}
+
+// outputExt is the extension of the files written with opts
+func outputExt(opts epubconv.Options) string {
+	if opts.Format == epubconv.FormatPandoc || opts.Format == epubconv.FormatJSON {
+		return ".json"
+	}
+	return ".txt"
+}
+
+// convertChapters converts epubPath to a file per chapter in outputDir, or
+// failing that --out-dir or the input file name without its extension,
+// running the pre and post commands around it
+func convertChapters(cf *convertFlags, epubPath, outputDir string, opts epubconv.Options) (bookStats, error) {
+	switch {
+	case opts.Format != epubconv.FormatText:
+		return bookStats{}, splitOptionError("--format " + opts.Format)
+	case *cf.koreader:
+		return bookStats{}, splitOptionError("--koreader")
+	case *cf.offsets != "":
+		return bookStats{}, splitOptionError("--offsets")
+	}
+	template, err := parseNameTemplate(*cf.nameTemplate)
+	if err != nil {
+		return bookStats{}, err
+	}
+	if outputDir == "" {
+		outputDir = *cf.outDir
+	}
+	if outputDir == "" {
+		outputDir = inputStem(epubPath)
+	}
+
+	if err := runHook(*cf.preCmd, hookEvent{name: "pre", input: epubPath, output: outputDir}); err != nil {
+		return bookStats{}, fmt.Errorf(msg("ErrPreCmd", "pre-command failed: %w"), err)
+	}
+
+	stats, err := writeChapters(epubPath, outputDir, cf.extractPaths(), template, opts)
+	post := hookEvent{name: "post", input: epubPath, output: outputDir, err: err, stats: stats}
+	if hookErr := runHook(*cf.postCmd, post); hookErr != nil {
+		err = errors.Join(err, fmt.Errorf(msg("ErrPostCmd", "post-command failed: %w"), hookErr))
+	}
+	return stats, err
+}
+
+// writeText converts epubPath and writes the text to outputPath, along with
+// KOReader sidecar metadata if koreader is set, the offsets map to
+// offsetsPath if it isn't empty, and the book's images, cover and fonts
+// where extract says. Plain text is written as it is converted. An
+// outputPath of "-" writes to stdout.
+func writeText(epubPath, outputPath string, extract extractPaths, opts epubconv.Options, koreader bool, offsetsPath string) (bookStats, error) {
+	if koreader && outputPath == stdinPath {
+		return bookStats{}, errors.New(msg("ErrKOReaderStdout", "--koreader needs an output file, not stdout"))
+	}
+	var offsets *offsetsMap
+	if offsetsPath != "" {
+		if opts.Format == epubconv.FormatPandoc {
+			return bookStats{}, fmt.Errorf(msg("ErrOffsetsFormat", "--offsets can't be used with --format %s"), opts.Format)
+		}
+		offsets = newOffsetsMap(epubPath, outputPath, &opts)
+	}
+	if extract.images != "" {
+		opts.ImageLinks = make(map[string]string)
+	}
+	book, err := openBook(epubPath, opts)
+	if err != nil {
+		return bookStats{}, fmt.Errorf(msg("ErrConvert", "failed to convert EPUB: %w"), err)
+	}
+	defer book.Close()
+	if err := writeExtracted(book, epubPath, extract, outputPath, opts.ImageLinks); err != nil {
+		return bookStats{}, err
+	}
+
+	var stats bookStats
+	if opts.Format != epubconv.FormatText {
+		text, err := book.Text()
+		if err != nil {
+			return bookStats{}, fmt.Errorf(msg("ErrConvert", "failed to convert EPUB: %w"), err)
+		}
+		if outputPath == stdinPath {
+			_, err = os.Stdout.WriteString(text)
+		} else {
+			err = os.WriteFile(outputPath, []byte(text), 0644)
+		}
+		if err != nil {
+			return bookStats{}, fmt.Errorf(msg("ErrWriteOutput", "failed to write output file: %w"), err)
+		}
+		stats.words, stats.characters = epubconv.Measure(text, opts.Format)
+	} else if stats.words, stats.characters, err = streamText(book, outputPath); err != nil {
+		return bookStats{}, err
+	}
+	if outputPath != stdinPath {
+		eraseProgress()
+		fmt.Printf(msg("Converted", "Successfully converted %s to %s")+"\n", epubPath, outputPath)
+	}
+
+	if offsets != nil {
+		if err := offsets.write(offsetsPath); err != nil {
+			return bookStats{}, fmt.Errorf(msg("ErrOffsets", "failed to write offsets map: %w"), err)
+		}
+	}
+	if koreader {
+		if err := writeKOReaderSidecar(outputPath, &book.Package); err != nil {
+			return bookStats{}, fmt.Errorf(msg("ErrKOReader", "failed to write KOReader metadata: %w"), err)
+		}
+	}
+
+	stats.describe(epubPath, book)
+	return stats, nil
+}
+
+// setSuppressedWarnings parses a comma-separated list of warning categories
+// and silences them, replacing any previously suppressed ones
+func setSuppressedWarnings(list string) error {
+	clear(suppressedWarnings)
+	for _, category := range strings.Split(list, ",") {
+		category = strings.TrimSpace(category)
+		switch {
+		case category == "":
+			continue
+		case category == "all":
+			for _, c := range warningCategories {
+				suppressedWarnings[c] = true
+			}
+		case slices.Contains(warningCategories, category):
+			suppressedWarnings[category] = true
+		default:
+			return fmt.Errorf(msg("ErrUnknownWarning", "unknown warning category %q (valid: %s, all)"), category, strings.Join(warningCategories, ", "))
+		}
+	}
+	return nil
+}
+
+// warnf prints a warning. The format is the English message for id, which is
+// empty for messages that are already localized.
+func warnf(category, id, format string, args ...interface{}) {
+	printWarning(epubconv.Warning{Category: category, Message: fmt.Sprintf(msg(id, format), args...)})
+}
+
+// printWarning prints a warning to stderr unless its category has been
+// suppressed
+func printWarning(w epubconv.Warning) {
+	if suppressedWarnings[w.Category] {
+		return
+	}
+	warning := fmt.Sprintf(msg("Warning", "Warning: %s"), w.Message)
+	warningsMu.Lock()
+	defer warningsMu.Unlock()
+	if sortWarnings {
+		heldWarnings = append(heldWarnings, warning)
+		return
+	}
+	eraseProgress()
+	fmt.Fprintln(os.Stderr, warning)
+}
+
+// debugOnly passes on only the debug records of a handler, for --verbose,
+// as printWarning prints the warnings
+type debugOnly struct{ slog.Handler }
+
+func (h debugOnly) Enabled(ctx context.Context, level slog.Level) bool {
+	return level < slog.LevelInfo && h.Handler.Enabled(ctx, level)
+}
+
+// flushWarnings prints the warnings held back by sortWarnings, in order
+func flushWarnings() {
+	warningsMu.Lock()
+	defer warningsMu.Unlock()
+	sort.Strings(heldWarnings)
+	if len(heldWarnings) > 0 {
+		eraseProgress()
+	}
+	for _, warning := range heldWarnings {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+	heldWarnings = nil
+}
@@ -0,0 +1,268 @@
+//go:build !minimal
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// manifestEntry is one book in a batch manifest
+type manifestEntry struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	// Preset names a preset applied before Options
+	Preset string `json:"preset"`
+	// Options maps flag names to values for this book, overriding the
+	// config file and preset but not the environment or command line
+	Options map[string]any `json:"options"`
+}
+
+// readManifest loads a batch manifest. JSON manifests are an array of
+// entries; CSV manifests have a header row with "input", "output" and
+// "preset" columns, and any other column names an option. Empty cells leave
+// the option unset.
+func readManifest(path string) ([]manifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer f.Close()
+
+	var entries []manifestEntry
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.NewDecoder(f).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest: %w", err)
+		}
+	} else if entries, err = readCSVManifest(f); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	// Relative paths are relative to the manifest itself
+	dir := filepath.Dir(path)
+	for i := range entries {
+		if entries[i].Input == "" {
+			return nil, fmt.Errorf("manifest entry %d has no input", i+1)
+		}
+		if !filepath.IsAbs(entries[i].Input) {
+			entries[i].Input = filepath.Join(dir, entries[i].Input)
+		}
+		if entries[i].Output != "" && !filepath.IsAbs(entries[i].Output) {
+			entries[i].Output = filepath.Join(dir, entries[i].Output)
+		}
+	}
+	return entries, nil
+}
+
+func readCSVManifest(r io.Reader) ([]manifestEntry, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	var entries []manifestEntry
+	for _, record := range records[1:] {
+		entry := manifestEntry{Options: make(map[string]any)}
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			switch column := strings.TrimSpace(header[i]); column {
+			case "input":
+				entry.Input = value
+			case "output":
+				entry.Output = value
+			case "preset":
+				entry.Preset = value
+			default:
+				entry.Options[column] = value
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func init() {
+	subcommands["manifest"] = runManifest
+	features["manifest"] = true
+}
+
+// runManifest implements the manifest subcommand, converting every book in
+// a manifest and reporting failures at the end
+func runManifest(args []string) {
+	fs := newManifestFlags(flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		printUsage("manifest [options] <books.csv|books.json>")
+		os.Exit(1)
+	}
+	layers, err := manifestLayers(fs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	reportPath := layers.report()
+
+	entries, err := readManifest(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+
+	report := newCorpusReport()
+	chapters := epubconv.NewChapterIndex()
+	for _, entry := range entries {
+		stats, err := convertManifestEntry(layers, entry, chapters)
+		if err != nil {
+			eraseProgress()
+			fmt.Fprintf(os.Stderr, msg("ErrorForFile", "Error: %s: %v")+"\n", entry.Input, err)
+		}
+		report.add(stats, err)
+	}
+
+	fmt.Printf(msg("ManifestSummary", "Converted %d of %d books")+"\n", report.Succeeded, report.Books)
+	if reportPath != "" {
+		if err := report.write(reportPath); err != nil {
+			fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", fmt.Sprintf(msg("ErrReportWrite", "failed to write report: %v"), err))
+			os.Exit(1)
+		}
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// newManifestFlags returns the flags of the manifest subcommand
+func newManifestFlags(errorHandling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet("manifest", errorHandling)
+	defineConvertFlags(fs)
+	fs.String("report", "", msg("FlagReport", "write a corpus report to `file` (.json or .csv)"))
+	return fs
+}
+
+// optionLayers are the options the config file, the environment and the
+// command line give a manifest run. Each book is converted with the config
+// file's options, overridden by its preset and then its own options, and
+// those by the environment and then the command line, the order preset use
+// applies them in.
+type optionLayers struct {
+	config, env, commandLine preset
+}
+
+// manifestLayers reads the options of a manifest run from the config file
+// and the environment, and from fs, parsed from the command line. The
+// environment's and command line's options are checked here, once, rather
+// than with each book.
+func manifestLayers(fs *flag.FlagSet) (optionLayers, error) {
+	layers := optionLayers{commandLine: setFlags(fs)}
+	configFlags := newManifestFlags(flag.ContinueOnError)
+	if err := applyConfig(configFlags, "manifest"); err != nil {
+		return layers, err
+	}
+	layers.config = setFlags(configFlags)
+	envFlags := newManifestFlags(flag.ContinueOnError)
+	if err := applyEnvFlags(envFlags); err != nil {
+		return layers, err
+	}
+	layers.env = setFlags(envFlags)
+	check := newManifestFlags(flag.ContinueOnError)
+	for _, layer := range []preset{layers.env, layers.commandLine} {
+		if err := setLayer(check, layer); err != nil {
+			return layers, err
+		}
+	}
+	return layers, nil
+}
+
+// setFlags returns the flags set in fs, as a preset
+func setFlags(fs *flag.FlagSet) preset {
+	p := make(preset)
+	fs.Visit(func(f *flag.Flag) {
+		p[f.Name] = f.Value.String()
+	})
+	return p
+}
+
+// setLayer sets the flags of fs that layer gives a value for, in order of
+// name so the result doesn't depend on map order. The report option of
+// the manifest subcommand is left out, as a book's flags don't have it.
+func setLayer(fs *flag.FlagSet, layer preset) error {
+	names := make([]string, 0, len(layer))
+	for name := range layer {
+		if name != "report" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fs.Set(name, layer[name]); err != nil {
+			return fmt.Errorf(msg("ErrOption", "invalid option --%s=%s: %w"), name, layer[name], err)
+		}
+	}
+	return nil
+}
+
+// report returns the path to write the corpus report to, or ""
+func (l optionLayers) report() string {
+	for _, layer := range []preset{l.commandLine, l.env, l.config} {
+		if path, ok := layer["report"]; ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// apply sets the flags of fs, defined by defineConvertFlags, to the options
+// entry is converted with, layered in order of precedence
+func (l optionLayers) apply(fs *flag.FlagSet, entry manifestEntry) error {
+	layers := []preset{l.config}
+	if entry.Preset != "" {
+		p, err := loadPreset(entry.Preset)
+		if err != nil {
+			return err
+		}
+		layers = append(layers, p)
+	}
+	options := make(preset)
+	for name, value := range entry.Options {
+		options[name] = fmt.Sprint(value)
+	}
+	layers = append(layers, options, l.env, l.commandLine)
+
+	for _, layer := range layers {
+		if err := setLayer(fs, layer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func convertManifestEntry(base optionLayers, entry manifestEntry, chapters *epubconv.ChapterIndex) (bookStats, error) {
+	fs := flag.NewFlagSet("manifest entry", flag.ContinueOnError)
+	cf := defineConvertFlags(fs)
+	if err := base.apply(fs, entry); err != nil {
+		return bookStats{}, err
+	}
+
+	if entry.Output != "" {
+		if err := os.MkdirAll(filepath.Dir(entry.Output), 0755); err != nil {
+			return bookStats{}, fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+	return convertFile(cf, entry.Input, entry.Output, chapters)
+}
@@ -0,0 +1,120 @@
+//go:build !minimal
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifestLayers(t *testing.T) {
+	// Each layer sets --wrap to a value of its own, and the config file
+	// sets --quotes too, which no other layer overrides
+	tests := []struct {
+		name                               string
+		config, preset, entry, env, option bool
+		want                               string
+	}{
+		{name: "config", config: true, want: "10"},
+		{name: "preset over config", config: true, preset: true, want: "20"},
+		{name: "entry over preset", config: true, preset: true, entry: true, want: "30"},
+		{name: "entry over config", config: true, entry: true, want: "30"},
+		{name: "env over entry", config: true, preset: true, entry: true, env: true, want: "40"},
+		{name: "env over preset", preset: true, env: true, want: "40"},
+		{name: "command line over env", config: true, preset: true, entry: true, env: true, option: true, want: "50"},
+		{name: "command line over entry", entry: true, option: true, want: "50"},
+		{name: "none", want: "0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("XDG_CONFIG_HOME", dir)
+			t.Setenv(configEnv, filepath.Join(dir, "config.yaml"))
+			t.Setenv(envFlagName("wrap"), "")
+			os.Unsetenv(envFlagName("wrap"))
+
+			config := "quotes: straight\n"
+			if test.config {
+				config += "wrap: 10\n"
+			}
+			writeTestFile(t, filepath.Join(dir, "config.yaml"), config)
+			entry := manifestEntry{Input: "book.epub"}
+			if test.preset {
+				writeTestFile(t, filepath.Join(dir, "epubconv", "presets", "test.json"), `{"wrap": "20"}`)
+				entry.Preset = "test"
+			}
+			if test.entry {
+				entry.Options = map[string]any{"wrap": 30}
+			}
+			if test.env {
+				t.Setenv(envFlagName("wrap"), "40")
+			}
+			args := []string{"books.csv"}
+			if test.option {
+				args = append([]string{"--wrap", "50"}, args...)
+			}
+
+			fs := newManifestFlags(flag.ContinueOnError)
+			if err := fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			layers, err := manifestLayers(fs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entryFlags := flag.NewFlagSet("manifest entry", flag.ContinueOnError)
+			defineConvertFlags(entryFlags)
+			if err := layers.apply(entryFlags, entry); err != nil {
+				t.Fatal(err)
+			}
+			if got := entryFlags.Lookup("wrap").Value.String(); got != test.want {
+				t.Errorf("--wrap = %s, want %s", got, test.want)
+			}
+			if got := entryFlags.Lookup("quotes").Value.String(); got != "straight" {
+				t.Errorf("--quotes = %s, want straight", got)
+			}
+		})
+	}
+}
+
+func TestManifestLayersInvalid(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(configEnv, filepath.Join(dir, "config.yaml"))
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv(envFlagName("wrap"), "wide")
+		fs := newManifestFlags(flag.ContinueOnError)
+		fs.Parse([]string{"books.csv"})
+		if _, err := manifestLayers(fs); err == nil || !strings.Contains(err.Error(), envFlagName("wrap")) {
+			t.Errorf("err = %v, want an error for %s", err, envFlagName("wrap"))
+		}
+	})
+	t.Run("entry", func(t *testing.T) {
+		fs := newManifestFlags(flag.ContinueOnError)
+		fs.Parse([]string{"books.csv"})
+		layers, err := manifestLayers(fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entryFlags := flag.NewFlagSet("manifest entry", flag.ContinueOnError)
+		defineConvertFlags(entryFlags)
+		err = layers.apply(entryFlags, manifestEntry{Input: "book.epub", Options: map[string]any{"wrap": "wide"}})
+		if err == nil || !strings.Contains(err.Error(), "--wrap=wide") {
+			t.Errorf("err = %v, want an error for --wrap=wide", err)
+		}
+	})
+}
+
+// writeTestFile writes data to path, creating its directory
+func writeTestFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
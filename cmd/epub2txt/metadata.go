@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fletcharoo/epubconv"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats of the metadata subcommand
+const (
+	metadataJSON = "json"
+	metadataYAML = "yaml"
+)
+
+// runMetadata implements the metadata subcommand, printing the metadata of a
+// book without converting it
+func runMetadata(args []string) {
+	fs := flag.NewFlagSet("metadata", flag.ExitOnError)
+	format := fs.String("format", metadataJSON, fmt.Sprintf(msg("FlagMetadataFormat", "output format: %s"), metadataJSON+", "+metadataYAML))
+	if err := applyDefaults(fs, "metadata"); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		printUsage("metadata [--format json|yaml] <input.epub>")
+		os.Exit(1)
+	}
+
+	if err := printMetadata(os.Stdout, fs.Arg(0), *format); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+}
+
+// printMetadata writes the metadata of the EPUB at epubPath to w in format
+func printMetadata(w io.Writer, epubPath, format string) error {
+	if format != metadataJSON && format != metadataYAML {
+		return fmt.Errorf(msg("ErrMetadataFormat", "unknown metadata format %q (valid: %s, %s)"), format, metadataJSON, metadataYAML)
+	}
+	book, err := openBook(epubPath, epubconv.Options{Lenient: true, Warn: printWarning})
+	if err != nil {
+		return fmt.Errorf(msg("ErrReadMetadata", "failed to read metadata: %w"), err)
+	}
+	defer book.Close()
+
+	info := book.Info()
+	if format == metadataYAML {
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(info); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// offsetsMap is the --offsets sidecar of a converted book: where in the
+// output each chapter, and each element with an id, starts
+type offsetsMap struct {
+	// Source is the file name of the book, and Output that of the text
+	Source  string            `json:"source"`
+	Output  string            `json:"output,omitempty"`
+	Anchors []epubconv.Anchor `json:"anchors"`
+}
+
+// newOffsetsMap starts the offsets map of epubPath converted to outputPath,
+// making opts report the anchors of the conversion to it
+func newOffsetsMap(epubPath, outputPath string, opts *epubconv.Options) *offsetsMap {
+	m := &offsetsMap{Source: filepath.Base(epubPath), Anchors: []epubconv.Anchor{}}
+	if outputPath != stdinPath {
+		m.Output = filepath.Base(outputPath)
+	}
+	opts.Anchors = func(anchor epubconv.Anchor) {
+		m.Anchors = append(m.Anchors, anchor)
+	}
+	return m
+}
+
+// write saves the map as JSON to path
+func (m *offsetsMap) write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	return f.Close()
+}
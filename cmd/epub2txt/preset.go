@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A preset is a named bundle of conversion options, stored as a JSON object
+// mapping flag names to values in <config dir>/epubconv/presets/<name>.json.
+// Preset files can be copied between machines to share settings.
+type preset map[string]string
+
+// builtinPresets are available without a preset file. A preset file with
+// the same name takes precedence.
+var builtinPresets = map[string]preset{
+	// Project Gutenberg EPUBs start and end with long license blocks
+	"gutenberg": {"strip-gutenberg": "true"},
+}
+
+var presetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// presetDir returns the directory presets are stored in
+func presetDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate config directory: %w", err)
+	}
+	return filepath.Join(configDir, "epubconv", "presets"), nil
+}
+
+func presetPath(name string) (string, error) {
+	if !presetNamePattern.MatchString(name) {
+		return "", fmt.Errorf(msg("ErrPresetName", "invalid preset name %q (use letters, digits, '.', '_' and '-')"), name)
+	}
+	dir, err := presetDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+func loadPreset(name string) (preset, error) {
+	path, err := presetPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if p, ok := builtinPresets[name]; ok {
+			return p, nil
+		}
+		return nil, fmt.Errorf(msg("ErrPresetNotFound", "preset %q not found"), name)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read preset %q: %w", name, err)
+	}
+
+	var p preset
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse preset %q: %w", name, err)
+	}
+	return p, nil
+}
+
+func savePreset(name string, p preset) (string, error) {
+	path, err := presetPath(name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create preset directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("failed to write preset %q: %w", name, err)
+	}
+	return path, nil
+}
+
+// String renders the preset as the command-line options it stands for
+func (p preset) String() string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	options := make([]string, len(names))
+	for i, name := range names {
+		options[i] = fmt.Sprintf("--%s=%s", name, p[name])
+	}
+	return strings.Join(options, " ")
+}
+
+// runPreset implements the preset subcommand
+func runPreset(args []string) {
+	if len(args) < 1 {
+		printUsage(
+			"preset save <name> [options]",
+			"preset list",
+			"preset use <name> [options] <input.epub> [output.txt]",
+		)
+		os.Exit(1)
+	}
+
+	var err error
+	switch args[0] {
+	case "save":
+		err = runPresetSave(args[1:])
+	case "list":
+		err = runPresetList()
+	case "use":
+		err = runPresetUse(args[1:])
+	default:
+		err = fmt.Errorf(msg("ErrPresetCommand", "unknown preset command %q (valid: save, list, use)"), args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+}
+
+func runPresetSave(args []string) error {
+	if len(args) < 1 {
+		return errors.New(msg("ErrPresetMissingName", "missing preset name"))
+	}
+	name := args[0]
+
+	fs := flag.NewFlagSet("preset save", flag.ExitOnError)
+	defineConvertFlags(fs)
+	fs.Parse(args[1:])
+	if fs.NArg() > 0 {
+		return fmt.Errorf(msg("ErrPresetArgument", "unexpected argument %q: presets only store options"), fs.Arg(0))
+	}
+
+	// Only options given explicitly become part of the preset
+	p := make(preset)
+	fs.Visit(func(f *flag.Flag) {
+		p[f.Name] = f.Value.String()
+	})
+
+	path, err := savePreset(name, p)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(msg("PresetSaved", "Saved preset %s to %s")+"\n", name, path)
+	return nil
+}
+
+func runPresetList() error {
+	dir, err := presetDir()
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read preset directory: %w", err)
+	}
+
+	saved := make(map[string]bool)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		p, err := loadPreset(name)
+		if err != nil {
+			warnf(warnPreset, "", "%v", err)
+			continue
+		}
+		saved[name] = true
+		fmt.Printf("%s\t%s\n", name, p)
+	}
+
+	names := make([]string, 0, len(builtinPresets))
+	for name := range builtinPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !saved[name] {
+			fmt.Printf("%s\t%s %s\n", name, builtinPresets[name], msg("PresetBuiltin", "(built-in)"))
+		}
+	}
+	return nil
+}
+
+func runPresetUse(args []string) error {
+	if len(args) < 1 {
+		return errors.New(msg("ErrPresetMissingName", "missing preset name"))
+	}
+	p, err := loadPreset(args[0])
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("preset use", flag.ExitOnError)
+	cf := defineConvertFlags(fs)
+	// The preset overrides the config file, and the environment and then
+	// the command line override the preset
+	if err := applyConfig(fs, "convert"); err != nil {
+		return err
+	}
+	for name, value := range p {
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf(msg("ErrPresetOption", "preset %q: invalid option --%s=%s: %w"), args[0], name, value, err)
+		}
+	}
+
+	if err := applyEnvFlags(fs); err != nil {
+		return err
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() < 1 {
+		return errors.New(msg("ErrMissingInput", "missing input file"))
+	}
+	runConvert(cf, fs.Args())
+	return nil
+}
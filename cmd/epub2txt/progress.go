@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// progressWidth is the number of cells of the --progress bar
+const progressWidth = 30
+
+// The --progress bar is a line of stderr redrawn in place. Warnings and
+// errors erase it before they are printed, and the next update draws it
+// again below them.
+var (
+	progressMu sync.Mutex
+	// progressShown is the width of the line drawn, 0 if there is none
+	progressShown int
+)
+
+// showProgress draws the progress bar for done of total, followed by the
+// count as formatted by the message countID and then label. Once done
+// reaches total, the bar is erased.
+func showProgress(label string, done, total int, countID, count string) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	if done >= total {
+		eraseProgressLocked()
+		return
+	}
+	filled := progressWidth * done / max(total, 1)
+	line := fmt.Sprintf("[%s%s] %s  %s",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressWidth-filled),
+		fmt.Sprintf(msg(countID, count), done, total), label)
+	width := utf8.RuneCountInString(line)
+	fmt.Fprint(os.Stderr, "\r"+line+strings.Repeat(" ", max(progressShown-width, 0)))
+	progressShown = width
+}
+
+// eraseProgress erases the progress bar, if it is shown
+func eraseProgress() {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	eraseProgressLocked()
+}
+
+func eraseProgressLocked() {
+	if progressShown > 0 {
+		fmt.Fprint(os.Stderr, "\r"+strings.Repeat(" ", progressShown)+"\r")
+		progressShown = 0
+	}
+}
+
+// chapterProgress shows the progress of a book through its chapters
+func chapterProgress(p epubconv.Progress) {
+	showProgress(filepath.Base(p.Name), p.Done, p.Total, "ProgressChapters", "%d/%d chapters")
+}
+
+// bookProgress shows the progress of a directory run through its books
+func bookProgress(dir string, done, total int) {
+	showProgress(dir, done, total, "ProgressBooks", "%d/%d books")
+}
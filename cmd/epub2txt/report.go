@@ -0,0 +1,180 @@
+//go:build !minimal
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// sizeBuckets are the upper bounds of the input size histogram in a corpus
+// report. Books larger than the last bound fall into a final open bucket.
+var sizeBuckets = []struct {
+	label string
+	max   int64
+}{
+	{"<100K", 100 << 10},
+	{"100K-1M", 1 << 20},
+	{"1M-10M", 10 << 20},
+	{"10M-100M", 100 << 20},
+}
+
+const sizeBucketOverflow = ">100M"
+
+// corpusReport aggregates per-book statistics over a manifest run
+type corpusReport struct {
+	Books          int            `json:"books"`
+	Succeeded      int            `json:"succeeded"`
+	Failed         int            `json:"failed"`
+	TotalWords     int            `json:"totalWords"`
+	TotalChars     int            `json:"totalCharacters"`
+	TotalInputSize int64          `json:"totalInputBytes"`
+	Languages      map[string]int `json:"languages"`
+	SizeHistogram  map[string]int `json:"sizeHistogram"`
+	Failures       map[string]int `json:"failures"`
+}
+
+func newCorpusReport() *corpusReport {
+	r := &corpusReport{
+		Languages:     make(map[string]int),
+		SizeHistogram: make(map[string]int),
+		Failures:      make(map[string]int),
+	}
+	for _, bucket := range sizeBuckets {
+		r.SizeHistogram[bucket.label] = 0
+	}
+	r.SizeHistogram[sizeBucketOverflow] = 0
+	return r
+}
+
+// add records the outcome of converting one book
+func (r *corpusReport) add(stats bookStats, err error) {
+	r.Books++
+	if err != nil {
+		r.Failed++
+		r.Failures[failureKind(err)]++
+		return
+	}
+
+	r.Succeeded++
+	r.TotalWords += stats.words
+	r.TotalChars += stats.characters
+	r.TotalInputSize += stats.inputSize
+
+	language := stats.language
+	if language == "" {
+		language = "unknown"
+	}
+	r.Languages[language]++
+
+	bucket := sizeBucketOverflow
+	for _, b := range sizeBuckets {
+		if stats.inputSize < b.max {
+			bucket = b.label
+			break
+		}
+	}
+	r.SizeHistogram[bucket]++
+}
+
+// failureKind classifies a conversion error for the failure breakdown
+func failureKind(err error) string {
+	var syntaxErr *xml.SyntaxError
+	switch {
+	case errors.Is(err, epubconv.ErrMemoryLimit):
+		return "memory-limit"
+	case errors.Is(err, epubconv.ErrParseLimit):
+		return "parse-limit"
+	case errors.Is(err, epubconv.ErrArchiveLimit):
+		return "archive-limit"
+	case errors.Is(err, epubconv.ErrUnsafePath):
+		return "unsafe-path"
+	case errors.Is(err, epubconv.ErrDRMProtected):
+		return "drm"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not-found"
+	case errors.Is(err, zip.ErrFormat):
+		return "not-an-epub"
+	case errors.As(err, &syntaxErr):
+		return "invalid-xml"
+	}
+	return "other"
+}
+
+// write saves the report as CSV if path ends in .csv and as JSON otherwise
+func (r *corpusReport) write(path string) error {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return r.writeCSV(path)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeCSV writes the report as section,key,value rows
+func (r *corpusReport) writeCSV(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"section", "key", "value"})
+	for _, row := range [][2]string{
+		{"books", strconv.Itoa(r.Books)},
+		{"succeeded", strconv.Itoa(r.Succeeded)},
+		{"failed", strconv.Itoa(r.Failed)},
+		{"totalWords", strconv.Itoa(r.TotalWords)},
+		{"totalCharacters", strconv.Itoa(r.TotalChars)},
+		{"totalInputBytes", strconv.FormatInt(r.TotalInputSize, 10)},
+	} {
+		w.Write([]string{"summary", row[0], row[1]})
+	}
+	writeCounts(w, "language", r.Languages)
+	for _, bucket := range sizeBuckets {
+		w.Write([]string{"size", bucket.label, strconv.Itoa(r.SizeHistogram[bucket.label])})
+	}
+	w.Write([]string{"size", sizeBucketOverflow, strconv.Itoa(r.SizeHistogram[sizeBucketOverflow])})
+	writeCounts(w, "failure", r.Failures)
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeCounts writes one row per key of counts, in sorted key order
+func writeCounts(w *csv.Writer, section string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		w.Write([]string{section, key, strconv.Itoa(counts[key])})
+	}
+}
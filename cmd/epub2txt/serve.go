@@ -0,0 +1,239 @@
+//go:build !minimal
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+func init() {
+	subcommands["serve"] = runServe
+	features["serve"] = true
+}
+
+// serveMarkdown is the format of the serve subcommand's responses that is
+// the plain text with Markdown headings and tables, and blank lines between
+// paragraphs
+const serveMarkdown = "markdown"
+
+// serveFormats are the values of the format query parameter, with the media
+// type each is sent as
+var serveFormats = map[string]string{
+	epubconv.FormatText:   "text/plain; charset=utf-8",
+	serveMarkdown:         "text/markdown; charset=utf-8",
+	epubconv.FormatJSON:   "application/json",
+	epubconv.FormatPandoc: "application/json",
+}
+
+// serveLimits are the defaults of the serve subcommand for the limits that
+// are off elsewhere, as it converts untrusted uploads: a zip bomb well under
+// the upload limit could otherwise fill the server's memory
+var serveLimits = map[string]string{
+	"max-memory":     "512M",
+	"max-file-size":  "64M",
+	"max-total-size": "1G",
+}
+
+// Timeouts of the serve subcommand's connections, so that slow clients
+// can't hold a connection, and the memory of its upload, indefinitely
+const (
+	serveReadTimeout  = 5 * time.Minute
+	serveWriteTimeout = 10 * time.Minute
+	serveIdleTimeout  = 2 * time.Minute
+)
+
+// server converts the books uploaded to it, a few at a time
+type server struct {
+	opts      epubconv.Options
+	maxUpload epubconv.ByteSize
+	// uploads holds a token for each upload being read or held until its
+	// conversion is done, bounding the memory uploads take
+	uploads chan struct{}
+	// slots holds a token for each conversion running
+	slots chan struct{}
+}
+
+// newServer returns a server converting up to maxConcurrent books at once,
+// and holding up to maxUploads uploads of up to maxUpload bytes, twice
+// maxConcurrent if it is 0
+func newServer(opts epubconv.Options, maxUpload epubconv.ByteSize, maxConcurrent, maxUploads int) *server {
+	maxConcurrent = max(maxConcurrent, 1)
+	if maxUploads <= 0 {
+		maxUploads = 2 * maxConcurrent
+	}
+	return &server{
+		opts:      opts,
+		maxUpload: maxUpload,
+		uploads:   make(chan struct{}, maxUploads),
+		slots:     make(chan struct{}, maxConcurrent),
+	}
+}
+
+// runServe implements the serve subcommand, converting books uploaded over
+// HTTP with the given options
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", msg("FlagServeAddr", "`address` to listen on"))
+	maxUpload := epubconv.ByteSize(64 << 20)
+	fs.Var(&maxUpload, "max-upload", msg("FlagServeMaxUpload", "reject uploads of more than `size` bytes with 413 Request Entity Too Large"))
+	maxConcurrent := fs.Int("max-concurrent", runtime.NumCPU(), msg("FlagServeMaxConcurrent", "number of books to convert at once; further requests wait for a turn"))
+	maxUploads := fs.Int("max-uploads", 0, msg("FlagServeMaxUploads", "number of uploads to read or hold at once; further requests wait before theirs is read (0: twice --max-concurrent)"))
+	unlimited := fs.Bool("unlimited", false, msg("FlagServeUnlimited", "allow --max-memory, --max-file-size or --max-total-size to be 0 (no limit)"))
+	cf := defineConvertFlags(fs)
+	for name, value := range serveLimits {
+		fs.Set(name, value)
+		fs.Lookup(name).DefValue = value
+	}
+	if err := applyDefaults(fs, "serve"); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		printUsage("serve [--addr address] [--max-upload size] [--max-concurrent n] [--max-uploads n] [--unlimited] [options]")
+		os.Exit(1)
+	}
+	if !*unlimited && (*cf.maxMemory == 0 || *cf.maxFileSize == 0 || *cf.maxTotalSize == 0) {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", msg("ErrServeUnlimited", "serve needs --max-memory, --max-file-size and --max-total-size limits to convert untrusted uploads; pass --unlimited to run without them"))
+		os.Exit(1)
+	}
+
+	opts, err := cf.options(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	// Warnings go to the log as each request has them
+	sortWarnings = false
+	opts.Progress = nil
+	s := newServer(opts, maxUpload, *maxConcurrent, *maxUploads)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/convert", s.convert)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+		ReadTimeout:       serveReadTimeout,
+		WriteTimeout:      serveWriteTimeout,
+		IdleTimeout:       serveIdleTimeout,
+	}
+	fmt.Fprintf(os.Stderr, msg("ServeListening", "Listening on %s")+"\n", *addr)
+	if err := srv.ListenAndServe(); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+}
+
+// convert handles POST /convert, whose body is the book, or a multipart
+// form with the book as its "file" field, and converts it to the format
+// query parameter
+func (s *server) convert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, msg("ErrServeMethod", "POST the book to convert"), http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = epubconv.FormatText
+	}
+	mediaType, ok := serveFormats[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf(msg("ErrServeFormat", "unknown format %q (valid: txt, markdown, json, pandoc-json)"), format), http.StatusBadRequest)
+		return
+	}
+
+	// The upload is read before waiting for a turn, so that slow uploads
+	// don't hold the conversion slots; the server's read timeout bounds how
+	// long they take. Only so many are read or held at once, so a flood of
+	// requests can't fill the server's memory with uploads.
+	select {
+	case s.uploads <- struct{}{}:
+		defer func() { <-s.uploads }()
+	case <-r.Context().Done():
+		return
+	}
+	name, data, err := s.readUpload(w, r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf(msg("ErrServeTooLarge", "upload larger than %s"), s.maxUpload.String()), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-r.Context().Done():
+		return
+	}
+
+	opts := s.opts
+	opts.Name = name
+	opts.Chapters = epubconv.NewChapterIndex()
+	if format == serveMarkdown {
+		opts.Format = epubconv.FormatText
+		opts.HeadingStyle = epubconv.HeadingHash
+		opts.Tables = epubconv.TablesMarkdown
+		opts.ParagraphSpacing = max(opts.ParagraphSpacing, 1)
+	} else {
+		opts.Format = format
+	}
+	var warnings atomic.Int64
+	opts.Warn = func(warning epubconv.Warning) {
+		warnings.Add(1)
+		printWarning(warning)
+	}
+
+	text, err := epubconv.Convert(bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("ErrorForFile", "Error: %s: %v")+"\n", name, err)
+		http.Error(w, fmt.Errorf(msg("ErrConvert", "failed to convert EPUB: %w"), err).Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Epubconv-Warnings", strconv.FormatInt(warnings.Load(), 10))
+	io.WriteString(w, text)
+}
+
+// readUpload reads the book uploaded with r, returning the name it is known
+// by in warnings: its file name in a multipart form, or "upload"
+func (s *server) readUpload(w http.ResponseWriter, r *http.Request) (string, []byte, error) {
+	body := http.MaxBytesReader(w, r.Body, int64(s.maxUpload))
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		r.Body = body
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			// The multipart reader hides the error of an upload over the
+			// limit, so read what is left of the body to tell
+			if _, tooLarge := io.Copy(io.Discard, body); tooLarge != nil {
+				err = tooLarge
+			}
+			return "", nil, err
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		return header.Filename, data, err
+	}
+	data, err := io.ReadAll(body)
+	return "upload", data, err
+}
@@ -0,0 +1,148 @@
+//go:build !minimal
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+func TestServeConvert(t *testing.T) {
+	book, err := demoEPUB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	multipartBody := func(data []byte) (string, []byte) {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		f, _ := w.CreateFormFile("file", "book.epub")
+		f.Write(data)
+		w.Close()
+		return w.FormDataContentType(), body.Bytes()
+	}
+	formType, form := multipartBody(book)
+	_, largeForm := multipartBody(make([]byte, 2*len(book)))
+
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		contentType string
+		body        []byte
+		want        int
+	}{
+		{name: "body", method: http.MethodPost, body: book, want: http.StatusOK},
+		{name: "markdown", method: http.MethodPost, query: "?format=markdown", body: book, want: http.StatusOK},
+		{name: "multipart", method: http.MethodPost, contentType: formType, body: form, want: http.StatusOK},
+		{name: "oversized body", method: http.MethodPost, body: make([]byte, 2*len(book)), want: http.StatusRequestEntityTooLarge},
+		{name: "oversized multipart", method: http.MethodPost, contentType: formType, body: largeForm, want: http.StatusRequestEntityTooLarge},
+		{name: "not a book", method: http.MethodPost, body: []byte("hello"), want: http.StatusUnprocessableEntity},
+		{name: "unknown format", method: http.MethodPost, query: "?format=pdf", body: book, want: http.StatusBadRequest},
+		{name: "get", method: http.MethodGet, want: http.StatusMethodNotAllowed},
+	}
+	s := newServer(epubconv.Options{}, epubconv.ByteSize(len(book)+1024), 2, 0)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/convert"+test.query, bytes.NewReader(test.body))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			w := httptest.NewRecorder()
+			s.convert(w, r)
+			if w.Code != test.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+			}
+		})
+	}
+}
+
+// heldBody is a request body that counts the requests whose bodies have
+// started being read, and blocks them until release is closed
+type heldBody struct {
+	data    io.Reader
+	started *atomic.Int64
+	release chan struct{}
+	once    sync.Once
+}
+
+func (b *heldBody) Read(p []byte) (int, error) {
+	b.once.Do(func() {
+		b.started.Add(1)
+		<-b.release
+	})
+	return b.data.Read(p)
+}
+
+func TestServeBoundsUploads(t *testing.T) {
+	book, err := demoEPUB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const maxUploads, requests = 3, 20
+	s := newServer(epubconv.Options{}, epubconv.ByteSize(len(book)), 1, maxUploads)
+
+	var started atomic.Int64
+	release := make(chan struct{})
+	codes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		body := &heldBody{data: bytes.NewReader(book), started: &started, release: release}
+		go func() {
+			w := httptest.NewRecorder()
+			s.convert(w, httptest.NewRequest(http.MethodPost, "/convert", body))
+			codes <- w.Code
+		}()
+	}
+
+	// Wait for the uploads let in to start, and give the rest the chance
+	// to start too if they weren't held back
+	for deadline := time.Now().Add(5 * time.Second); started.Load() < maxUploads; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d uploads started, want %d", started.Load(), maxUploads)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := started.Load(); n != maxUploads {
+		t.Errorf("%d uploads read at once, want %d", n, maxUploads)
+	}
+
+	close(release)
+	for i := 0; i < requests; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("status = %d, want %d", code, http.StatusOK)
+		}
+	}
+	if started.Load() != requests {
+		t.Errorf("%d uploads read, want %d", started.Load(), requests)
+	}
+	if len(s.uploads) != 0 || len(s.slots) != 0 {
+		t.Errorf("%d uploads and %d slots still held", len(s.uploads), len(s.slots))
+	}
+}
+
+func TestServeUploadsDefault(t *testing.T) {
+	tests := []struct {
+		maxConcurrent, maxUploads int
+		wantSlots, wantUploads    int
+	}{
+		{maxConcurrent: 4, wantSlots: 4, wantUploads: 8},
+		{maxConcurrent: 4, maxUploads: 5, wantSlots: 4, wantUploads: 5},
+		{maxConcurrent: 0, wantSlots: 1, wantUploads: 2},
+	}
+	for _, test := range tests {
+		s := newServer(epubconv.Options{}, 1<<20, test.maxConcurrent, test.maxUploads)
+		if cap(s.slots) != test.wantSlots || cap(s.uploads) != test.wantUploads {
+			t.Errorf("newServer(%d, %d) holds %d slots and %d uploads, want %d and %d", test.maxConcurrent, test.maxUploads,
+				cap(s.slots), cap(s.uploads), test.wantSlots, test.wantUploads)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// defaultNameTemplate names the chapter files of --split-chapters
+const defaultNameTemplate = "{index:03d}-{title}.txt"
+
+// nameFields are the fields a --name-template can use
+var nameFields = []string{"index", "title", "book", "file"}
+
+// nameTemplate is a parsed --name-template, such as "{index:03d}-{title}.txt"
+type nameTemplate struct {
+	parts []nameTemplatePart
+}
+
+// nameTemplatePart is either literal text or a field. Numeric fields can be
+// padded to width digits, with zeros if zero is set.
+type nameTemplatePart struct {
+	literal string
+	field   string
+	width   int
+	zero    bool
+}
+
+var (
+	nameFieldPattern = regexp.MustCompile(`\{([^{}]*)\}`)
+	nameSpecPattern  = regexp.MustCompile(`^(0?)([0-9]*)d$`)
+)
+
+// parseNameTemplate parses a --name-template. Fields are written {name},
+// and {index} also takes a Python-style width, e.g. {index:03d}.
+func parseNameTemplate(s string) (*nameTemplate, error) {
+	t := &nameTemplate{}
+	last := 0
+	for _, m := range nameFieldPattern.FindAllStringSubmatchIndex(s, -1) {
+		if m[0] > last {
+			t.parts = append(t.parts, nameTemplatePart{literal: s[last:m[0]]})
+		}
+		last = m[1]
+
+		name, spec, hasSpec := strings.Cut(s[m[2]:m[3]], ":")
+		if !slices.Contains(nameFields, name) {
+			return nil, fmt.Errorf(msg("ErrNameField", "unknown field {%s} in name template (valid: %s)"), name, strings.Join(nameFields, ", "))
+		}
+		part := nameTemplatePart{field: name}
+		if hasSpec {
+			sm := nameSpecPattern.FindStringSubmatch(spec)
+			if sm == nil || name != "index" {
+				return nil, fmt.Errorf(msg("ErrNameSpec", "invalid format %q for {%s} in name template"), spec, name)
+			}
+			part.zero = sm[1] != ""
+			part.width, _ = strconv.Atoi(sm[2])
+		}
+		t.parts = append(t.parts, part)
+	}
+	if last < len(s) {
+		t.parts = append(t.parts, nameTemplatePart{literal: s[last:]})
+	}
+	return t, nil
+}
+
+// expand returns the file name for the chapter at index. The other field
+// values are sanitized, so only the template's literal text can add
+// directories.
+func (t *nameTemplate) expand(index int, fields map[string]string) string {
+	var name strings.Builder
+	for _, part := range t.parts {
+		switch {
+		case part.field == "":
+			name.WriteString(part.literal)
+		case part.field == "index" && part.zero:
+			fmt.Fprintf(&name, "%0*d", part.width, index)
+		case part.field == "index":
+			fmt.Fprintf(&name, "%*d", part.width, index)
+		default:
+			name.WriteString(sanitizeFileName(fields[part.field]))
+		}
+	}
+	return name.String()
+}
+
+// maxNameField bounds the length, in characters, of a field in a file name
+const maxNameField = 80
+
+// windowsReserved are file names Windows doesn't allow, with or without an
+// extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFileName makes s safe to use as part of a file name on Linux,
+// macOS and Windows: path separators, characters Windows doesn't allow and
+// control characters become underscores, whitespace collapses to single
+// spaces, leading and trailing dots and spaces are dropped and long values
+// are shortened
+func sanitizeFileName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.Trim(strings.Join(strings.Fields(s), " "), ". ")
+	if utf8.RuneCountInString(s) > maxNameField {
+		s = strings.TrimRight(string([]rune(s)[:maxNameField]), ". ")
+	}
+	return s
+}
+
+// safeFileName adjusts a file name, relative to the output directory, that
+// Windows would reject
+func safeFileName(name string) string {
+	dir, base := path.Split(filepath.ToSlash(name))
+	stem, _, _ := strings.Cut(base, ".")
+	if windowsReserved[strings.ToUpper(stem)] {
+		base = "_" + base
+	}
+	return filepath.FromSlash(dir + base)
+}
+
+// uniqueFileName returns name, or if it is already used, name with a
+// number added before its extension
+func uniqueFileName(name string, used map[string]bool) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	unique := name
+	for n := 2; used[strings.ToLower(unique)]; n++ {
+		unique = fmt.Sprintf("%s-%d%s", stem, n, ext)
+	}
+	// Names differing only in case collide on macOS and Windows
+	used[strings.ToLower(unique)] = true
+	return unique
+}
+
+// writeChapters converts epubPath and writes each chapter to its own file in
+// outputDir, named by the template, and the book's images, cover and fonts
+// where extract says
+func writeChapters(epubPath, outputDir string, extract extractPaths, template *nameTemplate, opts epubconv.Options) (bookStats, error) {
+	book, err := openBook(epubPath, opts)
+	if err != nil {
+		return bookStats{}, fmt.Errorf(msg("ErrConvert", "failed to convert EPUB: %w"), err)
+	}
+	defer book.Close()
+	if err := writeExtracted(book, epubPath, extract, "", nil); err != nil {
+		return bookStats{}, err
+	}
+	chapters, err := book.Chapters()
+	if err != nil {
+		return bookStats{}, fmt.Errorf(msg("ErrConvert", "failed to convert EPUB: %w"), err)
+	}
+
+	bookName := filepath.Base(inputStem(epubPath))
+	used := make(map[string]bool)
+	var stats bookStats
+	for _, chapter := range chapters {
+		file := path.Base(chapter.Path)
+		file = strings.TrimSuffix(file, path.Ext(file))
+		title := chapter.Title
+		if sanitizeFileName(title) == "" {
+			title = file
+		}
+		name := template.expand(chapter.Index, map[string]string{
+			"title": title,
+			"book":  bookName,
+			"file":  file,
+		})
+		if !filepath.IsLocal(name) {
+			return bookStats{}, fmt.Errorf(msg("ErrNamePath", "name template gives %q, which is outside the output directory"), name)
+		}
+		chapterPath := filepath.Join(outputDir, uniqueFileName(safeFileName(name), used))
+
+		if err := os.MkdirAll(filepath.Dir(chapterPath), 0755); err != nil {
+			return bookStats{}, fmt.Errorf("failed to create output directory: %w", err)
+		}
+		if err := os.WriteFile(chapterPath, []byte(chapter.Text), 0644); err != nil {
+			return bookStats{}, fmt.Errorf(msg("ErrWriteOutput", "failed to write output file: %w"), err)
+		}
+		words, characters := epubconv.Measure(chapter.Text, epubconv.FormatText)
+		stats.words += words
+		stats.characters += characters
+	}
+	eraseProgress()
+	fmt.Printf(msg("ConvertedChapters", "Successfully converted %s to %d chapter files in %s")+"\n", epubPath, len(chapters), outputDir)
+	stats.describe(epubPath, book)
+	return stats, nil
+}
+
+// splitOptionError reports an option --split-chapters can't be used with
+func splitOptionError(option string) error {
+	return fmt.Errorf(msg("ErrSplitOption", "--split-chapters can't be combined with %s"), option)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// bookStatsReport is the stats of a book as the stats subcommand prints
+// them
+type bookStatsReport struct {
+	File string `json:"file"`
+	epubconv.Stats
+}
+
+// runStats implements the stats subcommand, printing the word and character
+// counts, reading time and language of books
+func runStats(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	stripGutenberg := fs.Bool("strip-gutenberg", false, msg("FlagStripGutenberg", "strip the Project Gutenberg license header and footer"))
+	if err := applyDefaults(fs, "stats"); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		printUsage("stats [--strip-gutenberg] <input.epub|directory>...")
+		os.Exit(1)
+	}
+
+	books, err := listBooks(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+
+	// A book on its own is printed as an indented object, and more than
+	// one as a line of JSON each
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	if len(books) == 1 && len(fs.Args()) == 1 && books[0] == fs.Arg(0) {
+		enc.SetIndent("", "  ")
+	}
+	opts := epubconv.Options{Lenient: true, StripGutenberg: *stripGutenberg, Warn: printWarning}
+	failed := 0
+	for _, bookPath := range books {
+		if err := printStats(enc, bookPath, opts); err != nil {
+			fmt.Fprintf(os.Stderr, msg("ErrorForFile", "Error: %s: %v")+"\n", bookPath, err)
+			failed++
+		}
+	}
+	flushWarnings()
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// printStats encodes the stats of the book at bookPath to enc
+func printStats(enc *json.Encoder, bookPath string, opts epubconv.Options) error {
+	book, err := openBook(bookPath, opts)
+	if err != nil {
+		return fmt.Errorf(msg("ErrReadStats", "failed to read book statistics: %w"), err)
+	}
+	defer book.Close()
+
+	stats, err := book.Stats()
+	if err != nil {
+		return fmt.Errorf(msg("ErrReadStats", "failed to read book statistics: %w"), err)
+	}
+	return enc.Encode(bookStatsReport{File: bookPath, Stats: stats})
+}
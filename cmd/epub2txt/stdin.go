@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// stdinPath as the input reads the EPUB from stdin, and as the output writes
+// to stdout
+const stdinPath = "-"
+
+// stdinName names a book read from stdin, in warnings and output file names
+const stdinName = "stdin"
+
+var (
+	stdinOnce sync.Once
+	stdin     io.ReaderAt
+	stdinSize int64
+	stdinErr  error
+)
+
+// openBook opens the EPUB at epubPath for converting with opts, or reads it
+// from stdin if epubPath is "-". The book must be closed when done with.
+func openBook(epubPath string, opts epubconv.Options) (*epubconv.Book, error) {
+	if epubPath != stdinPath {
+		return epubconv.OpenFile(epubPath, opts)
+	}
+	r, size, err := readStdin()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
+		opts.Name = stdinName
+	}
+	return epubconv.Open(r, size, opts)
+}
+
+// readStdin returns the EPUB on stdin. A file redirected to stdin is read in
+// place, but a pipe can only be read once from start to end, so it is read
+// into memory.
+func readStdin() (io.ReaderAt, int64, error) {
+	stdinOnce.Do(func() {
+		if info, err := os.Stdin.Stat(); err == nil && info.Mode().IsRegular() {
+			stdin, stdinSize = os.Stdin, info.Size()
+			return
+		}
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			stdinErr = fmt.Errorf("failed to read EPUB from stdin: %w", err)
+			return
+		}
+		stdin, stdinSize = bytes.NewReader(data), int64(len(data))
+	})
+	return stdin, stdinSize, stdinErr
+}
+
+// inputStem returns epubPath without its extension, which output file names
+// are derived from, or "stdin" for a book read from stdin
+func inputStem(epubPath string) string {
+	if epubPath == stdinPath {
+		return stdinName
+	}
+	return trimExt(epubPath)
+}
+
+// trimExt returns path without its extension, both of them for a zipped
+// FictionBook's .fb2.zip
+func trimExt(path string) string {
+	if ext := ".fb2.zip"; len(path) > len(ext) && strings.EqualFold(path[len(path)-len(ext):], ext) {
+		return path[:len(path)-len(ext)]
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path))
+}
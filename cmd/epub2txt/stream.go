@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// streamText converts book to plain text, writing it to outputPath as it
+// is converted, and returns its word and character counts. The text goes to
+// a temporary file that replaces outputPath once the conversion succeeds,
+// so a failed conversion leaves any earlier output alone. Output that isn't
+// a regular file, such as /dev/stdout, is written directly, and "-" writes
+// to stdout.
+func streamText(book *epubconv.Book, outputPath string) (words, characters int, err error) {
+	if outputPath == stdinPath {
+		return writeCounted(book, os.Stdout)
+	}
+	if info, err := os.Stat(outputPath); err == nil && !info.Mode().IsRegular() {
+		f, err := os.OpenFile(outputPath, os.O_WRONLY, 0)
+		if err != nil {
+			return 0, 0, fmt.Errorf(msg("ErrWriteOutput", "failed to write output file: %w"), err)
+		}
+		defer f.Close()
+		return writeCounted(book, f)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".*.tmp")
+	if err != nil {
+		return 0, 0, fmt.Errorf(msg("ErrWriteOutput", "failed to write output file: %w"), err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if words, characters, err = writeCounted(book, f); err != nil {
+		return 0, 0, err
+	}
+	err = f.Chmod(0644)
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), outputPath)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf(msg("ErrWriteOutput", "failed to write output file: %w"), err)
+	}
+	return words, characters, nil
+}
+
+// writeCounted converts book to plain text written to w, and returns its
+// word and character counts
+func writeCounted(book *epubconv.Book, w io.Writer) (words, characters int, err error) {
+	buf := bufio.NewWriter(w)
+	counter := &textCounter{w: buf}
+	if err := book.WriteText(counter); err != nil {
+		if counter.err != nil {
+			return 0, 0, fmt.Errorf(msg("ErrWriteOutput", "failed to write output file: %w"), counter.err)
+		}
+		return 0, 0, fmt.Errorf(msg("ErrConvert", "failed to convert EPUB: %w"), err)
+	}
+	if err := buf.Flush(); err != nil {
+		return 0, 0, fmt.Errorf(msg("ErrWriteOutput", "failed to write output file: %w"), err)
+	}
+	counter.finish()
+	return counter.words, counter.characters, nil
+}
+
+// textCounter counts the words and characters of the text written through
+// it, as epubconv.Measure does for plain text, and records the first error
+// writing to w
+type textCounter struct {
+	w          io.Writer
+	words      int
+	characters int
+	err        error
+	inWord     bool
+	// partial is an incomplete UTF-8 sequence ending the last write
+	partial []byte
+}
+
+func (c *textCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	data := append(c.partial, p[:n]...)
+	for len(data) > 0 && (utf8.FullRune(data) || len(data) >= utf8.UTFMax) {
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+		c.characters++
+		space := unicode.IsSpace(r)
+		if !space && !c.inWord {
+			c.words++
+		}
+		c.inWord = !space
+	}
+	c.partial = slices.Clone(data)
+	return n, err
+}
+
+// finish counts the bytes of an incomplete UTF-8 sequence ending the text,
+// which are invalid, as a character each
+func (c *textCounter) finish() {
+	if len(c.partial) > 0 {
+		c.characters += len(c.partial)
+		if !c.inWord {
+			c.words++
+		}
+		c.partial = nil
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// Output formats of --toc
+const (
+	tocText = "text"
+	tocJSON = "json"
+)
+
+// runTOC implements the toc subcommand, printing the table of contents of
+// a book instead of converting it
+func runTOC(args []string) {
+	fs := flag.NewFlagSet("toc", flag.ExitOnError)
+	format := fs.String("format", tocText, fmt.Sprintf(msg("FlagTOCFormat", "format of --toc: %s (an indented outline) or %s (nested entries)"), tocText, tocJSON))
+	lenient := fs.Bool("lenient", true, msg("FlagLenient", "recover what can be read of a book with a malformed container.xml or package document, with a recovered warning for each repair, instead of failing (--lenient=false to fail)"))
+	if err := applyDefaults(fs, "toc"); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	args = parseArgs(fs, args)
+	if len(args) < 1 || len(args) > 2 {
+		printUsage("toc [--format text|json] <input.epub> [output]")
+		os.Exit(1)
+	}
+
+	outputPath := ""
+	if len(args) == 2 {
+		outputPath = args[1]
+	}
+	err := writeTOC(args[0], outputPath, *format, epubconv.Options{Lenient: *lenient, Warn: printWarning})
+	flushWarnings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+}
+
+// writeTOC writes the table of contents of epubPath to outputPath, or to
+// stdout if it is empty or "-", instead of converting the book
+func writeTOC(epubPath, outputPath, format string, opts epubconv.Options) error {
+	if format != tocText && format != tocJSON {
+		return fmt.Errorf(msg("ErrTOCFormat", "unknown table of contents format %q (valid: %s, %s)"), format, tocText, tocJSON)
+	}
+	book, err := openBook(epubPath, opts)
+	if err != nil {
+		return fmt.Errorf(msg("ErrConvert", "failed to convert EPUB: %w"), err)
+	}
+	defer book.Close()
+	entries, err := book.TOC()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if format == tocJSON {
+		if entries == nil {
+			entries = []epubconv.TOCEntry{}
+		}
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			return err
+		}
+	} else {
+		writeOutline(&buf, entries, 0)
+	}
+
+	if outputPath == "" || outputPath == stdinPath {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	if err := os.WriteFile(outputPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf(msg("ErrWriteOutput", "failed to write output file: %w"), err)
+	}
+	return nil
+}
+
+// writeOutline writes entries as an outline, one title per line, indented by
+// two spaces per level. Untitled entries show their href instead.
+func writeOutline(w io.Writer, entries []epubconv.TOCEntry, depth int) {
+	for _, entry := range entries {
+		title := entry.Title
+		if title == "" {
+			title = entry.Href
+		}
+		fmt.Fprintf(w, "%s%s\n", strings.Repeat("  ", depth), title)
+		writeOutline(w, entry.Children, depth+1)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// validationReport is what the validate subcommand finds wrong with a book:
+// the error that stops its conversion, if any, and the warnings it gives
+type validationReport struct {
+	File     string    `json:"file"`
+	Valid    bool      `json:"valid"`
+	Error    string    `json:"error,omitempty"`
+	Problems []problem `json:"problems"`
+}
+
+// problem is a warning about a book, as validate --json prints it
+type problem struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// runValidate implements the validate subcommand, converting books without
+// writing them out to report their problems, and exiting with a non-zero
+// status if any has one
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, msg("FlagValidateJSON", "print a line of JSON for each book instead of a report"))
+	if err := applyDefaults(fs, "validate"); err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+	args = parseArgs(fs, args)
+	if len(args) < 1 {
+		printUsage("validate [--json] <input.epub|directory>...")
+		os.Exit(1)
+	}
+	books, err := listBooks(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	invalid := 0
+	for _, bookPath := range books {
+		report := validateBook(bookPath)
+		if !report.Valid {
+			invalid++
+		}
+		if *jsonOutput {
+			if err := enc.Encode(report); err != nil {
+				fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", err)
+				os.Exit(1)
+			}
+			continue
+		}
+		switch {
+		case report.Error != "":
+			fmt.Printf(msg("ValidateError", "%s: error: %s")+"\n", bookPath, report.Error)
+		case report.Valid:
+			fmt.Printf(msg("ValidateOK", "%s: ok")+"\n", bookPath)
+		default:
+			fmt.Printf(msg("ValidateProblems", "%s: %d problems")+"\n", bookPath, len(report.Problems))
+		}
+		for _, p := range report.Problems {
+			fmt.Printf("  [%s] %s\n", p.Category, p.Message)
+		}
+	}
+	if invalid > 0 {
+		os.Exit(1)
+	}
+}
+
+// validateBook converts the book at bookPath, leniently so that what had to
+// be recovered is reported, and returns what went wrong
+func validateBook(bookPath string) validationReport {
+	report := validationReport{File: bookPath, Problems: []problem{}}
+	opts := epubconv.Options{
+		Lenient: true,
+		Warn: func(w epubconv.Warning) {
+			report.Problems = append(report.Problems, problem{Category: w.Category, Message: w.Message})
+		},
+	}
+	book, err := openBook(bookPath, opts)
+	if err == nil {
+		err = book.WriteText(io.Discard)
+		book.Close()
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.Valid = err == nil && len(report.Problems) == 0
+	return report
+}
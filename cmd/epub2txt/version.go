@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/fletcharoo/epubconv"
+)
+
+// commit identifies the build along with epubconv.Version. Both are set at
+// build time with -ldflags "-X github.com/fletcharoo/epubconv.Version=...
+// -X main.commit=...". When commit isn't set, the VCS revision recorded by
+// the Go toolchain is used instead.
+var commit = ""
+
+// features records which optional features are compiled into this binary.
+// The align, build, demo, manifest and serve subcommands are left out of
+// builds with the minimal tag, for small devices, and set their entries
+// from init when they are compiled in.
+var features = map[string]bool{
+	"align":    false,
+	"build":    false,
+	"demo":     false,
+	"manifest": false,
+	"ocr":      false,
+	"pdf":      false,
+	"s3":       false,
+	"serve":    false,
+}
+
+// Formats the converter can read and write
+var (
+	inputFormats  = []string{"epub", "mobi", "azw3", "fb2"}
+	outputFormats = epubconv.Formats
+)
+
+// buildInfo is the report printed by the version subcommand
+type buildInfo struct {
+	Version       string          `json:"version"`
+	Commit        string          `json:"commit,omitempty"`
+	GoVersion     string          `json:"goVersion"`
+	Platform      string          `json:"platform"`
+	Features      map[string]bool `json:"features"`
+	InputFormats  []string        `json:"inputFormats"`
+	OutputFormats []string        `json:"outputFormats"`
+}
+
+func currentBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:       epubconv.Version,
+		Commit:        commit,
+		GoVersion:     runtime.Version(),
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+		Features:      features,
+		InputFormats:  inputFormats,
+		OutputFormats: outputFormats,
+	}
+
+	if info.Commit == "" {
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			modified := false
+			for _, setting := range bi.Settings {
+				switch setting.Key {
+				case "vcs.revision":
+					info.Commit = setting.Value
+				case "vcs.modified":
+					modified = setting.Value == "true"
+				}
+			}
+			if info.Commit != "" && modified {
+				info.Commit += "-dirty"
+			}
+		}
+	}
+	return info
+}
+
+// runVersion implements the version subcommand
+func runVersion(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, msg("FlagVersionJSON", "print build information as JSON"))
+	fs.Parse(args)
+
+	info := currentBuildInfo()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			fmt.Fprintf(os.Stderr, msg("Error", "Error: %v")+"\n", fmt.Sprintf(msg("ErrVersionWrite", "failed to write version information: %v"), err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Printf("epubconv %s\n", info.Version)
+	if info.Commit != "" {
+		fmt.Printf("commit: %s\n", info.Commit)
+	}
+	fmt.Printf("go: %s %s\n", info.GoVersion, info.Platform)
+}
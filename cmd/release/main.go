@@ -0,0 +1,178 @@
+// Command release cross-compiles the release binaries of epub2txt.
+//
+// Run it from the repository root:
+//
+//	go run ./cmd/release [-version v1.2.0] [-out dist] [-targets linux/arm,linux/arm64]
+//
+// Every binary is statically linked (CGO_ENABLED=0) and stripped, and is
+// written to the output directory with a SHA256SUMS file listing them all.
+// The e-reader targets are also built with the minimal tag, which leaves out
+// the features only servers and desktops need.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// target is one entry of the build matrix
+type target struct {
+	goos   string
+	goarch string
+	goarm  string // ARM version for goarch "arm"
+	// minimal also builds a variant with the minimal tag
+	minimal bool
+}
+
+// matrix lists the platforms binaries are released for. Kobo and other
+// e-readers running KOReader are 32-bit ARMv7 Linux, so linux/arm is built
+// for ARMv7 and, for older devices, ARMv6. The big-endian targets catch
+// byte-order assumptions that little-endian hosts would hide.
+var matrix = []target{
+	{goos: "linux", goarch: "amd64"},
+	{goos: "linux", goarch: "386"},
+	{goos: "linux", goarch: "arm64", minimal: true},
+	{goos: "linux", goarch: "arm", goarm: "7", minimal: true},
+	{goos: "linux", goarch: "arm", goarm: "6", minimal: true},
+	{goos: "linux", goarch: "mips", minimal: true},
+	{goos: "linux", goarch: "ppc64"},
+	{goos: "linux", goarch: "s390x"},
+	{goos: "darwin", goarch: "amd64"},
+	{goos: "darwin", goarch: "arm64"},
+	{goos: "windows", goarch: "amd64"},
+	{goos: "windows", goarch: "arm64"},
+	{goos: "freebsd", goarch: "amd64"},
+}
+
+func (t target) String() string {
+	return t.goos + "/" + t.goarch
+}
+
+// binaryName returns the file name of the binary built for t
+func (t target) binaryName(version string, minimal bool) string {
+	name := fmt.Sprintf("epub2txt-%s-%s-%s", version, t.goos, t.goarch)
+	if t.goarm != "" {
+		name += "v" + t.goarm
+	}
+	if minimal {
+		name += "-minimal"
+	}
+	if t.goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func main() {
+	version := flag.String("version", "", "version to stamp into the binaries (default: git describe)")
+	outDir := flag.String("out", "dist", "`directory` to write the binaries to")
+	targets := flag.String("targets", "", "comma-separated os/arch `list` to build (default: the whole matrix)")
+	flag.Parse()
+
+	if err := run(*version, *outDir, *targets); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(version, outDir, targets string) error {
+	commit, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return fmt.Errorf("failed to read commit: %w", err)
+	}
+	if version == "" {
+		if version, err = git("describe", "--tags", "--always", "--dirty"); err != nil {
+			return fmt.Errorf("failed to describe version: %w", err)
+		}
+	}
+
+	selected := matrix
+	if targets != "" {
+		names := strings.Split(targets, ",")
+		selected = nil
+		for _, t := range matrix {
+			if slices.Contains(names, t.String()) {
+				selected = append(selected, t)
+			}
+		}
+		if len(selected) == 0 {
+			return fmt.Errorf("no targets match %q", targets)
+		}
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	var sums strings.Builder
+	for _, t := range selected {
+		variants := []bool{false}
+		if t.minimal {
+			variants = append(variants, true)
+		}
+		for _, minimal := range variants {
+			name := t.binaryName(version, minimal)
+			path := filepath.Join(outDir, name)
+			if err := build(t, minimal, version, commit, path); err != nil {
+				return fmt.Errorf("failed to build %s: %w", name, err)
+			}
+			sum, err := sha256File(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&sums, "%s  %s\n", sum, name)
+			fmt.Println(path)
+		}
+	}
+
+	sumsPath := filepath.Join(outDir, "SHA256SUMS")
+	if err := os.WriteFile(sumsPath, []byte(sums.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write checksums: %w", err)
+	}
+	fmt.Println(sumsPath)
+	return nil
+}
+
+// build compiles a static, stripped binary for t to path
+func build(t target, minimal bool, version, commit, path string) error {
+	ldflags := fmt.Sprintf("-s -w -X github.com/fletcharoo/epubconv.Version=%s -X main.commit=%s", version, commit)
+	args := []string{"build", "-trimpath", "-ldflags", ldflags, "-o", path}
+	if minimal {
+		args = append(args, "-tags", "minimal")
+	}
+	cmd := exec.Command("go", append(args, "./cmd/epub2txt")...)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS="+t.goos, "GOARCH="+t.goarch)
+	if t.goarm != "" {
+		cmd.Env = append(cmd.Env, "GOARM="+t.goarm)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func git(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to checksum %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,117 @@
+package epubconv
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"path"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// ErrNoCover is returned by Book.Cover for a book without a cover image
+var ErrNoCover = errors.New("book has no cover image")
+
+// Cover opens the book's cover image for reading, returning its media type
+// as well. The cover is the manifest item with the EPUB 3 cover-image
+// property or else the item an EPUB 2 <meta name="cover"> names, failing
+// which it is the image on the guide's cover page or an image item named
+// "cover". It fails with ErrNoCover if the book has none of these, and
+// with a DRMError if the book is DRM-protected.
+func (b *Book) Cover() (io.ReadCloser, string, error) {
+	image, ok := b.coverImage()
+	if !ok {
+		return nil, "", ErrNoCover
+	}
+	rc, err := b.OpenImage(image.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	return rc, image.MediaType, nil
+}
+
+// coverImage finds the book's cover image, as Cover describes
+func (b *Book) coverImage() (Image, bool) {
+	contentDir := path.Dir(b.PackagePath)
+	item := func(match func(item ManifestItem) bool) (Image, bool) {
+		for _, item := range b.Manifest.Items {
+			mediaType := strings.ToLower(strings.TrimSpace(item.MediaType))
+			if item.Href != "" && strings.HasPrefix(mediaType, "image/") && match(item) {
+				return Image{Path: resolveHref(contentDir, item.Href), MediaType: mediaType}, true
+			}
+		}
+		return Image{}, false
+	}
+
+	if image, ok := item(func(item ManifestItem) bool {
+		return slices.Contains(strings.Fields(item.Properties), "cover-image")
+	}); ok {
+		return image, true
+	}
+	for _, meta := range b.Metadata.Metas {
+		if meta.Name != "cover" {
+			continue
+		}
+		// The content is an item ID, though some books give the href
+		content := strings.TrimSpace(meta.Content)
+		if image, ok := item(func(item ManifestItem) bool {
+			return item.ID == content || item.Href == content
+		}); ok && content != "" {
+			return image, true
+		}
+	}
+	for _, ref := range b.Guide.References {
+		if strings.EqualFold(strings.TrimSpace(ref.Type), "cover") {
+			if image, ok := b.pageImage(resolveHref(contentDir, strings.SplitN(ref.Href, "#", 2)[0])); ok {
+				return image, true
+			}
+		}
+	}
+	return item(func(item ManifestItem) bool {
+		name := strings.ToLower(path.Base(item.Href))
+		return strings.EqualFold(item.ID, "cover") || strings.TrimSuffix(name, path.Ext(name)) == "cover"
+	})
+}
+
+// pageImage returns the first image of the content document at pagePath,
+// for a cover page. The guide may name the image itself instead.
+func (b *Book) pageImage(pagePath string) (Image, bool) {
+	for _, image := range b.Images() {
+		if image.Path == pagePath {
+			return image, true
+		}
+	}
+	content, err := b.readFile(pagePath, 0)
+	if err != nil {
+		return Image{}, false
+	}
+	var src string
+	walkHTML(b.decodeContent(pagePath, content), func(tok html.Token) error {
+		if src != "" || tok.Type != html.StartTagToken && tok.Type != html.SelfClosingTagToken {
+			return nil
+		}
+		for _, a := range tok.Attr {
+			if tok.Data == "img" && a.Key == "src" || strings.HasSuffix(tok.Data, "image") && (a.Key == "href" || a.Key == "xlink:href") {
+				src = strings.TrimSpace(a.Val)
+			}
+		}
+		return nil
+	})
+	src = strings.SplitN(src, "#", 2)[0]
+	if src == "" || strings.Contains(src, ":") {
+		return Image{}, false
+	}
+	imagePath := resolveHref(path.Dir(pagePath), src)
+	for _, image := range b.Images() {
+		if image.Path == imagePath {
+			return image, true
+		}
+	}
+	if b.findFile(imagePath) == nil {
+		return Image{}, false
+	}
+	mediaType, _, _ := strings.Cut(mime.TypeByExtension(path.Ext(imagePath)), ";")
+	return Image{Path: imagePath, MediaType: mediaType}, true
+}
@@ -0,0 +1,42 @@
+package epubconv
+
+import (
+	"crypto/sha256"
+	"sync"
+	"unicode/utf8"
+)
+
+// minDuplicateChapterLen is the shortest chapter text, in runes, that is
+// checked for duplicates, so that short pages that legitimately repeat
+// (part titles, "The End") aren't flagged
+const minDuplicateChapterLen = 200
+
+// ChapterIndex remembers the chapters converted so far, so that chapters
+// repeated verbatim between books of a series (previews, recaps) can be
+// detected. One index is shared by every book in a manifest or directory
+// run, and it is safe for concurrent use.
+type ChapterIndex struct {
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]string
+}
+
+// NewChapterIndex returns an empty index
+func NewChapterIndex() *ChapterIndex {
+	return &ChapterIndex{seen: make(map[[sha256.Size]byte]string)}
+}
+
+// check records text as coming from source and, if the same text was seen
+// before, returns where it was first seen
+func (c *ChapterIndex) check(text, source string) (string, bool) {
+	if utf8.RuneCountInString(text) < minDuplicateChapterLen {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(text))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if first, ok := c.seen[sum]; ok {
+		return first, true
+	}
+	c.seen[sum] = source
+	return "", false
+}
@@ -0,0 +1,160 @@
+package epubconv
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrDRMProtected is returned, as a *DRMError naming the scheme, when
+// converting a book whose content is encrypted
+var ErrDRMProtected = errors.New("book is DRM-protected")
+
+// DRMError reports that a book can't be converted because DRM protects it.
+// Scheme names the DRM, e.g. "Adobe ADEPT".
+type DRMError struct {
+	Scheme string
+}
+
+func (e *DRMError) Error() string {
+	return fmt.Sprintf(msg("ErrDRMProtected", "book is DRM-protected (%s) and can't be converted; convert a DRM-free copy of it instead"), e.Scheme)
+}
+
+func (e *DRMError) Unwrap() error {
+	return ErrDRMProtected
+}
+
+// Encryption structure for parsing META-INF/encryption.xml
+type Encryption struct {
+	EncryptedData []struct {
+		EncryptionMethod struct {
+			Algorithm string `xml:"Algorithm,attr"`
+		} `xml:"EncryptionMethod"`
+		CipherData struct {
+			CipherReference struct {
+				URI string `xml:"URI,attr"`
+			} `xml:"CipherReference"`
+		} `xml:"CipherData"`
+	} `xml:"EncryptedData"`
+}
+
+// fontObfuscationAlgorithms only obfuscate embedded fonts, which doesn't
+// stop the text from being read
+var fontObfuscationAlgorithms = map[string]bool{
+	ObfuscationIDPF:  true,
+	ObfuscationAdobe: true,
+}
+
+// detectDRM returns the name of the DRM scheme protecting the book, or ""
+// if the content isn't encrypted
+func (b *Book) detectDRM() string {
+	if b.drm != "" {
+		return b.drm
+	}
+	var encryptionXML string
+	for _, file := range b.reader.File {
+		switch file.Name {
+		case "META-INF/rights.xml":
+			return "Adobe ADEPT"
+		case "META-INF/sinf.xml":
+			return "Apple FairPlay"
+		case "META-INF/license.lcpl":
+			return "Readium LCP"
+		case "META-INF/encryption.xml":
+			encryptionXML = file.Name
+		}
+	}
+	if encryptionXML == "" {
+		return ""
+	}
+
+	var enc Encryption
+	if err := b.parseXML(encryptionXML, &enc); err != nil {
+		return "unknown, unreadable encryption.xml"
+	}
+	for _, data := range enc.EncryptedData {
+		if algorithm := data.EncryptionMethod.Algorithm; !fontObfuscationAlgorithms[algorithm] {
+			return fmt.Sprintf("unknown, encrypted with %s", algorithm)
+		}
+	}
+	return ""
+}
+
+// isFixedLayout reports whether the package declares a fixed (pre-paginated)
+// layout, which usually means the pages are images
+func isFixedLayout(pkg *Package) bool {
+	for _, meta := range pkg.Metadata.Metas {
+		if meta.Property == "rendition:layout" && strings.TrimSpace(meta.Value) == "pre-paginated" {
+			return true
+		}
+		if meta.Name == "fixed-layout" && meta.Content == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// countImages counts the image references in an (X)HTML document
+func countImages(html string) int {
+	html = strings.ToLower(html)
+	return strings.Count(html, "<img") + strings.Count(html, "<image") + strings.Count(html, "<svg:image")
+}
+
+// textDiagnostics records what happened to the spine items of a book, to
+// explain a conversion that produced little or no text
+type textDiagnostics struct {
+	spineItems   int
+	contentFiles int
+	unreadable   int
+	binary       int
+	duplicates   int
+	images       int
+	nonlinear    int
+	fixedLayout  bool
+}
+
+// hints lists the likely reasons for a conversion producing too little text
+func (d *textDiagnostics) hints() []string {
+	var hints []string
+	if d.fixedLayout {
+		hints = append(hints, msg("HintFixedLayout", "the book is fixed-layout, so its pages are probably images"))
+	}
+	if d.images > 0 {
+		hints = append(hints, fmt.Sprintf(msg("HintImages", "the content references %d images, so the text may be in images"), d.images))
+	}
+	if d.spineItems == 0 {
+		hints = append(hints, msg("HintEmptySpine", "the spine is empty"))
+	} else if d.contentFiles < d.spineItems {
+		hints = append(hints, fmt.Sprintf(msg("HintNotInManifest", "%d of %d spine items aren't in the manifest"), d.spineItems-d.contentFiles, d.spineItems))
+	}
+	if d.nonlinear > 0 {
+		hints = append(hints, fmt.Sprintf(msg("HintNonlinear", "%d spine items are marked non-linear and were left out (see --include-nonlinear)"), d.nonlinear))
+	}
+	if skipped := d.unreadable + d.binary + d.duplicates; skipped > 0 && skipped == d.contentFiles {
+		hints = append(hints, msg("HintAllSkipped", "every spine item was skipped"))
+	} else {
+		if d.unreadable > 0 {
+			hints = append(hints, fmt.Sprintf(msg("HintUnreadable", "%d of %d spine items couldn't be read"), d.unreadable, d.contentFiles))
+		}
+		if d.binary > 0 {
+			hints = append(hints, fmt.Sprintf(msg("HintBinary", "%d of %d spine items contain binary data"), d.binary, d.contentFiles))
+		}
+		if d.duplicates > 0 {
+			hints = append(hints, fmt.Sprintf(msg("HintDuplicates", "%d of %d spine items were skipped as duplicates"), d.duplicates, d.contentFiles))
+		}
+	}
+	return hints
+}
+
+// shortTextMessage describes a conversion that produced only n characters
+func (d *textDiagnostics) shortTextMessage(epubPath string, n, minimum int) string {
+	var message strings.Builder
+	fmt.Fprintf(&message, msg("ShortText", "%s produced only %d characters of text (minimum %d)"), epubPath, n, minimum)
+	if hints := d.hints(); len(hints) > 0 {
+		message.WriteString(msg("ShortTextCauses", "; possible causes:"))
+		for _, hint := range hints {
+			message.WriteString("\n  - " + hint)
+		}
+	}
+	return message.String()
+}
@@ -0,0 +1,68 @@
+package epubconv
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// maxEntityGrowth bounds how much expanding the entities a document's
+// DOCTYPE defines can add to it, so that nested definitions (the "billion
+// laughs" attack) can't exhaust memory
+const maxEntityGrowth = 1 << 20
+
+var (
+	// internalSubsetPattern matches a DOCTYPE with an internal subset of
+	// declarations, e.g. <!DOCTYPE html [ <!ENTITY ...> ]>
+	internalSubsetPattern = regexp.MustCompile(`(?is)<!DOCTYPE[^\[>]*\[(.*?)\]\s*>`)
+	// entityDeclPattern matches the declaration of a general entity with a
+	// literal value. Parameter and external entities aren't matched.
+	entityDeclPattern = regexp.MustCompile(`(?s)<!ENTITY\s+([A-Za-z_:][\w.:-]*)\s+(?:"([^"]*)"|'([^']*)')\s*>`)
+	entityRefPattern  = regexp.MustCompile(`&([A-Za-z_:][\w.:-]*);`)
+)
+
+// expandEntities replaces references to the entities the internal subset of
+// a document's DOCTYPE defines, such as &author; after
+// <!ENTITY author "Jane Doe">, with their values, and removes the
+// internal subset, which the HTML tokenizer would otherwise read as text.
+// References to other entities are left for the tokenizer, which knows all
+// the HTML ones. It fails with ErrParseLimit if the expansion grows the
+// document by more than maxEntityGrowth.
+func expandEntities(content string) (string, error) {
+	loc := internalSubsetPattern.FindStringSubmatchIndex(content)
+	if loc == nil {
+		return content, nil
+	}
+	subset := content[loc[2]:loc[3]]
+	content = content[:loc[0]] + content[loc[1]:]
+
+	entities := make(map[string]string)
+	for _, m := range entityDeclPattern.FindAllStringSubmatch(subset, -1) {
+		if _, ok := entities[m[1]]; ok {
+			// The first declaration of an entity is binding
+			continue
+		}
+		entities[m[1]] = m[2] + m[3]
+	}
+	if len(entities) == 0 {
+		return content, nil
+	}
+
+	growth := 0
+	var expand func(s string, depth int) string
+	expand = func(s string, depth int) string {
+		return entityRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+			value, ok := entities[ref[1:len(ref)-1]]
+			if !ok || depth > len(entities) || growth > maxEntityGrowth {
+				return ref
+			}
+			value = expand(value, depth+1)
+			growth += len(value) - len(ref)
+			return value
+		})
+	}
+	content = expand(content, 0)
+	if growth > maxEntityGrowth {
+		return "", fmt.Errorf("%w: entities defined in the DOCTYPE expand to more than %s", ErrParseLimit, formatByteSize(maxEntityGrowth))
+	}
+	return content, nil
+}
@@ -0,0 +1,148 @@
+package epubconv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Emoji policies for Options.Emoji
+const (
+	EmojiKeep     = "keep"
+	EmojiStrip    = "strip"
+	EmojiDescribe = "describe"
+)
+
+var EmojiPolicies = []string{EmojiKeep, EmojiStrip, EmojiDescribe}
+
+// emojiNames maps common emoji and pictographs to their :shortcode: names.
+// Anything not listed is described by its code point instead.
+var emojiNames = map[rune]string{
+	0x1F600: "grinning", 0x1F603: "smiley", 0x1F604: "smile", 0x1F601: "grin",
+	0x1F606: "laughing", 0x1F605: "sweat_smile", 0x1F602: "joy", 0x1F923: "rofl",
+	0x1F60A: "blush", 0x1F607: "innocent", 0x1F642: "slightly_smiling_face", 0x1F643: "upside_down_face",
+	0x1F609: "wink", 0x1F60D: "heart_eyes", 0x1F618: "kissing_heart", 0x1F60B: "yum",
+	0x1F61C: "stuck_out_tongue_winking_eye", 0x1F61B: "stuck_out_tongue", 0x1F914: "thinking", 0x1F610: "neutral_face",
+	0x1F611: "expressionless", 0x1F636: "no_mouth", 0x1F60F: "smirk", 0x1F612: "unamused",
+	0x1F644: "roll_eyes", 0x1F62C: "grimacing", 0x1F60C: "relieved", 0x1F614: "pensive",
+	0x1F634: "sleeping", 0x1F637: "mask", 0x1F60E: "sunglasses", 0x1F615: "confused",
+	0x1F61F: "worried", 0x1F641: "slightly_frowning_face", 0x1F62E: "open_mouth", 0x1F632: "astonished",
+	0x1F633: "flushed", 0x1F622: "cry", 0x1F62D: "sob", 0x1F631: "scream",
+	0x1F621: "rage", 0x1F620: "angry", 0x1F480: "skull", 0x1F440: "eyes",
+	0x1F44D: "+1", 0x1F44E: "-1", 0x1F44F: "clap", 0x1F64F: "pray",
+	0x1F44B: "wave", 0x1F44C: "ok_hand", 0x270C: "v", 0x1F4AA: "muscle",
+	0x1F937: "shrug", 0x1F926: "facepalm", 0x1F468: "man", 0x1F469: "woman",
+	0x1F466: "boy", 0x1F467: "girl", 0x2764: "heart", 0x1F494: "broken_heart",
+	0x1F495: "two_hearts", 0x2B50: "star", 0x2728: "sparkles", 0x1F525: "fire",
+	0x1F4AF: "100", 0x1F389: "tada", 0x2600: "sunny", 0x2601: "cloud",
+	0x2614: "umbrella", 0x26A1: "zap", 0x2744: "snowflake", 0x2615: "coffee",
+	0x1F37A: "beer", 0x1F382: "birthday", 0x1F339: "rose", 0x1F436: "dog",
+	0x1F431: "cat", 0x2705: "white_check_mark", 0x274C: "x", 0x2714: "heavy_check_mark",
+	0x26A0: "warning", 0x2753: "question", 0x2757: "exclamation", 0x263A: "relaxed",
+	0x2639: "frowning_face", 0x2708: "airplane", 0x260E: "phone", 0x2709: "email",
+	0x2702: "scissors", 0x270F: "pencil2", 0x2665: "hearts", 0x2660: "spades",
+	0x2663: "clubs", 0x2666: "diamonds", 0x1F680: "rocket", 0x1F4A1: "bulb",
+	0x1F4DA: "books", 0x1F4D6: "book", 0x1F3B5: "musical_note", 0x1F3B6: "notes",
+}
+
+// isPictograph reports whether r is an emoji or pictographic symbol that
+// starts an emoji sequence
+func isPictograph(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF:
+		// Mahjong, cards, enclosed supplements, pictographs, emoticons,
+		// transport, supplemental symbols and symbols extended-A
+		return !isSkinTone(r)
+	case r >= 0x2600 && r <= 0x27BF:
+		// Miscellaneous symbols and dingbats
+		return true
+	case r == 0x231A || r == 0x231B || (r >= 0x23E9 && r <= 0x23F3) || (r >= 0x23F8 && r <= 0x23FA):
+		return true
+	case (r >= 0x2B05 && r <= 0x2B07) || r == 0x2B1B || r == 0x2B1C || r == 0x2B50 || r == 0x2B55:
+		return true
+	case r == 0x3030 || r == 0x303D || r == 0x3297 || r == 0x3299:
+		return true
+	}
+	return false
+}
+
+func isSkinTone(r rune) bool {
+	return r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// isEmojiModifier reports whether r only decorates the preceding emoji
+// (variation selectors, skin tones, keycap combiners and tag characters)
+func isEmojiModifier(r rune) bool {
+	return r == 0xFE0E || r == 0xFE0F || r == 0x20E3 || isSkinTone(r) || (r >= 0xE0020 && r <= 0xE007F)
+}
+
+// applyEmojiPolicy keeps, strips or describes emoji sequences in text.
+// Modifiers and zero-width joiners are handled as part of the sequence they
+// belong to, so a joined sequence is stripped or described as a whole.
+func applyEmojiPolicy(text, policy string) string {
+	if policy == EmojiKeep || policy == "" {
+		return text
+	}
+
+	runes := []rune(text)
+	var out strings.Builder
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		// Keycap sequences such as "1️⃣" start with a plain character
+		isKeycap := strings.ContainsRune("0123456789#*", r) &&
+			(i+1 < len(runes) && runes[i+1] == 0x20E3 ||
+				i+2 < len(runes) && runes[i+1] == 0xFE0F && runes[i+2] == 0x20E3)
+		if !isPictograph(r) && !isKeycap {
+			out.WriteRune(r)
+			continue
+		}
+
+		var names []string
+		for {
+			switch {
+			case isKeycap:
+				names = append(names, "keycap_"+string(r))
+				isKeycap = false
+			case isRegionalIndicator(r) && i+1 < len(runes) && isRegionalIndicator(runes[i+1]):
+				// A pair of regional indicators is a country flag
+				code := string([]rune{'a' + runes[i] - 0x1F1E6, 'a' + runes[i+1] - 0x1F1E6})
+				names = append(names, "flag-"+code)
+				i++
+			default:
+				name, ok := emojiNames[r]
+				if !ok {
+					name = fmt.Sprintf("U+%04X", r)
+				}
+				names = append(names, name)
+			}
+
+			for i+1 < len(runes) && isEmojiModifier(runes[i+1]) {
+				i++
+			}
+			// Continue through zero-width joiner sequences
+			if i+2 < len(runes) && runes[i+1] == 0x200D && isPictograph(runes[i+2]) {
+				i += 2
+				r = runes[i]
+				continue
+			}
+			break
+		}
+
+		if policy == EmojiDescribe {
+			for _, name := range names {
+				out.WriteString(":" + name + ":")
+			}
+			continue
+		}
+
+		// Avoid leaving a double space where a stripped emoji used to be
+		if i+1 < len(runes) && runes[i+1] == ' ' && strings.HasSuffix(out.String(), " ") {
+			i++
+		}
+	}
+	return out.String()
+}
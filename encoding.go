@@ -0,0 +1,88 @@
+package epubconv
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// sniffLength is how much of the start of a document is searched for an
+// encoding declaration
+const sniffLength = 1024
+
+var (
+	xmlEncodingPattern  = regexp.MustCompile(`^\s*<\?xml[^>]*?\sencoding\s*=\s*["']([^"']+)["']`)
+	metaCharsetPattern  = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([\w.:-]+)`)
+	utf8BOM             = "\xef\xbb\xbf"
+	utf16BOMs           = []string{"\xff\xfe", "\xfe\xff"}
+	utf16WithBOMDecoder = unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
+)
+
+// declaredEncoding returns the encoding label an (X)HTML document declares
+// in its XML declaration or, failing that, a <meta> charset, or ""
+func declaredEncoding(content string) string {
+	head := content[:min(len(content), sniffLength)]
+	if m := xmlEncodingPattern.FindStringSubmatch(head); m != nil {
+		return m[1]
+	}
+	if m := metaCharsetPattern.FindStringSubmatch(head); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// decodeContent transcodes the content document at path to UTF-8. The
+// encoding comes from a byte order mark, the XML declaration or a <meta>
+// charset, in that order. A document declaring none that isn't valid UTF-8
+// is read as Windows-1252, as browsers do, unless it looks binary.
+func (b *Book) decodeContent(path, content string) string {
+	if strings.HasPrefix(content, utf8BOM) {
+		return content[len(utf8BOM):]
+	}
+	for _, bom := range utf16BOMs {
+		if strings.HasPrefix(content, bom) {
+			if decoded, err := utf16WithBOMDecoder.NewDecoder().String(content); err == nil {
+				return decoded
+			}
+		}
+	}
+
+	label := declaredEncoding(content)
+	if label == "" {
+		if utf8.ValidString(content) || isBinaryContent(content) {
+			return content
+		}
+		b.warnf(WarnEncoding, "WarnEncodingGuessed", "%s declares no encoding and isn't valid UTF-8, reading it as Windows-1252", path)
+		label = "windows-1252"
+	}
+	enc, name := charset.Lookup(label)
+	if enc == nil {
+		b.warnf(WarnEncoding, "WarnEncodingUnknown", "%s declares unknown encoding %q, reading it as UTF-8", path, label)
+		return content
+	}
+	if name == "utf-8" {
+		return content
+	}
+	decoded, err := enc.NewDecoder().String(content)
+	if err != nil {
+		b.warnf(WarnEncoding, "WarnEncodingFailed", "failed to decode %s as %s: %v", path, name, err)
+		return content
+	}
+	return decoded
+}
+
+// newXMLDecoder returns a decoder for the XML document data, which can
+// declare any encoding known to browsers
+func newXMLDecoder(data []byte) *xml.Decoder {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.CharsetReader = func(label string, r io.Reader) (io.Reader, error) {
+		return charset.NewReaderLabel(label, r)
+	}
+	return d
+}
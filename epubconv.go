@@ -0,0 +1,1732 @@
+// Package epubconv extracts the text of EPUB books.
+//
+// Open a book with Open, OpenFile or OpenFS and convert it with Book.Text, or
+// do both at once with Convert:
+//
+//	text, err := epubconv.Convert(r, size, epubconv.Options{Header: true})
+//
+// Book.WriteText and ConvertToWriter write the text a chapter at a time
+// instead, for books too large to hold in memory.
+//
+// The epub2txt command in cmd/epub2txt is a command-line interface to it.
+package epubconv
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Version identifies the build in the header block. It is set at build time
+// with -ldflags "-X github.com/fletcharoo/epubconv.Version=...".
+var Version = "dev"
+
+// Container structure for parsing container.xml
+type Container struct {
+	Rootfiles struct {
+		Rootfile []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfile"`
+	} `xml:"rootfiles"`
+}
+
+// Package structure for parsing content.opf. UniqueIdentifier is the ID of
+// the identifier element that identifies the book.
+type Package struct {
+	UniqueIdentifier string   `xml:"unique-identifier,attr"`
+	Metadata         Metadata `xml:"metadata"`
+	Manifest         Manifest `xml:"manifest"`
+	Spine            Spine    `xml:"spine"`
+	Guide            Guide    `xml:"guide"`
+}
+
+// Metadata holds the Dublin Core elements and meta properties describing
+// the book
+type Metadata struct {
+	Titles       []string     `xml:"title"`
+	Creators     []Creator    `xml:"creator"`
+	Contributors []Creator    `xml:"contributor"`
+	Languages    []string     `xml:"language"`
+	Identifiers  []Identifier `xml:"identifier"`
+	Publishers   []string     `xml:"publisher"`
+	Dates        []Date       `xml:"date"`
+	Subjects     []string     `xml:"subject"`
+	Descriptions []string     `xml:"description"`
+	Rights       []string     `xml:"rights"`
+	Metas        []Meta       `xml:"meta"`
+}
+
+// CreatorNames returns the names of the book's creators, trimmed and
+// without empty ones
+func (m *Metadata) CreatorNames() []string {
+	names := make([]string, len(m.Creators))
+	for i, creator := range m.Creators {
+		names[i] = creator.Name
+	}
+	return trimAll(names)
+}
+
+// Creator is a dc:creator or dc:contributor element. Role is an EPUB 2
+// MARC relator code such as "aut"; EPUB 3 gives it in a meta refining the
+// element instead.
+type Creator struct {
+	ID     string `xml:"id,attr"`
+	Name   string `xml:",chardata"`
+	Role   string `xml:"role,attr"`
+	FileAs string `xml:"file-as,attr"`
+}
+
+// Identifier is a dc:identifier element. Scheme is the EPUB 2 scheme, such
+// as "ISBN".
+type Identifier struct {
+	ID     string `xml:"id,attr"`
+	Value  string `xml:",chardata"`
+	Scheme string `xml:"scheme,attr"`
+}
+
+// Date is a dc:date element. Event is the EPUB 2 event, such as
+// "publication".
+type Date struct {
+	Value string `xml:",chardata"`
+	Event string `xml:"event,attr"`
+}
+
+// Meta is an EPUB 2 name and content pair, or an EPUB 3 property whose value
+// is its text, optionally refining the element with the ID in Refines
+type Meta struct {
+	ID       string `xml:"id,attr"`
+	Name     string `xml:"name,attr"`
+	Content  string `xml:"content,attr"`
+	Property string `xml:"property,attr"`
+	Refines  string `xml:"refines,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// Manifest lists the files making up the book
+type Manifest struct {
+	Items []ManifestItem `xml:"item"`
+}
+
+// ManifestItem is a file in the book. Href is relative to the package
+// document.
+type ManifestItem struct {
+	ID         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+	// Fallback is the ID of the item to read instead if this one's media
+	// type can't be
+	Fallback string `xml:"fallback,attr"`
+}
+
+// Spine is the reading order of the book. Toc is the manifest ID of the
+// EPUB 2 NCX.
+type Spine struct {
+	Toc      string    `xml:"toc,attr"`
+	Itemrefs []Itemref `xml:"itemref"`
+	// PageProgressionDirection is DirectionRTL for a book whose pages turn
+	// from right to left, such as Japanese vertical text or manga,
+	// DirectionLTR, or "" if the book doesn't say. The itemrefs are in
+	// reading order either way.
+	PageProgressionDirection string `xml:"page-progression-direction,attr"`
+}
+
+// Itemref refers to the manifest item at a position in the reading order.
+// Linear is "no" for auxiliary content, such as a cover page.
+type Itemref struct {
+	IDRef  string `xml:"idref,attr"`
+	Linear string `xml:"linear,attr"`
+}
+
+// Guide is the EPUB 2 list of the book's structural components, which EPUB
+// 3 replaces with the navigation document's landmarks
+type Guide struct {
+	References []Reference `xml:"reference"`
+}
+
+// Reference is a structural component of the book, such as its title page,
+// by its type ("title-page") and href
+type Reference struct {
+	Type  string `xml:"type,attr"`
+	Title string `xml:"title,attr"`
+	Href  string `xml:"href,attr"`
+}
+
+// Series returns the series the book belongs to and its position in it,
+// from calibre's metadata or an EPUB 3 belongs-to-collection property. The
+// index is "" if unknown.
+func (pkg *Package) Series() (name, index string) {
+	for _, meta := range pkg.Metadata.Metas {
+		switch meta.Name {
+		case "calibre:series":
+			name = strings.TrimSpace(meta.Content)
+		case "calibre:series_index":
+			index = strings.TrimSpace(meta.Content)
+		}
+	}
+	if name != "" {
+		return name, index
+	}
+
+	for _, collection := range pkg.Metadata.Metas {
+		if collection.Property != "belongs-to-collection" {
+			continue
+		}
+		// Refinements name the collection's type and position
+		isSeries := true
+		index = ""
+		for _, meta := range pkg.Metadata.Metas {
+			if collection.ID == "" || meta.Refines != "#"+collection.ID {
+				continue
+			}
+			switch meta.Property {
+			case "collection-type":
+				isSeries = strings.TrimSpace(meta.Value) == "series"
+			case "group-position":
+				index = strings.TrimSpace(meta.Value)
+			}
+		}
+		if isSeries {
+			return strings.TrimSpace(collection.Value), index
+		}
+	}
+	return "", ""
+}
+
+// Options controls how an EPUB is converted to text. The zero value converts
+// the whole book to plain text, without limits.
+type Options struct {
+	// Name identifies the book in warnings and the header block, usually
+	// by its file name. OpenFile defaults it to the path of the file.
+	Name string
+	// Header prefixes the text with a provenance header block
+	Header bool
+	// MaxMemory aborts the conversion if it would hold more than this many
+	// bytes. Zero means unlimited.
+	MaxMemory ByteSize
+	// StripGutenberg removes the Project Gutenberg license header and footer
+	StripGutenberg bool
+	// Chapters detects chapters seen before in this or an earlier book
+	Chapters *ChapterIndex
+	// SkipDuplicateChapters omits chapters found in Chapters
+	SkipDuplicateChapters bool
+	// LinkFootnotes turns external links into numbered footnotes listed at
+	// the end of each chapter
+	LinkFootnotes bool
+	// ExpandAbbreviations follows the first use of each <abbr> with its
+	// title in parentheses
+	ExpandAbbreviations bool
+	// Captions wraps table captions in brackets
+	Captions bool
+	// AriaLabels adds aria-label and aria-describedby text as bracketed
+	// annotations
+	AriaLabels bool
+	// MinText is the least text, in characters, a conversion should produce
+	MinText int
+	// FailShortText fails conversions producing less than MinText instead
+	// of warning about them
+	FailShortText bool
+	// MaxDepth bounds the nesting depth of the parsed documents. Zero
+	// means unlimited.
+	MaxDepth int
+	// MaxAttrs bounds the number of attributes of an element in the parsed
+	// documents. Zero means unlimited.
+	MaxAttrs int
+	// MaxFileSize fails the conversion with ErrArchiveLimit if a file read
+	// from the archive decompresses to more than this many bytes. Zero
+	// means unlimited.
+	MaxFileSize ByteSize
+	// MaxTotalSize fails the conversion with ErrArchiveLimit if the files
+	// read from the archive, or the text of a MOBI book, decompress to more
+	// than this many bytes in all. Zero means unlimited.
+	MaxTotalSize ByteSize
+	// MaxEntries fails opening the book with ErrArchiveLimit if its archive
+	// has more entries, or its manifest or spine more items, than this.
+	// Zero means unlimited.
+	MaxEntries int
+	// StrictPaths fails opening the book with ErrUnsafePath if an archive
+	// entry is named with an absolute path or one climbing out with "..",
+	// or the manifest refers to a file outside the package directory,
+	// instead of resolving such paths within the archive and warning
+	StrictPaths bool
+	// Lenient recovers what it can of a book with a malformed container or
+	// package document instead of failing, with a WarnRecovered warning
+	// for each repair: it looks for the package document in the archive if
+	// container.xml names none there, reads one with undeclared entities or
+	// unclosed elements leniently, leaves out manifest items without an id
+	// or href and those repeating an id, and if there is no usable spine
+	// reads the manifest's content documents in manifest order or, failing
+	// that, the archive's HTML files in the order of their names
+	Lenient bool
+	// FixMojibake repairs double-encoded UTF-8
+	FixMojibake bool
+	// Emoji is the emoji policy: EmojiKeep (the default), EmojiStrip or
+	// EmojiDescribe
+	Emoji string
+	// Footnotes is what becomes of the notes that noterefs point to:
+	// FootnotesKeep (the default) leaves them where they are, FootnotesInline
+	// puts them in brackets in place of their noterefs, FootnotesEnd lists
+	// them at the end of the chapter and FootnotesStrip leaves them out
+	Footnotes string
+	// Order is the reading order: OrderSpine (the default), or OrderNCX for
+	// the table of contents'
+	Order string
+	// ChapterRange converts only the chapters at these positions in the
+	// reading order, counting from 1, such as "3-7", "-2,10-" or "5"
+	ChapterRange string
+	// From starts the conversion at the first chapter with this title in
+	// the table of contents or, failing that, as its first heading
+	From string
+	// SkipFrontMatter leaves out title pages, copyright pages, dedications,
+	// tables of contents, indexes and the like, whether the book marks them
+	// as such or they are named so before or after the body
+	SkipFrontMatter bool
+	// IncludeNonlinear appends the spine items marked linear="no", such as
+	// notes or answers, after the rest of the book, each after a
+	// "[Non-linear content]" line. Without it they are left out.
+	IncludeNonlinear bool
+	// PreviewPercent stops the conversion after the chapter that brings it
+	// to this percentage of the book. Zero converts the whole book.
+	PreviewPercent int
+	// Format is the output format: FormatText (the default), FormatPandoc
+	// or FormatJSON
+	Format string
+	// ImageLinks maps the archive path of an image to where the FormatPandoc
+	// output should refer to it, such as the file it was extracted to.
+	// References to other images are left out, and text output has none.
+	// It is read as the book is converted, so it can be filled in after
+	// opening the book, from Book.Images.
+	ImageLinks map[string]string
+	// Policy holds the redaction and transform rules applied to each
+	// paragraph, if any
+	Policy *Policy
+	// Canonical normalizes the text for diffing and leaves out the
+	// conversion time
+	Canonical bool
+	// Wrap breaks the lines of plain text paragraphs at this many columns.
+	// Zero doesn't wrap.
+	Wrap int
+	// ParagraphSpacing is the number of blank lines between paragraphs, up
+	// to MaxParagraphSpacing
+	ParagraphSpacing int
+	// HeadingStyle is how headings are set apart in plain text:
+	// HeadingPlain (the default), HeadingUnderline or HeadingHash
+	HeadingStyle string
+	// Tables is how tables are rendered in plain text: TablesFlatten (the
+	// default) puts each row on a line, for books that use tables for
+	// layout, TablesASCII draws aligned columns and TablesMarkdown writes
+	// GitHub Flavored Markdown tables
+	Tables string
+	// JoinLines joins the lines of a paragraph broken where a scanned page's
+	// lines ended: a line not ending a sentence goes on with the next if it
+	// starts in lower case
+	JoinLines bool
+	// Dehyphenate removes soft hyphens and rejoins words hyphenated across
+	// the end of a line
+	Dehyphenate bool
+	// PlainSpaces turns no-break, thin and other fixed-width spaces into
+	// plain spaces
+	PlainSpaces bool
+	// Quotes is what to do with quotation marks: QuotesKeep (the default),
+	// QuotesStraight or QuotesCurly
+	Quotes string
+	// NFC normalizes the text to Unicode Normalization Form C
+	NFC bool
+	// Ruby is what becomes of the ruby text annotating <ruby> elements,
+	// such as furigana: RubyKeep (the default) leaves it after its base
+	// text, as the document has it, RubyStrip leaves it out and
+	// RubyParenthesize puts it in parentheses after its base, as in
+	// 漢字(かんじ). It applies to text output.
+	Ruby string
+	// Filters rewrite each chapter's HTML and text in turn. FormatPandoc
+	// output is built from the filtered HTML without the text filters.
+	Filters []Filter
+	// Warn is called with each warning, if set
+	Warn func(Warning)
+	// Progress is called as the content documents are converted, if set
+	Progress func(Progress)
+	// Parallelism is how many content documents are converted at once.
+	// Zero or one converts them one at a time. Either way the chapters come
+	// out in reading order with the same text, and Warn, Progress and
+	// Anchors are called in order, but the Filters can be called for
+	// several documents at once. ExpandAbbreviations, which carries state
+	// from one document to the next, converts one at a time.
+	Parallelism int
+	// Anchors is called, if set, with the start of each chapter and of each
+	// element with an id, in the order they come in the text. The offsets
+	// are in the text Text and WriteText return, or in the chapter's text
+	// for Chapters and FormatJSON. FormatPandoc has none. A rule or text
+	// filter that rewrites a paragraph or chapter moves its anchors to the
+	// start of it.
+	Anchors func(Anchor)
+	// Logger, if set, logs each warning at the warning level and each
+	// content document converted at the debug level
+	Logger *slog.Logger
+}
+
+// Validate fails if an option has a value the converter doesn't know
+func (o Options) Validate() error {
+	if o.Emoji != "" && !slices.Contains(EmojiPolicies, o.Emoji) {
+		return fmt.Errorf(msg("ErrUnknownEmoji", "unknown emoji policy %q (valid: %s)"), o.Emoji, strings.Join(EmojiPolicies, ", "))
+	}
+	if o.Format != "" && !slices.Contains(Formats, o.Format) {
+		return fmt.Errorf(msg("ErrUnknownFormat", "unknown output format %q (valid: %s)"), o.Format, strings.Join(Formats, ", "))
+	}
+	if o.PreviewPercent < 0 || o.PreviewPercent > 100 {
+		return fmt.Errorf(msg("ErrPreview", "invalid preview percentage %d (valid: 0 to 100)"), o.PreviewPercent)
+	}
+	if o.Footnotes != "" && !slices.Contains(FootnoteModes, o.Footnotes) {
+		return fmt.Errorf(msg("ErrUnknownFootnotes", "unknown footnote mode %q (valid: %s)"), o.Footnotes, strings.Join(FootnoteModes, ", "))
+	}
+	if o.HeadingStyle != "" && !slices.Contains(HeadingStyles, o.HeadingStyle) {
+		return fmt.Errorf(msg("ErrUnknownHeadingStyle", "unknown heading style %q (valid: %s)"), o.HeadingStyle, strings.Join(HeadingStyles, ", "))
+	}
+	if o.Tables != "" && !slices.Contains(TableStyles, o.Tables) {
+		return fmt.Errorf(msg("ErrUnknownTables", "unknown table style %q (valid: %s)"), o.Tables, strings.Join(TableStyles, ", "))
+	}
+	if o.Quotes != "" && !slices.Contains(QuoteStyles, o.Quotes) {
+		return fmt.Errorf(msg("ErrUnknownQuotes", "unknown quote style %q (valid: %s)"), o.Quotes, strings.Join(QuoteStyles, ", "))
+	}
+	if o.Ruby != "" && !slices.Contains(RubyStyles, o.Ruby) {
+		return fmt.Errorf(msg("ErrUnknownRuby", "unknown ruby style %q (valid: %s)"), o.Ruby, strings.Join(RubyStyles, ", "))
+	}
+	if o.Parallelism < 0 {
+		return fmt.Errorf(msg("ErrParallelism", "invalid parallelism %d (valid: 0 or more)"), o.Parallelism)
+	}
+	if o.Wrap < 0 {
+		return fmt.Errorf(msg("ErrWrap", "invalid wrap width %d (valid: 0 or more)"), o.Wrap)
+	}
+	if o.ParagraphSpacing < 0 || o.ParagraphSpacing > MaxParagraphSpacing {
+		return fmt.Errorf(msg("ErrParagraphSpacing", "invalid paragraph spacing %d (valid: 0 to %d)"), o.ParagraphSpacing, MaxParagraphSpacing)
+	}
+	if o.ChapterRange != "" {
+		if _, err := parseChapterRange(o.ChapterRange); err != nil {
+			return err
+		}
+	}
+	if o.Order != "" && !slices.Contains(ReadingOrders, o.Order) {
+		return fmt.Errorf(msg("ErrUnknownOrder", "unknown reading order %q (valid: %s)"), o.Order, strings.Join(ReadingOrders, ", "))
+	}
+	return nil
+}
+
+func (o Options) limits() parseLimits {
+	return parseLimits{maxDepth: o.MaxDepth, maxAttrs: o.MaxAttrs}
+}
+
+// bookState carries state across the content files of one book
+type bookState struct {
+	// expandedAbbrs holds the abbreviations already expanded
+	expandedAbbrs map[string]bool
+	// notes holds the book's notes, unless they are kept where they are
+	notes *bookNotes
+	// anchors holds the anchors marked in the text, if they are reported
+	anchors *anchorTable
+}
+
+func newBookState() *bookState {
+	return &bookState{expandedAbbrs: make(map[string]bool)}
+}
+
+// Warning is a problem with a book that doesn't stop its conversion
+type Warning struct {
+	// Category is one of WarningCategories
+	Category string
+	Message  string
+}
+
+// Warning categories
+const (
+	WarnMissingFile    = "missing-file"
+	WarnBinary         = "binary"
+	WarnBoilerplate    = "boilerplate"
+	WarnDuplicate      = "duplicate-chapter"
+	WarnShortText      = "short-text"
+	WarnOrder          = "spine-order"
+	WarnDuplicateEntry = "duplicate-entry"
+	WarnOutsideHref    = "outside-href"
+	WarnEncoding       = "encoding"
+	WarnRecovered      = "recovered"
+)
+
+// WarningCategories lists every category a warning can have
+var WarningCategories = []string{
+	WarnMissingFile, WarnBinary, WarnBoilerplate, WarnDuplicate,
+	WarnShortText, WarnOrder, WarnDuplicateEntry, WarnOutsideHref, WarnEncoding,
+	WarnRecovered,
+}
+
+// Book is an opened EPUB. The embedded Package holds the metadata, manifest
+// and spine read from its package document.
+type Book struct {
+	Package
+	// PackagePath is the archive path of the package document
+	PackagePath string
+
+	reader *zip.Reader
+	closer io.Closer
+	opts   Options
+	budget *archiveBudget
+	// drm names the DRM scheme of a book converted from another format
+	// whose text is encrypted
+	drm string
+	// anchors holds the anchors marked in the text being converted, if the
+	// Anchors option is set
+	anchors *anchorTable
+}
+
+// Convert extracts the text of the EPUB in r, which is size bytes long
+func Convert(r io.ReaderAt, size int64, opts Options) (string, error) {
+	book, err := Open(r, size, opts)
+	if err != nil {
+		return "", err
+	}
+	return book.Text()
+}
+
+// ConvertToWriter extracts the text of the EPUB in r, which is size bytes
+// long, writing it to w a chapter at a time as Book.WriteText does
+func ConvertToWriter(r io.ReaderAt, size int64, w io.Writer, opts Options) error {
+	book, err := Open(r, size, opts)
+	if err != nil {
+		return err
+	}
+	return book.WriteText(w)
+}
+
+// Open reads the package document of the EPUB in r, which is size bytes
+// long, for converting with opts. A MOBI, AZW3 or FictionBook file, zipped
+// or not, is converted to the content documents of an EPUB as it is opened,
+// with the format told from the start of the file.
+func Open(r io.ReaderAt, size int64, opts Options) (*Book, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return openAny(r, size, nil, opts)
+}
+
+// OpenFile opens the EPUB, or other book as Open does, at path for
+// converting with opts. The book must be closed when done with.
+func OpenFile(path string, opts Options) (*Book, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open EPUB file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open EPUB file: %w", err)
+	}
+	if opts.Name == "" {
+		opts.Name = path
+	}
+	book, err := openAny(f, info.Size(), f, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return book, nil
+}
+
+// OpenFS opens the EPUB file name in fsys, such as an embed.FS, for
+// converting with opts. A file that can't be read at arbitrary offsets is
+// read into memory. The book must be closed when done with.
+func OpenFS(fsys fs.FS, name string, opts Options) (*Book, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open EPUB file: %w", err)
+	}
+	if opts.Name == "" {
+		opts.Name = name
+	}
+	book, err := openFSFile(f, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return book, nil
+}
+
+func openFSFile(f fs.File, opts Options) (*Book, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open EPUB file: %w", err)
+	}
+	r, ok := f.(io.ReaderAt)
+	size := info.Size()
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EPUB file: %w", err)
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+	return openAny(r, size, f, opts)
+}
+
+func open(reader *zip.Reader, closer io.Closer, opts Options) (*Book, error) {
+	if opts.Name == "" {
+		opts.Name = "book.epub"
+	}
+	b := &Book{reader: reader, closer: closer, opts: opts, budget: newArchiveBudget(opts)}
+	if err := checkEntries(b, opts.MaxEntries); err != nil {
+		return nil, err
+	}
+
+	// Find the package document from container.xml and parse it to get the
+	// reading order
+	if err := b.readPackage(); err != nil {
+		if !opts.Lenient {
+			return nil, err
+		}
+		b.recoverPackage(err)
+	}
+	if opts.Lenient {
+		b.cleanManifest()
+		if !b.hasSpine() {
+			b.recoverSpine()
+		}
+	}
+	if err := checkEntries(b, opts.MaxEntries); err != nil {
+		return nil, err
+	}
+	if opts.StrictPaths {
+		if err := checkPaths(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Close closes the file of a book opened with OpenFile or OpenFS
+func (b *Book) Close() error {
+	if b.closer == nil {
+		return nil
+	}
+	return b.closer.Close()
+}
+
+// warnf passes a warning to the Warn option and Logger, if set. The format
+// is the English message for id, which is empty for messages that are
+// already localized.
+func (b *Book) warnf(category, id, format string, args ...interface{}) {
+	if b.opts.Warn == nil && b.opts.Logger == nil {
+		return
+	}
+	b.warn(Warning{Category: category, Message: fmt.Sprintf(msg(id, format), args...)})
+}
+
+// warn passes w to the Warn option and Logger, if set
+func (b *Book) warn(w Warning) {
+	if b.opts.Warn != nil {
+		b.opts.Warn(w)
+	}
+	if b.opts.Logger != nil {
+		b.opts.Logger.Warn(w.Message, "category", w.Category, "book", b.opts.Name)
+	}
+}
+
+// quiet returns a copy of the book that gives no warnings, for reading
+// ahead documents whose problems are reported when they are converted
+func (b *Book) quiet() *Book {
+	quiet := *b
+	quiet.opts.Warn = nil
+	quiet.opts.Logger = nil
+	return &quiet
+}
+
+// Chapter is the text of one content document of a book
+type Chapter struct {
+	// Index is the chapter's position among the chapters converted,
+	// starting at 1
+	Index int
+	// Title is the title the table of contents gives the chapter, or
+	// failing that its first heading. It is "" if it has neither.
+	Title string
+	// Path is the archive path of the content document
+	Path string
+	Text string
+}
+
+// Text converts the book
+func (b *Book) Text() (string, error) {
+	opts := b.opts
+	if opts.Format == FormatJSON {
+		return b.jsonText()
+	}
+	var pandoc *pandocBuilder
+	if opts.Format == FormatPandoc {
+		pandoc = newPandocBuilder(opts.ImageLinks, b.cleanText)
+	}
+	var chapters []Chapter
+	diag, err := b.extract(pandoc, false, true, func(chapter Chapter) error {
+		chapters = append(chapters, chapter)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var textBuilder strings.Builder
+	for _, chapter := range chapters {
+		textBuilder.WriteString(chapter.Text)
+		textBuilder.WriteString("\n\n")
+	}
+	text := textBuilder.String()
+	if opts.StripGutenberg {
+		var found bool
+		if text, found = stripGutenbergBoilerplate(text); !found {
+			b.warnf(WarnBoilerplate, "WarnNoBoilerplate", "no Project Gutenberg header or footer found in %s", opts.Name)
+		}
+	}
+	if err := b.checkLength(text, diag); err != nil {
+		return "", err
+	}
+
+	if pandoc != nil {
+		// The metadata goes in the document instead of a header, and text
+		// clean-ups were applied as the document was built
+		doc, err := pandoc.document(&b.Package)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode Pandoc document: %w", err)
+		}
+		return doc, nil
+	}
+	return b.finishText(text, opts.Header), nil
+}
+
+// Chapters converts the book to plain text one content document at a time,
+// leaving out those without text. Format is ignored, and with Header set
+// every chapter gets the header block.
+func (b *Book) Chapters() ([]Chapter, error) {
+	return b.chapters(b.opts.Header)
+}
+
+// chapters converts the book chapter by chapter, giving each the header
+// block if header is set
+func (b *Book) chapters(header bool) ([]Chapter, error) {
+	var chapters []Chapter
+	diag, err := b.extract(nil, true, true, func(chapter Chapter) error {
+		chapters = append(chapters, chapter)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if b.opts.StripGutenberg {
+		var found bool
+		if chapters, found = stripGutenbergChapters(chapters); !found {
+			b.warnf(WarnBoilerplate, "WarnNoBoilerplate", "no Project Gutenberg header or footer found in %s", b.opts.Name)
+		}
+	}
+
+	var all strings.Builder
+	for i := range chapters {
+		all.WriteString(chapters[i].Text)
+		all.WriteString("\n\n")
+	}
+	if err := b.checkLength(all.String(), diag); err != nil {
+		return nil, err
+	}
+
+	for i := range chapters {
+		chapters[i].Index = i + 1
+		chapters[i].Text = b.finishText(chapters[i].Text+"\n", header)
+	}
+	return chapters, nil
+}
+
+// WriteText converts the book like Text, but writes the text to w a chapter
+// at a time, so that the text of the whole book is never held in memory.
+// Nothing is written until the text reaches MinText, so a book failing
+// FailShortText writes nothing. StripGutenberg, FormatPandoc and FormatJSON
+// need the whole book before writing any of it, so with any of them the book
+// is converted with Text and then written.
+func (b *Book) WriteText(w io.Writer) error {
+	opts := b.opts
+	if opts.StripGutenberg || opts.Format != FormatText && opts.Format != "" {
+		text, err := b.Text()
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, text)
+		return err
+	}
+
+	s := &textStream{book: b, w: w, checked: opts.MinText <= 0}
+	if opts.Header {
+		s.add(b.header())
+	}
+	diag, err := b.extract(nil, false, false, func(chapter Chapter) error {
+		return s.addChapter(chapter.Text)
+	})
+	if err != nil {
+		return err
+	}
+	if !s.checked {
+		if err := b.checkLength(s.raw.String(), diag); err != nil {
+			return err
+		}
+	}
+	return s.flush()
+}
+
+// textStream writes the text of a book as WriteText converts it, with the
+// clean-ups of finishText applied. The text is held back until it reaches
+// MinText.
+type textStream struct {
+	book *Book
+	w    io.Writer
+	// raw is the text held back, before the clean-ups, for checkLength
+	raw  strings.Builder
+	held strings.Builder
+	// checked is set once the text is long enough to pass checkLength
+	checked bool
+	// blocks is set once canonical text has been added, which the next
+	// text must be separated from by a blank line
+	blocks bool
+	// runes and bytes are the length of the text added, for the offsets of
+	// anchors
+	runes, bytes int
+}
+
+// addChapter adds the text of a chapter, writing it unless it is held back
+func (s *textStream) addChapter(text string) error {
+	text += "\n\n"
+	if !s.checked {
+		s.raw.WriteString(text)
+		s.checked = textLength(s.raw.String()) >= s.book.opts.MinText
+	}
+	s.add(text)
+	if s.checked {
+		return s.flush()
+	}
+	return nil
+}
+
+// add cleans up text and holds it for the next flush
+func (s *textStream) add(text string) {
+	text = s.book.cleanText(text)
+	if s.book.opts.Canonical {
+		// Canonical text is made of blocks each ending in a newline, and
+		// separated by a blank line
+		if text = canonicalText(text); text == "" {
+			return
+		}
+		if s.blocks {
+			s.held.WriteString("\n")
+			s.runes++
+			s.bytes++
+		}
+		s.blocks = true
+	}
+	text = s.book.takeAnchors(text, s.runes, s.bytes)
+	s.held.WriteString(text)
+	s.runes += utf8.RuneCountInString(text)
+	s.bytes += len(text)
+}
+
+// flush writes the text held back
+func (s *textStream) flush() error {
+	if _, err := io.WriteString(s.w, s.held.String()); err != nil {
+		return err
+	}
+	s.held.Reset()
+	s.raw.Reset()
+	return nil
+}
+
+// extract reads the content documents in reading order and extracts their
+// text, passing each chapter to emit and adding it to pandoc as well if it
+// isn't nil. Documents without text are left out, and the chapters are only
+// given titles if titled is set. If keep is set the caller holds on to the
+// chapters, so their text counts against MaxMemory until the end.
+func (b *Book) extract(pandoc *pandocBuilder, titled, keep bool, emit func(Chapter) error) (textDiagnostics, error) {
+	// Encrypted content would only come out as binary garbage
+	if scheme := b.detectDRM(); scheme != "" {
+		return textDiagnostics{}, &DRMError{Scheme: scheme}
+	}
+
+	opts := b.opts
+	epubPath := opts.Name
+	contentPath := b.PackagePath
+	contentDir := path.Dir(contentPath)
+
+	// Get the ordered list of content files
+	spine := b.readSpine()
+	contentFiles := spine.linear
+
+	// Compare the reading order with the table of contents, which
+	// malformed books sometimes get right when the spine is wrong
+	toc, err := b.readTOC(contentDir)
+	if errors.Is(err, ErrParseLimit) || errors.Is(err, ErrArchiveLimit) {
+		return textDiagnostics{}, fmt.Errorf("parsing %s: %w", toc.path, err)
+	} else if err != nil {
+		b.warnf(WarnOrder, "WarnTOCUnreadable", "failed to read table of contents %s: %v", toc.path, err)
+	} else if mismatches := compareOrder(contentFiles, toc.files); len(mismatches) > 0 {
+		b.warnf(WarnOrder, "WarnOrder", "spine order of %s differs from %s: %s", epubPath, toc.path, formatMismatches(mismatches))
+		if opts.Order == OrderNCX {
+			contentFiles = reorderByTOC(contentFiles, toc.files)
+		}
+	}
+	if opts.Order == OrderNCX && toc.files == nil {
+		b.warnf(WarnOrder, "WarnNoTOC", "no usable table of contents in %s, using spine order", epubPath)
+	}
+
+	// Extract text from each content file
+	budget := memoryBudget{limit: int64(opts.MaxMemory)}
+	state := newBookState()
+	b.anchors = nil
+	if opts.hasAnchors() {
+		b.anchors = &anchorTable{}
+		state.anchors = b.anchors
+	}
+	if opts.Footnotes != "" && opts.Footnotes != FootnotesKeep {
+		// Before the preview is cut, whose chapters can have notes at the
+		// end of the book
+		state.notes = b.readNotes(append(slices.Clip(contentFiles), spine.nonlinear...), budget.remaining())
+	}
+	nonlinear := make(map[string]bool)
+	if opts.IncludeNonlinear {
+		for _, file := range spine.nonlinear {
+			nonlinear[file] = true
+		}
+		contentFiles = append(contentFiles, spine.nonlinear...)
+	}
+
+	// Spine items not in the manifest, which the diagnostics count among
+	// those converted however few are selected
+	missing := spine.missing
+	if opts.ChapterRange != "" || opts.From != "" || opts.SkipFrontMatter {
+		if contentFiles, err = b.selectChapters(contentFiles, toc, opts); err != nil {
+			return textDiagnostics{}, err
+		}
+	}
+	if opts.PreviewPercent > 0 {
+		contentFiles = previewFiles(b.reader, contentFiles, opts.PreviewPercent)
+	}
+	diag := textDiagnostics{
+		spineItems:   len(contentFiles) + missing,
+		contentFiles: len(contentFiles),
+		nonlinear:    len(spine.nonlinear) - len(nonlinear),
+	}
+	convert := func(i int) chapterResult {
+		return b.convertChapter(contentFiles[i], toc.titles[contentFiles[i]], titled, pandoc != nil, state, &budget)
+	}
+	err = convertInOrder(len(contentFiles), opts.parallelism(), convert, func(i int, result chapterResult) error {
+		filePath := contentFiles[i]
+		b.progress(i, len(contentFiles), filePath)
+		for _, w := range result.warnings {
+			b.warn(w)
+		}
+		diag.images += result.images
+		switch {
+		case result.err != nil:
+			return result.err
+		case result.unreadable:
+			diag.unreadable++
+			return nil
+		case result.binary:
+			diag.binary++
+			return nil
+		case result.skipped:
+			return nil
+		}
+		text := result.text
+
+		if opts.Chapters != nil {
+			if first, dup := opts.Chapters.check(withoutAnchors(text), epubPath+": "+filePath); dup {
+				if opts.SkipDuplicateChapters {
+					b.warnf(WarnDuplicate, "WarnDuplicateSkipped", "skipping %s in %s: same text as %s", filePath, epubPath, first)
+					diag.duplicates++
+					return nil
+				}
+				b.warnf(WarnDuplicate, "WarnDuplicate", "%s in %s has the same text as %s", filePath, epubPath, first)
+			}
+		}
+
+		if pandoc != nil {
+			pandoc.add(filePath, result.content)
+		}
+		if text != "" && nonlinear[filePath] {
+			text = nonlinearMarker + "\n" + text
+		}
+		if text != "" {
+			if err := budget.reserve(int64(len(text) + 2)); err != nil {
+				return fmt.Errorf("converting %s: %w", filePath, err)
+			}
+			chapter := Chapter{Path: filePath, Text: text}
+			if titled {
+				chapter.Title = toc.titles[filePath]
+				if chapter.Title == "" {
+					chapter.Title = result.heading
+				}
+			}
+			if err := emit(chapter); err != nil {
+				return err
+			}
+			if !keep {
+				budget.release(int64(len(text) + 2))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return diag, err
+	}
+	b.progress(len(contentFiles), len(contentFiles), "")
+	return diag, nil
+}
+
+// chapterResult is a content document converted by convertChapter, with
+// the warnings given on the way, to be passed on in reading order
+type chapterResult struct {
+	text string
+	// heading is the document's first heading, if it was needed
+	heading string
+	// content is the document, kept for the Pandoc builder
+	content string
+	// unreadable and binary are set for documents that couldn't be read or
+	// were binary, and skipped for those left out as front matter
+	unreadable, binary, skipped bool
+	images                      int
+	warnings                    []Warning
+	err                         error
+}
+
+// convertChapter reads the content document at filePath, titled title in
+// the table of contents, and extracts its text, applying the options up to
+// the text filters. It is safe to call for several documents at once: the
+// warnings it gives are held in the result.
+func (b *Book) convertChapter(filePath, title string, titled, keepContent bool, state *bookState, budget *memoryBudget) (result chapterResult) {
+	opts := b.opts
+	book := *b
+	if opts.Warn != nil || opts.Logger != nil {
+		book.opts.Warn = func(w Warning) {
+			result.warnings = append(result.warnings, w)
+		}
+		book.opts.Logger = nil
+	}
+	b = &book
+
+	content, err := b.readFile(filePath, budget.remaining())
+	if errors.Is(err, ErrMemoryLimit) || errors.Is(err, ErrArchiveLimit) {
+		result.err = fmt.Errorf("reading %s: %w", filePath, err)
+		return result
+	} else if err != nil {
+		b.warnf(WarnMissingFile, "WarnReadFailed", "failed to read %s: %v", filePath, err)
+		result.unreadable = true
+		return result
+	}
+
+	content = b.decodeContent(filePath, content)
+	if isBinaryContent(content) {
+		b.warnf(WarnBinary, "WarnBinary", "skipping %s: content appears to be binary", filePath)
+		result.binary = true
+		return result
+	}
+	if content, err = expandEntities(content); err != nil {
+		result.err = fmt.Errorf("parsing %s: %w", filePath, err)
+		return result
+	}
+	if opts.SkipFrontMatter && isFrontMatter(content) {
+		result.skipped = true
+		return result
+	}
+	chapterInfo := FilterChapter{Book: opts.Name, Path: filePath, Title: title}
+	if content, err = filterHTML(opts.Filters, content, chapterInfo); err != nil {
+		result.err = fmt.Errorf("filtering %s: %w", filePath, err)
+		return result
+	}
+	result.images = countImages(content)
+
+	if err := budget.reserve(int64(len(content))); err != nil {
+		result.err = fmt.Errorf("reading %s: %w", filePath, err)
+		return result
+	}
+	text, err := extractTextFromHTML(filePath, content, opts, state)
+	budget.release(int64(len(content)))
+	if err != nil {
+		result.err = fmt.Errorf("parsing %s: %w", filePath, err)
+		return result
+	}
+	if opts.JoinLines || opts.Dehyphenate {
+		text = joinLines(text, opts)
+	}
+	if opts.Policy != nil || (titled || len(opts.Filters) > 0) && title == "" {
+		result.heading = chapterName(content)
+	}
+	if opts.Policy != nil {
+		text = opts.Policy.apply(text, result.heading)
+	}
+	if opts.hasLayout() {
+		text = layoutText(text, opts)
+	}
+	if text != "" && len(opts.Filters) > 0 {
+		if chapterInfo.Title == "" {
+			chapterInfo.Title = result.heading
+		}
+		text, err = keepAnchors(text, func(text string) (string, error) {
+			return filterText(opts.Filters, text, chapterInfo)
+		})
+		if err != nil {
+			result.err = fmt.Errorf("filtering %s: %w", filePath, err)
+			return result
+		}
+	}
+	result.text = text
+	if keepContent {
+		result.content = content
+	}
+	return result
+}
+
+// checkLength guards against silently writing a near-empty file, warning,
+// or failing with FailShortText, if text is shorter than MinText
+func (b *Book) checkLength(text string, diag textDiagnostics) error {
+	n := textLength(text)
+	if n >= b.opts.MinText {
+		return nil
+	}
+	diag.fixedLayout = isFixedLayout(&b.Package)
+	message := diag.shortTextMessage(b.opts.Name, n, b.opts.MinText)
+	if b.opts.FailShortText {
+		return errors.New(message)
+	}
+	b.warnf(WarnShortText, "", "%s", message)
+	return nil
+}
+
+// finishText applies the clean-ups of the options to plain text, and the
+// header block if header is set, and reports the anchors in it
+func (b *Book) finishText(text string, header bool) string {
+	if header {
+		text = b.header() + text
+	}
+	text = b.cleanText(text)
+	if b.opts.Canonical {
+		text = canonicalText(text)
+	}
+	return b.takeAnchors(text, 0, 0)
+}
+
+// cleanText applies the mojibake, emoji, space, quote and normalization
+// clean-ups of the options to plain text
+func (b *Book) cleanText(text string) string {
+	if b.opts.FixMojibake {
+		text = fixMojibake(text)
+	}
+	text = foldVerticalForms(text)
+	return applyCleanups(applyEmojiPolicy(text, b.opts.Emoji), b.opts)
+}
+
+// header returns the header block of the book, which leaves out the
+// conversion time in canonical text
+func (b *Book) header() string {
+	convertedAt := time.Now()
+	if b.opts.Canonical {
+		convertedAt = time.Time{}
+	}
+	return formatHeader(&b.Package, b.opts.Name, convertedAt)
+}
+
+// Measure counts the words and characters of text converted to format
+func Measure(text, format string) (words, characters int) {
+	switch format {
+	case FormatPandoc:
+		return pandocStats(text)
+	case FormatJSON:
+		return jsonStats(text)
+	}
+	return countWords(text), utf8.RuneCountInString(text)
+}
+
+// formatHeader builds the provenance header block written before the text
+// when --header is set. The Converted-At line is left out if convertedAt is
+// zero.
+func formatHeader(pkg *Package, epubPath string, convertedAt time.Time) string {
+	var header strings.Builder
+	fmt.Fprintf(&header, "Title: %s\n", strings.Join(trimAll(pkg.Metadata.Titles), "; "))
+	fmt.Fprintf(&header, "Author: %s\n", strings.Join(pkg.Metadata.CreatorNames(), "; "))
+	fmt.Fprintf(&header, "Source-File: %s\n", filepath.Base(epubPath))
+	if !convertedAt.IsZero() {
+		fmt.Fprintf(&header, "Converted-At: %s\n", convertedAt.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&header, "Epubconv-Version: %s\n", Version)
+	header.WriteString("\n")
+	return header.String()
+}
+
+// trimAll trims surrounding whitespace from each value and drops empty ones
+func trimAll(values []string) []string {
+	var trimmed []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			trimmed = append(trimmed, v)
+		}
+	}
+	return trimmed
+}
+
+// parseXML decodes the XML document at path into v, after checking it
+// against the parse limits
+func (b *Book) parseXML(path string, v interface{}) error {
+	data, err := b.readXML(path)
+	if err != nil {
+		return err
+	}
+	return newXMLDecoder(data).Decode(v)
+}
+
+// readXML returns the contents of the XML file at path, checked against
+// the parse limits
+func (b *Book) readXML(path string) ([]byte, error) {
+	file := b.findFile(path)
+	if file == nil {
+		return nil, fmt.Errorf("file not found in EPUB: %s", path)
+	}
+
+	rc, err := b.budget.open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkXMLLimits(data, b.opts.limits()); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// findFile returns the archive entry named path, or nil. A malformed
+// archive can store the same name more than once; the last entry wins, since
+// tools that append to an archive add replacements after what they replace,
+// with a warning rather than silently using stale content.
+func (b *Book) findFile(path string) *zip.File {
+	// Normalize path separators
+	path = filepath.ToSlash(path)
+
+	var found *zip.File
+	count := 0
+	for _, file := range b.reader.File {
+		if filepath.ToSlash(file.Name) == path {
+			found = file
+			count++
+		}
+	}
+	if count > 1 {
+		b.warnf(WarnDuplicateEntry, "WarnDuplicateEntry", "%s is stored %d times in the archive, using the last copy", path, count)
+	}
+	return found
+}
+
+// resolveHref returns the archive path of href, found in a file in the
+// archive directory dir. Absolute hrefs are taken from the archive root, and
+// hrefs climbing above the root with "../" stop at it.
+func resolveHref(dir, href string) string {
+	if strings.HasPrefix(href, "/") {
+		return path.Clean(strings.TrimLeft(href, "/"))
+	}
+	resolved := path.Join(dir, href)
+	for resolved == ".." || strings.HasPrefix(resolved, "../") {
+		resolved = strings.TrimPrefix(strings.TrimPrefix(resolved, ".."), "/")
+	}
+	return resolved
+}
+
+// isWithinDir reports whether the archive path name is inside dir
+func isWithinDir(dir, name string) bool {
+	return dir == "." || strings.HasPrefix(name, dir+"/")
+}
+
+// readFile returns the decompressed contents of path. If maxSize is
+// non-zero, files larger than maxSize fail with ErrMemoryLimit.
+func (b *Book) readFile(path string, maxSize int64) (string, error) {
+	file := b.findFile(path)
+	if file == nil {
+		return "", fmt.Errorf("file not found: %s", path)
+	}
+	if maxSize > 0 && file.UncompressedSize64 > uint64(maxSize) {
+		return "", fmt.Errorf("%w: %s is %d bytes uncompressed", ErrMemoryLimit, path, file.UncompressedSize64)
+	}
+
+	rc, err := b.budget.open(file)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	// Don't trust the size in the zip header
+	var r io.Reader = rc
+	if maxSize > 0 {
+		r = io.LimitReader(rc, maxSize+1)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if maxSize > 0 && int64(len(content)) > maxSize {
+		return "", fmt.Errorf("%w: %s is larger than %d bytes uncompressed", ErrMemoryLimit, path, maxSize)
+	}
+	return string(content), nil
+}
+
+// isBinaryContent sniffs the start of a content file and reports whether it
+// looks like binary data rather than (X)HTML text. Content is considered
+// binary if it contains NUL bytes or if more than a tenth of the sniffed
+// runes are invalid UTF-8.
+func isBinaryContent(content string) bool {
+	const sniffLen = 8192
+	sample := content
+	if len(sample) > sniffLen {
+		sample = sample[:sniffLen]
+		// Don't count a rune cut in half by the sniff window as invalid
+		for i := 1; i < utf8.UTFMax && i <= len(sample); i++ {
+			if utf8.RuneStart(sample[len(sample)-i]) {
+				if !utf8.FullRuneInString(sample[len(sample)-i:]) {
+					sample = sample[:len(sample)-i]
+				}
+				break
+			}
+		}
+	}
+
+	if strings.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+
+	runes, invalid := 0, 0
+	for i := 0; i < len(sample); {
+		r, size := utf8.DecodeRuneInString(sample[i:])
+		if r == utf8.RuneError && size == 1 {
+			invalid++
+		}
+		runes++
+		i += size
+	}
+	return runes > 0 && invalid*10 > runes
+}
+
+// blockElements start and end a line of text
+var blockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"body": true, "caption": true, "center": true, "details": true,
+	"dialog": true, "div": true, "fieldset": true, "figcaption": true,
+	"figure": true, "footer": true, "form": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hgroup": true, "hr": true, "legend": true, "li": true, "main": true,
+	"nav": true, "ol": true, "p": true, "pre": true, "section": true,
+	"summary": true, "table": true, "tr": true, "ul": true,
+}
+
+// skippedElements have no text to extract
+var skippedElements = map[string]bool{
+	"head": true, "script": true, "style": true, "template": true,
+}
+
+// textExtractor collects the text of one content file from its tokens
+type textExtractor struct {
+	opts   Options
+	limits parseLimits
+	// state carries over between the content files of a book
+	state *bookState
+	text  bytes.Buffer
+
+	// skip is the element whose content is being left out, or ""
+	skip string
+	// pre is the number of open <pre> elements, inside which whitespace
+	// is kept
+	pre int
+	// External links currently open, and the footnotes collected for them
+	openLinks []openLink
+	footnotes linkFootnotes
+	// Abbreviations currently open
+	openAbbrs []openAbbr
+	// Definition lists render as "term — definition" lines. listMark is the
+	// text length at the last </dt> or </dd> and listPrev is which of the two
+	// it was, so the whitespace up to the next <dt> or <dd> can be replaced.
+	listMark int
+	listPrev string
+	// listItem is set inside a <dt> or <dd>, whose blocks share its line
+	listItem bool
+	// Names of the open elements, to enforce the nesting limit
+	open []string
+	// Elements with an id that are still open, and the text of those that
+	// have closed, for resolving aria-describedby references
+	openIDs []openElement
+	idText  map[string]string
+	// Elements with a class the policy selects on that are still open
+	openClasses []openClass
+	// docPath is the archive path of the content file, for resolving
+	// noterefs
+	docPath string
+	// Noterefs currently open, and the notes listed at the end of the
+	// chapter with FootnotesEnd
+	openNoterefs []openNoteref
+	noteList     noteList
+	noterefs     int
+	// noteDepth is the depth in open of the note being left out, or 0
+	noteDepth int
+	// tableDepth is the number of tables open, and table the outermost
+	// while it is read, if tables are rendered
+	tableDepth int
+	table      *tableState
+	// anchors are the elements with an id read, if anchors are reported
+	anchors []markedAnchor
+	// ruby is the ruby annotation element being read, "rt", "rtc" or "rp",
+	// if Options.Ruby handles them
+	ruby string
+}
+
+// openNoteref is a noteref whose end tag hasn't been reached yet
+type openNoteref struct {
+	name   string
+	target noteElement
+	// start is the length of the extracted text when the noteref opened
+	start int
+}
+
+// extractTextFromHTML returns the text of the content file at the archive
+// path docPath. State that carries over between the content files of a
+// book is kept in state.
+func extractTextFromHTML(docPath, content string, opts Options, state *bookState) (string, error) {
+	e := &textExtractor{
+		docPath:  docPath,
+		opts:     opts,
+		limits:   opts.limits(),
+		state:    state,
+		listMark: -1,
+		idText:   make(map[string]string),
+	}
+	err := walkHTML(content, func(tok html.Token) error {
+		if tok.Type == html.TextToken {
+			e.addText(tok.Data)
+			return nil
+		}
+		return e.tag(tokenTag(tok))
+	})
+	if err != nil {
+		return "", err
+	}
+	if e.table != nil {
+		// A table left open at the end of the document
+		e.endRow()
+		e.writeTable(e.table)
+	}
+
+	// Clean up the text
+	result := e.text.String()
+	if state.anchors != nil {
+		result = insertAnchors(e.text.Bytes(), docPath, e.anchors, state.anchors)
+	}
+	if opts.AriaLabels {
+		result = resolveDescribedBy(result, e.idText)
+	}
+
+	// Remove excessive whitespace
+	lines := strings.Split(result, "\n")
+	var cleanedLines []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			cleanedLines = append(cleanedLines, line)
+		}
+	}
+
+	result = strings.Join(cleanedLines, "\n")
+	if len(e.noteList.labels) > 0 && result != "" {
+		result += "\n\n" + e.noteList.String()
+	}
+	if len(e.footnotes.urls) > 0 && result != "" {
+		result += "\n\n" + e.footnotes.String()
+	}
+	return result, nil
+}
+
+// tag handles a start or end tag
+func (e *textExtractor) tag(t htmlTag) error {
+	if t.closing {
+		for j := len(e.open) - 1; j >= 0; j-- {
+			if e.open[j] == t.name {
+				// Closing an element also closes any left open inside it
+				e.open = e.open[:j]
+				break
+			}
+		}
+		e.endNote()
+	} else {
+		if len(e.open) > 0 && e.open[len(e.open)-1] == t.name && impliedEndTags[t.name] {
+			// An unclosed <p> or <li> ends at its next sibling
+			e.open = e.open[:len(e.open)-1]
+			e.endNote()
+		}
+		if err := e.limits.check(t.name, len(e.open)+1, len(t.attrs)); err != nil {
+			return err
+		}
+		if !t.selfClosing && !voidElements[t.name] {
+			e.open = append(e.open, t.name)
+		}
+	}
+
+	switch {
+	case e.skip == "head" && t.name == "body" && !t.closing:
+		// The head's end tag is optional
+		e.skip = ""
+	case e.skip != "":
+		if t.closing && t.name == e.skip {
+			e.skip = ""
+		}
+		return nil
+	case skippedElements[t.name] && !t.closing && !t.selfClosing:
+		e.skip = t.name
+		return nil
+	}
+	if e.state.notes != nil && e.noteTag(t) {
+		return nil
+	}
+	if e.state.anchors != nil && !t.closing {
+		if id := strings.TrimSpace(t.attrs["id"]); id != "" {
+			e.anchors = append(e.anchors, markedAnchor{id: id, pos: e.text.Len()})
+		}
+	}
+
+	if e.opts.Ruby == RubyStrip || e.opts.Ruby == RubyParenthesize {
+		e.rubyTag(t)
+	}
+
+	if e.opts.AriaLabels {
+		if t.closing {
+			for j := len(e.openIDs) - 1; j >= 0; j-- {
+				if e.openIDs[j].name == t.name {
+					e.idText[e.openIDs[j].id] = strings.TrimSpace(string(e.text.Bytes()[e.openIDs[j].start:]))
+					e.openIDs = e.openIDs[:j]
+					break
+				}
+			}
+		} else {
+			if label := strings.TrimSpace(t.attrs["aria-label"]); label != "" {
+				writeAnnotation(&e.text, label)
+			}
+			if ids := strings.Fields(t.attrs["aria-describedby"]); len(ids) > 0 {
+				// Resolved once the whole document has been read
+				e.text.WriteString(describedByMarker + strings.Join(ids, " ") + describedByMarker)
+			}
+			if id := t.attrs["id"]; id != "" && !t.selfClosing && !voidElements[t.name] {
+				e.openIDs = append(e.openIDs, openElement{name: t.name, id: id, start: e.text.Len()})
+			}
+		}
+	}
+
+	if e.opts.Policy != nil && len(e.opts.Policy.classes) > 0 {
+		if t.closing {
+			for j := len(e.openClasses) - 1; j >= 0; j-- {
+				if e.openClasses[j].name == t.name {
+					// Closing an element also closes any left open inside it
+					for k := len(e.openClasses) - 1; k >= j; k-- {
+						e.text.WriteString(classMarker + "-" + e.openClasses[k].classes + classMarker)
+					}
+					e.openClasses = e.openClasses[:j]
+					break
+				}
+			}
+		} else if classes := e.opts.Policy.selectedClasses(t.attrs["class"]); classes != "" && !t.selfClosing && !voidElements[t.name] {
+			// Resolved when the policy is applied to the text
+			e.text.WriteString(classMarker + "+" + classes + classMarker)
+			e.openClasses = append(e.openClasses, openClass{name: t.name, classes: classes})
+		}
+	}
+
+	if e.opts.Tables != "" && e.opts.Tables != TablesFlatten {
+		e.tableTag(t)
+	}
+
+	block := blockElements[t.name]
+	if block && !t.closing {
+		e.blockBoundary()
+	}
+
+	switch {
+	case isHeading(t.name) && !t.closing && e.opts.hasLayout():
+		e.text.WriteString(headingMarker + t.name[1:])
+	case t.name == "br":
+		e.text.WriteByte('\n')
+	case t.name == "pre" && !t.closing && !t.selfClosing:
+		e.pre++
+	case t.name == "pre" && t.closing && e.pre > 0:
+		e.pre--
+	case (t.name == "td" || t.name == "th") && !t.closing:
+		e.space()
+	case t.name == "caption" && e.opts.Captions:
+		if t.closing {
+			e.text.WriteString("]\n")
+		} else {
+			e.text.WriteString("\n[")
+		}
+	case t.name == "dt" && !t.closing:
+		if e.listPrev == "dt" && isSpace(e.text.Bytes()[e.listMark:]) {
+			// Several terms sharing a definition
+			e.text.Truncate(len(bytes.TrimRight(e.text.Bytes(), " \t\r\n")))
+			e.text.WriteString(", ")
+		} else {
+			e.text.WriteByte('\n')
+		}
+		e.listPrev, e.listItem = "", !t.selfClosing
+	case t.name == "dd" && !t.closing:
+		if e.listPrev != "" && isSpace(e.text.Bytes()[e.listMark:]) {
+			e.text.Truncate(len(bytes.TrimRight(e.text.Bytes(), " \t\r\n")))
+			if e.listPrev == "dt" {
+				e.text.WriteString(" — ")
+			} else if e.text.Len() > 0 && bytes.ContainsAny(e.text.Bytes()[e.text.Len()-1:], ".!?;") {
+				// Further definitions of the same term
+				e.text.WriteByte(' ')
+			} else {
+				e.text.WriteString("; ")
+			}
+		} else {
+			e.text.WriteByte('\n')
+		}
+		e.listPrev, e.listItem = "", !t.selfClosing
+	case (t.name == "dt" || t.name == "dd") && t.closing:
+		e.listMark, e.listPrev, e.listItem = e.text.Len(), t.name, false
+	case t.name == "dl" && t.closing:
+		e.text.WriteByte('\n')
+		e.listPrev, e.listItem = "", false
+	case t.name == "a" && !t.closing && e.opts.LinkFootnotes:
+		e.openLinks = append(e.openLinks, openLink{href: t.attrs["href"], start: e.text.Len()})
+	case t.name == "a" && len(e.openLinks) > 0:
+		link := e.openLinks[len(e.openLinks)-1]
+		e.openLinks = e.openLinks[:len(e.openLinks)-1]
+		linkText := strings.TrimSpace(string(e.text.Bytes()[link.start:]))
+		if isExternalLink(link.href) && linkText != link.href {
+			fmt.Fprintf(&e.text, "[%d]", e.footnotes.add(link.href))
+		}
+	case (t.name == "abbr" || t.name == "acronym") && !t.closing && e.opts.ExpandAbbreviations:
+		e.openAbbrs = append(e.openAbbrs, openAbbr{title: strings.TrimSpace(t.attrs["title"]), start: e.text.Len()})
+	case (t.name == "abbr" || t.name == "acronym") && len(e.openAbbrs) > 0:
+		abbr := e.openAbbrs[len(e.openAbbrs)-1]
+		e.openAbbrs = e.openAbbrs[:len(e.openAbbrs)-1]
+		abbrText := strings.TrimSpace(string(e.text.Bytes()[abbr.start:]))
+		if abbr.title != "" && abbrText != "" && abbr.title != abbrText && !e.state.expandedAbbrs[abbrText] {
+			e.text.WriteString(" (" + abbr.title + ")")
+			e.state.expandedAbbrs[abbrText] = true
+		}
+	}
+
+	if block && (t.closing || t.selfClosing || voidElements[t.name]) {
+		e.blockBoundary()
+	}
+	return nil
+}
+
+// noteTag handles the notes and noterefs of Options.Footnotes, reporting
+// whether t is part of a note being left out where it is
+func (e *textExtractor) noteTag(t htmlTag) bool {
+	notes := e.state.notes
+	switch {
+	case e.noteDepth > 0:
+		return true
+	case !t.closing && notes.isNote(e.docPath, t):
+		if !t.selfClosing && !voidElements[t.name] {
+			e.noteDepth = len(e.open)
+		}
+		return true
+	case !t.closing && !t.selfClosing && hasType(t.attrs, "noteref"):
+		target, _ := noteTarget(e.docPath, t.attrs["href"])
+		e.openNoterefs = append(e.openNoterefs, openNoteref{name: t.name, target: target, start: e.text.Len()})
+	case t.closing && len(e.openNoterefs) > 0 && e.openNoterefs[len(e.openNoterefs)-1].name == t.name:
+		ref := e.openNoterefs[len(e.openNoterefs)-1]
+		e.openNoterefs = e.openNoterefs[:len(e.openNoterefs)-1]
+		e.noterefs++
+		text, found := notes.text[ref.target]
+		if e.opts.Footnotes != FootnotesStrip && (!found || text == "") {
+			// Nothing to put in place of the noteref's own text
+			return false
+		}
+		label := noteLabel(string(e.text.Bytes()[ref.start:]), e.noterefs)
+		e.text.Truncate(ref.start)
+		e.clampMarks(ref.start)
+		switch e.opts.Footnotes {
+		case FootnotesInline:
+			writeAnnotation(&e.text, label+": "+text)
+		case FootnotesEnd:
+			e.text.WriteString("[" + label + "]")
+			e.noteList.add(ref.target, label, text)
+		}
+	}
+	return false
+}
+
+// endNote notes the end of the note being left out, if the element it
+// was has closed
+func (e *textExtractor) endNote() {
+	if e.noteDepth > len(e.open) {
+		e.noteDepth = 0
+	}
+}
+
+// blockBoundary separates a block from the text around it
+func (e *textExtractor) blockBoundary() {
+	if e.listItem {
+		e.space()
+	} else {
+		e.newline()
+	}
+}
+
+// addText appends character data. Outside <pre>, runs of whitespace
+// collapse to a single space, as a browser shows them, and no-break spaces
+// become plain spaces.
+func (e *textExtractor) addText(s string) {
+	if e.skip != "" || e.noteDepth > 0 || e.inRubyText() {
+		return
+	}
+	s = strings.ReplaceAll(s, "\u00a0", " ")
+	if e.pre > 0 {
+		e.text.WriteString(s)
+		return
+	}
+	for i := 0; i < len(s); i++ {
+		if isHTMLSpace(s[i]) {
+			e.space()
+		} else {
+			e.text.WriteByte(s[i])
+		}
+	}
+}
+
+// space separates what follows from the preceding text on the same line
+func (e *textExtractor) space() {
+	if b := e.text.Bytes(); len(b) > 0 && b[len(b)-1] != ' ' && b[len(b)-1] != '\n' {
+		e.text.WriteByte(' ')
+	}
+}
+
+// newline ends the current line of text, if it has any
+func (e *textExtractor) newline() {
+	if b := e.text.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+		e.text.WriteByte('\n')
+	}
+}
@@ -0,0 +1,454 @@
+// Package epubtest generates small EPUB files for testing code that reads
+// them, epubconv included: EPUB 2 and EPUB 3 books with the chapters,
+// spine and nested table of contents they are given, content documents in
+// legacy encodings or defining their own entities, and books broken the
+// ways real ones are, with duplicate or incomplete manifest items, missing
+// files or a bad container. The same Book always gives the same bytes, so
+// conversions of it can be compared with expected output.
+package epubtest
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// modified is the modification time of every file in a generated archive,
+// and of the book in its EPUB 3 metadata
+var modified = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Book describes an EPUB to generate. The zero value of each field gives a
+// well-formed EPUB 3 book.
+type Book struct {
+	// Version is 2 or 3, the EPUB version; 0 means 3. EPUB 2 books get an
+	// NCX table of contents, and EPUB 3 books a navigation document.
+	Version    int
+	Title      string
+	Authors    []string
+	Language   string
+	Identifier string
+	// Direction is the page-progression-direction of the spine, if any
+	Direction string
+	Chapters  []Chapter
+	// TOC is the table of contents. If nil, it has an entry for each
+	// chapter with a title.
+	TOC []TOCEntry
+	// Items are added to the manifest as they are, after those of the
+	// chapters, for books whose manifest is broken
+	Items []Item
+	// Files are stored in the archive as they are, such as images or
+	// stylesheets. Names are archive paths.
+	Files map[string][]byte
+
+	// PackagePath is the archive path of the package document,
+	// "OEBPS/content.opf" if empty
+	PackagePath string
+	// Package replaces the package document that would be generated, if
+	// set, and Container replaces META-INF/container.xml. NoContainer
+	// leaves container.xml out.
+	Package     string
+	Container   string
+	NoContainer bool
+	// NoPackage leaves the package document out of the archive
+	NoPackage bool
+}
+
+// Chapter is a content document of a Book
+type Chapter struct {
+	// ID is its manifest id, "chapterN" if empty, and Href its path from
+	// the package document, "chapterN.xhtml" if empty
+	ID   string
+	Href string
+	// Title is the document's <title>, and its entry in the default table
+	// of contents
+	Title string
+	// Body is the XHTML content of its <body>
+	Body string
+	// Content replaces the whole document that would be generated, if set
+	Content string
+	// Encoding is the character encoding the document is declared in and
+	// encoded to, such as "windows-1252" or "shift_jis"; UTF-8 if empty
+	Encoding string
+	// Entities are declared in the internal subset of the DOCTYPE, to be
+	// referred to as &name; in Body
+	Entities map[string]string
+	// MediaType is its manifest media type, "application/xhtml+xml" if
+	// empty
+	MediaType string
+	// NonLinear marks its spine item linear="no"
+	NonLinear bool
+	// NotInSpine leaves it out of the spine, and Missing leaves its file
+	// out of the archive
+	NotInSpine bool
+	Missing    bool
+}
+
+// TOCEntry is an entry of a Book's table of contents. Href is relative to
+// the package document, e.g. "chapter1.xhtml#part2".
+type TOCEntry struct {
+	Title    string
+	Href     string
+	Children []TOCEntry
+}
+
+// Item is a manifest item written as it is. Empty attributes are left
+// out.
+type Item struct {
+	ID         string
+	Href       string
+	MediaType  string
+	Properties string
+	Fallback   string
+}
+
+// id returns the manifest id of the chapter at index i
+func (c Chapter) id(i int) string {
+	if c.ID != "" {
+		return c.ID
+	}
+	return fmt.Sprintf("chapter%d", i+1)
+}
+
+// href returns the path of the chapter at index i from the package
+// document
+func (c Chapter) href(i int) string {
+	if c.Href != "" {
+		return c.Href
+	}
+	return fmt.Sprintf("chapter%d.xhtml", i+1)
+}
+
+// Bytes returns the EPUB file of b
+func (b *Book) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := b.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteFile writes the EPUB file of b to name
+func (b *Book) WriteFile(name string) error {
+	data, err := b.Bytes()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+// WriteTo writes the EPUB file of b to w
+func (b *Book) WriteTo(w io.Writer) (int64, error) {
+	packagePath := b.PackagePath
+	if packagePath == "" {
+		packagePath = "OEBPS/content.opf"
+	}
+	dir := path.Dir(packagePath)
+	inDir := func(href string) string {
+		name, _, _ := strings.Cut(href, "#")
+		return path.Join(dir, name)
+	}
+
+	files := []file{{name: "mimetype", data: []byte("application/epub+zip"), stored: true}}
+	if !b.NoContainer {
+		container := b.Container
+		if container == "" {
+			container = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="` + html.EscapeString(packagePath) + `" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+		}
+		files = append(files, file{name: "META-INF/container.xml", data: []byte(container)})
+	}
+
+	for i, chapter := range b.Chapters {
+		if chapter.Missing {
+			continue
+		}
+		data, err := b.document(chapter)
+		if err != nil {
+			return 0, fmt.Errorf("chapter %d: %w", i+1, err)
+		}
+		files = append(files, file{name: inDir(chapter.href(i)), data: data})
+	}
+	toc := b.toc()
+	if b.version() == 2 {
+		files = append(files, file{name: inDir("toc.ncx"), data: []byte(b.ncx(toc))})
+	} else {
+		files = append(files, file{name: inDir("nav.xhtml"), data: []byte(b.nav(toc))})
+	}
+	if !b.NoPackage {
+		opf := b.Package
+		if opf == "" {
+			opf = b.opf()
+		}
+		files = append(files, file{name: packagePath, data: []byte(opf)})
+	}
+	names := make([]string, 0, len(b.Files))
+	for name := range b.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		files = append(files, file{name: name, data: b.Files[name]})
+	}
+
+	cw := &countingWriter{w: w}
+	zw := zip.NewWriter(cw)
+	for _, f := range files {
+		method := zip.Deflate
+		if f.stored {
+			// The mimetype file must come first and be stored uncompressed
+			method = zip.Store
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: method, Modified: modified})
+		if err != nil {
+			return cw.n, err
+		}
+		if _, err := fw.Write(f.data); err != nil {
+			return cw.n, err
+		}
+	}
+	err := zw.Close()
+	return cw.n, err
+}
+
+// file is an entry of a generated archive
+type file struct {
+	name   string
+	data   []byte
+	stored bool
+}
+
+// countingWriter counts the bytes written to w, for WriteTo
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (b *Book) version() int {
+	if b.Version == 2 {
+		return 2
+	}
+	return 3
+}
+
+func (b *Book) language() string {
+	if b.Language == "" {
+		return "en"
+	}
+	return b.Language
+}
+
+func (b *Book) identifier() string {
+	if b.Identifier == "" {
+		return "urn:uuid:00000000-0000-4000-8000-000000000000"
+	}
+	return b.Identifier
+}
+
+// document returns the content document of chapter, encoded as it says
+func (b *Book) document(chapter Chapter) ([]byte, error) {
+	content := chapter.Content
+	if content == "" {
+		label := "UTF-8"
+		if chapter.Encoding != "" {
+			label = chapter.Encoding
+		}
+		var doctype strings.Builder
+		doctype.WriteString("<!DOCTYPE html")
+		if len(chapter.Entities) > 0 {
+			names := make([]string, 0, len(chapter.Entities))
+			for name := range chapter.Entities {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			doctype.WriteString(" [\n")
+			for _, name := range names {
+				fmt.Fprintf(&doctype, "  <!ENTITY %s \"%s\">\n", name, html.EscapeString(chapter.Entities[name]))
+			}
+			doctype.WriteString("]")
+		}
+		doctype.WriteString(">")
+		lang := html.EscapeString(b.language())
+		content = `<?xml version="1.0" encoding="` + label + `"?>
+` + doctype.String() + `
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="` + lang + `" lang="` + lang + `">
+<head>
+  <title>` + html.EscapeString(chapter.Title) + `</title>
+</head>
+<body>
+` + chapter.Body + `
+</body>
+</html>
+`
+	}
+	if chapter.Encoding == "" {
+		return []byte(content), nil
+	}
+	enc, err := htmlindex.Get(chapter.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := enc.NewEncoder().String(content)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encoded), nil
+}
+
+// toc returns the table of contents of b
+func (b *Book) toc() []TOCEntry {
+	if b.TOC != nil {
+		return b.TOC
+	}
+	var toc []TOCEntry
+	for i, chapter := range b.Chapters {
+		if chapter.Title != "" {
+			toc = append(toc, TOCEntry{Title: chapter.Title, Href: chapter.href(i)})
+		}
+	}
+	return toc
+}
+
+// opf returns the package document of b
+func (b *Book) opf() string {
+	var metadata, manifest, spine strings.Builder
+	fmt.Fprintf(&metadata, "    <dc:identifier id=\"bookid\">%s</dc:identifier>\n", html.EscapeString(b.identifier()))
+	fmt.Fprintf(&metadata, "    <dc:title>%s</dc:title>\n", html.EscapeString(b.Title))
+	for _, author := range b.Authors {
+		fmt.Fprintf(&metadata, "    <dc:creator>%s</dc:creator>\n", html.EscapeString(author))
+	}
+	fmt.Fprintf(&metadata, "    <dc:language>%s</dc:language>\n", html.EscapeString(b.language()))
+
+	item := func(it Item) {
+		manifest.WriteString("    <item")
+		for _, attr := range [][2]string{{"id", it.ID}, {"href", it.Href}, {"media-type", it.MediaType}, {"properties", it.Properties}, {"fallback", it.Fallback}} {
+			if attr[1] != "" {
+				fmt.Fprintf(&manifest, ` %s="%s"`, attr[0], html.EscapeString(attr[1]))
+			}
+		}
+		manifest.WriteString("/>\n")
+	}
+	version, toc := "3.0", ""
+	if b.version() == 2 {
+		version, toc = "2.0", ` toc="ncx"`
+		item(Item{ID: "ncx", Href: "toc.ncx", MediaType: "application/x-dtbncx+xml"})
+	} else {
+		fmt.Fprintf(&metadata, "    <meta property=\"dcterms:modified\">%s</meta>\n", modified.Format("2006-01-02T15:04:05Z"))
+		item(Item{ID: "nav", Href: "nav.xhtml", MediaType: "application/xhtml+xml", Properties: "nav"})
+	}
+	for i, chapter := range b.Chapters {
+		mediaType := chapter.MediaType
+		if mediaType == "" {
+			mediaType = "application/xhtml+xml"
+		}
+		item(Item{ID: chapter.id(i), Href: chapter.href(i), MediaType: mediaType})
+		if chapter.NotInSpine {
+			continue
+		}
+		fmt.Fprintf(&spine, `    <itemref idref="%s"`, html.EscapeString(chapter.id(i)))
+		if chapter.NonLinear {
+			spine.WriteString(` linear="no"`)
+		}
+		spine.WriteString("/>\n")
+	}
+	for _, it := range b.Items {
+		item(it)
+	}
+	if b.Direction != "" {
+		toc += ` page-progression-direction="` + html.EscapeString(b.Direction) + `"`
+	}
+
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="` + version + `" unique-identifier="bookid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+` + metadata.String() + `  </metadata>
+  <manifest>
+` + manifest.String() + `  </manifest>
+  <spine` + toc + `>
+` + spine.String() + `  </spine>
+</package>
+`
+}
+
+// nav returns the EPUB 3 navigation document of b, listing toc
+func (b *Book) nav(toc []TOCEntry) string {
+	var list strings.Builder
+	var write func(entries []TOCEntry, indent string)
+	write = func(entries []TOCEntry, indent string) {
+		list.WriteString(indent + "<ol>\n")
+		for _, entry := range entries {
+			fmt.Fprintf(&list, "%s  <li><a href=\"%s\">%s</a>", indent, html.EscapeString(entry.Href), html.EscapeString(entry.Title))
+			if len(entry.Children) > 0 {
+				list.WriteString("\n")
+				write(entry.Children, indent+"    ")
+				list.WriteString(indent + "  ")
+			}
+			list.WriteString("</li>\n")
+		}
+		list.WriteString(indent + "</ol>\n")
+	}
+	write(toc, "    ")
+	lang := html.EscapeString(b.language())
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="` + lang + `" lang="` + lang + `">
+<head>
+  <title>` + html.EscapeString(b.Title) + `</title>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+` + list.String() + `  </nav>
+</body>
+</html>
+`
+}
+
+// ncx returns the EPUB 2 NCX of b, listing toc
+func (b *Book) ncx(toc []TOCEntry) string {
+	var points strings.Builder
+	order := 0
+	var write func(entries []TOCEntry, indent string)
+	write = func(entries []TOCEntry, indent string) {
+		for _, entry := range entries {
+			order++
+			fmt.Fprintf(&points, "%s<navPoint id=\"nav%d\" playOrder=\"%d\"><navLabel><text>%s</text></navLabel><content src=\"%s\"/>",
+				indent, order, order, html.EscapeString(entry.Title), html.EscapeString(entry.Href))
+			if len(entry.Children) > 0 {
+				points.WriteString("\n")
+				write(entry.Children, indent+"  ")
+				points.WriteString(indent)
+			}
+			points.WriteString("</navPoint>\n")
+		}
+	}
+	write(toc, "    ")
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head>
+    <meta name="dtb:uid" content="` + html.EscapeString(b.identifier()) + `"/>
+  </head>
+  <docTitle><text>` + html.EscapeString(b.Title) + `</text></docTitle>
+  <navMap>
+` + points.String() + `  </navMap>
+</ncx>
+`
+}
@@ -0,0 +1,530 @@
+package epubconv
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// fb2Node is an element of a FictionBook document, or a text node if name
+// is empty. Attributes are keyed by their local name, so l:href is "href".
+type fb2Node struct {
+	name     string
+	attrs    map[string]string
+	children []*fb2Node
+	text     string
+}
+
+// child returns the first child element of n named name, or nil
+func (n *fb2Node) child(name string) *fb2Node {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// all returns the child elements of n named name
+func (n *fb2Node) all(name string) []*fb2Node {
+	if n == nil {
+		return nil
+	}
+	var nodes []*fb2Node
+	for _, c := range n.children {
+		if c.name == name {
+			nodes = append(nodes, c)
+		}
+	}
+	return nodes
+}
+
+// plainText returns the text of n and its descendants, with runs of
+// whitespace collapsed
+func (n *fb2Node) plainText() string {
+	if n == nil {
+		return ""
+	}
+	var sb strings.Builder
+	var walk func(n *fb2Node)
+	walk = func(n *fb2Node) {
+		if n.name == "" {
+			sb.WriteString(n.text)
+			return
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+		sb.WriteByte(' ')
+	}
+	walk(n)
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// parseFB2 parses a FictionBook document into a tree of its elements,
+// failing if an element exceeds limits. The tree is walked recursively, so
+// it is never deeper than the limits allow.
+func parseFB2(data []byte, limits parseLimits) (*fb2Node, error) {
+	d := newXMLDecoder(data)
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	root := &fb2Node{}
+	stack := []*fb2Node{root}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		parent := stack[len(stack)-1]
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if err := limits.check(tok.Name.Local, len(stack), len(tok.Attr)); err != nil {
+				return nil, err
+			}
+			n := &fb2Node{name: tok.Name.Local, attrs: make(map[string]string)}
+			for _, attr := range tok.Attr {
+				n.attrs[attr.Name.Local] = attr.Value
+			}
+			parent.children = append(parent.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			parent.children = append(parent.children, &fb2Node{text: string(tok)})
+		}
+	}
+	book := root.child("FictionBook")
+	if book == nil {
+		return nil, errors.New("no FictionBook element")
+	}
+	return book, nil
+}
+
+// fb2Converter renders the bodies of a FictionBook as XHTML content
+// documents
+type fb2Converter struct {
+	book *convertedBook
+	// docs holds the archive path of the content document each id is in
+	docs map[string]string
+	// refs holds the id given to the first noteref to each note, and
+	// placed those given to a noteref so far
+	refs   map[string]string
+	placed map[string]bool
+	// images holds the archive path of each binary by its id
+	images map[string]string
+	// doc is the content document being rendered
+	doc string
+	// sections counts sections given an id for the table of contents
+	sections int
+}
+
+// fb2NotesPath is the archive path of the content document holding a
+// FictionBook's notes
+const fb2NotesPath = "notes.xhtml"
+
+// readFB2 reads a FictionBook 2 ebook. Each top-level section of its main
+// body becomes a content document and its notes bodies one more, with the
+// notes marked as footnotes and the links to them as noterefs. The
+// decoded images count against MaxMemory.
+func readFB2(data []byte, opts Options) (*convertedBook, error) {
+	fb, err := parseFB2(data, opts.limits())
+	if err != nil {
+		return nil, err
+	}
+	c := &fb2Converter{
+		book:   &convertedBook{metadata: fb2Metadata(fb.child("description"))},
+		docs:   make(map[string]string),
+		refs:   make(map[string]string),
+		placed: make(map[string]bool),
+		images: make(map[string]string),
+	}
+	budget := memoryBudget{limit: int64(opts.MaxMemory)}
+	for _, binary := range fb.all("binary") {
+		id := binary.attrs["id"]
+		if id == "" {
+			continue
+		}
+		encoded := strings.Join(strings.Fields(binary.plainText()), "")
+		if err := budget.reserve(int64(base64.StdEncoding.DecodedLen(len(encoded)))); err != nil {
+			return nil, err
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		name := "images/" + sanitizeArchiveName(id)
+		c.images[id] = name
+		mediaType := binary.attrs["content-type"]
+		if !strings.HasPrefix(mediaType, "image/") {
+			mediaType = "image/jpeg"
+		}
+		c.book.files = append(c.book.files, convertedFile{path: name, mediaType: mediaType, data: data})
+	}
+
+	var main *fb2Node
+	var notes []*fb2Node
+	for _, body := range fb.all("body") {
+		if main == nil && body.attrs["name"] == "" {
+			main = body
+		} else {
+			notes = append(notes, body)
+		}
+	}
+	if main == nil {
+		if len(notes) == 0 {
+			return nil, errors.New("no body element")
+		}
+		main, notes = notes[0], notes[1:]
+	}
+
+	// Work out which document each id will be in, so links to them can
+	// find them, before rendering any
+	var docs [][]*fb2Node
+	var intro []*fb2Node
+	for _, child := range main.children {
+		if child.name == "section" {
+			docs = append(docs, []*fb2Node{child})
+		} else if child.name != "" {
+			intro = append(intro, child)
+		}
+	}
+	if len(intro) > 0 || len(docs) == 0 {
+		docs = append([][]*fb2Node{intro}, docs...)
+	}
+	for i, nodes := range docs {
+		c.doc = fmt.Sprintf("part%04d.xhtml", i+1)
+		for _, n := range nodes {
+			c.index(n, false)
+		}
+	}
+	c.doc = fb2NotesPath
+	for _, body := range notes {
+		c.index(body, true)
+	}
+
+	title := firstTitle(c.book.metadata)
+	for i, nodes := range docs {
+		c.doc = fmt.Sprintf("part%04d.xhtml", i+1)
+		var body strings.Builder
+		for _, n := range nodes {
+			c.render(&body, n, 1, false)
+		}
+		docTitle := title
+		if len(nodes) == 1 && nodes[0].name == "section" {
+			if sectionTitle := nodes[0].child("title").plainText(); sectionTitle != "" {
+				docTitle = sectionTitle
+			}
+			c.book.toc = append(c.book.toc, c.tocEntries(nodes, true)...)
+		}
+		c.book.addDocument(c.doc, docTitle, body.String())
+	}
+	if len(notes) > 0 {
+		c.doc = fb2NotesPath
+		var body strings.Builder
+		for _, n := range notes {
+			for _, child := range n.children {
+				c.render(&body, child, 1, true)
+			}
+		}
+		c.book.addDocument(c.doc, title, body.String())
+	}
+	return c.book, nil
+}
+
+// index records the document the ids in n are in. In a notes body, links
+// don't count as noterefs.
+func (c *fb2Converter) index(n *fb2Node, inNotes bool) {
+	if id := n.attrs["id"]; id != "" {
+		if _, ok := c.docs[id]; !ok {
+			c.docs[id] = c.doc
+		}
+	}
+	if n.name == "a" && !inNotes && n.attrs["type"] == "note" {
+		if id, ok := strings.CutPrefix(n.attrs["href"], "#"); ok {
+			if _, ok := c.refs[id]; !ok {
+				c.refs[id] = "ref-" + id
+				c.docs[c.refs[id]] = c.doc
+			}
+		}
+	}
+	for _, child := range n.children {
+		c.index(child, inNotes)
+	}
+}
+
+// fb2Elements maps FictionBook elements to the XHTML elements and classes
+// they are rendered as, for those with a direct equivalent
+var fb2Elements = map[string][2]string{
+	"p":             {"p", ""},
+	"v":             {"p", ""},
+	"text-author":   {"p", "text-author"},
+	"date":          {"p", "date"},
+	"poem":          {"div", "poem"},
+	"stanza":        {"div", "stanza"},
+	"epigraph":      {"blockquote", "epigraph"},
+	"cite":          {"blockquote", ""},
+	"annotation":    {"div", "annotation"},
+	"emphasis":      {"em", ""},
+	"strong":        {"strong", ""},
+	"strikethrough": {"del", ""},
+	"sub":           {"sub", ""},
+	"sup":           {"sup", ""},
+	"code":          {"code", ""},
+	"style":         {"span", ""},
+	"table":         {"table", ""},
+	"tr":            {"tr", ""},
+	"td":            {"td", ""},
+	"th":            {"th", ""},
+}
+
+// render writes n as XHTML to w. Depth is the nesting of the sections n is
+// in, for the levels of their headings.
+func (c *fb2Converter) render(w *strings.Builder, n *fb2Node, depth int, inNotes bool) {
+	if n.name == "" {
+		w.WriteString(html.EscapeString(n.text))
+		return
+	}
+	id := ""
+	if n.attrs["id"] != "" {
+		id = ` id="` + html.EscapeString(n.attrs["id"]) + `"`
+	}
+	children := func(depth int) {
+		for _, child := range n.children {
+			c.render(w, child, depth, inNotes)
+		}
+	}
+
+	switch n.name {
+	case "section":
+		if inNotes && n.attrs["id"] != "" {
+			fmt.Fprintf(w, `<aside epub:type="footnote"%s>`, id)
+			c.renderNoteTitle(w, n)
+			for _, child := range n.children {
+				if child.name != "title" {
+					c.render(w, child, depth+1, inNotes)
+				}
+			}
+			w.WriteString("</aside>\n")
+			return
+		}
+		if id == "" && n.child("title") != nil && depth > 1 {
+			c.sections++
+			n.attrs["id"] = fmt.Sprintf("section-%d", c.sections)
+			id = ` id="` + n.attrs["id"] + `"`
+		}
+		fmt.Fprintf(w, "<div%s>\n", id)
+		for _, child := range n.children {
+			c.render(w, child, depth+1, inNotes)
+		}
+		w.WriteString("</div>\n")
+	case "title":
+		level := min(max(depth-1, 1), 6)
+		fmt.Fprintf(w, "<h%d%s>", level, id)
+		c.renderLines(w, n, inNotes)
+		fmt.Fprintf(w, "</h%d>\n", level)
+	case "subtitle":
+		level := min(depth, 6)
+		fmt.Fprintf(w, "<h%d%s>", level, id)
+		children(depth)
+		fmt.Fprintf(w, "</h%d>\n", level)
+	case "empty-line":
+		w.WriteString("<br/>\n")
+	case "a":
+		href := n.attrs["href"]
+		attrs := ""
+		if target, ok := strings.CutPrefix(href, "#"); ok {
+			href = c.docs[target] + href
+			if !inNotes && n.attrs["type"] == "note" {
+				attrs = ` epub:type="noteref"`
+				if ref := c.refs[target]; ref != "" && c.docs[ref] == c.doc && !c.placed[ref] {
+					c.placed[ref] = true
+					attrs += ` id="` + ref + `"`
+				}
+			}
+		}
+		fmt.Fprintf(w, `<a href="%s"%s%s>`, html.EscapeString(href), id, attrs)
+		children(depth)
+		w.WriteString("</a>")
+	case "image":
+		target, _ := strings.CutPrefix(n.attrs["href"], "#")
+		src, ok := c.images[target]
+		if !ok {
+			return
+		}
+		fmt.Fprintf(w, `<img src="%s" alt="%s"%s/>`, html.EscapeString(src), html.EscapeString(n.attrs["alt"]), id)
+	default:
+		element, ok := fb2Elements[n.name]
+		if !ok {
+			// Unknown elements keep their text
+			children(depth)
+			return
+		}
+		class := ""
+		if element[1] != "" {
+			class = ` class="` + element[1] + `"`
+		}
+		fmt.Fprintf(w, "<%s%s%s>", element[0], id, class)
+		children(depth)
+		fmt.Fprintf(w, "</%s>", element[0])
+		if blockElements[element[0]] {
+			w.WriteByte('\n')
+		}
+	}
+}
+
+// renderLines writes the paragraphs of a title as lines of one heading
+func (c *fb2Converter) renderLines(w *strings.Builder, title *fb2Node, inNotes bool) {
+	first := true
+	for _, child := range title.children {
+		switch child.name {
+		case "":
+		case "p":
+			if !first {
+				w.WriteString("<br/>")
+			}
+			first = false
+			for _, grandchild := range child.children {
+				c.render(w, grandchild, 1, inNotes)
+			}
+		default:
+			c.render(w, child, 1, inNotes)
+		}
+	}
+}
+
+// renderNoteTitle writes the title of a note, usually its number, as a
+// backlink to its noteref, which is left out when notes are moved
+func (c *fb2Converter) renderNoteTitle(w *strings.Builder, note *fb2Node) {
+	title := note.child("title").plainText()
+	if title == "" {
+		return
+	}
+	ref := c.refs[note.attrs["id"]]
+	if ref == "" {
+		fmt.Fprintf(w, "<p>%s</p>\n", html.EscapeString(title))
+		return
+	}
+	fmt.Fprintf(w, `<p><a href="%s#%s" epub:type="backlink">%s</a></p>`+"\n", c.docs[ref], ref, html.EscapeString(title))
+}
+
+// tocEntries returns table of contents entries for the titled sections
+// among nodes and their subsections. Top-level sections start their
+// documents, so only subsections are linked to by id.
+func (c *fb2Converter) tocEntries(nodes []*fb2Node, top bool) []TOCEntry {
+	var entries []TOCEntry
+	for _, n := range nodes {
+		if n.name != "section" {
+			continue
+		}
+		children := c.tocEntries(n.all("section"), false)
+		title := n.child("title").plainText()
+		if title == "" {
+			entries = append(entries, children...)
+			continue
+		}
+		href := c.doc
+		if id := n.attrs["id"]; id != "" && !top {
+			href += "#" + id
+		}
+		entries = append(entries, TOCEntry{Title: title, Href: href, Children: children})
+	}
+	return entries
+}
+
+// fb2Metadata returns the metadata in the description element of a
+// FictionBook
+func fb2Metadata(description *fb2Node) Metadata {
+	var m Metadata
+	info := description.child("title-info")
+	if title := info.child("book-title").plainText(); title != "" {
+		m.Titles = []string{title}
+	}
+	for _, author := range info.all("author") {
+		if name := fb2Name(author); name != "" {
+			m.Creators = append(m.Creators, Creator{Name: name, Role: "aut"})
+		}
+	}
+	for _, translator := range info.all("translator") {
+		if name := fb2Name(translator); name != "" {
+			m.Contributors = append(m.Contributors, Creator{Name: name, Role: "trl"})
+		}
+	}
+	if lang := info.child("lang").plainText(); lang != "" {
+		m.Languages = []string{lang}
+	}
+	for _, genre := range info.all("genre") {
+		if g := genre.plainText(); g != "" {
+			m.Subjects = append(m.Subjects, g)
+		}
+	}
+	if annotation := info.child("annotation").plainText(); annotation != "" {
+		m.Descriptions = []string{annotation}
+	}
+	if date := info.child("date"); date != nil {
+		value := date.attrs["value"]
+		if value == "" {
+			value = date.plainText()
+		}
+		if value != "" {
+			m.Dates = append(m.Dates, Date{Value: value, Event: "creation"})
+		}
+	}
+	if sequence := info.child("sequence"); sequence != nil && strings.TrimSpace(sequence.attrs["name"]) != "" {
+		m.Metas = append(m.Metas, Meta{Name: "calibre:series", Content: sequence.attrs["name"]})
+		if number := sequence.attrs["number"]; number != "" {
+			m.Metas = append(m.Metas, Meta{Name: "calibre:series_index", Content: number})
+		}
+	}
+
+	publish := description.child("publish-info")
+	if publisher := publish.child("publisher").plainText(); publisher != "" {
+		m.Publishers = []string{publisher}
+	}
+	if year := publish.child("year").plainText(); year != "" {
+		m.Dates = append(m.Dates, Date{Value: year, Event: "publication"})
+	}
+	if isbn := publish.child("isbn").plainText(); isbn != "" {
+		m.Identifiers = append(m.Identifiers, Identifier{Value: isbn, Scheme: "ISBN"})
+	}
+	if id := description.child("document-info").child("id").plainText(); id != "" {
+		m.Identifiers = append(m.Identifiers, Identifier{Value: id})
+	}
+	return m
+}
+
+// fb2Name returns the name of an author or translator element
+func fb2Name(person *fb2Node) string {
+	var parts []string
+	for _, part := range []string{"first-name", "middle-name", "last-name"} {
+		if s := person.child(part).plainText(); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return person.child("nickname").plainText()
+	}
+	return strings.Join(parts, " ")
+}
+
+// sanitizeArchiveName makes the id of a FictionBook binary safe to use as
+// an archive file name
+func sanitizeArchiveName(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '#' || r == '?' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, id)
+}
@@ -0,0 +1,109 @@
+package epubconv
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fb2Book returns a FictionBook document whose body holds body
+func fb2Book(body string) []byte {
+	return []byte(`<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+<description><title-info><book-title>Test</book-title></title-info></description>
+<body>` + body + `</body>
+</FictionBook>`)
+}
+
+// nested returns text inside n nested elements named name
+func nested(name string, n int, text string) string {
+	return strings.Repeat("<"+name+">", n) + text + strings.Repeat("</"+name+">", n)
+}
+
+func TestParseFB2Limits(t *testing.T) {
+	// FictionBook and body take two levels, so the section is at three
+	tests := []struct {
+		name    string
+		body    string
+		limits  parseLimits
+		wantErr bool
+	}{
+		{
+			name:   "unlimited",
+			body:   nested("section", 1000, "<p>deep</p>"),
+			limits: parseLimits{},
+		},
+		{
+			name:   "at the depth limit",
+			body:   nested("section", 2, "<p>deep</p>"),
+			limits: parseLimits{maxDepth: 5},
+		},
+		{
+			name:    "past the depth limit",
+			body:    nested("section", 3, "<p>deep</p>"),
+			limits:  parseLimits{maxDepth: 5},
+			wantErr: true,
+		},
+		{
+			name:    "far past the depth limit",
+			body:    nested("section", 100000, ""),
+			limits:  parseLimits{maxDepth: 256},
+			wantErr: true,
+		},
+		{
+			name:   "at the attribute limit",
+			body:   `<p a="1" b="2">attrs</p>`,
+			limits: parseLimits{maxAttrs: 2},
+		},
+		{
+			name:    "past the attribute limit",
+			body:    `<p a="1" b="2" c="3">attrs</p>`,
+			limits:  parseLimits{maxAttrs: 2},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseFB2(fb2Book(test.body), test.limits)
+			if test.wantErr {
+				if !errors.Is(err, ErrParseLimit) {
+					t.Fatalf("err = %v, want ErrParseLimit", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestReadFB2Binaries(t *testing.T) {
+	image := base64.StdEncoding.EncodeToString(make([]byte, 3000))
+	data := []byte(strings.Replace(string(fb2Book("<p>text</p>")), "</FictionBook>",
+		`<binary id="cover.jpg" content-type="image/jpeg">`+image+`</binary></FictionBook>`, 1))
+	tests := []struct {
+		name      string
+		maxMemory ByteSize
+		wantErr   bool
+	}{
+		{name: "unlimited"},
+		{name: "within MaxMemory", maxMemory: 4000},
+		{name: "over MaxMemory", maxMemory: 2000, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := readFB2(data, Options{MaxMemory: test.maxMemory})
+			if test.wantErr {
+				if !errors.Is(err, ErrMemoryLimit) {
+					t.Fatalf("err = %v, want ErrMemoryLimit", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if len(c.files) == 0 || c.files[0].path != "images/cover.jpg" || len(c.files[0].data) != 3000 {
+				t.Errorf("image not decoded: %v", c.files)
+			}
+		})
+	}
+}
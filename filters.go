@@ -0,0 +1,115 @@
+package epubconv
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/net/html"
+)
+
+// Filter rewrites the chapters of a book as it is converted, for clean-ups
+// the options don't cover, such as removing a publisher's boilerplate or
+// adding chapter markers. Either function can be nil.
+type Filter struct {
+	// HTML is called with the element tree of each content document before
+	// its text is extracted, and can change it in place. The tree is what
+	// the FormatPandoc output is built from too.
+	HTML func(doc *html.Node, chapter FilterChapter) error
+	// Text is called with the text of each chapter that has any, after the
+	// layout options are applied, and returns the text to use instead
+	Text func(text string, chapter FilterChapter) (string, error)
+}
+
+// FilterChapter describes the chapter a Filter is called for
+type FilterChapter struct {
+	// Book is the Name option, identifying the book
+	Book string
+	// Path is the archive path of the content document
+	Path string
+	// Title is the title the table of contents gives the chapter or, for
+	// Text, failing that its first heading. It is "" if it has neither.
+	Title string
+}
+
+// filterHTML passes content, the content document of chapter, through the
+// HTML functions of filters, returning it unchanged if none has one
+func filterHTML(filters []Filter, content string, chapter FilterChapter) (string, error) {
+	var doc *html.Node
+	for _, filter := range filters {
+		if filter.HTML == nil {
+			continue
+		}
+		if doc == nil {
+			var err error
+			if doc, err = parseTree(content); err != nil {
+				return "", err
+			}
+		}
+		if err := filter.HTML(doc, chapter); err != nil {
+			return "", err
+		}
+	}
+	if doc == nil {
+		return content, nil
+	}
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return "", fmt.Errorf("failed to render filtered document: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// filterText passes text, the text of chapter, through the Text functions
+// of filters
+func filterText(filters []Filter, text string, chapter FilterChapter) (string, error) {
+	for _, filter := range filters {
+		if filter.Text == nil {
+			continue
+		}
+		var err error
+		if text, err = filter.Text(text, chapter); err != nil {
+			return "", err
+		}
+	}
+	return text, nil
+}
+
+// parseTree builds the element tree of an HTML or XHTML document from the
+// tokens walkHTML reads, so that it has the elements the text is extracted
+// from: XHTML prefixes are dropped, self-closing elements are empty and
+// unclosed elements end where the extractor ends them
+func parseTree(content string) (*html.Node, error) {
+	doc := &html.Node{Type: html.DocumentNode}
+	open := []*html.Node{doc}
+	err := walkHTML(content, func(tok html.Token) error {
+		top := open[len(open)-1]
+		switch tok.Type {
+		case html.TextToken:
+			top.AppendChild(&html.Node{Type: html.TextNode, Data: tok.Data})
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if len(open) > 1 && top.Data == tok.Data && impliedEndTags[tok.Data] {
+				// An unclosed <p> or <li> ends at its next sibling
+				open = open[:len(open)-1]
+				top = open[len(open)-1]
+			}
+			n := &html.Node{Type: html.ElementNode, Data: tok.Data, Attr: tok.Attr}
+			top.AppendChild(n)
+			if tok.Type == html.StartTagToken && !voidElements[tok.Data] {
+				open = append(open, n)
+			}
+		case html.EndTagToken:
+			for i := len(open) - 1; i > 0; i-- {
+				if open[i].Data == tok.Data {
+					// Closing an element also closes any left open inside it
+					open = open[:i]
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,170 @@
+package epubconv
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Font obfuscation algorithms of META-INF/encryption.xml
+const (
+	ObfuscationIDPF  = "http://www.idpf.org/2008/embedding"
+	ObfuscationAdobe = "http://ns.adobe.com/pdf/enc#RC"
+)
+
+// fontExtensions are the extensions of font files, for manifests that give
+// them a generic media type
+var fontExtensions = map[string]bool{".otf": true, ".ttf": true, ".woff": true, ".woff2": true}
+
+// Font is a font embedded in the book. Obfuscation is the algorithm
+// obfuscating it, ObfuscationIDPF or ObfuscationAdobe, or "" if it isn't
+// obfuscated.
+type Font struct {
+	// Path is the archive path of the font
+	Path        string
+	MediaType   string
+	Obfuscation string
+}
+
+// Fonts returns the fonts in the manifest, in manifest order. Items listing
+// the same file twice give one Font.
+func (b *Book) Fonts() []Font {
+	contentDir := path.Dir(b.PackagePath)
+	obfuscated := b.obfuscatedFonts()
+	seen := make(map[string]bool)
+	var fonts []Font
+	for _, item := range b.Manifest.Items {
+		mediaType := strings.ToLower(strings.TrimSpace(item.MediaType))
+		if item.Href == "" || !isFont(mediaType, item.Href) {
+			continue
+		}
+		href := item.Href
+		if unescaped, err := url.PathUnescape(href); err == nil {
+			href = unescaped
+		}
+		fontPath := resolveHref(contentDir, href)
+		if seen[fontPath] {
+			continue
+		}
+		seen[fontPath] = true
+		fonts = append(fonts, Font{Path: fontPath, MediaType: mediaType, Obfuscation: obfuscated[fontPath]})
+	}
+	return fonts
+}
+
+// isFont reports whether a manifest item with mediaType and href is a font
+func isFont(mediaType, href string) bool {
+	switch {
+	case strings.HasPrefix(mediaType, "font/"), strings.Contains(mediaType, "font-"),
+		strings.Contains(mediaType, "opentype"), strings.Contains(mediaType, "truetype"), strings.Contains(mediaType, "woff"):
+		return true
+	}
+	return fontExtensions[strings.ToLower(path.Ext(href))]
+}
+
+// OpenFont opens the font at the archive path name, such as the Path of one
+// of Fonts, for reading, undoing its obfuscation. It fails with a DRMError
+// if the book is DRM-protected.
+func (b *Book) OpenFont(name string) (io.ReadCloser, error) {
+	rc, err := b.openResource(name)
+	if err != nil {
+		return nil, err
+	}
+	algorithm := b.obfuscatedFonts()[name]
+	if algorithm == "" {
+		return rc, nil
+	}
+	key, length, err := b.obfuscationKey(algorithm)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("failed to deobfuscate %s: %w", name, err)
+	}
+	return &deobfuscatedFile{ReadCloser: rc, key: key, length: length}, nil
+}
+
+// obfuscatedFonts maps the archive paths of the files encryption.xml
+// obfuscates to the algorithm obfuscating each
+func (b *Book) obfuscatedFonts() map[string]string {
+	obfuscated := make(map[string]string)
+	if b.findFile("META-INF/encryption.xml") == nil {
+		return obfuscated
+	}
+	var enc Encryption
+	if err := b.parseXML("META-INF/encryption.xml", &enc); err != nil {
+		return obfuscated
+	}
+	for _, data := range enc.EncryptedData {
+		algorithm := data.EncryptionMethod.Algorithm
+		if !fontObfuscationAlgorithms[algorithm] {
+			continue
+		}
+		uri := strings.TrimSpace(data.CipherData.CipherReference.URI)
+		if unescaped, err := url.PathUnescape(uri); err == nil {
+			uri = unescaped
+		}
+		// The URI is relative to the root of the container
+		obfuscated[resolveHref("", uri)] = algorithm
+	}
+	return obfuscated
+}
+
+// obfuscationKey returns the key a font obfuscated with algorithm is XORed
+// with, and how many bytes at its start are: the SHA-1 of the unique
+// identifier, without white space, for the IDPF algorithm, and the bytes of
+// the book's UUID for Adobe's
+func (b *Book) obfuscationKey(algorithm string) ([]byte, int, error) {
+	identifier := b.Info().Identifier
+	if algorithm == ObfuscationIDPF {
+		if identifier == "" {
+			return nil, 0, errors.New("book has no unique identifier")
+		}
+		identifier = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, identifier)
+		sum := sha1.Sum([]byte(identifier))
+		return sum[:], 1040, nil
+	}
+
+	// Adobe uses the unique identifier if it's a UUID, or failing that
+	// another identifier that is
+	candidates := []string{identifier}
+	for _, id := range b.Metadata.Identifiers {
+		candidates = append(candidates, id.Value)
+	}
+	for _, candidate := range candidates {
+		candidate = strings.TrimSpace(candidate)
+		if len(candidate) > 9 && strings.EqualFold(candidate[:9], "urn:uuid:") {
+			candidate = candidate[9:]
+		}
+		if key, err := hex.DecodeString(strings.ReplaceAll(candidate, "-", "")); err == nil && len(key) == 16 {
+			return key, 1024, nil
+		}
+	}
+	return nil, 0, errors.New("book has no UUID identifier")
+}
+
+// deobfuscatedFile reads an obfuscated font, XORing its first length bytes
+// with key
+type deobfuscatedFile struct {
+	io.ReadCloser
+	key    []byte
+	length int
+	offset int
+}
+
+func (f *deobfuscatedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	for i := 0; i < n && f.offset < f.length; i++ {
+		p[i] ^= f.key[f.offset%len(f.key)]
+		f.offset++
+	}
+	return n, err
+}
@@ -0,0 +1,237 @@
+package epubconv
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Input formats Open recognizes, by the start of the file rather than its
+// name
+const (
+	inputEPUB = "epub"
+	inputMOBI = "mobi"
+	inputFB2  = "fb2"
+)
+
+// sniffLen is how much of the start of a file detectInput looks at
+const sniffLen = 1024
+
+// detectInput returns the format of the book in r from its magic bytes.
+// Anything that isn't recognised as MOBI or FictionBook is read as an EPUB,
+// or a FictionBook in a ZIP archive.
+func detectInput(r io.ReaderAt, size int64) string {
+	head := make([]byte, min(size, sniffLen))
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+	// A Palm database names its type and creator at offset 60
+	if len(head) >= 68 && (string(head[60:68]) == "BOOKMOBI" || string(head[60:68]) == "TEXtREAd") {
+		return inputMOBI
+	}
+	if bytes.HasPrefix(head, []byte("PK")) {
+		return inputEPUB
+	}
+	if bytes.Contains(head, []byte("<FictionBook")) {
+		return inputFB2
+	}
+	return inputEPUB
+}
+
+// openAny opens the book in r, which is size bytes long, in whichever
+// format it is in. Closer, if not nil, is closed along with the book.
+func openAny(r io.ReaderAt, size int64, closer io.Closer, opts Options) (*Book, error) {
+	switch detectInput(r, size) {
+	case inputMOBI:
+		data, err := readAll(r, size, opts)
+		if err != nil {
+			return nil, err
+		}
+		c, err := readMOBI(data, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MOBI file: %w", err)
+		}
+		return c.open(closer, opts)
+	case inputFB2:
+		data, err := readAll(r, size, opts)
+		if err != nil {
+			return nil, err
+		}
+		c, err := readFB2(data, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read FictionBook file: %w", err)
+		}
+		return c.open(closer, opts)
+	}
+
+	reader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open EPUB file: %w", err)
+	}
+	if fb2 := zippedFB2(reader); fb2 != nil {
+		data, err := readZipFile(fb2, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read FictionBook file: %w", err)
+		}
+		c, err := readFB2(data, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read FictionBook file: %w", err)
+		}
+		return c.open(closer, opts)
+	}
+	return open(reader, closer, opts)
+}
+
+// readAll reads the whole of r, which is size bytes long, failing with
+// ErrMemoryLimit if that is more than MaxMemory
+func readAll(r io.ReaderAt, size int64, opts Options) ([]byte, error) {
+	if opts.MaxMemory > 0 && size > int64(opts.MaxMemory) {
+		return nil, fmt.Errorf("%w: the book is %d bytes", ErrMemoryLimit, size)
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read book: %w", err)
+	}
+	return data, nil
+}
+
+// zippedFB2 returns the FictionBook in an archive that isn't an EPUB, as
+// FictionBooks are often distributed zipped, or nil
+func zippedFB2(reader *zip.Reader) *zip.File {
+	var fb2 *zip.File
+	for _, file := range reader.File {
+		switch {
+		case file.Name == "META-INF/container.xml":
+			return nil
+		case strings.EqualFold(path.Ext(file.Name), ".fb2") && fb2 == nil:
+			fb2 = file
+		}
+	}
+	return fb2
+}
+
+// readZipFile returns the decompressed contents of file, failing with
+// ErrMemoryLimit if it is larger than MaxMemory
+func readZipFile(file *zip.File, opts Options) ([]byte, error) {
+	if opts.MaxMemory > 0 && file.UncompressedSize64 > uint64(opts.MaxMemory) {
+		return nil, fmt.Errorf("%w: %s is %d bytes uncompressed", ErrMemoryLimit, file.Name, file.UncompressedSize64)
+	}
+	rc, err := newArchiveBudget(opts).open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if opts.MaxMemory > 0 {
+		r = io.LimitReader(rc, int64(opts.MaxMemory)+1)
+	}
+	data, err := io.ReadAll(r)
+	if err == nil && opts.MaxMemory > 0 && int64(len(data)) > int64(opts.MaxMemory) {
+		err = fmt.Errorf("%w: %s is larger than %d bytes uncompressed", ErrMemoryLimit, file.Name, int64(opts.MaxMemory))
+	}
+	return data, err
+}
+
+// convertedBook is a book read from another format, as the content
+// documents, images and table of contents of an EPUB
+type convertedBook struct {
+	metadata Metadata
+	// files are the content documents, in reading order, and images
+	files []convertedFile
+	// toc is the table of contents, if the format has one
+	toc []TOCEntry
+	// drm names the DRM scheme the text is encrypted with, if it is
+	drm string
+}
+
+// convertedFile is a file of a convertedBook. Only content documents are
+// in the spine.
+type convertedFile struct {
+	path      string
+	mediaType string
+	data      []byte
+}
+
+// addDocument adds an XHTML content document to the reading order, with
+// body as the content of its body element
+func (c *convertedBook) addDocument(name, title, body string) {
+	doc := `<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+		`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">` +
+		"<head><title>" + html.EscapeString(title) + "</title></head>\n<body>" + body + "</body></html>\n"
+	c.files = append(c.files, convertedFile{path: name, mediaType: "application/xhtml+xml", data: []byte(doc)})
+}
+
+// convertedNavPath is the archive path of a convertedBook's navigation
+// document
+const convertedNavPath = "nav.xhtml"
+
+// open opens the book as an EPUB holding its files
+func (c *convertedBook) open(closer io.Closer, opts Options) (*Book, error) {
+	if opts.Name == "" {
+		opts.Name = "book.epub"
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	b := &Book{closer: closer, opts: opts, drm: c.drm, budget: newArchiveBudget(opts)}
+	b.Metadata = c.metadata
+	files := c.files
+	if len(c.toc) > 0 {
+		files = append(files, convertedFile{path: convertedNavPath, mediaType: "application/xhtml+xml", data: navDocument(c.toc)})
+	}
+	for i, file := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file.path, Method: zip.Store})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(file.data); err != nil {
+			return nil, err
+		}
+		item := ManifestItem{ID: fmt.Sprintf("item%d", i+1), Href: file.path, MediaType: file.mediaType}
+		if file.path == convertedNavPath {
+			item.Properties = "nav"
+		} else if file.mediaType == "application/xhtml+xml" {
+			b.Spine.Itemrefs = append(b.Spine.Itemrefs, Itemref{IDRef: item.ID})
+		}
+		b.Manifest.Items = append(b.Manifest.Items, item)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		return nil, err
+	}
+	b.reader = reader
+	b.PackagePath = "content.opf"
+	if err := checkEntries(b, opts.MaxEntries); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// navDocument returns an EPUB 3 navigation document listing entries
+func navDocument(entries []TOCEntry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+		`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">` +
+		"<head><title>Contents</title></head>\n<body><nav epub:type=\"toc\">")
+	var list func(entries []TOCEntry)
+	list = func(entries []TOCEntry) {
+		buf.WriteString("<ol>")
+		for _, entry := range entries {
+			fmt.Fprintf(&buf, `<li><a href="%s">%s</a>`, html.EscapeString(entry.Href), html.EscapeString(entry.Title))
+			if len(entry.Children) > 0 {
+				list(entry.Children)
+			}
+			buf.WriteString("</li>")
+		}
+		buf.WriteString("</ol>")
+	}
+	list(entries)
+	buf.WriteString("</nav></body></html>\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,9 @@
+module github.com/fletcharoo/epubconv
+
+go 1.21
+
+require (
+	golang.org/x/net v0.33.0
+	golang.org/x/text v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,254 @@
+package epubconv_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fletcharoo/epubconv"
+	"github.com/fletcharoo/epubconv/epubtest"
+)
+
+// update rewrites the golden files with the output of the conversions
+// instead of comparing it: go test -run TestGolden -update
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// goldenCase is a book and the options it is converted with
+type goldenCase struct {
+	name string
+	book epubtest.Book
+	opts epubconv.Options
+}
+
+// goldenCases are the conversions checked, named after their golden files
+// in testdata/golden
+var goldenCases = []goldenCase{
+	{
+		name: "epub2",
+		book: epubtest.Book{
+			Version: 2,
+			Title:   "An EPUB 2 Book",
+			Authors: []string{"A. Author"},
+			Chapters: []epubtest.Chapter{
+				{Title: "One", Body: "<h1>Chapter One</h1>\n<p>It was a bright cold day in April.</p>\n<p>The clocks were striking.</p>"},
+				{Title: "Two", Body: "<h1>Chapter Two</h1>\n<p>Second <em>chapter</em> text, with a <a href=\"chapter1.xhtml\">link</a>.</p>"},
+			},
+		},
+	},
+	{
+		name: "nested-toc",
+		book: epubtest.Book{
+			Title: "Nested Contents",
+			Chapters: []epubtest.Chapter{
+				{Title: "Part One", Body: "<h1>Part One</h1>\n<h2 id=\"s1\">Section 1</h2>\n<p>First section.</p>\n<h2 id=\"s2\">Section 2</h2>\n<p>Second section.</p>"},
+				{Title: "Part Two", Body: "<h1>Part Two</h1>\n<p>Last part.</p>"},
+			},
+			TOC: []epubtest.TOCEntry{
+				{Title: "Part One", Href: "chapter1.xhtml", Children: []epubtest.TOCEntry{
+					{Title: "Section 1", Href: "chapter1.xhtml#s1"},
+					{Title: "Section 2", Href: "chapter1.xhtml#s2"},
+				}},
+				{Title: "Part Two", Href: "chapter2.xhtml"},
+			},
+		},
+	},
+	{
+		name: "entities",
+		book: epubtest.Book{
+			Title: "Entities",
+			Chapters: []epubtest.Chapter{
+				{
+					Title:    "Entities",
+					Body:     "<p>Caf&eacute; &amp; cr&egrave;me &mdash; &ldquo;quoted&rdquo;&nbsp;text &#233;&#x263A;.</p>\n<p>&publisher; published &title;.</p>",
+					Entities: map[string]string{"publisher": "Example Press", "title": "this book"},
+				},
+			},
+		},
+	},
+	{
+		name: "windows-1252",
+		book: epubtest.Book{
+			Title: "Legacy Encoding",
+			Chapters: []epubtest.Chapter{
+				{Title: "Cp1252", Encoding: "windows-1252", Body: "<p>“Smart quotes” – and a café, naïve façade, 50€.</p>"},
+			},
+		},
+	},
+	{
+		name: "shift-jis",
+		book: epubtest.Book{
+			Title:    "日本語",
+			Language: "ja",
+			Chapters: []epubtest.Chapter{
+				{Title: "第一章", Encoding: "shift_jis", Body: "<h1>第一章</h1>\n<p>吾輩は猫である。名前はまだ無い。</p>"},
+			},
+		},
+	},
+	{
+		name: "ruby",
+		book: epubtest.Book{
+			Title:    "ルビ",
+			Language: "ja",
+			Chapters: []epubtest.Chapter{
+				{Title: "ルビ", Body: "<p><ruby>漢<rp>(</rp><rt>かん</rt><rp>)</rp>字<rp>(</rp><rt>じ</rt><rp>)</rp></ruby>を読む︒</p>"},
+			},
+		},
+		opts: epubconv.Options{Ruby: epubconv.RubyParenthesize},
+	},
+	{
+		name: "non-linear",
+		book: epubtest.Book{
+			Title: "Non-linear",
+			Chapters: []epubtest.Chapter{
+				{Title: "Main", Body: "<p>The main text.</p>"},
+				{Title: "Answers", Body: "<p>Answers to the exercises.</p>", NonLinear: true},
+				{Title: "End", Body: "<p>The end.</p>"},
+			},
+		},
+	},
+	{
+		name: "missing-chapter",
+		book: epubtest.Book{
+			Title: "Missing Chapter",
+			Chapters: []epubtest.Chapter{
+				{Title: "Present", Body: "<p>This chapter is here.</p>"},
+				{Title: "Absent", Body: "<p>This one is not.</p>", Missing: true},
+			},
+		},
+	},
+	{
+		name: "broken-manifest",
+		book: epubtest.Book{
+			Title: "Broken Manifest",
+			Chapters: []epubtest.Chapter{
+				{Title: "First", Body: "<p>First chapter.</p>"},
+				{Title: "Second", Body: "<p>Second chapter.</p>"},
+			},
+			Items: []epubtest.Item{
+				{ID: "chapter1", Href: "chapter2.xhtml", MediaType: "application/xhtml+xml"},
+				{ID: "nohref", MediaType: "application/xhtml+xml"},
+				{Href: "noid.xhtml", MediaType: "application/xhtml+xml"},
+			},
+		},
+		opts: epubconv.Options{Lenient: true},
+	},
+	{
+		name: "no-container",
+		book: epubtest.Book{
+			Title:       "No Container",
+			NoContainer: true,
+			Chapters: []epubtest.Chapter{
+				{Title: "Only", Body: "<p>Found without container.xml.</p>"},
+			},
+		},
+		opts: epubconv.Options{Lenient: true},
+	},
+	{
+		name: "rtl",
+		book: epubtest.Book{
+			Title:     "كتاب",
+			Language:  "ar",
+			Direction: "rtl",
+			Chapters: []epubtest.Chapter{
+				{Title: "الفصل", Body: "<p>مرحبا بالعالم.</p>"},
+			},
+		},
+	},
+}
+
+// TestGolden converts the book of each case and compares the output with
+// its golden file, which holds the text it converts to, a "--- toc" line
+// and the table of contents read, one entry per line indented by depth,
+// and then a "--- warnings" line and the warnings given. To add a
+// regression test, add a case and run the test with -update, then review
+// the new golden file.
+func TestGolden(t *testing.T) {
+	for _, c := range goldenCases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := convertGolden(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", "golden", c.name+".txt")
+			if *update {
+				if err := os.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s\n%s", path, diffLines(string(want), string(got)))
+			}
+		})
+	}
+}
+
+// convertGolden returns the output of c as its golden file holds it
+func convertGolden(c goldenCase) ([]byte, error) {
+	data, err := c.book.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var warnings []string
+	opts := c.opts
+	opts.Warn = func(w epubconv.Warning) {
+		warnings = append(warnings, fmt.Sprintf("[%s] %s", w.Category, w.Message))
+	}
+	book, err := epubconv.Open(bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer book.Close()
+
+	var out bytes.Buffer
+	if err := book.WriteText(&out); err != nil {
+		return nil, err
+	}
+	toc, err := book.TOC()
+	if err != nil {
+		return nil, err
+	}
+	out.WriteString("--- toc\n")
+	writeTOC(&out, toc, "")
+	out.WriteString("--- warnings\n")
+	for _, w := range warnings {
+		out.WriteString(w + "\n")
+	}
+	return out.Bytes(), nil
+}
+
+// writeTOC writes entries to out, one per line, indenting their children
+func writeTOC(out *bytes.Buffer, entries []epubconv.TOCEntry, indent string) {
+	for _, entry := range entries {
+		fmt.Fprintf(out, "%s%s -> %s\n", indent, entry.Title, entry.Href)
+		writeTOC(out, entry.Children, indent+"  ")
+	}
+}
+
+// diffLines returns the lines of want and got that differ, by line number
+func diffLines(want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	var out strings.Builder
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			fmt.Fprintf(&out, "  line %d:\n    want %q\n    got  %q\n", i+1, w, g)
+		}
+	}
+	return out.String()
+}
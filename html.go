@@ -0,0 +1,229 @@
+package epubconv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// htmlTag is a start or end tag
+type htmlTag struct {
+	name        string
+	closing     bool
+	selfClosing bool
+	attrs       map[string]string
+}
+
+// voidElements never have an end tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"source": true, "track": true, "wbr": true,
+}
+
+// impliedEndTags are often left unclosed, ending at their next sibling
+var impliedEndTags = map[string]bool{
+	"p": true, "li": true, "dt": true, "dd": true, "tr": true, "td": true,
+	"th": true, "option": true,
+}
+
+// markupRawTextElements are elements the tokenizer reads as raw text whose
+// content in an EPUB is markup to extract, as reading systems don't run
+// scripts
+var markupRawTextElements = map[string]bool{
+	"noscript": true, "noembed": true, "noframes": true, "iframe": true,
+}
+
+// Namespaces whose prefixed elements walkHTML understands
+const (
+	xhtmlNamespace = "http://www.w3.org/1999/xhtml"
+	opsNamespace   = "http://www.idpf.org/2007/ops"
+)
+
+var xmlnsPattern = regexp.MustCompile(`xmlns:([\w.-]+)\s*=\s*["']([^"']*)["']`)
+
+// namespacePrefixes returns the prefixes, lower-cased, that content binds to
+// namespace
+func namespacePrefixes(content, namespace string) map[string]bool {
+	prefixes := make(map[string]bool)
+	for _, m := range xmlnsPattern.FindAllStringSubmatch(content, -1) {
+		if strings.TrimSpace(m[2]) == namespace {
+			prefixes[strings.ToLower(m[1])] = true
+		}
+	}
+	return prefixes
+}
+
+// walkHTML calls fn with each text and tag token of an HTML or XHTML
+// document, stopping at the first error fn returns. Text is unescaped and
+// tag and attribute names are lower-cased. Elements in the XHTML namespace
+// lose their prefix (<x:p> is a p), while other prefixes are kept (e.g.
+// "epub:type"). Only the epub:default fallback of an epub:switch is read,
+// not its epub:case branches. CDATA sections, which XHTML allows anywhere,
+// are read as text.
+func walkHTML(content string, fn func(tok html.Token) error) error {
+	xhtml := namespacePrefixes(content, xhtmlNamespace)
+	ops := namespacePrefixes(content, opsNamespace)
+	ops["epub"] = true
+	// skip counts the epub:case elements open
+	skip := 0
+
+	z := html.NewTokenizer(strings.NewReader(content))
+	z.AllowCDATA(true)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if err := z.Err(); err != io.EOF {
+				return err
+			}
+			return nil
+		case html.TextToken, html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if prefix, local, ok := strings.Cut(tok.Data, ":"); ok && tok.Type != html.TextToken {
+				switch {
+				case xhtml[prefix]:
+					tok.Data = local
+				case ops[prefix] && local == "case" && tok.Type == html.StartTagToken:
+					skip++
+				case ops[prefix] && local == "case" && tok.Type == html.EndTagToken && skip > 0:
+					skip--
+					continue
+				}
+			}
+			if skip > 0 {
+				continue
+			}
+			// An XHTML <title/> or <script/> is empty, rather than starting
+			// raw text that runs to its end tag
+			if tok.Type == html.SelfClosingTagToken || tok.Type == html.StartTagToken && markupRawTextElements[tok.Data] {
+				z.NextIsNotRawText()
+			}
+			if err := fn(tok); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// tokenTag converts a tag token to an htmlTag
+func tokenTag(tok html.Token) htmlTag {
+	t := htmlTag{
+		name:        tok.Data,
+		closing:     tok.Type == html.EndTagToken,
+		selfClosing: tok.Type == html.SelfClosingTagToken,
+		attrs:       make(map[string]string, len(tok.Attr)),
+	}
+	for _, a := range tok.Attr {
+		t.attrs[a.Key] = a.Val
+	}
+	return t
+}
+
+// isHTMLSpace reports whether c is one of the whitespace characters HTML
+// collapses
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
+
+// isSpace reports whether b is empty or only whitespace
+func isSpace(b []byte) bool {
+	return len(bytes.TrimSpace(b)) == 0
+}
+
+// openElement is an element with an id whose end tag hasn't been reached
+// yet
+type openElement struct {
+	name string
+	id   string
+	// start is the length of the extracted text when the element opened
+	start int
+}
+
+// writeAnnotation writes s in brackets, separated by a space from any
+// preceding text
+func writeAnnotation(buf *bytes.Buffer, s string) {
+	if b := buf.Bytes(); len(b) > 0 && !isSpace(b[len(b)-1:]) {
+		buf.WriteByte(' ')
+	}
+	buf.WriteString("[" + s + "]")
+}
+
+// describedByMarker delimits the ids of an aria-describedby reference in
+// the extracted text until the referenced elements have been read
+const describedByMarker = "\x00"
+
+// resolveDescribedBy replaces aria-describedby references in text with the
+// bracketed text of the elements they name. References to unknown or empty
+// elements are dropped.
+func resolveDescribedBy(text string, idText map[string]string) string {
+	parts := strings.Split(text, describedByMarker)
+	var out bytes.Buffer
+	for i, part := range parts {
+		if i%2 == 0 {
+			out.WriteString(part)
+			continue
+		}
+		var descriptions []string
+		for _, id := range strings.Fields(part) {
+			if desc := idText[id]; desc != "" {
+				descriptions = append(descriptions, desc)
+			}
+		}
+		if len(descriptions) > 0 {
+			writeAnnotation(&out, strings.Join(descriptions, " "))
+		}
+	}
+	return out.String()
+}
+
+// openLink is an <a> element whose end tag hasn't been reached yet
+type openLink struct {
+	href string
+	// start is the length of the extracted text when the link opened
+	start int
+}
+
+// openAbbr is an <abbr> or <acronym> element whose end tag hasn't been
+// reached yet
+type openAbbr struct {
+	title string
+	// start is the length of the extracted text when the element opened
+	start int
+}
+
+// isExternalLink reports whether href points outside the book
+func isExternalLink(href string) bool {
+	href = strings.ToLower(strings.TrimSpace(href))
+	return strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") ||
+		strings.HasPrefix(href, "ftp://") || strings.HasPrefix(href, "mailto:")
+}
+
+// linkFootnotes numbers the external links of a chapter. A URL linked more
+// than once keeps its first number.
+type linkFootnotes struct {
+	urls []string
+}
+
+// add returns the footnote number for url
+func (f *linkFootnotes) add(url string) int {
+	for i, u := range f.urls {
+		if u == url {
+			return i + 1
+		}
+	}
+	f.urls = append(f.urls, url)
+	return len(f.urls)
+}
+
+// String renders the footnote list, one "[n] url" line per link
+func (f *linkFootnotes) String() string {
+	lines := make([]string, len(f.urls))
+	for i, url := range f.urls {
+		lines[i] = fmt.Sprintf("[%d] %s", i+1, url)
+	}
+	return strings.Join(lines, "\n")
+}
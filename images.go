@@ -0,0 +1,78 @@
+package epubconv
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Image is an image in the book's manifest
+type Image struct {
+	// Path is the archive path of the image
+	Path      string
+	MediaType string
+}
+
+// Images returns the images in the manifest, in manifest order. Items
+// listing the same file twice give one Image.
+func (b *Book) Images() []Image {
+	contentDir := path.Dir(b.PackagePath)
+	seen := make(map[string]bool)
+	var images []Image
+	for _, item := range b.Manifest.Items {
+		mediaType := strings.ToLower(strings.TrimSpace(item.MediaType))
+		if !strings.HasPrefix(mediaType, "image/") || item.Href == "" {
+			continue
+		}
+		imagePath := resolveHref(contentDir, item.Href)
+		if seen[imagePath] {
+			continue
+		}
+		seen[imagePath] = true
+		images = append(images, Image{Path: imagePath, MediaType: mediaType})
+	}
+	return images
+}
+
+// OpenImage opens the image at the archive path name, such as the Path of
+// one of Images, for reading. It fails with a DRMError if the book is
+// DRM-protected.
+func (b *Book) OpenImage(name string) (io.ReadCloser, error) {
+	return b.openResource(name)
+}
+
+// openResource opens the file at the archive path name for reading, unless
+// the book is DRM-protected
+func (b *Book) openResource(name string) (io.ReadCloser, error) {
+	if scheme := b.detectDRM(); scheme != "" {
+		return nil, &DRMError{Scheme: scheme}
+	}
+	file := b.findFile(name)
+	if file == nil {
+		return nil, fmt.Errorf("file not found: %s", name)
+	}
+	return b.budget.open(file)
+}
+
+// imageLink returns where a reference to src, found in the content document
+// docPath, points in the output according to links, or "" if it isn't an
+// image in links
+func imageLink(links map[string]string, docPath, src string) string {
+	src = strings.TrimSpace(src)
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		// Data URIs and external images aren't in the archive
+		return ""
+	}
+	// Manifest hrefs are usually written as they are referenced, but may
+	// differ in escaping
+	raw, _, _ := strings.Cut(src, "#")
+	raw, _, _ = strings.Cut(raw, "?")
+	dir := path.Dir(docPath)
+	if link, ok := links[resolveHref(dir, raw)]; ok {
+		return link
+	}
+	return links[resolveHref(dir, u.Path)]
+}
@@ -0,0 +1,71 @@
+// Package i18n looks up the translations of the messages shown by epubconv
+// and epub2txt.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+)
+
+// localeFiles holds the message catalogs, one go-i18n style JSON file per
+// language mapping message IDs to translations. English is the default
+// message written next to each ID in the code, so it has no catalog.
+//
+//go:embed locales
+var localeFiles embed.FS
+
+// language is the language messages are shown in, taken from
+// EPUBCONV_LANG or the usual locale environment variables
+var language = detectLanguage()
+
+var (
+	catalogOnce sync.Once
+	catalog     map[string]string
+)
+
+func detectLanguage() string {
+	for _, name := range []string{"EPUBCONV_LANG", "LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := os.Getenv(name); value != "" {
+			return normalizeLanguage(value)
+		}
+	}
+	return "en"
+}
+
+// normalizeLanguage reduces a locale such as "ja_JP.UTF-8" to its language
+func normalizeLanguage(locale string) string {
+	lang := strings.ToLower(locale)
+	if i := strings.IndexAny(lang, "_-.@"); i >= 0 {
+		lang = lang[:i]
+	}
+	if lang == "c" || lang == "posix" {
+		return "en"
+	}
+	return lang
+}
+
+func loadCatalog() {
+	data, err := localeFiles.ReadFile("locales/active." + language + ".json")
+	if err != nil {
+		// No translations for this language
+		return
+	}
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		catalog = nil
+	}
+}
+
+// Msg returns the message with the given ID in the user's language, or the
+// English default if it hasn't been translated. Messages containing format
+// verbs are passed to the fmt functions, and translations may reorder the
+// arguments with explicit indexes such as %[2]s.
+func Msg(id, english string) string {
+	catalogOnce.Do(loadCatalog)
+	if translated, ok := catalog[id]; ok {
+		return translated
+	}
+	return english
+}
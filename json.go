@@ -0,0 +1,70 @@
+package epubconv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// jsonDocument is a book converted to FormatJSON: its metadata and the
+// plain text of each chapter, for indexing books chapter by chapter
+type jsonDocument struct {
+	Metadata Info          `json:"metadata"`
+	Chapters []jsonChapter `json:"chapters"`
+}
+
+// jsonChapter is a chapter of a jsonDocument. Href is the archive path of
+// the content document, and Offset the position of the chapter, in
+// characters, in the plain text of the book without a header block.
+type jsonChapter struct {
+	Title     string `json:"title"`
+	Href      string `json:"href"`
+	Offset    int    `json:"offset"`
+	Text      string `json:"text"`
+	WordCount int    `json:"wordCount"`
+}
+
+// jsonText converts the book to a FormatJSON document
+func (b *Book) jsonText() (string, error) {
+	chapters, err := b.chapters(false)
+	if err != nil {
+		return "", err
+	}
+
+	doc := jsonDocument{Metadata: b.Info(), Chapters: []jsonChapter{}}
+	offset := 0
+	for _, chapter := range chapters {
+		doc.Chapters = append(doc.Chapters, jsonChapter{
+			Title:     chapter.Title,
+			Href:      chapter.Path,
+			Offset:    offset,
+			Text:      chapter.Text,
+			WordCount: countWords(chapter.Text),
+		})
+		// Chapters are separated by a blank line in plain text
+		offset += utf8.RuneCountInString(chapter.Text) + 1
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return "", fmt.Errorf("failed to encode JSON document: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// jsonStats counts the words and characters of the chapters of a FormatJSON
+// document
+func jsonStats(doc string) (words, characters int) {
+	var d jsonDocument
+	if err := json.Unmarshal([]byte(doc), &d); err != nil {
+		return 0, 0
+	}
+	for _, chapter := range d.Chapters {
+		words += chapter.WordCount
+		characters += utf8.RuneCountInString(chapter.Text)
+	}
+	return words, characters
+}
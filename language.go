@@ -0,0 +1,187 @@
+package epubconv
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// languageSamples are short texts in the languages written in the Latin
+// and Cyrillic scripts that DetectLanguage tells apart by their trigrams:
+// the start of the Universal Declaration of Human Rights and a line of
+// narrative, by BCP 47 language tag
+var languageSamples = map[string]string{
+	"en": "Whereas recognition of the inherent dignity and of the equal and inalienable rights of all members of the human family is the foundation of freedom, justice and peace in the world. All human beings are born free and equal in dignity and rights. They are endowed with reason and conscience and should act towards one another in a spirit of brotherhood. Everyone is entitled to all the rights and freedoms set forth in this Declaration, without distinction of any kind, such as race, colour, sex, language, religion, political or other opinion, national or social origin, property, birth or other status. Everyone has the right to life, liberty and security of person. No one shall be held in slavery or servitude. It was late in the evening when she came home, and he was waiting for her at the door. They did not say anything for a long time.",
+	"fr": "Considérant que la reconnaissance de la dignité inhérente à tous les membres de la famille humaine et de leurs droits égaux et inaliénables constitue le fondement de la liberté, de la justice et de la paix dans le monde. Tous les êtres humains naissent libres et égaux en dignité et en droits. Ils sont doués de raison et de conscience et doivent agir les uns envers les autres dans un esprit de fraternité. Chacun peut se prévaloir de tous les droits et de toutes les libertés proclamés dans la présente Déclaration, sans distinction aucune, notamment de race, de couleur, de sexe, de langue, de religion, d'opinion politique ou de toute autre opinion, d'origine nationale ou sociale, de fortune, de naissance ou de toute autre situation. Tout individu a droit à la vie, à la liberté et à la sûreté de sa personne. Nul ne sera tenu en esclavage ni en servitude. Il était tard dans la soirée quand elle est rentrée à la maison, et il l'attendait devant la porte. Ils n'ont rien dit pendant longtemps.",
+	"es": "Considerando que la libertad, la justicia y la paz en el mundo tienen por base el reconocimiento de la dignidad intrínseca y de los derechos iguales e inalienables de todos los miembros de la familia humana. Todos los seres humanos nacen libres e iguales en dignidad y derechos y, dotados como están de razón y conciencia, deben comportarse fraternalmente los unos con los otros. Toda persona tiene todos los derechos y libertades proclamados en esta Declaración, sin distinción alguna de raza, color, sexo, idioma, religión, opinión política o de cualquier otra índole, origen nacional o social, posición económica, nacimiento o cualquier otra condición. Todo individuo tiene derecho a la vida, a la libertad y a la seguridad de su persona. Nadie estará sometido a esclavitud ni a servidumbre. Era tarde por la noche cuando ella llegó a casa, y él la estaba esperando en la puerta. No dijeron nada durante mucho tiempo.",
+	"pt": "Considerando que o reconhecimento da dignidade inerente a todos os membros da família humana e dos seus direitos iguais e inalienáveis constitui o fundamento da liberdade, da justiça e da paz no mundo. Todos os seres humanos nascem livres e iguais em dignidade e em direitos. Dotados de razão e de consciência, devem agir uns para com os outros em espírito de fraternidade. Todos os seres humanos podem invocar os direitos e as liberdades proclamados na presente Declaração, sem distinção alguma, nomeadamente de raça, de cor, de sexo, de língua, de religião, de opinião política ou outra, de origem nacional ou social, de fortuna, de nascimento ou de qualquer outra situação. Todo o indivíduo tem direito à vida, à liberdade e à segurança pessoal. Ninguém será mantido em escravatura ou em servidão. Era tarde da noite quando ela chegou em casa, e ele estava esperando por ela na porta. Não disseram nada durante muito tempo.",
+	"it": "Considerato che il riconoscimento della dignità inerente a tutti i membri della famiglia umana e dei loro diritti, uguali ed inalienabili, costituisce il fondamento della libertà, della giustizia e della pace nel mondo. Tutti gli esseri umani nascono liberi ed eguali in dignità e diritti. Essi sono dotati di ragione e di coscienza e devono agire gli uni verso gli altri in spirito di fratellanza. Ad ogni individuo spettano tutti i diritti e tutte le libertà enunciate nella presente Dichiarazione, senza distinzione alcuna, per ragioni di razza, di colore, di sesso, di lingua, di religione, di opinione politica o di altro genere, di origine nazionale o sociale, di ricchezza, di nascita o di altra condizione. Ogni individuo ha diritto alla vita, alla libertà ed alla sicurezza della propria persona. Nessun individuo potrà essere tenuto in stato di schiavitù o di servitù. Era tardi la sera quando lei tornò a casa, e lui la stava aspettando davanti alla porta. Non dissero niente per molto tempo.",
+	"de": "Da die Anerkennung der angeborenen Würde und der gleichen und unveräußerlichen Rechte aller Mitglieder der Gemeinschaft der Menschen die Grundlage von Freiheit, Gerechtigkeit und Frieden in der Welt bildet. Alle Menschen sind frei und gleich an Würde und Rechten geboren. Sie sind mit Vernunft und Gewissen begabt und sollen einander im Geist der Brüderlichkeit begegnen. Jeder hat Anspruch auf alle in dieser Erklärung verkündeten Rechte und Freiheiten ohne irgendeinen Unterschied, etwa nach Rasse, Hautfarbe, Geschlecht, Sprache, Religion, politischer oder sonstiger Überzeugung, nationaler oder sozialer Herkunft, Vermögen, Geburt oder sonstigem Stand. Jeder hat das Recht auf Leben, Freiheit und Sicherheit der Person. Niemand darf in Sklaverei oder Leibeigenschaft gehalten werden. Es war spät am Abend, als sie nach Hause kam, und er wartete an der Tür auf sie. Sie sagten lange Zeit nichts.",
+	"nl": "Overwegende, dat erkenning van de inherente waardigheid en van de gelijke en onvervreemdbare rechten van alle leden van de mensengemeenschap grondslag is voor de vrijheid, gerechtigheid en vrede in de wereld. Alle mensen worden vrij en gelijk in waardigheid en rechten geboren. Zij zijn begiftigd met verstand en geweten, en behoren zich jegens elkander in een geest van broederschap te gedragen. Een ieder heeft aanspraak op alle rechten en vrijheden, in deze Verklaring opgesomd, zonder enig onderscheid van welke aard ook, zoals ras, kleur, geslacht, taal, godsdienst, politieke of andere overtuiging, nationale of maatschappelijke afkomst, eigendom, geboorte of andere status. Een ieder heeft het recht op leven, vrijheid en onschendbaarheid van zijn persoon. Niemand zal in slavernij of horigheid gehouden worden. Het was laat op de avond toen ze thuiskwam, en hij wachtte op haar bij de deur. Ze zeiden lange tijd niets.",
+	"sv": "Eftersom erkännandet av det inneboende värdet hos alla medlemmar av människosläktet och av deras lika och oförytterliga rättigheter är grundvalen för frihet, rättvisa och fred i världen. Alla människor är födda fria och lika i värde och rättigheter. De är utrustade med förnuft och samvete och bör handla gentemot varandra i en anda av broderskap. Var och en är berättigad till alla de rättigheter och friheter som uttalas i denna förklaring utan åtskillnad av något slag, såsom ras, hudfärg, kön, språk, religion, politisk eller annan uppfattning, nationellt eller socialt ursprung, egendom, börd eller ställning i övrigt. Var och en har rätt till liv, frihet och personlig säkerhet. Ingen får hållas i slaveri eller träldom. Det var sent på kvällen när hon kom hem, och han väntade på henne vid dörren. De sa ingenting på länge.",
+	"pl": "Zważywszy, że uznanie przyrodzonej godności oraz równych i niezbywalnych praw wszystkich członków wspólnoty ludzkiej jest podstawą wolności, sprawiedliwości i pokoju na świecie. Wszyscy ludzie rodzą się wolni i równi pod względem swej godności i swych praw. Są oni obdarzeni rozumem i sumieniem i powinni postępować wobec innych w duchu braterstwa. Każdy człowiek posiada wszystkie prawa i wolności zawarte w niniejszej Deklaracji bez względu na jakiekolwiek różnice rasy, koloru skóry, płci, języka, wyznania, poglądów politycznych i innych, narodowości, pochodzenia społecznego, majątku, urodzenia lub jakiegokolwiek innego stanu. Każdy człowiek ma prawo do życia, wolności i bezpieczeństwa swej osoby. Nikt nie może być trzymany w niewolnictwie ani w służebności. Było późno wieczorem, kiedy wróciła do domu, a on czekał na nią przy drzwiach. Długo nic nie mówili.",
+	"ru": "Принимая во внимание, что признание достоинства, присущего всем членам человеческой семьи, и равных и неотъемлемых прав их является основой свободы, справедливости и всеобщего мира. Все люди рождаются свободными и равными в своем достоинстве и правах. Они наделены разумом и совестью и должны поступать в отношении друг друга в духе братства. Каждый человек должен обладать всеми правами и всеми свободами, провозглашенными настоящей Декларацией, без какого бы то ни было различия, как-то в отношении расы, цвета кожи, пола, языка, религии, политических или иных убеждений, национального или социального происхождения, имущественного, сословного или иного положения. Каждый человек имеет право на жизнь, на свободу и на личную неприкосновенность. Никто не должен содержаться в рабстве или в подневольном состоянии. Было поздно вечером, когда она пришла домой, а он ждал её у двери. Они долго ничего не говорили.",
+	"uk": "Беручи до уваги, що визнання гідності, яка властива всім членам людської сім'ї, і рівних та невід'ємних їх прав є основою свободи, справедливості та загального миру. Всі люди народжуються вільними і рівними у своїй гідності та правах. Вони наділені розумом і совістю і повинні діяти у відношенні один до одного в дусі братерства. Кожна людина повинна мати всі права і всі свободи, проголошені цією Декларацією, незалежно від раси, кольору шкіри, статі, мови, релігії, політичних або інших переконань, національного чи соціального походження, майнового, станового або іншого становища. Кожна людина має право на життя, на свободу і на особисту недоторканність. Ніхто не повинен бути в рабстві або в підневільному стані. Було пізно ввечері, коли вона прийшла додому, а він чекав її біля дверей. Вони довго нічого не казали.",
+}
+
+// scriptLanguages are the languages detected by their script alone
+var scriptLanguages = []struct {
+	script   *unicode.RangeTable
+	language string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Greek, "el"},
+	{unicode.Hebrew, "he"},
+	{unicode.Arabic, "ar"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+const (
+	// profileSize is the number of most frequent trigrams compared
+	profileSize = 300
+	// languageSampleSize is the number of letters of a text DetectLanguage
+	// looks at
+	languageSampleSize = 100000
+	// minLanguageLetters is the fewest letters DetectLanguage guesses from
+	minLanguageLetters = 50
+)
+
+var (
+	languageProfilesOnce sync.Once
+	languageProfiles     map[string]map[string]int
+)
+
+// DetectLanguage guesses the language of text, returning its BCP 47 tag or
+// "" if there are too few letters to tell. Chinese, Japanese, Korean, Greek,
+// Hebrew, Arabic, Thai and Hindi are told by their script, and the languages
+// of languageSamples by how close the ranks of their most frequent letter
+// trigrams are to those of the text.
+func DetectLanguage(text string) string {
+	scripts := make(map[*unicode.RangeTable]int)
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if letters++; letters > languageSampleSize {
+			break
+		}
+		for _, script := range []*unicode.RangeTable{unicode.Latin, unicode.Cyrillic, unicode.Han, unicode.Hiragana, unicode.Katakana} {
+			if unicode.Is(script, r) {
+				scripts[script]++
+			}
+		}
+		for _, s := range scriptLanguages {
+			if unicode.Is(s.script, r) {
+				scripts[s.script]++
+			}
+		}
+	}
+	if letters < minLanguageLetters {
+		return ""
+	}
+
+	var dominant *unicode.RangeTable
+	for script, n := range scripts {
+		if dominant == nil || n > scripts[dominant] {
+			dominant = script
+		}
+	}
+	kana := scripts[unicode.Hiragana] + scripts[unicode.Katakana]
+	switch dominant {
+	case unicode.Han, unicode.Hiragana, unicode.Katakana:
+		// Japanese mixes kana into its kanji, Chinese has none
+		if kana*10 >= kana+scripts[unicode.Han] {
+			return "ja"
+		}
+		return "zh"
+	case unicode.Latin, unicode.Cyrillic:
+		return closestLanguage(trigramProfile(text), dominant == unicode.Cyrillic)
+	}
+	for _, s := range scriptLanguages {
+		if s.script == dominant {
+			return s.language
+		}
+	}
+	return ""
+}
+
+// closestLanguage returns the language of languageSamples, in the Cyrillic
+// script if cyrillic is set and the Latin one otherwise, whose trigram
+// profile is closest to profile
+func closestLanguage(profile map[string]int, cyrillic bool) string {
+	languageProfilesOnce.Do(func() {
+		languageProfiles = make(map[string]map[string]int)
+		for language, sample := range languageSamples {
+			languageProfiles[language] = trigramProfile(sample)
+		}
+	})
+
+	best, bestDistance := "", -1
+	for language, sample := range languageSamples {
+		if isCyrillic(sample) != cyrillic {
+			continue
+		}
+		// The out-of-place measure: how far each trigram of the text is
+		// from its rank in the language, or the most it can be if absent
+		distance := 0
+		for trigram, rank := range profile {
+			if sampleRank, ok := languageProfiles[language][trigram]; ok {
+				distance += max(rank-sampleRank, sampleRank-rank)
+			} else {
+				distance += profileSize
+			}
+		}
+		if bestDistance < 0 || distance < bestDistance || distance == bestDistance && language < best {
+			best, bestDistance = language, distance
+		}
+	}
+	return best
+}
+
+// isCyrillic reports whether text starts with a Cyrillic letter
+func isCyrillic(text string) bool {
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			return unicode.Is(unicode.Cyrillic, r)
+		}
+	}
+	return false
+}
+
+// trigramProfile ranks, from 0, the profileSize most frequent trigrams of
+// the lower-cased words of text, each padded with a space either side
+func trigramProfile(text string) map[string]int {
+	counts := make(map[string]int)
+	letters := 0
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if letters += len(word); letters > languageSampleSize {
+			break
+		}
+		runes := []rune(" " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			counts[string(runes[i:i+3])]++
+		}
+	}
+
+	trigrams := make([]string, 0, len(counts))
+	for trigram := range counts {
+		trigrams = append(trigrams, trigram)
+	}
+	sort.Slice(trigrams, func(i, j int) bool {
+		if counts[trigrams[i]] != counts[trigrams[j]] {
+			return counts[trigrams[i]] > counts[trigrams[j]]
+		}
+		return trigrams[i] < trigrams[j]
+	})
+	profile := make(map[string]int)
+	for rank, trigram := range trigrams {
+		if rank == profileSize {
+			break
+		}
+		profile[trigram] = rank
+	}
+	return profile
+}
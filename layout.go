@@ -0,0 +1,151 @@
+package epubconv
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Heading styles for Options.HeadingStyle
+const (
+	HeadingPlain     = "plain"
+	HeadingUnderline = "underline"
+	HeadingHash      = "hash"
+)
+
+var HeadingStyles = []string{HeadingPlain, HeadingUnderline, HeadingHash}
+
+// MaxParagraphSpacing is the most blank lines Options.ParagraphSpacing can
+// put between paragraphs
+const MaxParagraphSpacing = 2
+
+// headingMarker starts a heading line in the extracted text, followed by its
+// level as a digit, until the layout options are applied
+const headingMarker = "\x02"
+
+// hasLayout reports whether any of the layout options is set, in which case
+// headings are marked in the extracted text, as JoinLines needs them to be
+func (o Options) hasLayout() bool {
+	return o.Wrap > 0 || o.ParagraphSpacing > 0 || o.HeadingStyle != "" && o.HeadingStyle != HeadingPlain || o.JoinLines
+}
+
+// isHeading reports whether name is the name of a heading element, h1 to h6
+func isHeading(name string) bool {
+	return len(name) == 2 && name[0] == 'h' && name[1] >= '1' && name[1] <= '6'
+}
+
+// cutHeading returns the heading level of a line of extracted text, or 0 if
+// it isn't a heading, and the line without its heading marker
+func cutHeading(line string) (level int, rest string) {
+	if len(line) >= 2 && line[:1] == headingMarker && line[1] >= '1' && line[1] <= '6' {
+		return int(line[1] - '0'), strings.TrimSpace(line[2:])
+	}
+	return 0, line
+}
+
+// layoutText applies the layout options to the extracted text of a chapter:
+// each paragraph (line) is wrapped, headings are decorated and paragraphs
+// are separated by blank lines. Headings and the lines of a table aren't
+// wrapped, and a table's lines aren't separated. A blank line
+// already in the text, such as the one before a list of footnotes, stays.
+func layoutText(text string, opts Options) string {
+	var out strings.Builder
+	blank, inTable := false, false
+	for _, line := range strings.Split(text, "\n") {
+		tableLine, isTable := strings.CutPrefix(line, tableMarker)
+		level, line := cutHeading(line)
+		line = strings.TrimSpace(removeHeadingMarkers(line))
+		if line == "" {
+			blank = true
+			continue
+		}
+		if out.Len() > 0 {
+			spacing := opts.ParagraphSpacing
+			if blank {
+				spacing = max(spacing, 1)
+			} else if isTable && inTable {
+				spacing = 0
+			}
+			out.WriteString(strings.Repeat("\n", spacing+1))
+		}
+		blank, inTable = false, isTable
+		switch {
+		case isTable:
+			out.WriteString(strings.TrimSpace(tableLine))
+		case level > 0 && opts.HeadingStyle == HeadingHash:
+			out.WriteString(strings.Repeat("#", level) + " " + line)
+		case level > 0 && opts.HeadingStyle == HeadingUnderline:
+			rule := "-"
+			if level == 1 {
+				rule = "="
+			}
+			out.WriteString(line + "\n" + strings.Repeat(rule, max(displayWidth(line), 1)))
+		case level > 0:
+			out.WriteString(line)
+		default:
+			out.WriteString(wrapLine(line, opts.Wrap))
+		}
+	}
+	return out.String()
+}
+
+// removeHeadingMarkers removes heading markers that don't start a line, such
+// as those in the text of an aria-describedby reference
+func removeHeadingMarkers(s string) string {
+	for {
+		i := strings.Index(s, headingMarker)
+		if i < 0 {
+			return s
+		}
+		end := i + 1
+		if end < len(s) && s[end] >= '1' && s[end] <= '6' {
+			end++
+		}
+		s = s[:i] + s[end:]
+	}
+}
+
+// wrapLine breaks line into lines no wider than width columns at spaces,
+// and between the characters of Chinese and Japanese text, where breakWord
+// allows. A word wider than that gets a line of its own. Zero width doesn't
+// wrap.
+func wrapLine(line string, width int) string {
+	if width <= 0 || displayWidth(line) <= width {
+		return line
+	}
+	var out strings.Builder
+	col := 0
+	for _, word := range strings.Fields(line) {
+		for i, part := range breakWord(word) {
+			w, space := displayWidth(part), i == 0
+			switch {
+			case col == 0:
+			case col+w > width || space && col+1+w > width:
+				out.WriteByte('\n')
+				col = 0
+			case space:
+				out.WriteByte(' ')
+				col++
+			}
+			out.WriteString(part)
+			col += w
+		}
+	}
+	return out.String()
+}
+
+// displayWidth returns the number of terminal columns s takes up: two for
+// wide East Asian characters, none for combining marks and anchor markers and
+// one for the rest
+func displayWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		switch {
+		case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf), isAnchorRune(r):
+		case isWide(r):
+			n += 2
+		default:
+			n++
+		}
+	}
+	return n
+}
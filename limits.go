@@ -0,0 +1,294 @@
+package epubconv
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrMemoryLimit is returned when a conversion would hold more memory than
+// Options.MaxMemory allows
+var ErrMemoryLimit = errors.New("memory limit exceeded")
+
+// ErrParseLimit is returned when a document nests elements too deeply or
+// gives an element too many attributes
+var ErrParseLimit = errors.New("parse limit exceeded")
+
+// ErrArchiveLimit is returned when a book's archive has more entries, or
+// decompresses to more data, than Options.MaxEntries, Options.MaxFileSize
+// or Options.MaxTotalSize allow
+var ErrArchiveLimit = errors.New("archive limit exceeded")
+
+// ErrUnsafePath is returned, with Options.StrictPaths, when a book's
+// archive or package document names a file outside where it should be
+var ErrUnsafePath = errors.New("unsafe path")
+
+// parseLimits bounds the structure of the XML and HTML documents parsed
+// during a conversion, so adversarial documents can't exhaust resources.
+// Zero means unlimited.
+type parseLimits struct {
+	maxDepth int
+	maxAttrs int
+}
+
+// check fails if an element named name, nested depth deep and with attrs
+// attributes, exceeds the limits
+func (l parseLimits) check(name string, depth, attrs int) error {
+	if l.maxDepth > 0 && depth > l.maxDepth {
+		return fmt.Errorf("%w: elements nested more than %d deep (--max-depth)", ErrParseLimit, l.maxDepth)
+	}
+	if l.maxAttrs > 0 && attrs > l.maxAttrs {
+		return fmt.Errorf("%w: <%s> has %d attributes, more than %d (--max-attrs)", ErrParseLimit, name, attrs, l.maxAttrs)
+	}
+	return nil
+}
+
+// checkXMLLimits walks the elements of an XML document, failing if any
+// exceeds the limits. Syntax errors are left for the real decoder to report.
+func checkXMLLimits(data []byte, limits parseLimits) error {
+	d := newXMLDecoder(data)
+	depth := 0
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return nil
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if err := limits.check(t.Name.Local, depth, len(t.Attr)); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// ByteSize is a size in bytes. It is also a flag.Value, taking a plain
+// number or one with a K, M or G suffix (powers of 1024).
+type ByteSize int64
+
+func (b *ByteSize) String() string {
+	return formatByteSize(int64(*b))
+}
+
+func (b *ByteSize) Set(s string) error {
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"GIB", 1 << 30}, {"GB", 1 << 30}, {"G", 1 << 30},
+		{"MIB", 1 << 20}, {"MB", 1 << 20}, {"M", 1 << 20},
+		{"KIB", 1 << 10}, {"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	}
+
+	number, multiplier := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+	for _, unit := range units {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(trimmed), unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * multiplier, nil
+}
+
+func formatByteSize(n int64) string {
+	switch {
+	case n > 0 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dG", n>>30)
+	case n > 0 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dM", n>>20)
+	case n > 0 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dK", n>>10)
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// memoryBudget tracks the approximate memory held by a single conversion:
+// the decompressed content file being processed plus the text produced so
+// far. A zero limit means unlimited.
+type memoryBudget struct {
+	limit int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// reserve accounts for n more bytes, failing if that would exceed the limit
+func (b *memoryBudget) reserve(n int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		return fmt.Errorf("%w: conversion needs more than %s (--max-memory)", ErrMemoryLimit, formatByteSize(b.limit))
+	}
+	b.used += n
+	return nil
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// remaining returns how many bytes may still be reserved, or 0 if unlimited
+func (b *memoryBudget) remaining() int64 {
+	if b.limit == 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(b.limit-b.used, 1)
+}
+
+// archiveBudget bounds the data decompressed from a book's archive, so a
+// zip bomb fails instead of filling memory. Sizes in the archive's headers
+// aren't trusted: the data is counted as it is read. A file read more than
+// once counts once towards the total. It is shared by the copies of a Book.
+// Zero means unlimited.
+type archiveBudget struct {
+	maxFile  int64
+	maxTotal int64
+
+	mu    sync.Mutex
+	total int64
+	// read is the most read of each file so far
+	read map[*zip.File]int64
+}
+
+func newArchiveBudget(opts Options) *archiveBudget {
+	return &archiveBudget{maxFile: int64(opts.MaxFileSize), maxTotal: int64(opts.MaxTotalSize), read: make(map[*zip.File]int64)}
+}
+
+// open opens file for reading, failing with ErrArchiveLimit as soon as it
+// decompresses to more than the limits allow
+func (a *archiveBudget) open(file *zip.File) (io.ReadCloser, error) {
+	if a.maxFile > 0 && file.UncompressedSize64 > uint64(a.maxFile) {
+		return nil, fmt.Errorf("%w: %s is %d bytes uncompressed, more than %s (--max-file-size)", ErrArchiveLimit, file.Name, file.UncompressedSize64, formatByteSize(a.maxFile))
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	if a.maxFile == 0 && a.maxTotal == 0 {
+		return rc, nil
+	}
+	return &budgetedFile{ReadCloser: rc, file: file, budget: a}, nil
+}
+
+// add accounts for file having been read to offset n, failing if that
+// takes the book over the total
+func (a *archiveBudget) add(file *zip.File, n int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n <= a.read[file] {
+		return nil
+	}
+	a.total += n - a.read[file]
+	a.read[file] = n
+	if a.maxTotal > 0 && a.total > a.maxTotal {
+		return fmt.Errorf("%w: the book decompresses to more than %s (--max-total-size)", ErrArchiveLimit, formatByteSize(a.maxTotal))
+	}
+	return nil
+}
+
+// budgetedFile is a file of the archive being read within an archiveBudget
+type budgetedFile struct {
+	io.ReadCloser
+	file   *zip.File
+	budget *archiveBudget
+	n      int64
+}
+
+func (f *budgetedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	f.n += int64(n)
+	if f.budget.maxFile > 0 && f.n > f.budget.maxFile {
+		return n, fmt.Errorf("%w: %s is larger than %s uncompressed (--max-file-size)", ErrArchiveLimit, f.file.Name, formatByteSize(f.budget.maxFile))
+	}
+	if limitErr := f.budget.add(f.file, f.n); limitErr != nil {
+		return n, limitErr
+	}
+	return n, err
+}
+
+// checkEntries fails if the archive, or the manifest or spine of the
+// package document, has more than max entries
+func checkEntries(b *Book, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	for _, count := range []struct {
+		what string
+		n    int
+	}{
+		{"archive entries", len(b.reader.File)},
+		{"manifest items", len(b.Manifest.Items)},
+		{"spine items", len(b.Spine.Itemrefs)},
+	} {
+		if count.n > max {
+			return fmt.Errorf("%w: %d %s, more than %d (--max-entries)", ErrArchiveLimit, count.n, count.what, max)
+		}
+	}
+	return nil
+}
+
+// checkPaths fails with ErrUnsafePath if an archive entry's name is
+// absolute or climbs out of the archive with "..", as extracting it would
+// write outside the target directory, or if the package document or an item
+// of its manifest is found that way or outside the package directory
+func checkPaths(b *Book) error {
+	unsafe := func(name string) bool {
+		return strings.HasPrefix(name, "/") || strings.Contains(name, "\\") ||
+			name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "/../") || strings.HasSuffix(name, "/..")
+	}
+	for _, file := range b.reader.File {
+		if unsafe(file.Name) {
+			return fmt.Errorf("%w: archive entry %s", ErrUnsafePath, file.Name)
+		}
+	}
+	if unsafe(b.PackagePath) {
+		return fmt.Errorf("%w: package document %s", ErrUnsafePath, b.PackagePath)
+	}
+	contentDir := path.Dir(b.PackagePath)
+	for _, item := range b.Manifest.Items {
+		href, _, _ := strings.Cut(item.Href, "#")
+		if href == "" {
+			continue
+		}
+		resolved := path.Join(contentDir, href)
+		if strings.HasPrefix(href, "/") || strings.Contains(href, "\\") || unsafe(resolved) || !isWithinDir(contentDir, resolved) {
+			return fmt.Errorf("%w: manifest item %s refers to %s outside the package directory %s", ErrUnsafePath, item.ID, item.Href, contentDir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package epubconv
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "64k", want: 64 << 10},
+		{in: "64KB", want: 64 << 10},
+		{in: "64 KiB", want: 64 << 10},
+		{in: " 64M ", want: 64 << 20},
+		{in: "1G", want: 1 << 30},
+		{in: "1gib", want: 1 << 30},
+		{in: "9223372036854775807", want: 1<<63 - 1},
+		{in: "8589934591G", want: 8589934591 << 30},
+		{in: "8589934592G", wantErr: true},
+		{in: "9007199254740992K", wantErr: true},
+		{in: "9223372036854775808", wantErr: true},
+		{in: "-1M", wantErr: true},
+		{in: "1.5G", wantErr: true},
+		{in: "G", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "10T", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := parseByteSize(test.in)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseByteSize(%q) = %d, want an error", test.in, got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("parseByteSize(%q) = %d, %v, want %d", test.in, got, err, test.want)
+			}
+		})
+	}
+}
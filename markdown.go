@@ -0,0 +1,457 @@
+package epubconv
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// markdownRenderer renders the common subset of Markdown, CommonMark's
+// blocks and inlines without reference links or raw HTML, as XHTML
+type markdownRenderer struct {
+	// image maps the src of an image to the URL it has in the book, or
+	// returns false if the image isn't in the book, which leaves its alt
+	// text in its place
+	image func(src string) (string, bool)
+	// images holds the srcs of the images rendered, in order
+	images []string
+	// heading is the text of the first heading rendered
+	heading string
+}
+
+var (
+	atxHeadingPattern    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	setextPattern        = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	thematicBreakPattern = regexp.MustCompile(`^ {0,3}((\*[ \t]*){3,}|(-[ \t]*){3,}|(_[ \t]*){3,})$`)
+	fencePattern         = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})")
+	listItemPattern      = regexp.MustCompile(`^( {0,3})([-*+]|[0-9]{1,9}[.)])([ \t]+|$)`)
+	blockquotePattern    = regexp.MustCompile(`^ {0,3}> ?`)
+)
+
+// render returns the XHTML rendering of the Markdown source
+func (r *markdownRenderer) render(source string) string {
+	var out strings.Builder
+	r.blocks(&out, strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n"))
+	return out.String()
+}
+
+// blocks renders lines as a sequence of blocks
+func (r *markdownRenderer) blocks(out *strings.Builder, lines []string) {
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			out.WriteString("<p>" + r.inlines(strings.TrimRight(strings.Join(para, "\n"), " \t")) + "</p>\n")
+			para = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case len(para) > 0 && setextPattern.MatchString(line):
+			level := 2
+			if strings.TrimSpace(line)[0] == '=' {
+				level = 1
+			}
+			r.headingBlock(out, level, strings.Join(para, "\n"))
+			para = nil
+		case thematicBreakPattern.MatchString(line):
+			flush()
+			out.WriteString("<hr/>\n")
+		case atxHeadingPattern.MatchString(line):
+			flush()
+			m := atxHeadingPattern.FindStringSubmatch(line)
+			r.headingBlock(out, len(m[1]), m[2])
+		case fencePattern.MatchString(line):
+			flush()
+			m := fencePattern.FindStringSubmatch(line)
+			indent, fence := len(m[1]), m[2]
+			var code []string
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), fence) && strings.Trim(strings.TrimSpace(lines[i]), fence[:1]) == "" {
+					break
+				}
+				code = append(code, trimIndent(lines[i], indent))
+			}
+			r.codeBlock(out, code)
+		case len(para) == 0 && indentWidth(line) >= 4:
+			var code []string
+			for ; i < len(lines) && (indentWidth(lines[i]) >= 4 || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(code, trimIndent(lines[i], 4))
+			}
+			i--
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			r.codeBlock(out, code)
+		case blockquotePattern.MatchString(line):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				quoted = append(quoted, blockquotePattern.ReplaceAllString(lines[i], ""))
+			}
+			i--
+			out.WriteString("<blockquote>\n")
+			r.blocks(out, quoted)
+			out.WriteString("</blockquote>\n")
+		case listItemPattern.MatchString(line):
+			flush()
+			i = r.list(out, lines, i) - 1
+		default:
+			// Trailing spaces are kept for hard line breaks
+			para = append(para, strings.TrimLeft(line, " \t"))
+		}
+	}
+	flush()
+}
+
+// headingBlock renders a heading of the given level
+func (r *markdownRenderer) headingBlock(out *strings.Builder, level int, text string) {
+	content := r.inlines(strings.TrimSpace(text))
+	if r.heading == "" {
+		r.heading = strings.Join(strings.Fields(html.UnescapeString(tagPattern.ReplaceAllString(content, ""))), " ")
+	}
+	out.WriteString("<h" + strconv.Itoa(level) + ">" + content + "</h" + strconv.Itoa(level) + ">\n")
+}
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// codeBlock renders lines as preformatted code
+func (r *markdownRenderer) codeBlock(out *strings.Builder, lines []string) {
+	out.WriteString("<pre><code>" + html.EscapeString(strings.Join(lines, "\n")) + "</code></pre>\n")
+}
+
+// list renders the list starting at lines[start] and returns the index of
+// the line after it
+func (r *markdownRenderer) list(out *strings.Builder, lines []string, start int) int {
+	first := listItemPattern.FindStringSubmatch(lines[start])
+	ordered := first[2][0] >= '0' && first[2][0] <= '9'
+	marker := first[2][len(first[2])-1:]
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if n, _ := strconv.Atoi(first[2][:len(first[2])-1]); n != 1 {
+			tag += ` start="` + strconv.Itoa(n) + `"`
+		}
+	}
+
+	// Each item is its first line's text and the lines that follow it,
+	// indented to the item's content or continuing its paragraph
+	var items [][]string
+	loose, blankBefore := false, false
+	i := start
+	for i < len(lines) {
+		m := listItemPattern.FindStringSubmatch(lines[i])
+		if m == nil || m[2][len(m[2])-1:] != marker || (m[2][0] >= '0' && m[2][0] <= '9') != ordered {
+			break
+		}
+		if blankBefore {
+			loose = true
+		}
+		indent := len(m[0])
+		if m[3] == "" {
+			indent++
+		}
+		item := []string{lines[i][len(m[0]):]}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				// A blank line continues the item if more of it follows
+				next := i + 1
+				for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+					next++
+				}
+				if next < len(lines) && indentWidth(lines[next]) >= indent {
+					loose = true
+					item = append(item, "")
+					continue
+				}
+				// A blank line between items makes the list loose
+				blankBefore = true
+				i = next
+				break
+			}
+			if indentWidth(line) >= indent {
+				item = append(item, trimIndent(line, indent))
+			} else if listItemPattern.MatchString(line) || thematicBreakPattern.MatchString(line) ||
+				atxHeadingPattern.MatchString(line) || fencePattern.MatchString(line) || blockquotePattern.MatchString(line) {
+				break
+			} else {
+				// A lazy continuation of the paragraph
+				item = append(item, strings.TrimSpace(line))
+			}
+		}
+		items = append(items, item)
+		if i < len(lines) && !listItemPattern.MatchString(lines[i]) {
+			break
+		}
+	}
+
+	out.WriteString("<" + tag + ">\n")
+	for _, item := range items {
+		var content strings.Builder
+		r.blocks(&content, item)
+		s := strings.TrimSuffix(content.String(), "\n")
+		if !loose && strings.HasPrefix(s, "<p>") {
+			// A tight list's paragraphs aren't wrapped in <p>
+			if end := strings.Index(s, "</p>"); end >= 0 {
+				s = s[3:end] + s[end+4:]
+			}
+		}
+		out.WriteString("<li>" + s + "</li>\n")
+	}
+	out.WriteString("</" + strings.Fields(tag)[0] + ">\n")
+	return i
+}
+
+// indentWidth returns the number of columns of leading whitespace in line,
+// with tabs to the next multiple of 4
+func indentWidth(line string) int {
+	n := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 4 - n%4
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// trimIndent removes up to n columns of leading whitespace from line
+func trimIndent(line string, n int) string {
+	col := 0
+	for i, c := range line {
+		if col >= n || (c != ' ' && c != '\t') {
+			return line[i:]
+		}
+		if c == '\t' {
+			col += 4 - col%4
+		} else {
+			col++
+		}
+	}
+	return ""
+}
+
+// markdownEscapable are the characters a backslash escapes
+const markdownEscapable = "\\`*_{}[]()#+-.!<>|~\"'"
+
+// inlines renders the inline Markdown of a block's text
+func (r *markdownRenderer) inlines(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(markdownEscapable, s[i+1]) >= 0:
+			i++
+			out.WriteString(html.EscapeString(s[i : i+1]))
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			out.WriteString("<br/>")
+		case c == '\n':
+			if strings.HasSuffix(out.String(), "  ") {
+				trimmed := strings.TrimRight(out.String(), " ")
+				out.Reset()
+				out.WriteString(trimmed + "<br/>")
+			} else {
+				out.WriteByte('\n')
+			}
+		case c == '`':
+			n := runLength(s, i, '`')
+			fence := s[i : i+n]
+			end := strings.Index(s[i+n:], fence)
+			if end < 0 {
+				out.WriteString(fence)
+				i += n - 1
+				continue
+			}
+			code := strings.ReplaceAll(s[i+n:i+n+end], "\n", " ")
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+				code = code[1 : len(code)-1]
+			}
+			out.WriteString("<code>" + html.EscapeString(code) + "</code>")
+			i += n + end + n - 1
+		case c == '*' || c == '_':
+			n := min(runLength(s, i, c), 3)
+			if content, end, ok := emphasis(s, i, n); ok {
+				inner := r.inlines(content)
+				switch n {
+				case 1:
+					inner = "<em>" + inner + "</em>"
+				case 2:
+					inner = "<strong>" + inner + "</strong>"
+				default:
+					inner = "<em><strong>" + inner + "</strong></em>"
+				}
+				out.WriteString(inner)
+				i = end - 1
+				continue
+			}
+			run := runLength(s, i, c)
+			out.WriteString(s[i : i+run])
+			i += run - 1
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if text, dest, title, end, ok := markdownLink(s, i+1); ok {
+				src, ok := dest, true
+				r.images = append(r.images, dest)
+				if r.image != nil {
+					src, ok = r.image(dest)
+				}
+				alt := strings.Join(strings.Fields(html.UnescapeString(tagPattern.ReplaceAllString(r.inlines(text), ""))), " ")
+				i = end - 1
+				if !ok {
+					out.WriteString(html.EscapeString(alt))
+					continue
+				}
+				out.WriteString(`<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(alt) + `"`)
+				if title != "" {
+					out.WriteString(` title="` + html.EscapeString(title) + `"`)
+				}
+				out.WriteString("/>")
+				continue
+			}
+			out.WriteString("!")
+		case c == '[':
+			if text, dest, title, end, ok := markdownLink(s, i); ok {
+				out.WriteString(`<a href="` + html.EscapeString(dest) + `"`)
+				if title != "" {
+					out.WriteString(` title="` + html.EscapeString(title) + `"`)
+				}
+				out.WriteString(">" + r.inlines(text) + "</a>")
+				i = end - 1
+				continue
+			}
+			out.WriteString("[")
+		case c == '<':
+			if end := strings.IndexByte(s[i:], '>'); end > 0 && autolinkPattern.MatchString(s[i+1:i+end]) {
+				url := s[i+1 : i+end]
+				href := url
+				if !strings.Contains(url, "://") && strings.Contains(url, "@") {
+					href = "mailto:" + url
+				}
+				out.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(url) + "</a>")
+				i += end
+				continue
+			}
+			out.WriteString("&lt;")
+		default:
+			out.WriteString(html.EscapeString(s[i : i+1]))
+		}
+	}
+	return out.String()
+}
+
+var autolinkPattern = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^\s<>]*|[^\s<>@]+@[^\s<>@]+\.[^\s<>@]+)$`)
+
+// runLength returns how many times c repeats in s from i
+func runLength(s string, i int, c byte) int {
+	n := 0
+	for i+n < len(s) && s[i+n] == c {
+		n++
+	}
+	return n
+}
+
+// emphasis finds the end of the emphasis opened by n of the delimiter at
+// s[i], returning its content and the index after its closing delimiter
+func emphasis(s string, i, n int) (content string, end int, ok bool) {
+	c := s[i]
+	start := i + n
+	if start >= len(s) || s[start] == ' ' || s[start] == '\n' {
+		return "", 0, false
+	}
+	if c == '_' && i > 0 && isWordByte(s[i-1]) {
+		// Underscores within a word aren't emphasis
+		return "", 0, false
+	}
+	for j := start + 1; j+n <= len(s); j++ {
+		switch {
+		case s[j] == '`':
+			// Delimiters in code spans don't count
+			if k := strings.Index(s[j+1:], "`"); k >= 0 {
+				j += k + 1
+			}
+		case s[j] == '\\':
+			j++
+		case s[j] == c && runLength(s, j, c) >= n && s[j-1] != ' ' && s[j-1] != '\n':
+			if c == '_' && j+n < len(s) && isWordByte(s[j+n]) {
+				continue
+			}
+			if run := runLength(s, j, c); run > n && j+run < len(s) {
+				j += run - 1
+				continue
+			}
+			return s[start:j], j + n, true
+		}
+	}
+	return "", 0, false
+}
+
+// isWordByte reports whether b is an ASCII letter or digit, or part of a
+// multibyte character
+func isWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b >= 0x80
+}
+
+// markdownLink parses the [text](destination "title") link starting at
+// s[i], returning its parts and the index after it
+func markdownLink(s string, i int) (text, dest, title string, end int, ok bool) {
+	depth := 0
+	close := -1
+	for j := i; j < len(s) && close < 0; j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				close = j
+			}
+		}
+	}
+	if close < 0 || close+1 >= len(s) || s[close+1] != '(' {
+		return "", "", "", 0, false
+	}
+	depth = 0
+	paren := -1
+	for j := close + 1; j < len(s) && paren < 0; j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				paren = j
+			}
+		}
+	}
+	if paren < 0 {
+		return "", "", "", 0, false
+	}
+	inner := strings.TrimSpace(s[close+2 : paren])
+	if strings.HasPrefix(inner, "<") {
+		if gt := strings.IndexByte(inner, '>'); gt > 0 {
+			dest, inner = inner[1:gt], strings.TrimSpace(inner[gt+1:])
+		}
+	} else if sp := strings.IndexAny(inner, " \t\n"); sp >= 0 {
+		dest, inner = inner[:sp], strings.TrimSpace(inner[sp:])
+	} else {
+		dest, inner = inner, ""
+	}
+	if len(inner) >= 2 && strings.ContainsRune(`"'(`, rune(inner[0])) {
+		title = inner[1 : len(inner)-1]
+	} else if inner != "" {
+		return "", "", "", 0, false
+	}
+	return s[i+1 : close], dest, title, paren + 1, true
+}
@@ -0,0 +1,118 @@
+package epubconv
+
+import "strings"
+
+// Info is a book's metadata, with the EPUB 3 meta elements refining the
+// Dublin Core elements applied to them
+type Info struct {
+	Titles       []string   `json:"titles,omitempty" yaml:"titles,omitempty"`
+	Creators     []Person   `json:"creators,omitempty" yaml:"creators,omitempty"`
+	Contributors []Person   `json:"contributors,omitempty" yaml:"contributors,omitempty"`
+	Languages    []string   `json:"languages,omitempty" yaml:"languages,omitempty"`
+	Identifier   string     `json:"identifier,omitempty" yaml:"identifier,omitempty"`
+	Identifiers  []InfoID   `json:"identifiers,omitempty" yaml:"identifiers,omitempty"`
+	Publishers   []string   `json:"publishers,omitempty" yaml:"publishers,omitempty"`
+	Dates        []InfoDate `json:"dates,omitempty" yaml:"dates,omitempty"`
+	Modified     string     `json:"modified,omitempty" yaml:"modified,omitempty"`
+	Subjects     []string   `json:"subjects,omitempty" yaml:"subjects,omitempty"`
+	Description  string     `json:"description,omitempty" yaml:"description,omitempty"`
+	Rights       string     `json:"rights,omitempty" yaml:"rights,omitempty"`
+	Series       string     `json:"series,omitempty" yaml:"series,omitempty"`
+	SeriesIndex  string     `json:"seriesIndex,omitempty" yaml:"seriesIndex,omitempty"`
+	// Direction is the page progression direction of the spine
+	Direction string `json:"direction,omitempty" yaml:"direction,omitempty"`
+}
+
+// Person is a creator or contributor. Role is a MARC relator code such as
+// "aut" or "trl".
+type Person struct {
+	Name   string `json:"name" yaml:"name"`
+	FileAs string `json:"fileAs,omitempty" yaml:"fileAs,omitempty"`
+	Role   string `json:"role,omitempty" yaml:"role,omitempty"`
+}
+
+// InfoID is an identifier of the book, such as its ISBN or UUID
+type InfoID struct {
+	Value  string `json:"value" yaml:"value"`
+	Scheme string `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+}
+
+// InfoDate is a date in the book's history. Event is what happened then,
+// such as "publication", if known.
+type InfoDate struct {
+	Value string `json:"value" yaml:"value"`
+	Event string `json:"event,omitempty" yaml:"event,omitempty"`
+}
+
+// Info returns the book's metadata
+func (pkg *Package) Info() Info {
+	m := &pkg.Metadata
+
+	// EPUB 3 meta properties refining an element, by element ID
+	refinements := make(map[string]map[string]string)
+	for _, meta := range m.Metas {
+		id, ok := strings.CutPrefix(strings.TrimSpace(meta.Refines), "#")
+		if !ok || meta.Property == "" {
+			continue
+		}
+		if refinements[id] == nil {
+			refinements[id] = make(map[string]string)
+		}
+		if _, seen := refinements[id][meta.Property]; !seen {
+			refinements[id][meta.Property] = strings.TrimSpace(meta.Value)
+		}
+	}
+	refined := func(id, property, value string) string {
+		if value = strings.TrimSpace(value); value != "" || id == "" {
+			return value
+		}
+		return refinements[id][property]
+	}
+	people := func(creators []Creator) []Person {
+		var people []Person
+		for _, c := range creators {
+			if name := strings.TrimSpace(c.Name); name != "" {
+				people = append(people, Person{
+					Name:   name,
+					FileAs: refined(c.ID, "file-as", c.FileAs),
+					Role:   refined(c.ID, "role", c.Role),
+				})
+			}
+		}
+		return people
+	}
+
+	info := Info{
+		Titles:       trimAll(m.Titles),
+		Creators:     people(m.Creators),
+		Contributors: people(m.Contributors),
+		Languages:    trimAll(m.Languages),
+		Publishers:   trimAll(m.Publishers),
+		Subjects:     trimAll(m.Subjects),
+		Description:  strings.Join(trimAll(m.Descriptions), "\n\n"),
+		Rights:       strings.Join(trimAll(m.Rights), "\n\n"),
+	}
+	for _, id := range m.Identifiers {
+		value := strings.TrimSpace(id.Value)
+		if value == "" {
+			continue
+		}
+		info.Identifiers = append(info.Identifiers, InfoID{Value: value, Scheme: refined(id.ID, "identifier-type", id.Scheme)})
+		if id.ID != "" && id.ID == pkg.UniqueIdentifier {
+			info.Identifier = value
+		}
+	}
+	for _, date := range m.Dates {
+		if value := strings.TrimSpace(date.Value); value != "" {
+			info.Dates = append(info.Dates, InfoDate{Value: value, Event: strings.TrimSpace(date.Event)})
+		}
+	}
+	for _, meta := range m.Metas {
+		if meta.Property == "dcterms:modified" && meta.Refines == "" {
+			info.Modified = strings.TrimSpace(meta.Value)
+		}
+	}
+	info.Series, info.SeriesIndex = pkg.Series()
+	info.Direction = strings.ToLower(strings.TrimSpace(pkg.Spine.PageProgressionDirection))
+	return info
+}
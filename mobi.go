@@ -0,0 +1,583 @@
+package epubconv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// MOBI compression types
+const (
+	mobiUncompressed = 1
+	mobiPalmDoc      = 2
+	mobiHuffCDIC     = 17480
+)
+
+// mobiNoIndex is the record index of a MOBI header field that doesn't
+// point to a record
+const mobiNoIndex uint32 = 0xffffffff
+
+// mobiHeader holds the fields of the first record of a MOBI file, the
+// PalmDOC header and MOBI header, that reading its text needs
+type mobiHeader struct {
+	compression int
+	textLength  uint32
+	textRecords int
+	encryption  int
+	// The rest are only set in a MOBI file, not a plain PalmDOC one. Record
+	// indexes and counts are kept as the file gives them, as they may not
+	// fit in an int.
+	mobi       bool
+	encoding   uint32 // 1252 or 65001 (UTF-8)
+	version    uint32
+	huffRecord uint32
+	huffCount  uint32
+	extraFlags int
+	fdstRecord uint32
+	exth       []byte
+	fullName   []byte
+}
+
+var errMOBITruncated = errors.New("file is truncated")
+
+// readMOBI reads a MOBI, AZW3 or PalmDOC ebook. Each
+// <mbp:pagebreak/>-separated part of a MOBI's text becomes a content
+// document, and so does each HTML file of a KF8 (AZW3) book.
+func readMOBI(data []byte, opts Options) (*convertedBook, error) {
+	records, err := pdbRecords(data)
+	if err != nil {
+		return nil, err
+	}
+	h, err := parseMOBIHeader(records[0])
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxMemory > 0 && int64(h.textLength) > int64(opts.MaxMemory) {
+		return nil, fmt.Errorf("%w: the text is %d bytes", ErrMemoryLimit, h.textLength)
+	}
+	limit := newMOBILimit(opts)
+
+	c := &convertedBook{metadata: h.metadata(data)}
+	if h.encryption != 0 {
+		// The text can't be read, but the metadata can
+		c.drm = "Mobipocket"
+		return c, nil
+	}
+	text, err := h.text(records, limit)
+	if err != nil {
+		return nil, err
+	}
+	if h.encoding == 65001 {
+		text = bytes.ToValidUTF8(text, []byte("�"))
+	} else if text, err = charmap.Windows1252.NewDecoder().Bytes(text); err != nil {
+		return nil, err
+	}
+
+	if !h.mobi {
+		// A PalmDOC book is plain text, a paragraph to a line
+		var body strings.Builder
+		for _, line := range strings.Split(string(text), "\n") {
+			body.WriteString("<p>" + html.EscapeString(line) + "</p>\n")
+		}
+		c.addDocument("text.xhtml", firstTitle(c.metadata), body.String())
+		return c, nil
+	}
+	if h.version >= 8 && uint64(h.fdstRecord) < uint64(len(records)) {
+		// The first flow of a KF8 book is its HTML, and the rest its
+		// stylesheets and images
+		text = firstFlow(records[h.fdstRecord], text)
+	}
+	for i, part := range splitMOBIText(string(text), h.version >= 8) {
+		c.addDocument(fmt.Sprintf("part%04d.xhtml", i+1), firstTitle(c.metadata), part)
+	}
+	return c, nil
+}
+
+// pdbRecords splits a Palm database into its records
+func pdbRecords(data []byte) ([][]byte, error) {
+	if len(data) < 78 {
+		return nil, errMOBITruncated
+	}
+	n := int(binary.BigEndian.Uint16(data[76:]))
+	if n == 0 || len(data) < 78+8*n {
+		return nil, errMOBITruncated
+	}
+	// Offsets are checked against the length of data before they become
+	// ints, which on 32-bit platforms can't hold every uint32
+	offsets := make([]uint64, n+1)
+	for i := 0; i < n; i++ {
+		offsets[i] = uint64(binary.BigEndian.Uint32(data[78+8*i:]))
+	}
+	offsets[n] = uint64(len(data))
+	records := make([][]byte, n)
+	for i := range records {
+		start, end := offsets[i], offsets[i+1]
+		if start > end || end > uint64(len(data)) {
+			return nil, fmt.Errorf("record %d is out of bounds", i)
+		}
+		records[i] = data[int(start):int(end)]
+	}
+	return records, nil
+}
+
+// parseMOBIHeader reads the headers in the first record of a MOBI file
+func parseMOBIHeader(rec []byte) (*mobiHeader, error) {
+	if len(rec) < 16 {
+		return nil, errMOBITruncated
+	}
+	be := binary.BigEndian
+	h := &mobiHeader{
+		compression: int(be.Uint16(rec[0:])),
+		textLength:  be.Uint32(rec[4:]),
+		textRecords: int(be.Uint16(rec[8:])),
+		encryption:  int(be.Uint16(rec[12:])),
+		encoding:    1252,
+		fdstRecord:  mobiNoIndex,
+	}
+	if len(rec) < 0x84 || string(rec[16:20]) != "MOBI" {
+		return h, nil
+	}
+	h.mobi = true
+	headerLength := uint64(be.Uint32(rec[0x14:]))
+	h.encoding = be.Uint32(rec[0x1c:])
+	h.version = be.Uint32(rec[0x24:])
+	if nameOffset, nameLength := uint64(be.Uint32(rec[0x54:])), uint64(be.Uint32(rec[0x58:])); nameOffset+nameLength <= uint64(len(rec)) {
+		h.fullName = rec[int(nameOffset):int(nameOffset+nameLength)]
+	}
+	h.huffRecord = be.Uint32(rec[0x70:])
+	h.huffCount = be.Uint32(rec[0x74:])
+	if h.version >= 5 && headerLength >= 0xe4 && len(rec) >= 0xf4 {
+		h.extraFlags = int(be.Uint16(rec[0xf2:]))
+	}
+	if h.version >= 8 && len(rec) >= 0xc4 {
+		h.fdstRecord = be.Uint32(rec[0xc0:])
+	}
+	if exthFlags := be.Uint32(rec[0x80:]); exthFlags&0x40 != 0 && 16+headerLength+12 <= uint64(len(rec)) {
+		h.exth = rec[int(16+headerLength):]
+	}
+	return h, nil
+}
+
+// metadata returns the book's metadata from the EXTH header, or failing
+// that the full name in the MOBI header or the name of the database in data
+func (h *mobiHeader) metadata(data []byte) Metadata {
+	decode := func(b []byte) string {
+		if h.encoding != 65001 {
+			b, _ = charmap.Windows1252.NewDecoder().Bytes(b)
+		}
+		return strings.TrimSpace(string(bytes.ToValidUTF8(b, nil)))
+	}
+	var m Metadata
+	title := ""
+	if exth := h.exth; len(exth) >= 12 && string(exth[:4]) == "EXTH" {
+		count := binary.BigEndian.Uint32(exth[8:])
+		pos := 12
+		for i := uint32(0); i < count && pos+8 <= len(exth); i++ {
+			kind := binary.BigEndian.Uint32(exth[pos:])
+			length := uint64(binary.BigEndian.Uint32(exth[pos+4:]))
+			if length < 8 || uint64(pos)+length > uint64(len(exth)) {
+				break
+			}
+			value := decode(exth[pos+8 : pos+int(length)])
+			pos += int(length)
+			if value == "" {
+				continue
+			}
+			switch kind {
+			case 100:
+				m.Creators = append(m.Creators, Creator{Name: value})
+			case 101:
+				m.Publishers = append(m.Publishers, value)
+			case 103:
+				m.Descriptions = append(m.Descriptions, value)
+			case 104:
+				m.Identifiers = append(m.Identifiers, Identifier{Value: value, Scheme: "ISBN"})
+			case 105:
+				m.Subjects = append(m.Subjects, value)
+			case 106:
+				m.Dates = append(m.Dates, Date{Value: value, Event: "publication"})
+			case 109:
+				m.Rights = append(m.Rights, value)
+			case 503:
+				title = value
+			case 524:
+				m.Languages = append(m.Languages, value)
+			}
+		}
+	}
+	if title == "" {
+		title = decode(h.fullName)
+	}
+	if title == "" {
+		name, _, _ := bytes.Cut(data[:32], []byte{0})
+		title = decode(name)
+	}
+	if title != "" {
+		m.Titles = []string{title}
+	}
+	return m
+}
+
+// mobiLimit bounds the text decompressed from a MOBI book by MaxMemory and
+// MaxTotalSize, whichever is smaller, as the sizes in its headers aren't
+// trusted. Zero means unlimited.
+type mobiLimit struct {
+	max  int64
+	used int64
+	err  error
+}
+
+func newMOBILimit(opts Options) *mobiLimit {
+	l := &mobiLimit{max: int64(opts.MaxTotalSize)}
+	if l.max > 0 {
+		l.err = fmt.Errorf("%w: the book decompresses to more than %s (--max-total-size)", ErrArchiveLimit, formatByteSize(l.max))
+	}
+	if opts.MaxMemory > 0 && (l.max == 0 || int64(opts.MaxMemory) < l.max) {
+		l.max = int64(opts.MaxMemory)
+		l.err = fmt.Errorf("%w: the text decompresses to more than %s (--max-memory)", ErrMemoryLimit, formatByteSize(l.max))
+	}
+	return l
+}
+
+// add accounts for n more bytes decompressed, failing if that goes over the
+// limit
+func (l *mobiLimit) add(n int) error {
+	l.used += int64(n)
+	if l.max > 0 && l.used > l.max {
+		return l.err
+	}
+	return nil
+}
+
+// text returns the book's text, decompressed within limit, from the
+// records following the header
+func (h *mobiHeader) text(records [][]byte, limit *mobiLimit) ([]byte, error) {
+	if h.textRecords >= len(records) {
+		return nil, errMOBITruncated
+	}
+	var huff *huffReader
+	switch h.compression {
+	case mobiUncompressed, mobiPalmDoc:
+	case mobiHuffCDIC:
+		start, end := uint64(h.huffRecord), uint64(h.huffRecord)+uint64(h.huffCount)
+		if h.huffRecord == 0 || h.huffRecord == mobiNoIndex || h.huffCount < 1 || end > uint64(len(records)) {
+			return nil, errors.New("missing HUFF/CDIC records")
+		}
+		var err error
+		if huff, err = newHuffReader(records[int(start):int(end)], limit); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression type %d", h.compression)
+	}
+
+	var text bytes.Buffer
+	for _, rec := range records[1 : h.textRecords+1] {
+		rec = rec[:len(rec)-trailingEntriesSize(rec, h.extraFlags)]
+		switch h.compression {
+		case mobiUncompressed:
+			if err := limit.add(len(rec)); err != nil {
+				return nil, err
+			}
+			text.Write(rec)
+		case mobiPalmDoc:
+			out := palmDocDecompress(rec)
+			if err := limit.add(len(out)); err != nil {
+				return nil, err
+			}
+			text.Write(out)
+		case mobiHuffCDIC:
+			// The reader counts what it decompresses against limit itself,
+			// as a single record can expand to any size
+			out, err := huff.unpack(rec, 0)
+			if err != nil {
+				return nil, err
+			}
+			text.Write(out)
+		}
+	}
+	if h.textLength > 0 && uint64(text.Len()) > uint64(h.textLength) {
+		text.Truncate(int(h.textLength))
+	}
+	return text.Bytes(), nil
+}
+
+// trailingEntriesSize returns the size of the extra data at the end of a
+// text record, which the extra flags of the MOBI header describe
+func trailingEntriesSize(rec []byte, flags int) int {
+	size := 0
+	for f := flags >> 1; f != 0; f >>= 1 {
+		if f&1 == 0 {
+			continue
+		}
+		// Each entry ends with its size, in 7-bit groups with the high bit
+		// marking the first
+		entry, shift := 0, 0
+		for i := len(rec) - size - 1; i >= 0 && shift < 28; i-- {
+			b := rec[i]
+			entry |= int(b&0x7f) << shift
+			shift += 7
+			if b&0x80 != 0 {
+				break
+			}
+		}
+		size += entry
+		if size > len(rec) {
+			return len(rec)
+		}
+	}
+	if flags&1 != 0 && size < len(rec) {
+		// The bytes of a multibyte character continued in the next record
+		size += int(rec[len(rec)-size-1]&0x3) + 1
+	}
+	return min(size, len(rec))
+}
+
+// palmDocDecompress expands PalmDOC (LZ77) compressed data
+func palmDocDecompress(in []byte) []byte {
+	out := make([]byte, 0, 4096)
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		switch {
+		case c >= 1 && c <= 8:
+			// A run of literal bytes
+			end := min(i+1+int(c), len(in))
+			out = append(out, in[i+1:end]...)
+			i = end - 1
+		case c <= 0x7f:
+			out = append(out, c)
+		case c <= 0xbf:
+			// A distance and length back into what has been decompressed
+			if i+1 >= len(in) {
+				return out
+			}
+			i++
+			pair := int(c)<<8 | int(in[i])
+			distance, length := (pair&0x3fff)>>3, pair&7+3
+			if distance == 0 || distance > len(out) {
+				continue
+			}
+			for j := 0; j < length; j++ {
+				out = append(out, out[len(out)-distance])
+			}
+		default:
+			// A space followed by a character
+			out = append(out, ' ', c^0x80)
+		}
+	}
+	return out
+}
+
+// huffReader decompresses MOBI text compressed with HUFF/CDIC: Huffman
+// codes for phrases in a dictionary, which may themselves be compressed
+type huffReader struct {
+	dict1      [256]huffCode
+	minCode    [33]uint64
+	maxCode    [33]uint64
+	dictionary []huffPhrase
+	// limit counts all the data decompressed, dictionary entries included
+	limit *mobiLimit
+}
+
+// huffCode is an entry of the table of codes by their first byte
+type huffCode struct {
+	length   int
+	terminal bool
+	maxCode  uint64
+}
+
+// huffPhrase is a dictionary entry, which when not decompressed yet may
+// refer to other entries
+type huffPhrase struct {
+	data         []byte
+	decompressed bool
+}
+
+// maxHuffDepth bounds how deeply dictionary entries can refer to others
+const maxHuffDepth = 32
+
+func newHuffReader(records [][]byte, limit *mobiLimit) (*huffReader, error) {
+	huff := records[0]
+	if len(huff) < 24 || string(huff[:8]) != "HUFF\x00\x00\x00\x18" {
+		return nil, errors.New("invalid HUFF record")
+	}
+	be := binary.BigEndian
+	offset1, offset2 := uint64(be.Uint32(huff[8:])), uint64(be.Uint32(huff[12:]))
+	if offset1+256*4 > uint64(len(huff)) || offset2+64*4 > uint64(len(huff)) {
+		return nil, errors.New("invalid HUFF record")
+	}
+	off1, off2 := int(offset1), int(offset2)
+
+	r := &huffReader{limit: limit}
+	for i := range r.dict1 {
+		v := be.Uint32(huff[off1+4*i:])
+		code := huffCode{length: int(v & 0x1f), terminal: v&0x80 != 0}
+		if code.length == 0 {
+			return nil, errors.New("invalid HUFF code length")
+		}
+		code.maxCode = (uint64(v>>8)+1)<<(32-code.length) - 1
+		r.dict1[i] = code
+	}
+	for length := 1; length <= 32; length++ {
+		r.minCode[length] = uint64(be.Uint32(huff[off2+8*(length-1):])) << (32 - length)
+		r.maxCode[length] = (uint64(be.Uint32(huff[off2+8*(length-1)+4:]))+1)<<(32-length) - 1
+	}
+
+	for _, cdic := range records[1:] {
+		if len(cdic) < 16 || string(cdic[:8]) != "CDIC\x00\x00\x00\x10" {
+			return nil, errors.New("invalid CDIC record")
+		}
+		phrases, bits := int64(be.Uint32(cdic[8:])), be.Uint32(cdic[12:])
+		if bits > 31 {
+			return nil, errors.New("invalid CDIC record")
+		}
+		n := min(int64(1)<<bits, phrases-int64(len(r.dictionary)))
+		for i := 0; int64(i) < n; i++ {
+			if 16+2*i+2 > len(cdic) {
+				return nil, errMOBITruncated
+			}
+			off := int(be.Uint16(cdic[16+2*i:]))
+			if 18+off > len(cdic) {
+				return nil, errMOBITruncated
+			}
+			length := int(be.Uint16(cdic[16+off:]))
+			end := 18 + off + length&0x7fff
+			if end > len(cdic) {
+				return nil, errMOBITruncated
+			}
+			r.dictionary = append(r.dictionary, huffPhrase{data: cdic[18+off : end], decompressed: length&0x8000 != 0})
+		}
+	}
+	return r, nil
+}
+
+// unpack decompresses data. Depth counts the dictionary entries being
+// decompressed that data is part of.
+func (r *huffReader) unpack(data []byte, depth int) ([]byte, error) {
+	if depth > maxHuffDepth {
+		return nil, errors.New("HUFF/CDIC dictionary entries refer to each other too deeply")
+	}
+	bitsLeft := len(data) * 8
+	padded := append(append([]byte{}, data...), make([]byte, 8)...)
+	pos := 0
+	x := binary.BigEndian.Uint64(padded)
+	n := 32
+	var out []byte
+	for {
+		if n <= 0 {
+			pos += 4
+			x = binary.BigEndian.Uint64(padded[pos:])
+			n += 32
+		}
+		code := (x >> n) & 0xffffffff
+
+		c := r.dict1[code>>24]
+		length, maxCode := c.length, c.maxCode
+		if !c.terminal {
+			for length < 32 && code < r.minCode[length] {
+				length++
+			}
+			maxCode = r.maxCode[length]
+		}
+		n -= length
+		bitsLeft -= length
+		if bitsLeft < 0 {
+			return out, nil
+		}
+
+		index := int((maxCode - code) >> (32 - length))
+		if index < 0 || index >= len(r.dictionary) {
+			return nil, errors.New("invalid HUFF/CDIC code")
+		}
+		phrase := &r.dictionary[index]
+		if !phrase.decompressed {
+			expanded, err := r.unpack(phrase.data, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			phrase.data, phrase.decompressed = expanded, true
+		}
+		if err := r.limit.add(len(phrase.data)); err != nil {
+			return nil, err
+		}
+		out = append(out, phrase.data...)
+	}
+}
+
+// firstFlow returns the first flow of KF8 text, as listed in its FDST
+// record, or all of text if the record can't be read
+func firstFlow(fdst, text []byte) []byte {
+	if len(fdst) < 20 || string(fdst[:4]) != "FDST" {
+		return text
+	}
+	start, end := uint64(binary.BigEndian.Uint32(fdst[12:])), uint64(binary.BigEndian.Uint32(fdst[16:]))
+	if start > end || end > uint64(len(text)) {
+		return text
+	}
+	return text[int(start):int(end)]
+}
+
+var (
+	mobiPageBreakPattern = regexp.MustCompile(`(?i)<mbp:pagebreak\s*/?>`)
+	kf8FilePattern       = regexp.MustCompile(`(?i)<html[\s>]`)
+	mobiFileposPattern   = regexp.MustCompile(`(?i)\s(filepos|recindex)=["']?[0-9]+["']?`)
+)
+
+// splitMOBIText splits the text of a MOBI book into the bodies of its
+// content documents: the parts between page breaks, or for a KF8 book the
+// HTML files it was made from
+func splitMOBIText(text string, kf8 bool) []string {
+	var parts []string
+	if kf8 {
+		starts := kf8FilePattern.FindAllStringIndex(text, -1)
+		for i, start := range starts {
+			end := len(text)
+			if i+1 < len(starts) {
+				end = starts[i+1][0]
+			}
+			parts = append(parts, htmlBody(text[start[0]:end]))
+		}
+	} else {
+		for _, part := range mobiPageBreakPattern.Split(htmlBody(text), -1) {
+			parts = append(parts, mobiFileposPattern.ReplaceAllString(part, ""))
+		}
+	}
+	var bodies []string
+	for _, part := range parts {
+		if strings.TrimSpace(part) != "" {
+			bodies = append(bodies, part)
+		}
+	}
+	return bodies
+}
+
+var (
+	bodyStartPattern = regexp.MustCompile(`(?is)^.*?<body[^>]*>`)
+	bodyEndPattern   = regexp.MustCompile(`(?is)</body>.*$`)
+)
+
+// htmlBody returns the content of the body element of an HTML document,
+// or all of it if it has no body tags
+func htmlBody(doc string) string {
+	if loc := bodyStartPattern.FindStringIndex(doc); loc != nil {
+		doc = doc[loc[1]:]
+	}
+	if loc := bodyEndPattern.FindStringIndex(doc); loc != nil {
+		doc = doc[:loc[0]]
+	}
+	return doc
+}
+
+// firstTitle returns the first title in m, or ""
+func firstTitle(m Metadata) string {
+	if titles := trimAll(m.Titles); len(titles) > 0 {
+		return titles[0]
+	}
+	return ""
+}
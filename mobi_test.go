@@ -0,0 +1,240 @@
+package epubconv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// palmDB returns a Palm database holding records
+func palmDB(records ...[]byte) []byte {
+	var db bytes.Buffer
+	header := make([]byte, 78)
+	copy(header, "Test Book")
+	copy(header[60:], "BOOKMOBI")
+	binary.BigEndian.PutUint16(header[76:], uint16(len(records)))
+	db.Write(header)
+	offset := 78 + 8*len(records)
+	for _, rec := range records {
+		entry := make([]byte, 8)
+		binary.BigEndian.PutUint32(entry, uint32(offset))
+		db.Write(entry)
+		offset += len(rec)
+	}
+	for _, rec := range records {
+		db.Write(rec)
+	}
+	return db.Bytes()
+}
+
+// palmDocHeader returns the first record of a PalmDOC book whose text is
+// in textRecords records of textLength bytes in all
+func palmDocHeader(compression, textLength, textRecords int) []byte {
+	rec := make([]byte, 16)
+	binary.BigEndian.PutUint16(rec[0:], uint16(compression))
+	binary.BigEndian.PutUint32(rec[4:], uint32(textLength))
+	binary.BigEndian.PutUint16(rec[8:], uint16(textRecords))
+	binary.BigEndian.PutUint16(rec[10:], 4096)
+	return rec
+}
+
+// mobiHeaderRecord returns the first record of a MOBI book whose text is in
+// one record compressed with HUFF/CDIC, with the HUFF and CDIC records at
+// huffRecord and after
+func mobiHeaderRecord(huffRecord, huffCount uint32) []byte {
+	rec := make([]byte, 0x84)
+	copy(rec, palmDocHeader(mobiHuffCDIC, 5, 1))
+	copy(rec[16:], "MOBI")
+	binary.BigEndian.PutUint32(rec[0x14:], 0x74)
+	binary.BigEndian.PutUint32(rec[0x1c:], 65001)
+	binary.BigEndian.PutUint32(rec[0x24:], 6)
+	binary.BigEndian.PutUint32(rec[0x70:], huffRecord)
+	binary.BigEndian.PutUint32(rec[0x74:], huffCount)
+	return rec
+}
+
+// huffRecord returns a HUFF record whose codes are all eight bits long
+func huffRecord() []byte {
+	rec := make([]byte, 24+256*4+64*4)
+	copy(rec, "HUFF\x00\x00\x00\x18")
+	binary.BigEndian.PutUint32(rec[8:], 24)
+	binary.BigEndian.PutUint32(rec[12:], 24+256*4)
+	for i := 0; i < 256; i++ {
+		binary.BigEndian.PutUint32(rec[24+4*i:], uint32(i)<<8|0x80|8)
+	}
+	return rec
+}
+
+// cdicRecord returns a CDIC record holding phrase as its only, already
+// decompressed, entry
+func cdicRecord(phrase []byte) []byte {
+	rec := []byte("CDIC\x00\x00\x00\x10\x00\x00\x00\x01\x00\x00\x00\x01\x00\x02")
+	rec = binary.BigEndian.AppendUint16(rec, 0x8000|uint16(len(phrase)))
+	return append(rec, phrase...)
+}
+
+// palmDocRepeat returns PalmDOC compressed data expanding to 'a' followed
+// by n copies of ten more
+func palmDocRepeat(n int) []byte {
+	data := []byte{'a'}
+	for i := 0; i < n; i++ {
+		// Distance 1, length 10
+		data = append(data, 0x80, 1<<3|7)
+	}
+	return data
+}
+
+func TestReadMOBILimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		opts    Options
+		wantErr error
+		// wantMsg is part of the error expected when wantErr is nil
+		wantMsg  string
+		wantText string
+	}{
+		{
+			name:     "uncompressed",
+			data:     palmDB(palmDocHeader(mobiUncompressed, 5, 1), []byte("hello")),
+			wantText: "<p>hello</p>",
+		},
+		{
+			name:     "palmdoc",
+			data:     palmDB(palmDocHeader(mobiPalmDoc, 21, 1), palmDocRepeat(2)),
+			wantText: strings.Repeat("a", 21),
+		},
+		{
+			name:     "palmdoc with a truncated pair",
+			data:     palmDB(palmDocHeader(mobiPalmDoc, 2, 1), []byte{'a', 'b', 0x80}),
+			wantText: "<p>ab</p>",
+		},
+		{
+			name:    "too short for a header",
+			data:    []byte("BOOKMOBI"),
+			wantErr: errMOBITruncated,
+		},
+		{
+			name:    "record list past the end",
+			data:    palmDB(palmDocHeader(mobiUncompressed, 5, 1), []byte("hello"))[:80],
+			wantErr: errMOBITruncated,
+		},
+		{
+			name: "record past the end",
+			data: func() []byte {
+				data := palmDB(palmDocHeader(mobiUncompressed, 5, 1), []byte("hello"))
+				binary.BigEndian.PutUint32(data[78+8:], 0xfffffff0)
+				return data
+			}(),
+			wantMsg: "is out of bounds",
+		},
+		{
+			name:    "text records missing",
+			data:    palmDB(palmDocHeader(mobiUncompressed, 15, 3), []byte("hello")),
+			wantErr: errMOBITruncated,
+		},
+		{
+			name:    "header record truncated",
+			data:    palmDB([]byte{0, 1}, []byte("hello")),
+			wantErr: errMOBITruncated,
+		},
+		{
+			name:    "palmdoc text over MaxMemory",
+			data:    palmDB(palmDocHeader(mobiPalmDoc, 10, 1), palmDocRepeat(100)),
+			opts:    Options{MaxMemory: 500},
+			wantErr: ErrMemoryLimit,
+		},
+		{
+			name:    "uncompressed text over MaxMemory",
+			data:    palmDB(palmDocHeader(mobiUncompressed, 1, 1), bytes.Repeat([]byte("a"), 1000)),
+			opts:    Options{MaxMemory: 500},
+			wantErr: ErrMemoryLimit,
+		},
+		{
+			name:    "text length over MaxMemory",
+			data:    palmDB(palmDocHeader(mobiUncompressed, 1000, 1), []byte("hello")),
+			opts:    Options{MaxMemory: 500},
+			wantErr: ErrMemoryLimit,
+		},
+		{
+			name:    "palmdoc text over MaxTotalSize",
+			data:    palmDB(palmDocHeader(mobiPalmDoc, 10, 1), palmDocRepeat(100)),
+			opts:    Options{MaxTotalSize: 500},
+			wantErr: ErrArchiveLimit,
+		},
+		{
+			name:    "MaxMemory below MaxTotalSize",
+			data:    palmDB(palmDocHeader(mobiPalmDoc, 10, 1), palmDocRepeat(100)),
+			opts:    Options{MaxMemory: 500, MaxTotalSize: 800},
+			wantErr: ErrMemoryLimit,
+		},
+		{
+			name:    "MaxTotalSize below MaxMemory",
+			data:    palmDB(palmDocHeader(mobiPalmDoc, 10, 1), palmDocRepeat(100)),
+			opts:    Options{MaxMemory: 800, MaxTotalSize: 500},
+			wantErr: ErrArchiveLimit,
+		},
+		{
+			name:    "huff records out of range",
+			data:    palmDB(mobiHeaderRecord(0xfffffff0, 0x20), []byte{0}),
+			wantMsg: "missing HUFF/CDIC records",
+		},
+		{
+			name:    "huff record count overflowing",
+			data:    palmDB(mobiHeaderRecord(2, mobiNoIndex), []byte{0}, huffRecord()),
+			wantMsg: "missing HUFF/CDIC records",
+		},
+		{
+			name:    "huff record truncated",
+			data:    palmDB(mobiHeaderRecord(2, 1), []byte{0}, huffRecord()[:100]),
+			wantMsg: "invalid HUFF record",
+		},
+		{
+			name: "cdic record truncated",
+			data: palmDB(mobiHeaderRecord(2, 2), []byte{0}, huffRecord(),
+				[]byte("CDIC\x00\x00\x00\x10\x00\x00\x00\x0a\x00\x00\x00\x04")),
+			wantErr: errMOBITruncated,
+		},
+		{
+			name:     "huff-cdic",
+			data:     palmDB(mobiHeaderRecord(2, 2), []byte{0}, huffRecord(), cdicRecord([]byte("hello"))),
+			wantText: "hello",
+		},
+		{
+			name:    "huff-cdic text over MaxMemory",
+			data:    palmDB(mobiHeaderRecord(2, 2), make([]byte, 10), huffRecord(), cdicRecord(bytes.Repeat([]byte("a"), 1000))),
+			opts:    Options{MaxMemory: 5000},
+			wantErr: ErrMemoryLimit,
+		},
+		{
+			name:    "huff-cdic text over MaxTotalSize",
+			data:    palmDB(mobiHeaderRecord(2, 2), make([]byte, 10), huffRecord(), cdicRecord(bytes.Repeat([]byte("a"), 1000))),
+			opts:    Options{MaxTotalSize: 5000},
+			wantErr: ErrArchiveLimit,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := readMOBI(test.data, test.opts)
+			switch {
+			case test.wantErr != nil:
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("err = %v, want %v", err, test.wantErr)
+				}
+				return
+			case test.wantMsg != "":
+				if err == nil || !strings.Contains(err.Error(), test.wantMsg) {
+					t.Fatalf("err = %v, want %q", err, test.wantMsg)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+			if len(c.files) == 0 || !strings.Contains(string(c.files[0].data), test.wantText) {
+				t.Errorf("text doesn't contain %q: %v", test.wantText, c.files)
+			}
+		})
+	}
+}
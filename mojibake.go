@@ -0,0 +1,86 @@
+package epubconv
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// cp1252Bytes maps the characters Windows-1252 assigns to bytes 0x80-0x9F
+// back to those bytes. Every other byte decodes to the Latin-1 character
+// with the same value.
+var cp1252Bytes = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E,
+	'‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+	'˜': 0x98, '™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// cp1252Byte returns the byte r was decoded from when UTF-8 text was
+// misread as Windows-1252 or Latin-1
+func cp1252Byte(r rune) (byte, bool) {
+	if r < 0x100 {
+		return byte(r), true
+	}
+	b, ok := cp1252Bytes[r]
+	return b, ok
+}
+
+// fixMojibake repairs text that was UTF-8 encoded, misread as Windows-1252
+// or Latin-1 and encoded as UTF-8 again, so that "itâ€™s" becomes "it’s".
+// Only character sequences that re-encode to a complete, valid multi-byte
+// UTF-8 sequence are replaced, which leaves genuine Latin-1 text such as
+// "café" alone. Text that went through the round trip more than once is
+// repaired by repeating the pass.
+func fixMojibake(text string) string {
+	for pass := 0; pass < 3; pass++ {
+		fixed, changed := fixMojibakePass(text)
+		if !changed {
+			break
+		}
+		text = fixed
+	}
+	return text
+}
+
+func fixMojibakePass(text string) (string, bool) {
+	runes := []rune(text)
+	var out strings.Builder
+	changed := false
+	for i := 0; i < len(runes); i++ {
+		if n := utf8SequenceLen(runes[i]); n > 1 && i+n <= len(runes) {
+			seq := make([]byte, 0, n)
+			for _, r := range runes[i : i+n] {
+				b, ok := cp1252Byte(r)
+				if !ok {
+					break
+				}
+				seq = append(seq, b)
+			}
+			if len(seq) == n {
+				if r, size := utf8.DecodeRune(seq); r != utf8.RuneError && size == n {
+					out.WriteRune(r)
+					i += n - 1
+					changed = true
+					continue
+				}
+			}
+		}
+		out.WriteRune(runes[i])
+	}
+	return out.String(), changed
+}
+
+// utf8SequenceLen returns the length of the UTF-8 sequence that would start
+// with the byte r was misread from, or 0 if that byte can't start a
+// multi-byte sequence
+func utf8SequenceLen(r rune) int {
+	switch {
+	case r >= 0xC2 && r <= 0xDF:
+		return 2
+	case r >= 0xE0 && r <= 0xEF:
+		return 3
+	case r >= 0xF0 && r <= 0xF4:
+		return 4
+	}
+	return 0
+}
@@ -0,0 +1,244 @@
+package epubconv
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Footnote modes for Options.Footnotes
+const (
+	FootnotesKeep   = "keep"
+	FootnotesInline = "inline"
+	FootnotesEnd    = "end"
+	FootnotesStrip  = "strip"
+)
+
+var FootnoteModes = []string{FootnotesKeep, FootnotesInline, FootnotesEnd, FootnotesStrip}
+
+// noteElement identifies an element by the archive path of its content
+// document and its id
+type noteElement struct {
+	path string
+	id   string
+}
+
+// bookNotes holds the notes of a book: the elements its noterefs point to,
+// with their text, and the noterefs themselves, which backlinks in the
+// notes point back to
+type bookNotes struct {
+	text map[noteElement]string
+	refs map[noteElement]bool
+}
+
+// hasType reports whether an element with attrs has the EPUB structural
+// semantics type epubType or the equivalent DPUB-ARIA role
+func hasType(attrs map[string]string, epubType string) bool {
+	for _, t := range strings.Fields(attrs["epub:type"]) {
+		if t == epubType {
+			return true
+		}
+	}
+	for _, role := range strings.Fields(attrs["role"]) {
+		if role == "doc-"+epubType {
+			return true
+		}
+	}
+	return false
+}
+
+// isNoteBody reports whether an element with attrs is marked as a note
+func isNoteBody(attrs map[string]string) bool {
+	return hasType(attrs, "footnote") || hasType(attrs, "endnote") || hasType(attrs, "rearnote")
+}
+
+// noteTarget returns the element href points to, from the content document
+// docPath, or false if href doesn't point to an element
+func noteTarget(docPath, href string) (noteElement, bool) {
+	file, id, ok := strings.Cut(strings.TrimSpace(href), "#")
+	if !ok || id == "" || strings.Contains(file, ":") {
+		return noteElement{}, false
+	}
+	if file == "" {
+		return noteElement{docPath, id}, true
+	}
+	return noteElement{resolveHref(path.Dir(docPath), file), id}, true
+}
+
+// readNotes finds the noterefs of the content documents in files and reads
+// the text of the notes they point to, failing to read files larger than
+// maxSize if it isn't zero. The documents are read again as the book is
+// converted, so problems with them are left for then to report.
+func (b *Book) readNotes(files []string, maxSize int64) *bookNotes {
+	notes := &bookNotes{text: make(map[noteElement]string), refs: make(map[noteElement]bool)}
+	quiet := b.quiet()
+	content := func(filePath string) string {
+		content, err := quiet.readFile(filePath, maxSize)
+		if err != nil {
+			return ""
+		}
+		content = quiet.decodeContent(filePath, content)
+		if isBinaryContent(content) {
+			return ""
+		}
+		if content, err = expandEntities(content); err != nil {
+			return ""
+		}
+		return content
+	}
+
+	targets := make(map[string]map[string]bool)
+	for _, filePath := range files {
+		walkHTML(content(filePath), func(tok html.Token) error {
+			if tok.Type != html.StartTagToken && tok.Type != html.SelfClosingTagToken {
+				return nil
+			}
+			t := tokenTag(tok)
+			if !hasType(t.attrs, "noteref") {
+				return nil
+			}
+			if target, ok := noteTarget(filePath, t.attrs["href"]); ok {
+				if targets[target.path] == nil {
+					targets[target.path] = make(map[string]bool)
+				}
+				targets[target.path][target.id] = true
+			}
+			if id := t.attrs["id"]; id != "" {
+				notes.refs[noteElement{filePath, id}] = true
+			}
+			return nil
+		})
+	}
+	for _, filePath := range files {
+		if targets[filePath] != nil {
+			notes.collect(filePath, content(filePath), targets[filePath])
+		}
+	}
+	return notes
+}
+
+// collect reads the text of the elements of the content document docPath
+// whose ids are in ids, leaving out noterefs and backlinks
+func (n *bookNotes) collect(docPath, content string, ids map[string]bool) {
+	// open holds the names of the open elements. The note being read, if
+	// any, is the one opened at depth, and links being left out at skip.
+	var (
+		open  []string
+		id    string
+		depth int
+		skip  int
+		text  strings.Builder
+	)
+	walkHTML(content, func(tok html.Token) error {
+		if tok.Type == html.TextToken {
+			if depth > 0 && skip == 0 {
+				text.WriteString(tok.Data)
+			}
+			return nil
+		}
+		t := tokenTag(tok)
+		if t.closing {
+			for j := len(open) - 1; j >= 0; j-- {
+				if open[j] == t.name {
+					open = open[:j]
+					break
+				}
+			}
+		} else if len(open) > 0 && open[len(open)-1] == t.name && impliedEndTags[t.name] {
+			open = open[:len(open)-1]
+		}
+		if skip > len(open) {
+			skip = 0
+		}
+		if depth > len(open) {
+			n.text[noteElement{docPath, id}] = strings.Join(strings.Fields(text.String()), " ")
+			depth = 0
+		}
+		if t.closing || t.selfClosing || voidElements[t.name] {
+			if blockElements[t.name] || t.name == "br" {
+				text.WriteByte(' ')
+			}
+			return nil
+		}
+
+		open = append(open, t.name)
+		switch {
+		case depth == 0 && ids[t.attrs["id"]]:
+			id, depth = t.attrs["id"], len(open)
+			text.Reset()
+		case depth > 0 && skip == 0 && n.isBacklink(docPath, t):
+			skip = len(open)
+		case blockElements[t.name]:
+			text.WriteByte(' ')
+		}
+		return nil
+	})
+	if depth > 0 {
+		n.text[noteElement{docPath, id}] = strings.Join(strings.Fields(text.String()), " ")
+	}
+}
+
+// isBacklink reports whether t, in a note in the content document docPath,
+// links back to a noteref or is a noteref itself
+func (n *bookNotes) isBacklink(docPath string, t htmlTag) bool {
+	if hasType(t.attrs, "backlink") || hasType(t.attrs, "noteref") {
+		return true
+	}
+	target, ok := noteTarget(docPath, t.attrs["href"])
+	return ok && t.name == "a" && n.refs[target]
+}
+
+// isNote reports whether the element t, in the content document docPath,
+// is a note, which is left out where it is found
+func (n *bookNotes) isNote(docPath string, t htmlTag) bool {
+	if isNoteBody(t.attrs) {
+		return true
+	}
+	if id := t.attrs["id"]; id != "" {
+		_, ok := n.text[noteElement{docPath, id}]
+		return ok
+	}
+	return false
+}
+
+// noteList is the notes of a chapter, listed at its end with FootnotesEnd
+type noteList struct {
+	labels []string
+	text   []string
+	seen   map[noteElement]bool
+}
+
+// add adds the note target with the given label, unless it has already
+// been added
+func (l *noteList) add(target noteElement, label, text string) {
+	if l.seen == nil {
+		l.seen = make(map[noteElement]bool)
+	}
+	if l.seen[target] {
+		return
+	}
+	l.seen[target] = true
+	l.labels = append(l.labels, label)
+	l.text = append(l.text, text)
+}
+
+// String renders the list, one "[label] text" line per note
+func (l *noteList) String() string {
+	lines := make([]string, len(l.labels))
+	for i, label := range l.labels {
+		lines[i] = fmt.Sprintf("[%s] %s", label, l.text[i])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// noteLabel cleans up the text of a noteref for use as the label of its
+// note, falling back to n if it has none
+func noteLabel(text string, n int) string {
+	label := strings.Trim(strings.Join(strings.Fields(text), " "), "[]() ")
+	if label == "" {
+		return fmt.Sprint(n)
+	}
+	return label
+}
@@ -0,0 +1,347 @@
+package epubconv
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Reading orders for Options.Order
+const (
+	OrderSpine = "spine"
+	OrderNCX   = "ncx"
+)
+
+var ReadingOrders = []string{OrderSpine, OrderNCX}
+
+// NCX structure for parsing toc.ncx
+type NCX struct {
+	NavPoints []navPoint `xml:"navMap>navPoint"`
+}
+
+type navPoint struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	NavPoints []navPoint `xml:"navPoint"`
+}
+
+// TOCEntry is an entry of a book's table of contents. Href is the archive
+// path of the content document it points to, with any fragment, or a URL
+// for links outside the book.
+type TOCEntry struct {
+	Title    string     `json:"title"`
+	Href     string     `json:"href,omitempty"`
+	Children []TOCEntry `json:"children,omitempty"`
+}
+
+// TOC reads the book's table of contents: the NCX named by the spine, or
+// failing that the EPUB 3 navigation document. It returns nil if the book
+// has neither.
+func (b *Book) TOC() ([]TOCEntry, error) {
+	entries, tocPath, err := b.parseTOC(path.Dir(b.PackagePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table of contents %s: %w", tocPath, err)
+	}
+	return entries, nil
+}
+
+// bookTOC is a book's table of contents, reduced to the content files it
+// lists
+type bookTOC struct {
+	// path is the archive path of the NCX or navigation document read, or
+	// "" if the book has neither
+	path string
+	// files are the content files listed, in order and without repeats
+	files []string
+	// titles maps each listed file to the title of its first entry
+	titles map[string]string
+}
+
+// readTOC reads the book's table of contents and reduces it to content
+// files. On failure, the returned table of contents still has its path.
+func (b *Book) readTOC(contentDir string) (bookTOC, error) {
+	entries, tocPath, err := b.parseTOC(contentDir)
+	toc := bookTOC{path: tocPath}
+	if err != nil || tocPath == "" {
+		return toc, err
+	}
+
+	toc.titles = make(map[string]string)
+	var add func(entries []TOCEntry)
+	add = func(entries []TOCEntry) {
+		for _, entry := range entries {
+			file, _, _ := strings.Cut(entry.Href, "#")
+			if _, seen := toc.titles[file]; file != "" && !isExternalLink(file) && !seen {
+				toc.titles[file] = entry.Title
+				toc.files = append(toc.files, file)
+			}
+			add(entry.Children)
+		}
+	}
+	add(entries)
+	return toc, nil
+}
+
+// parseTOC reads the NCX named by the spine, or failing that the EPUB 3
+// navigation document. The returned path is that of the file read, or "" if
+// the book has neither.
+func (b *Book) parseTOC(contentDir string) ([]TOCEntry, string, error) {
+	pkg := &b.Package
+	var ncxHref, navHref string
+	for _, item := range pkg.Manifest.Items {
+		switch {
+		case pkg.Spine.Toc != "" && item.ID == pkg.Spine.Toc:
+			ncxHref = item.Href
+		case ncxHref == "" && item.MediaType == "application/x-dtbncx+xml":
+			ncxHref = item.Href
+		case slices.Contains(strings.Fields(item.Properties), "nav"):
+			navHref = item.Href
+		}
+	}
+
+	var tocPath string
+	var entries []TOCEntry
+	switch {
+	case ncxHref != "":
+		tocPath = resolveHref(contentDir, ncxHref)
+		var ncx NCX
+		if err := b.parseXML(tocPath, &ncx); err != nil {
+			return nil, tocPath, err
+		}
+		entries = navPointEntries(ncx.NavPoints)
+	case navHref != "":
+		tocPath = resolveHref(contentDir, navHref)
+		content, err := b.readFile(tocPath, 0)
+		if err != nil {
+			return nil, tocPath, err
+		}
+		if err := checkXMLLimits([]byte(content), b.opts.limits()); err != nil {
+			return nil, tocPath, err
+		}
+		entries = navTOCEntries(content)
+	default:
+		return nil, "", nil
+	}
+	resolveTOCHrefs(entries, path.Dir(tocPath))
+	return entries, tocPath, nil
+}
+
+// resolveTOCHrefs resolves the hrefs of entries, which are relative to dir,
+// to archive paths
+func resolveTOCHrefs(entries []TOCEntry, dir string) {
+	for i := range entries {
+		href := strings.TrimSpace(entries[i].Href)
+		if file, fragment, _ := strings.Cut(href, "#"); file != "" && !isExternalLink(file) {
+			href = resolveHref(dir, file)
+			if fragment != "" {
+				href += "#" + fragment
+			}
+		}
+		entries[i].Href = href
+		resolveTOCHrefs(entries[i].Children, dir)
+	}
+}
+
+func navPointEntries(points []navPoint) []TOCEntry {
+	var entries []TOCEntry
+	for _, point := range points {
+		entries = append(entries, TOCEntry{
+			Title:    strings.Join(strings.Fields(point.Label), " "),
+			Href:     point.Content.Src,
+			Children: navPointEntries(point.NavPoints),
+		})
+	}
+	return entries
+}
+
+// tocNode is an entry of a table of contents being read
+type tocNode struct {
+	entry    TOCEntry
+	children []*tocNode
+}
+
+func (n *tocNode) entries() []TOCEntry {
+	var entries []TOCEntry
+	for _, child := range n.children {
+		entry := child.entry
+		entry.Children = child.entries()
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// navTOCEntries returns the entries of the epub:type="toc" <nav> in an EPUB
+// 3 navigation document. Each <li> is an entry, titled by its <a> or, for
+// headings that don't link anywhere, <span>, with a nested <ol> holding its
+// children.
+func navTOCEntries(content string) []TOCEntry {
+	d := newXMLDecoder([]byte(content))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	root := &tocNode{}
+	// open holds the <li> elements being read, innermost last, along with
+	// the nesting depth each started at
+	open := []*tocNode{root}
+	var openDepths []int
+	var title strings.Builder
+	var label *tocNode // the entry titled by the open <a> or <span>
+	navDepth := 0      // nesting depth inside the toc <nav>, 0 outside it
+	labelDepth := 0    // navDepth of the open <a> or <span>, 0 outside one
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return root.entries()
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if navDepth == 0 {
+				if t.Name.Local == "nav" && slices.Contains(strings.Fields(xmlAttr(t, "type")), "toc") {
+					navDepth = 1
+				}
+				continue
+			}
+			navDepth++
+			node := open[len(open)-1]
+			switch {
+			case t.Name.Local == "li":
+				child := &tocNode{}
+				node.children = append(node.children, child)
+				open = append(open, child)
+				openDepths = append(openDepths, navDepth)
+			case (t.Name.Local == "a" || t.Name.Local == "span") && labelDepth == 0:
+				label = node
+				if node == root || node.entry.Title != "" || node.entry.Href != "" {
+					if t.Name.Local != "a" {
+						continue
+					}
+					// A link outside an <li>, or after the one titling it
+					label = &tocNode{}
+					node.children = append(node.children, label)
+				}
+				label.entry.Href = xmlAttr(t, "href")
+				labelDepth = navDepth
+				title.Reset()
+			}
+		case xml.CharData:
+			if labelDepth > 0 {
+				title.Write(t)
+			}
+		case xml.EndElement:
+			if navDepth == 0 {
+				continue
+			}
+			if labelDepth > 0 && navDepth == labelDepth {
+				label.entry.Title = strings.Join(strings.Fields(title.String()), " ")
+				labelDepth = 0
+			}
+			if len(openDepths) > 0 && navDepth == openDepths[len(openDepths)-1] {
+				open = open[:len(open)-1]
+				openDepths = openDepths[:len(openDepths)-1]
+			}
+			navDepth--
+			if navDepth == 0 {
+				// Only the first toc <nav> is read
+				return root.entries()
+			}
+		}
+	}
+}
+
+// xmlAttr returns the value of the attribute with the given local name
+func xmlAttr(t xml.StartElement, name string) string {
+	for _, attr := range t.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// orderMismatch is a content file whose position among the files listed in
+// both the spine and the table of contents differs between the two
+type orderMismatch struct {
+	file     string
+	spinePos int // 1-based
+	tocPos   int // 1-based
+}
+
+// compareOrder returns the files of spine and toc that appear in a different
+// position in each, considering only the files listed in both
+func compareOrder(spine, toc []string) []orderMismatch {
+	inSpine := make(map[string]bool)
+	for _, file := range spine {
+		inSpine[file] = true
+	}
+	tocPos := make(map[string]int)
+	for _, file := range toc {
+		if inSpine[file] {
+			tocPos[file] = len(tocPos) + 1
+		}
+	}
+
+	var mismatches []orderMismatch
+	spinePos := 0
+	for _, file := range spine {
+		pos, ok := tocPos[file]
+		if !ok {
+			continue
+		}
+		spinePos++
+		if pos != spinePos {
+			mismatches = append(mismatches, orderMismatch{file: file, spinePos: spinePos, tocPos: pos})
+		}
+	}
+	return mismatches
+}
+
+// formatMismatches describes up to the first five mismatches
+func formatMismatches(mismatches []orderMismatch) string {
+	const shown = 5
+	var parts []string
+	for i, m := range mismatches {
+		if i == shown {
+			parts = append(parts, fmt.Sprintf(msg("OrderMore", "and %d more"), len(mismatches)-shown))
+			break
+		}
+		parts = append(parts, fmt.Sprintf(msg("OrderMismatch", "%s is #%d in the spine but #%d in the table of contents"), m.file, m.spinePos, m.tocPos))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// reorderByTOC puts the spine files in table of contents order. Files the
+// table of contents doesn't list stay after the file preceding them in the
+// spine, so untitled continuation files travel with their chapter, and files
+// before the first listed one stay at the start.
+func reorderByTOC(spine, toc []string) []string {
+	tocPos := make(map[string]int)
+	for i, file := range toc {
+		tocPos[file] = i
+	}
+
+	var lead []string
+	var groups [][]string
+	for _, file := range spine {
+		if _, ok := tocPos[file]; ok {
+			groups = append(groups, []string{file})
+		} else if len(groups) == 0 {
+			lead = append(lead, file)
+		} else {
+			groups[len(groups)-1] = append(groups[len(groups)-1], file)
+		}
+	}
+	slices.SortStableFunc(groups, func(a, b []string) int {
+		return tocPos[a[0]] - tocPos[b[0]]
+	})
+
+	ordered := lead
+	for _, group := range groups {
+		ordered = append(ordered, group...)
+	}
+	return ordered
+}
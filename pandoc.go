@@ -0,0 +1,440 @@
+package epubconv
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Output formats for Options.Format
+const (
+	FormatText   = "txt"
+	FormatPandoc = "pandoc-json"
+	FormatJSON   = "json"
+)
+
+var Formats = []string{FormatText, FormatPandoc, FormatJSON}
+
+// pandocAPIVersion is the version of the Pandoc AST the JSON output follows
+var pandocAPIVersion = []int{1, 23, 1}
+
+// pandocNode is a block, inline or metadata value of a Pandoc AST, encoded
+// the way pandoc's JSON reader expects: {"t": type, "c": contents}
+type pandocNode struct {
+	T string `json:"t"`
+	C any    `json:"c,omitempty"`
+}
+
+// pandocNoAttr is an empty Pandoc attribute: no identifier, classes or
+// key-value pairs
+var pandocNoAttr = []any{"", []string{}, [][2]string{}}
+
+// pandocBlockFrame is an open element holding blocks: the document itself,
+// a block quote, a list or a list item
+type pandocBlockFrame struct {
+	name   string // "" for the document
+	blocks []pandocNode
+	// items holds the items of a list, and start the first number of an
+	// ordered one
+	items [][]pandocNode
+	start int
+}
+
+// pandocInlineFrame is an open element holding inlines: the paragraph or
+// heading being built, or emphasis, strong emphasis or a link within it
+type pandocInlineFrame struct {
+	name    string // HTML element name, "" for the paragraph
+	kind    string // Pandoc inline type
+	href    string
+	inlines []pandocNode
+}
+
+// pandocBuilder turns XHTML content into Pandoc blocks. Headings,
+// paragraphs, lists, block quotes, preformatted text, rules, emphasis, links,
+// line breaks and images in imageLinks are kept; everything else contributes
+// only its text.
+type pandocBuilder struct {
+	// clean is applied to every piece of text
+	clean func(string) string
+	// imageLinks maps archive paths of images to where the document refers
+	// to them, as Options.ImageLinks
+	imageLinks map[string]string
+	// path is the archive path of the content document being added
+	path string
+
+	blocks  []pandocBlockFrame
+	inlines []pandocInlineFrame
+	header  int  // heading level of the paragraph being built, 0 if none
+	space   bool // whitespace seen since the last word
+	words   bool // a word precedes on the current line
+	pre     *strings.Builder
+	skip    string // element whose content is being skipped
+}
+
+func newPandocBuilder(imageLinks map[string]string, clean func(string) string) *pandocBuilder {
+	return &pandocBuilder{
+		clean:      clean,
+		imageLinks: imageLinks,
+		blocks:     []pandocBlockFrame{{blocks: []pandocNode{}}},
+		inlines:    []pandocInlineFrame{{}},
+	}
+}
+
+// pandocBlockElements end the paragraph being built when they open or close
+var pandocBlockElements = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "aside": true,
+	"header": true, "footer": true, "nav": true, "main": true, "body": true,
+	"figure": true, "figcaption": true, "table": true, "caption": true,
+	"tr": true, "td": true, "th": true, "dl": true, "dt": true, "dd": true,
+}
+
+// add appends the blocks of the content document at the archive path
+// docPath. Parse limits aren't checked again here, as the text of every
+// document is extracted first.
+func (b *pandocBuilder) add(docPath, content string) {
+	b.path = docPath
+	walkHTML(content, func(tok html.Token) error {
+		if tok.Type == html.TextToken {
+			b.text(tok.Data)
+		} else {
+			b.tag(tokenTag(tok))
+		}
+		return nil
+	})
+	b.endParagraph()
+}
+
+func (b *pandocBuilder) tag(t htmlTag) {
+	switch {
+	case b.skip == "head" && t.name == "body" && !t.closing:
+		// The head's end tag is optional
+		b.skip = ""
+	case b.skip != "":
+		if t.closing && t.name == b.skip {
+			b.skip = ""
+		}
+		return
+	case b.pre != nil:
+		if t.closing && t.name == "pre" {
+			code := strings.Trim(b.pre.String(), "\n")
+			b.pre = nil
+			b.appendBlock(pandocNode{T: "CodeBlock", C: []any{pandocNoAttr, code}})
+		}
+		return
+	}
+
+	switch t.name {
+	case "head", "script", "style", "template":
+		if !t.closing && !t.selfClosing {
+			b.skip = t.name
+		}
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		b.endParagraph()
+		if !t.closing {
+			b.header = int(t.name[1] - '0')
+		}
+	case "pre":
+		b.endParagraph()
+		if !t.closing {
+			b.pre = new(strings.Builder)
+		}
+	case "hr":
+		b.endParagraph()
+		b.appendBlock(pandocNode{T: "HorizontalRule"})
+	case "br":
+		b.appendInline(pandocNode{T: "LineBreak"})
+		b.space, b.words = false, false
+	case "blockquote", "ul", "ol":
+		b.endParagraph()
+		if t.closing {
+			b.closeBlock(t.name)
+		} else {
+			frame := pandocBlockFrame{name: t.name, blocks: []pandocNode{}, items: [][]pandocNode{}, start: 1}
+			if n, err := strconv.Atoi(t.attrs["start"]); err == nil {
+				frame.start = n
+			}
+			b.blocks = append(b.blocks, frame)
+		}
+	case "li":
+		b.endParagraph()
+		if t.closing {
+			b.closeBlock("li")
+			return
+		}
+		if b.blocks[len(b.blocks)-1].name == "li" {
+			// An unclosed <li> ends at its next sibling
+			b.closeBlock("li")
+		}
+		if name := b.blocks[len(b.blocks)-1].name; name == "ul" || name == "ol" {
+			b.blocks = append(b.blocks, pandocBlockFrame{name: "li", blocks: []pandocNode{}})
+		}
+	case "em", "i", "cite", "strong", "b":
+		if t.closing {
+			b.closeInline(t.name)
+		} else if !t.selfClosing {
+			kind := "Emph"
+			if t.name == "strong" || t.name == "b" {
+				kind = "Strong"
+			}
+			b.openInline(pandocInlineFrame{name: t.name, kind: kind})
+		}
+	case "a":
+		if t.closing {
+			b.closeInline("a")
+		} else if href := t.attrs["href"]; href != "" && !t.selfClosing {
+			b.openInline(pandocInlineFrame{name: "a", kind: "Link", href: href})
+		}
+	case "img", "image", "svg:image":
+		if t.closing {
+			return
+		}
+		src := t.attrs["src"]
+		if t.name != "img" {
+			src = t.attrs["xlink:href"]
+			if src == "" {
+				src = t.attrs["href"]
+			}
+		}
+		if link := imageLink(b.imageLinks, b.path, src); link != "" {
+			b.image(link, b.clean(t.attrs["alt"]), b.clean(t.attrs["title"]))
+		}
+	default:
+		if pandocBlockElements[t.name] {
+			b.endParagraph()
+		}
+	}
+}
+
+// text adds character data, collapsing whitespace as a browser would
+func (b *pandocBuilder) text(s string) {
+	if b.skip != "" {
+		return
+	}
+	s = b.clean(strings.ReplaceAll(s, "\u00a0", " "))
+	if b.pre != nil {
+		b.pre.WriteString(s)
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		b.space = b.space || s != ""
+		return
+	}
+	if s[0] == ' ' || s[0] == '\t' || s[0] == '\n' || s[0] == '\r' {
+		b.space = true
+	}
+	for i, word := range words {
+		if (i > 0 || b.space) && b.words {
+			b.appendInline(pandocNode{T: "Space"})
+		}
+		b.appendInline(pandocNode{T: "Str", C: word})
+		b.words = true
+	}
+	last := s[len(s)-1]
+	b.space = last == ' ' || last == '\t' || last == '\n' || last == '\r'
+}
+
+// image adds an image inline referring to link, with the alternative text
+// alt
+func (b *pandocBuilder) image(link, alt, title string) {
+	if b.space && b.words {
+		b.appendInline(pandocNode{T: "Space"})
+	}
+	alts := pandocWords(alt)
+	if alts == nil {
+		alts = []pandocNode{}
+	}
+	b.appendInline(pandocNode{T: "Image", C: []any{pandocNoAttr, alts, []string{link, strings.TrimSpace(title)}}})
+	b.space, b.words = false, true
+}
+
+func (b *pandocBuilder) appendInline(node pandocNode) {
+	top := &b.inlines[len(b.inlines)-1]
+	top.inlines = append(top.inlines, node)
+}
+
+func (b *pandocBuilder) appendBlock(node pandocNode) {
+	top := &b.blocks[len(b.blocks)-1]
+	top.blocks = append(top.blocks, node)
+}
+
+// openInline opens an inline element, leaving any whitespace before it
+// outside it
+func (b *pandocBuilder) openInline(frame pandocInlineFrame) {
+	if b.space && b.words {
+		b.appendInline(pandocNode{T: "Space"})
+		b.space = false
+	}
+	b.inlines = append(b.inlines, frame)
+}
+
+// closeInline closes the innermost open inline element with the given name,
+// and any left open inside it
+func (b *pandocBuilder) closeInline(name string) {
+	for j := len(b.inlines) - 1; j > 0; j-- {
+		if b.inlines[j].name == name {
+			for len(b.inlines) > j {
+				b.popInline()
+			}
+			return
+		}
+	}
+}
+
+func (b *pandocBuilder) popInline() {
+	frame := b.inlines[len(b.inlines)-1]
+	b.inlines = b.inlines[:len(b.inlines)-1]
+	if len(frame.inlines) == 0 {
+		return
+	}
+	switch frame.kind {
+	case "Link":
+		b.appendInline(pandocNode{T: "Link", C: []any{pandocNoAttr, frame.inlines, []string{frame.href, ""}}})
+	default:
+		b.appendInline(pandocNode{T: frame.kind, C: frame.inlines})
+	}
+}
+
+// endParagraph finishes the paragraph or heading being built, if any
+func (b *pandocBuilder) endParagraph() {
+	for len(b.inlines) > 1 {
+		b.popInline()
+	}
+	inlines := b.inlines[0].inlines
+	for len(inlines) > 0 && (inlines[len(inlines)-1].T == "Space" || inlines[len(inlines)-1].T == "LineBreak") {
+		inlines = inlines[:len(inlines)-1]
+	}
+	if len(inlines) > 0 {
+		if b.header > 0 {
+			b.appendBlock(pandocNode{T: "Header", C: []any{b.header, pandocNoAttr, inlines}})
+		} else {
+			b.appendBlock(pandocNode{T: "Para", C: inlines})
+		}
+	}
+	b.inlines[0].inlines = nil
+	b.header = 0
+	b.space, b.words = false, false
+}
+
+// closeBlock closes the innermost open block element with the given name,
+// and any left open inside it
+func (b *pandocBuilder) closeBlock(name string) {
+	for j := len(b.blocks) - 1; j > 0; j-- {
+		if b.blocks[j].name == name {
+			for len(b.blocks) > j {
+				b.popBlock()
+			}
+			return
+		}
+	}
+}
+
+func (b *pandocBuilder) popBlock() {
+	frame := b.blocks[len(b.blocks)-1]
+	b.blocks = b.blocks[:len(b.blocks)-1]
+	parent := &b.blocks[len(b.blocks)-1]
+	switch frame.name {
+	case "li":
+		parent.items = append(parent.items, frame.blocks)
+	case "ul":
+		parent.blocks = append(parent.blocks, pandocNode{T: "BulletList", C: frame.items})
+	case "ol":
+		attrs := []any{frame.start, pandocNode{T: "Decimal"}, pandocNode{T: "Period"}}
+		parent.blocks = append(parent.blocks, pandocNode{T: "OrderedList", C: []any{attrs, frame.items}})
+	case "blockquote":
+		parent.blocks = append(parent.blocks, pandocNode{T: "BlockQuote", C: frame.blocks})
+	}
+}
+
+// document closes anything left open and returns the Pandoc JSON document,
+// with the book's title, authors, language and page progression direction
+// as its metadata
+func (b *pandocBuilder) document(pkg *Package) (string, error) {
+	b.endParagraph()
+	for len(b.blocks) > 1 {
+		b.popBlock()
+	}
+
+	meta := make(map[string]pandocNode)
+	if titles := trimAll(pkg.Metadata.Titles); len(titles) > 0 {
+		meta["title"] = pandocNode{T: "MetaInlines", C: pandocWords(strings.Join(titles, " - "))}
+	}
+	if creators := pkg.Metadata.CreatorNames(); len(creators) > 0 {
+		var authors []pandocNode
+		for _, creator := range creators {
+			authors = append(authors, pandocNode{T: "MetaInlines", C: pandocWords(creator)})
+		}
+		meta["author"] = pandocNode{T: "MetaList", C: authors}
+	}
+	if languages := trimAll(pkg.Metadata.Languages); len(languages) > 0 {
+		meta["lang"] = pandocNode{T: "MetaString", C: languages[0]}
+	}
+	if dir := strings.ToLower(strings.TrimSpace(pkg.Spine.PageProgressionDirection)); dir == DirectionRTL || dir == DirectionLTR {
+		meta["dir"] = pandocNode{T: "MetaString", C: dir}
+	}
+
+	doc := struct {
+		APIVersion []int                 `json:"pandoc-api-version"`
+		Meta       map[string]pandocNode `json:"meta"`
+		Blocks     []pandocNode          `json:"blocks"`
+	}{pandocAPIVersion, meta, b.blocks[0].blocks}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// pandocStats counts the words and characters of the text in a Pandoc JSON
+// document, for the corpus report
+func pandocStats(doc string) (words, characters int) {
+	var root any
+	if err := json.Unmarshal([]byte(doc), &root); err != nil {
+		return 0, 0
+	}
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			switch v["t"] {
+			case "Str":
+				if s, ok := v["c"].(string); ok {
+					words += countWords(s)
+					characters += utf8.RuneCountInString(s)
+				}
+			case "Space", "LineBreak":
+				characters++
+			default:
+				walk(v["c"])
+			}
+		case []any:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	if doc, ok := root.(map[string]any); ok {
+		walk(doc["blocks"])
+	}
+	return words, characters
+}
+
+// pandocWords splits s into Str and Space inlines
+func pandocWords(s string) []pandocNode {
+	var inlines []pandocNode
+	for i, word := range strings.Fields(s) {
+		if i > 0 {
+			inlines = append(inlines, pandocNode{T: "Space"})
+		}
+		inlines = append(inlines, pandocNode{T: "Str", C: word})
+	}
+	return inlines
+}
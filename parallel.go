@@ -0,0 +1,66 @@
+package epubconv
+
+import "sync"
+
+// parallelism is the number of content documents to convert at once.
+// ExpandAbbreviations carries state from one document to the next, so
+// with it they are converted one at a time.
+func (o Options) parallelism() int {
+	if o.ExpandAbbreviations {
+		return 1
+	}
+	return max(o.Parallelism, 1)
+}
+
+// convertInOrder calls convert for each of n content documents, with up to
+// parallelism calls at once, and passes the results to use in order, one at
+// a time. A document is only started once fewer than parallelism results
+// are waiting or in progress, so the text held is bounded. It stops at the
+// first error use returns, after the calls already started finish.
+func convertInOrder(n, parallelism int, convert func(i int) chapterResult, use func(i int, result chapterResult) error) error {
+	if parallelism <= 1 {
+		for i := 0; i < n; i++ {
+			if err := use(i, convert(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	results := make([]chan chapterResult, n)
+	for i := range results {
+		results[i] = make(chan chapterResult, 1)
+	}
+	slots := make(chan struct{}, parallelism)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(done)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] <- convert(i)
+			}(i)
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		result := <-results[i]
+		err := use(i, result)
+		<-slots
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
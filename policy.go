@@ -0,0 +1,248 @@
+package epubconv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"gopkg.in/yaml.v3"
+)
+
+// policyFile is the YAML rules file read with --rules:
+//
+//	rules:
+//	  - name: email addresses
+//	    match: '[\w.+-]+@[\w-]+(\.[\w-]+)+'
+//	    replace: '[email]'
+//	  - name: answer key
+//	    class: answers
+//	    action: drop
+//	  - name: internal appendices
+//	    chapter: '^Appendix'
+//	    action: drop
+type policyFile struct {
+	Rules []policyFileRule `yaml:"rules"`
+}
+
+type policyFileRule struct {
+	Name    string  `yaml:"name"`
+	Match   string  `yaml:"match"`
+	Class   string  `yaml:"class"`
+	Chapter string  `yaml:"chapter"`
+	Action  string  `yaml:"action"`
+	Replace *string `yaml:"replace"`
+}
+
+// Policy rule actions
+const (
+	actionRedact = "redact"
+	actionDrop   = "drop"
+)
+
+// defaultRedaction replaces redacted text when a rule doesn't say otherwise
+const defaultRedaction = "[REDACTED]"
+
+// policyRule applies to the paragraphs matching all of its selectors: the
+// match pattern, the class of an enclosing element and the chapter name
+type policyRule struct {
+	name    string
+	match   *regexp.Regexp
+	class   string
+	chapter *regexp.Regexp
+	// drop removes the paragraph. Otherwise text matching match, or the
+	// whole paragraph if there's no match pattern, becomes replace, which
+	// can refer to capture groups as $1.
+	drop    bool
+	replace string
+}
+
+// Policy is a set of redaction and transform rules, evaluated in order on
+// every paragraph of the text
+type Policy struct {
+	rules []policyRule
+	// classes holds the element classes the rules select on
+	classes map[string]bool
+}
+
+// LoadPolicy reads and compiles the rules file at path
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+
+	var file policyFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse rules file: %w", err)
+	}
+
+	p := &Policy{classes: make(map[string]bool)}
+	for i, r := range file.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		rule := policyRule{name: name, class: r.Class, replace: defaultRedaction}
+		if r.Match == "" && r.Class == "" && r.Chapter == "" {
+			return nil, fmt.Errorf("rule %s has no match, class or chapter", name)
+		}
+		if r.Match != "" {
+			if rule.match, err = regexp.Compile(r.Match); err != nil {
+				return nil, fmt.Errorf("rule %s: invalid match pattern: %w", name, err)
+			}
+		}
+		if r.Chapter != "" {
+			if rule.chapter, err = regexp.Compile(r.Chapter); err != nil {
+				return nil, fmt.Errorf("rule %s: invalid chapter pattern: %w", name, err)
+			}
+		}
+		switch r.Action {
+		case "", actionRedact:
+		case actionDrop:
+			rule.drop = true
+		default:
+			return nil, fmt.Errorf("rule %s: unknown action %q (valid: %s, %s)", name, r.Action, actionRedact, actionDrop)
+		}
+		if r.Replace != nil {
+			rule.replace = *r.Replace
+		}
+		if r.Class != "" {
+			p.classes[r.Class] = true
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// classMarker delimits the start and end of an element with a class the
+// rules select on in the extracted text, until the policy is applied:
+// "\x01+class\x01" opens the element and "\x01-class\x01" closes it
+const classMarker = "\x01"
+
+var classMarkerPattern = regexp.MustCompile(classMarker + `([+-])([^` + classMarker + `]*)` + classMarker)
+
+// openClass is an element with a class selected on by the rules whose end
+// tag hasn't been reached yet
+type openClass struct {
+	name    string
+	classes string
+}
+
+// selectedClasses returns those of the space-separated classes the rules
+// select on, or "" if none
+func (p *Policy) selectedClasses(classes string) string {
+	var selected []string
+	for _, class := range strings.Fields(classes) {
+		if p.classes[class] {
+			selected = append(selected, class)
+		}
+	}
+	return strings.Join(selected, " ")
+}
+
+// errHeadingRead stops reading a content document once its first heading
+// has been read
+var errHeadingRead = errors.New("heading read")
+
+// chapterName returns the text of the first heading in a content document,
+// which chapter rules match against, or "" if it has none
+func chapterName(content string) string {
+	var heading string
+	var name strings.Builder
+	walkHTML(content, func(tok html.Token) error {
+		switch {
+		case heading == "":
+			if tok.Type == html.StartTagToken && isHeading(tok.Data) {
+				heading = tok.Data
+			}
+		case tok.Type == html.TextToken:
+			name.WriteString(tok.Data)
+		case tok.Type == html.EndTagToken && tok.Data == heading:
+			return errHeadingRead
+		default:
+			name.WriteByte(' ')
+		}
+		return nil
+	})
+	return strings.Join(strings.Fields(name.String()), " ")
+}
+
+// apply evaluates the rules on each paragraph (line) of the text of the
+// named chapter, removing the class markers
+func (p *Policy) apply(text, chapter string) string {
+	lines := strings.Split(text, "\n")
+
+	// Number of open elements with each class
+	open := make(map[string]int)
+	var out []string
+	for _, line := range lines {
+		// A paragraph is in every class open at its start or opened in it
+		inClass := make(map[string]bool)
+		for class, n := range open {
+			inClass[class] = n > 0
+		}
+		marked := false
+		for _, m := range classMarkerPattern.FindAllStringSubmatch(line, -1) {
+			marked = true
+			for _, class := range strings.Fields(m[2]) {
+				if m[1] == "+" {
+					open[class]++
+					inClass[class] = true
+				} else if open[class] > 0 {
+					open[class]--
+				}
+			}
+		}
+		if marked {
+			line = strings.TrimSpace(classMarkerPattern.ReplaceAllString(line, ""))
+			if line == "" {
+				continue
+			}
+		}
+
+		// Rules see headings without their marker
+		level, line := cutHeading(line)
+		keep := true
+		line, _ = keepAnchors(line, func(line string) (string, error) {
+			line, keep = p.applyRules(line, chapter, inClass)
+			return line, nil
+		})
+		if keep {
+			if level > 0 {
+				line = headingMarker + string(rune('0'+level)) + line
+			}
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// applyRules evaluates the rules on one paragraph, reporting false if it
+// is dropped
+func (p *Policy) applyRules(line, chapter string, inClass map[string]bool) (string, bool) {
+	if line == "" {
+		return line, true
+	}
+	for _, rule := range p.rules {
+		switch {
+		case rule.chapter != nil && !rule.chapter.MatchString(chapter),
+			rule.class != "" && !inClass[rule.class],
+			rule.match != nil && !rule.match.MatchString(line):
+			continue
+		case rule.drop:
+			return "", false
+		case rule.match != nil:
+			line = rule.match.ReplaceAllString(line, rule.replace)
+		default:
+			line = rule.replace
+		}
+	}
+	return line, true
+}
@@ -0,0 +1,30 @@
+package epubconv
+
+import (
+	"archive/zip"
+	"path/filepath"
+)
+
+// previewFiles returns the leading content files that make up at least
+// percent of the book, so a preview only needs to convert those. Sizes are
+// the uncompressed sizes in the zip headers, which are only an estimate of
+// the text each file holds but are known without reading anything.
+func previewFiles(reader *zip.Reader, files []string, percent int) []string {
+	sizes := make(map[string]int64)
+	for _, file := range reader.File {
+		sizes[filepath.ToSlash(file.Name)] = int64(file.UncompressedSize64)
+	}
+
+	var total int64
+	for _, file := range files {
+		total += sizes[filepath.ToSlash(file)]
+	}
+	var sum int64
+	for i, file := range files {
+		sum += sizes[filepath.ToSlash(file)]
+		if sum*100 >= total*int64(percent) {
+			return files[:i+1]
+		}
+	}
+	return files
+}
@@ -0,0 +1,25 @@
+package epubconv
+
+// Progress is how far the conversion of a book has got. It is passed to
+// Options.Progress before each content document in the reading order is
+// converted, and once more after the last.
+type Progress struct {
+	// Name is the Name option, identifying the book
+	Name string
+	// Done is how many of the Total content documents have been converted
+	Done, Total int
+	// Path is the archive path of the content document converted next, or
+	// "" once they all are
+	Path string
+}
+
+// progress reports to the Progress option and Logger, if set, that done of
+// total content documents have been converted and path is next
+func (b *Book) progress(done, total int, path string) {
+	if b.opts.Progress != nil {
+		b.opts.Progress(Progress{Name: b.opts.Name, Done: done, Total: total, Path: path})
+	}
+	if b.opts.Logger != nil && done > 0 {
+		b.opts.Logger.Debug("converted content document", "book", b.opts.Name, "done", done, "total", total)
+	}
+}
@@ -0,0 +1,226 @@
+package epubconv
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// htmlExtensions are the file extensions of the content documents a book is
+// read from when its package document can't be
+var htmlExtensions = map[string]string{
+	".xhtml": "application/xhtml+xml",
+	".xht":   "application/xhtml+xml",
+	".html":  "text/html",
+	".htm":   "text/html",
+}
+
+// readPackage reads the package document that META-INF/container.xml names
+func (b *Book) readPackage() error {
+	var container Container
+	if err := b.parseXML("META-INF/container.xml", &container); err != nil {
+		return fmt.Errorf("failed to parse container.xml: %w", err)
+	}
+	if len(container.Rootfiles.Rootfile) == 0 {
+		return errors.New("no rootfile found in container.xml")
+	}
+	b.PackagePath = filepath.ToSlash(container.Rootfiles.Rootfile[0].FullPath)
+	if err := b.parseXML(b.PackagePath, &b.Package); err != nil {
+		return fmt.Errorf("failed to parse content.opf: %w", err)
+	}
+	return nil
+}
+
+// recoverPackage reads what it can of the package document after
+// readPackage failed with err: the one found in the archive if
+// container.xml doesn't name one there, leniently if it is malformed, and
+// if it can't be read at all, nothing, leaving recoverSpine to find the
+// content documents
+func (b *Book) recoverPackage(err error) {
+	b.Package = Package{}
+	if b.PackagePath == "" || b.quiet().findFile(b.PackagePath) == nil {
+		if !b.recoverPackagePath(err) {
+			return
+		}
+		if err = b.parseXML(b.PackagePath, &b.Package); err == nil {
+			return
+		}
+		err = fmt.Errorf("failed to parse content.opf: %w", err)
+		b.Package = Package{}
+	}
+	if lenientErr := b.parseXMLLenient(b.PackagePath, &b.Package); lenientErr != nil {
+		b.Package = Package{}
+		b.warnf(WarnRecovered, "WarnPackageUnusable", "%v; %s can't be read even leniently", err, b.PackagePath)
+		return
+	}
+	b.warnf(WarnRecovered, "WarnPackageLenient", "%v; read %s leniently", err, b.PackagePath)
+}
+
+// recoverPackagePath looks for the package document in the archive after
+// reading container.xml failed with err. Of several .opf files it takes the
+// one nearest the root, then the first by name. It returns false if there
+// is none.
+func (b *Book) recoverPackagePath(err error) bool {
+	var found []string
+	for _, file := range b.reader.File {
+		name := filepath.ToSlash(file.Name)
+		if strings.EqualFold(path.Ext(name), ".opf") && !slices.Contains(found, name) {
+			found = append(found, name)
+		}
+	}
+	if len(found) == 0 {
+		b.PackagePath = ""
+		b.warnf(WarnRecovered, "WarnNoPackage", "%v; no package document found in the archive", err)
+		return false
+	}
+	slices.SortFunc(found, func(x, y string) int {
+		if d := strings.Count(x, "/") - strings.Count(y, "/"); d != 0 {
+			return d
+		}
+		return strings.Compare(x, y)
+	})
+	b.PackagePath = found[0]
+	b.warnf(WarnRecovered, "WarnPackageFound", "%v; using the package document %s found in the archive", err, b.PackagePath)
+	return true
+}
+
+// parseXMLLenient parses the XML file at path into v like parseXML, but
+// expanding the entities its DOCTYPE declares, leaving undeclared entities
+// as text and closing unclosed elements
+func (b *Book) parseXMLLenient(path string, v interface{}) error {
+	data, err := b.readXML(path)
+	if err != nil {
+		return err
+	}
+	content, err := expandEntities(string(data))
+	if err != nil {
+		return err
+	}
+	d := newXMLDecoder([]byte(content))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	return d.Decode(v)
+}
+
+// cleanManifest leaves out the manifest items without an id or href, and
+// those repeating the id of an earlier item, with a warning for each
+func (b *Book) cleanManifest() {
+	items := b.Manifest.Items[:0]
+	seen := make(map[string]bool)
+	for _, item := range b.Manifest.Items {
+		item.ID, item.Href = strings.TrimSpace(item.ID), strings.TrimSpace(item.Href)
+		switch {
+		case item.ID == "" || item.Href == "":
+			b.warnf(WarnRecovered, "WarnManifestIncomplete", "%s: skipped a manifest item without an id or href (id %q, href %q)", b.PackagePath, item.ID, item.Href)
+		case seen[item.ID]:
+			b.warnf(WarnRecovered, "WarnManifestDuplicate", "%s: skipped the manifest item %s with the repeated id %q", b.PackagePath, item.Href, item.ID)
+		default:
+			seen[item.ID] = true
+			items = append(items, item)
+		}
+	}
+	b.Manifest.Items = items
+}
+
+// hasSpine reports whether an item of the spine is in the manifest
+func (b *Book) hasSpine() bool {
+	ids := make(map[string]bool)
+	for _, item := range b.Manifest.Items {
+		ids[item.ID] = true
+	}
+	for _, itemref := range b.Spine.Itemrefs {
+		if ids[itemref.IDRef] {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverSpine makes a spine for a book whose package document gives none
+// that can be read: of the manifest's content documents in manifest order,
+// or failing that of the archive's HTML files in the order of their names
+func (b *Book) recoverSpine() {
+	var spine []Itemref
+	for _, item := range b.Manifest.Items {
+		mediaType, _, _ := strings.Cut(strings.ToLower(item.MediaType), ";")
+		mediaType = strings.TrimSpace(mediaType)
+		if contentMediaTypes[mediaType] && mediaType != "image/svg+xml" && !isNavItem(item) {
+			spine = append(spine, Itemref{IDRef: item.ID})
+		}
+	}
+	if len(spine) > 0 {
+		b.Spine.Itemrefs = spine
+		b.warnf(WarnRecovered, "WarnSpineFromManifest", "%s has no usable spine; reading its %d manifest content documents in manifest order", b.PackagePath, len(spine))
+		return
+	}
+
+	b.Spine.Itemrefs = nil
+	var names []string
+	for _, file := range b.reader.File {
+		name := filepath.ToSlash(file.Name)
+		if _, ok := htmlExtensions[strings.ToLower(path.Ext(name))]; ok && !strings.HasPrefix(name, "META-INF/") && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	slices.SortFunc(names, compareNatural)
+	dir := path.Dir(b.PackagePath)
+	for i, name := range names {
+		href := name
+		if isWithinDir(dir, name) && dir != "." {
+			href = strings.TrimPrefix(name, dir+"/")
+		} else if dir != "." {
+			href = "/" + name
+		}
+		id := fmt.Sprintf("recovered-%d", i+1)
+		b.Manifest.Items = append(b.Manifest.Items, ManifestItem{ID: id, Href: href, MediaType: htmlExtensions[strings.ToLower(path.Ext(name))]})
+		b.Spine.Itemrefs = append(b.Spine.Itemrefs, Itemref{IDRef: id})
+	}
+	b.warnf(WarnRecovered, "WarnSpineFromArchive", "no usable spine; reading the %d HTML files of the archive in the order of their names", len(names))
+}
+
+// isNavItem reports whether item is the EPUB 3 navigation document
+func isNavItem(item ManifestItem) bool {
+	return slices.Contains(strings.Fields(item.Properties), "nav")
+}
+
+// compareNatural orders archive paths by name, comparing runs of digits by
+// their value, so that chapter2.xhtml comes before chapter10.xhtml
+func compareNatural(x, y string) int {
+	for x != "" && y != "" {
+		if isDigit(x[0]) && isDigit(y[0]) {
+			nx, ny := digitRun(x), digitRun(y)
+			vx, vy := strings.TrimLeft(x[:nx], "0"), strings.TrimLeft(y[:ny], "0")
+			if d := len(vx) - len(vy); d != 0 {
+				return d
+			}
+			if c := strings.Compare(vx, vy); c != 0 {
+				return c
+			}
+			x, y = x[nx:], y[ny:]
+			continue
+		}
+		if c := strings.Compare(strings.ToLower(x[:1]), strings.ToLower(y[:1])); c != 0 {
+			return c
+		}
+		x, y = x[1:], y[1:]
+	}
+	return len(x) - len(y)
+}
+
+// digitRun returns the length of the run of ASCII digits s starts with
+func digitRun(s string) int {
+	n := 0
+	for n < len(s) && isDigit(s[n]) {
+		n++
+	}
+	return n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
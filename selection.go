@@ -0,0 +1,291 @@
+package epubconv
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// chapterSpan is a range of chapter positions, counting from 1. Zero is
+// open-ended.
+type chapterSpan struct {
+	first, last int
+}
+
+// parseChapterRange parses a comma-separated list of chapter positions and
+// ranges, such as "3-7", "-2,10-" or "5"
+func parseChapterRange(s string) ([]chapterSpan, error) {
+	invalid := fmt.Errorf(msg("ErrChapterRange", "invalid chapter range %q (e.g. 3-7, -2, 10- or 1,4-6)"), s)
+	var spans []chapterSpan
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+		var span chapterSpan
+		var err error
+		if first = strings.TrimSpace(first); first != "" {
+			if span.first, err = strconv.Atoi(first); err != nil || span.first < 1 {
+				return nil, invalid
+			}
+		}
+		if !isRange {
+			span.last = span.first
+		} else if last = strings.TrimSpace(last); last != "" {
+			if span.last, err = strconv.Atoi(last); err != nil || span.last < 1 {
+				return nil, invalid
+			}
+		}
+		if span == (chapterSpan{}) || span.last != 0 && span.last < span.first {
+			return nil, invalid
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+// contains reports whether the span includes position n
+func (s chapterSpan) contains(n int) bool {
+	return n >= s.first && (s.last == 0 || n <= s.last)
+}
+
+// frontMatterTypes are the EPUB 3 structural semantics and EPUB 2 guide
+// types of the documents SkipFrontMatter leaves out
+var frontMatterTypes = map[string]bool{
+	"cover": true, "titlepage": true, "title-page": true, "halftitlepage": true,
+	"copyright-page": true, "dedication": true, "toc": true, "loi": true,
+	"lot": true, "index": true, "colophon": true, "imprint": true,
+	"seriespage": true, "other-credits": true,
+}
+
+// frontMatterNames are the file names and table of contents titles, reduced
+// to lower case letters, of front and back matter in books without the
+// semantics to say so
+var frontMatterNames = map[string]bool{
+	"cover": true, "titlepage": true, "title": true, "halftitle": true,
+	"copyright": true, "copyrightpage": true, "dedication": true, "toc": true,
+	"contents": true, "tableofcontents": true, "index": true, "colophon": true,
+}
+
+// frontMatterName reduces a file name or title to the lower case letters
+// frontMatterNames are written in
+func frontMatterName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+// selectChapters narrows the content files, in reading order, to those
+// opts.ChapterRange, opts.From and opts.SkipFrontMatter select. Documents
+// that only say they are front matter in their own markup are left out as
+// they are converted, by isFrontMatter.
+func (b *Book) selectChapters(files []string, toc bookTOC, opts Options) ([]string, error) {
+	total := len(files)
+	if opts.ChapterRange != "" {
+		spans, err := parseChapterRange(opts.ChapterRange)
+		if err != nil {
+			return nil, err
+		}
+		var selected []string
+		for i, file := range files {
+			if slices.ContainsFunc(spans, func(s chapterSpan) bool { return s.contains(i + 1) }) {
+				selected = append(selected, file)
+			}
+		}
+		if len(selected) == 0 {
+			return nil, fmt.Errorf(msg("ErrChapterRangeEmpty", "chapter range %q selects none of the book's %d chapters"), opts.ChapterRange, total)
+		}
+		files = selected
+	}
+
+	if opts.From != "" {
+		start := b.findChapter(files, toc, opts.From)
+		if start < 0 {
+			return nil, fmt.Errorf(msg("ErrFromNotFound", "no chapter titled %q"), opts.From)
+		}
+		files = files[start:]
+	}
+
+	if opts.SkipFrontMatter {
+		marked := b.frontMatterFiles()
+		// Going by names alone, only the documents before the first and
+		// after the last that isn't front or back matter are left out
+		named := func(file string) bool {
+			stem := strings.TrimSuffix(path.Base(file), path.Ext(file))
+			return frontMatterNames[frontMatterName(stem)] || frontMatterNames[frontMatterName(toc.titles[file])]
+		}
+		first, last := 0, len(files)
+		for first < last && (marked[files[first]] || named(files[first])) {
+			first++
+		}
+		for last > first && (marked[files[last-1]] || named(files[last-1])) {
+			last--
+		}
+		var selected []string
+		for i, file := range files {
+			if i >= first && i < last && !marked[file] {
+				selected = append(selected, file)
+			}
+		}
+		files = selected
+	}
+	return files, nil
+}
+
+// findChapter returns the index of the first of files titled title in the
+// table of contents or, failing that, by its first heading, or -1
+func (b *Book) findChapter(files []string, toc bookTOC, title string) int {
+	for i, file := range files {
+		if titleMatches(toc.titles[file], title) {
+			return i
+		}
+	}
+	quiet := b.quiet()
+	for i, file := range files {
+		content, err := quiet.readFile(file, 0)
+		if err != nil {
+			continue
+		}
+		if titleMatches(chapterName(quiet.decodeContent(file, content)), title) {
+			return i
+		}
+	}
+	return -1
+}
+
+// titleMatches reports whether a chapter with the title have matches the
+// title want: the same, ignoring case and spacing, or starting with it
+// followed by something other than a letter or digit, so that "Chapter 1"
+// matches "Chapter 1: Dawn" but not "Chapter 12"
+func titleMatches(have, want string) bool {
+	have = strings.ToLower(strings.Join(strings.Fields(have), " "))
+	want = strings.ToLower(strings.Join(strings.Fields(want), " "))
+	if want == "" || !strings.HasPrefix(have, want) {
+		return false
+	}
+	rest := []rune(have[len(want):])
+	return len(rest) == 0 || !unicode.IsLetter(rest[0]) && !unicode.IsDigit(rest[0])
+}
+
+// frontMatterFiles returns the content files the package document, or the
+// navigation document's landmarks, mark as front or back matter
+func (b *Book) frontMatterFiles() map[string]bool {
+	pkg := &b.Package
+	contentDir := path.Dir(b.PackagePath)
+	files := make(map[string]bool)
+	items := make(map[string]ManifestItem)
+	var navPath string
+	for _, item := range pkg.Manifest.Items {
+		items[item.ID] = item
+		if slices.Contains(strings.Fields(item.Properties), "nav") {
+			navPath = resolveHref(contentDir, item.Href)
+			// In the spine, the navigation document is a table of contents
+			files[navPath] = true
+		}
+	}
+	for _, itemref := range pkg.Spine.Itemrefs {
+		if item, ok := items[itemref.IDRef]; ok && itemref.Linear == "no" {
+			files[resolveHref(contentDir, item.Href)] = true
+		}
+	}
+	for _, ref := range pkg.Guide.References {
+		if file, _, _ := strings.Cut(ref.Href, "#"); file != "" && frontMatterTypes[strings.ToLower(ref.Type)] {
+			files[resolveHref(contentDir, file)] = true
+		}
+	}
+
+	if navPath == "" {
+		return files
+	}
+	quiet := b.quiet()
+	content, err := quiet.readFile(navPath, 0)
+	if err != nil {
+		return files
+	}
+	inLandmarks := 0
+	var open []string
+	walkHTML(content, func(tok html.Token) error {
+		if tok.Type == html.TextToken {
+			return nil
+		}
+		t := tokenTag(tok)
+		switch {
+		case t.closing:
+			if len(open) > 0 && open[len(open)-1] == t.name {
+				open = open[:len(open)-1]
+			}
+			if inLandmarks > len(open) {
+				inLandmarks = 0
+			}
+		case t.selfClosing || voidElements[t.name]:
+		default:
+			open = append(open, t.name)
+			if t.name == "nav" && hasType(t.attrs, "landmarks") {
+				inLandmarks = len(open)
+			}
+			if inLandmarks == 0 || t.name != "a" {
+				return nil
+			}
+			file, _, _ := strings.Cut(t.attrs["href"], "#")
+			for _, epubType := range strings.Fields(t.attrs["epub:type"]) {
+				if file != "" && frontMatterTypes[epubType] {
+					files[resolveHref(path.Dir(navPath), file)] = true
+				}
+			}
+		}
+		return nil
+	})
+	return files
+}
+
+// errMatterRead stops reading a content document once it is known whether
+// it is front matter
+var errMatterRead = errors.New("front matter read")
+
+// isFrontMatter reports whether a content document marks itself as front
+// or back matter, with the epub:type or role of its body or the first
+// section in it
+func isFrontMatter(content string) bool {
+	found := false
+	inBody := false
+	walkHTML(content, func(tok html.Token) error {
+		if tok.Type == html.TextToken {
+			if inBody && strings.TrimSpace(tok.Data) != "" {
+				return errMatterRead
+			}
+			return nil
+		}
+		if tok.Type != html.StartTagToken {
+			return nil
+		}
+		t := tokenTag(tok)
+		switch t.name {
+		case "body", "section", "div", "aside", "nav", "header":
+		default:
+			if inBody {
+				return errMatterRead
+			}
+			return nil
+		}
+		inBody = true
+		types := strings.Fields(t.attrs["epub:type"])
+		for _, role := range strings.Fields(t.attrs["role"]) {
+			types = append(types, strings.TrimPrefix(role, "doc-"))
+		}
+		for _, epubType := range types {
+			if frontMatterTypes[epubType] {
+				found = true
+				return errMatterRead
+			}
+		}
+		return nil
+	})
+	return found
+}
@@ -0,0 +1,82 @@
+package epubconv
+
+import (
+	"path"
+	"strings"
+)
+
+// contentMediaTypes are the media types of the spine items whose text can
+// be extracted. A spine item of another type, such as an image or a
+// foreign document, is read through its manifest fallback chain instead.
+var contentMediaTypes = map[string]bool{
+	"application/xhtml+xml": true,
+	"text/html":             true,
+	"text/x-oeb1-document":  true,
+	"image/svg+xml":         true,
+}
+
+// nonlinearMarker is the line put before the text of each spine item marked
+// linear="no" that IncludeNonlinear appends after the rest of the book
+const nonlinearMarker = "[Non-linear content]"
+
+// spineFiles is the reading order of a book's spine as archive paths
+type spineFiles struct {
+	// linear are the content files of the main reading order
+	linear []string
+	// nonlinear are those of the items marked linear="no", such as notes
+	// or answers, in spine order
+	nonlinear []string
+	// missing counts the spine items that aren't in the manifest
+	missing int
+}
+
+// readSpine resolves the spine items of the book to content files,
+// following the fallback chain of any item that isn't a content document
+// to one that is
+func (b *Book) readSpine() spineFiles {
+	pkg := &b.Package
+	contentDir := path.Dir(b.PackagePath)
+	items := make(map[string]ManifestItem)
+	for _, item := range pkg.Manifest.Items {
+		items[item.ID] = item
+	}
+
+	var files spineFiles
+	for _, itemref := range pkg.Spine.Itemrefs {
+		item, ok := items[itemref.IDRef]
+		if !ok {
+			files.missing++
+			continue
+		}
+		item = contentFallback(item, items)
+		fullPath := resolveHref(contentDir, item.Href)
+		if strings.HasPrefix(item.Href, "/") || !isWithinDir(contentDir, fullPath) {
+			b.warnf(WarnOutsideHref, "WarnOutsideHref", "%s refers to %s outside the package directory %s", b.PackagePath, fullPath, contentDir)
+		}
+		if strings.TrimSpace(itemref.Linear) == "no" {
+			files.nonlinear = append(files.nonlinear, fullPath)
+		} else {
+			files.linear = append(files.linear, fullPath)
+		}
+	}
+	return files
+}
+
+// contentFallback follows the fallback chain of item to the first item that
+// is a content document. It returns item itself if it is one, if its media
+// type isn't given, or if no item of the chain is one.
+func contentFallback(item ManifestItem, items map[string]ManifestItem) ManifestItem {
+	seen := make(map[string]bool)
+	for next := item; ; {
+		mediaType, _, _ := strings.Cut(strings.ToLower(next.MediaType), ";")
+		mediaType = strings.TrimSpace(mediaType)
+		if mediaType == "" || contentMediaTypes[mediaType] {
+			return next
+		}
+		seen[next.ID] = true
+		var ok bool
+		if next, ok = items[strings.TrimSpace(next.Fallback)]; !ok || seen[next.ID] {
+			return item
+		}
+	}
+}
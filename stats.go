@@ -0,0 +1,115 @@
+package epubconv
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Reading speeds ReadingMinutes is estimated at: silent reading of prose,
+// in words a minute, and in characters a minute for languages written
+// without spaces between words
+const (
+	WordsPerMinute      = 238
+	CharactersPerMinute = 500
+)
+
+// unspacedLanguages are the languages written without spaces between words,
+// whose reading time goes by characters
+var unspacedLanguages = map[string]bool{"ja": true, "zh": true, "th": true}
+
+// Stats are counts of a book's converted text. Language is detected from
+// the text, and DeclaredLanguage is the first language of the metadata.
+type Stats struct {
+	Words            int    `json:"words"`
+	Characters       int    `json:"characters"`
+	Chapters         int    `json:"chapters"`
+	ReadingMinutes   int    `json:"readingMinutes"`
+	Language         string `json:"language,omitempty"`
+	DeclaredLanguage string `json:"declaredLanguage,omitempty"`
+}
+
+// Stats converts the book chapter by chapter and counts its words and
+// characters, estimates its reading time and detects its language. Format
+// and Header are ignored.
+func (b *Book) Stats() (Stats, error) {
+	chapters, err := b.chapters(false)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{Chapters: len(chapters)}
+	var text strings.Builder
+	visible := 0
+	for _, chapter := range chapters {
+		stats.Words += countWords(chapter.Text)
+		characters := utf8.RuneCountInString(chapter.Text)
+		stats.Characters += characters
+		visible += characters - countSpaces(chapter.Text)
+		if text.Len() < languageSampleSize*4 {
+			text.WriteString(chapter.Text)
+		}
+	}
+	stats.Language = DetectLanguage(text.String())
+	if languages := trimAll(b.Metadata.Languages); len(languages) > 0 {
+		stats.DeclaredLanguage = languages[0]
+	}
+
+	if unspacedLanguages[stats.Language] {
+		stats.ReadingMinutes = (visible + CharactersPerMinute - 1) / CharactersPerMinute
+	} else {
+		stats.ReadingMinutes = (stats.Words + WordsPerMinute - 1) / WordsPerMinute
+	}
+	return stats, nil
+}
+
+// countWords counts the words of text, the runs of characters between
+// white space. In a run holding characters of a script written without
+// spaces between words, such as Chinese, Japanese or Thai, each of those
+// counts as a word, as telling where their words end would take a
+// dictionary, and so does each run of other characters between them and
+// punctuation.
+func countWords(text string) int {
+	words := 0
+	for _, field := range strings.Fields(text) {
+		if !strings.ContainsFunc(field, isUnspacedRune) {
+			words++
+			continue
+		}
+		inWord := false
+		for _, r := range field {
+			switch {
+			case isUnspacedRune(r):
+				words++
+				inWord = false
+			case unicode.IsMark(r):
+				// A combining mark stays with the character before it
+			case unicode.IsPunct(r) || unicode.IsSymbol(r):
+				inWord = false
+			case !inWord:
+				words++
+				inWord = true
+			}
+		}
+	}
+	return words
+}
+
+// isUnspacedRune reports whether r is a letter of a script written without
+// spaces between words, counted by countWords as a word of its own
+func isUnspacedRune(r rune) bool {
+	return (unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Thai, unicode.Lao, unicode.Khmer, unicode.Myanmar) &&
+		!unicode.IsMark(r) && !unicode.IsPunct(r)) ||
+		r == 'ー' || r == '々'
+}
+
+// countSpaces counts the white space characters of s
+func countSpaces(s string) int {
+	n := 0
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,33 @@
+package epubconv
+
+import "testing"
+
+func TestCountWords(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want int
+	}{
+		{"empty", "", 0},
+		{"latin", "The quick brown fox", 4},
+		{"latin with punctuation", "Well, it's \"done\", isn't it?", 5},
+		{"latin with combining accents", "café näive", 2},
+		{"japanese", "今日は良い天気です。", 9},
+		{"prolonged sound mark", "ラーメンを食べた", 8},
+		{"chinese", "我爱读书", 4},
+		{"thai", "ภาษาไทย", 7},
+		{"thai with combining marks", "ง่าย", 3},
+		{"thai sentence", "ภาษาไทย ง่าย", 10},
+		{"mixed run", "Hello世界", 3},
+		{"mixed run with punctuation", "日本語(Japanese)です", 6},
+		{"mixed with spaces", "Hello世界 안녕 하세요", 5},
+		{"digits between characters", "第3章", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := countWords(test.text); got != test.want {
+				t.Errorf("countWords(%q) = %d, want %d", test.text, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package epubconv
+
+import (
+	"strings"
+)
+
+// Table styles for Options.Tables
+const (
+	TablesFlatten  = "flatten"
+	TablesASCII    = "ascii"
+	TablesMarkdown = "markdown"
+)
+
+var TableStyles = []string{TablesFlatten, TablesASCII, TablesMarkdown}
+
+// tableMarker starts a line of a rendered table in the extracted text,
+// which the layout options leave as it is, until they are applied
+const tableMarker = "\x03"
+
+// tableCell is a cell of a table being read
+type tableCell struct {
+	text    string
+	header  bool
+	colspan int
+	rowspan int
+}
+
+// tableRow is a row of a table being read. It is a header row if it is in
+// the table's <thead> or all its cells are <th>.
+type tableRow struct {
+	cells  []tableCell
+	header bool
+}
+
+// tableState is the table being read, outside any other. The text of each
+// cell is taken out of the extracted text as the cell ends, and the table
+// is rendered in its place at </table>.
+type tableState struct {
+	rows   []tableRow
+	inHead bool
+	// rowOpen is set between the start and end of a row
+	rowOpen bool
+	// cellStart is the length of the extracted text when the cell being
+	// read started, or -1 outside a cell
+	cellStart int
+	cell      tableCell
+}
+
+// tableTag handles the tags that give a table its structure, if tables
+// are rendered. Tables inside a table are flattened into its cells.
+func (e *textExtractor) tableTag(t htmlTag) {
+	if t.name == "table" {
+		switch {
+		case !t.closing && !t.selfClosing:
+			e.tableDepth++
+			if e.tableDepth == 1 {
+				e.table = &tableState{cellStart: -1}
+			}
+		case t.closing && e.tableDepth > 0:
+			e.tableDepth--
+			if e.tableDepth == 0 {
+				e.endRow()
+				e.writeTable(e.table)
+				e.table = nil
+			}
+		}
+		return
+	}
+	if e.tableDepth != 1 {
+		return
+	}
+	table := e.table
+	switch t.name {
+	case "thead", "tbody", "tfoot":
+		e.endRow()
+		table.inHead = t.name == "thead" && !t.closing
+	case "tr":
+		e.endRow()
+		table.rowOpen = !t.closing && !t.selfClosing
+		if table.rowOpen {
+			table.rows = append(table.rows, tableRow{header: table.inHead})
+		}
+	case "td", "th":
+		e.endCell()
+		if t.closing || t.selfClosing {
+			return
+		}
+		if !table.rowOpen {
+			table.rowOpen = true
+			table.rows = append(table.rows, tableRow{header: table.inHead})
+		}
+		table.cell = tableCell{header: t.name == "th", colspan: spanAttr(t.attrs["colspan"]), rowspan: spanAttr(t.attrs["rowspan"])}
+		table.cellStart = e.text.Len()
+	}
+}
+
+// spanAttr parses a colspan or rowspan attribute, which is 1 if missing or
+// invalid and at most 100
+func spanAttr(s string) int {
+	n := 0
+	for _, c := range strings.TrimSpace(s) {
+		if c < '0' || c > '9' {
+			break
+		}
+		n = min(n*10+int(c-'0'), 100)
+	}
+	return max(n, 1)
+}
+
+// endCell takes the text of the cell being read, if any, out of the
+// extracted text and adds the cell to its row
+func (e *textExtractor) endCell() {
+	table := e.table
+	if table.cellStart < 0 {
+		return
+	}
+	text := string(e.text.Bytes()[table.cellStart:])
+	e.text.Truncate(table.cellStart)
+	e.clampMarks(table.cellStart)
+	table.cell.text = strings.Join(strings.Fields(removeHeadingMarkers(text)), " ")
+	row := &table.rows[len(table.rows)-1]
+	row.cells = append(row.cells, table.cell)
+	table.cellStart = -1
+}
+
+// endRow ends the cell and row being read, if any
+func (e *textExtractor) endRow() {
+	e.endCell()
+	if table := e.table; table.rowOpen {
+		table.rowOpen = false
+		row := &table.rows[len(table.rows)-1]
+		if len(row.cells) == 0 {
+			table.rows = table.rows[:len(table.rows)-1]
+			return
+		}
+		if !row.header {
+			row.header = true
+			for _, cell := range row.cells {
+				row.header = row.header && cell.header
+			}
+		}
+	}
+}
+
+// clampMarks moves the positions in the extracted text noted by open
+// elements back to n, where the text has been cut
+func (e *textExtractor) clampMarks(n int) {
+	for i := range e.openLinks {
+		e.openLinks[i].start = min(e.openLinks[i].start, n)
+	}
+	for i := range e.openAbbrs {
+		e.openAbbrs[i].start = min(e.openAbbrs[i].start, n)
+	}
+	for i := range e.openIDs {
+		e.openIDs[i].start = min(e.openIDs[i].start, n)
+	}
+	for i := range e.openNoterefs {
+		e.openNoterefs[i].start = min(e.openNoterefs[i].start, n)
+	}
+	for i := range e.anchors {
+		e.anchors[i].pos = min(e.anchors[i].pos, n)
+	}
+	e.listMark = min(e.listMark, n)
+}
+
+// gridCell is a cell of a table laid out on its grid. A cell spanning
+// several columns is followed by span-1 covered ones.
+type gridCell struct {
+	text    string
+	span    int
+	covered bool
+}
+
+// layoutGrid places the cells of rows on a grid of columns, leaving empty
+// cells where a cell of a row above spans down
+func layoutGrid(rows []tableRow) [][]gridCell {
+	var grid [][]gridCell
+	// pending is the number of rows more a cell in each column spans down
+	var pending []int
+	columns := 0
+	for _, row := range rows {
+		var line []gridCell
+		col := 0
+		next := func() {
+			for col < len(pending) && pending[col] > 0 {
+				pending[col]--
+				line = append(line, gridCell{span: 1})
+				col++
+			}
+		}
+		for _, cell := range row.cells {
+			next()
+			line = append(line, gridCell{text: cell.text, span: cell.colspan})
+			for i := 0; i < cell.colspan; i++ {
+				if i > 0 {
+					line = append(line, gridCell{covered: true})
+				}
+				for len(pending) <= col {
+					pending = append(pending, 0)
+				}
+				pending[col] = cell.rowspan - 1
+				col++
+			}
+		}
+		next()
+		columns = max(columns, len(line))
+		grid = append(grid, line)
+	}
+	for i := range grid {
+		for len(grid[i]) < columns {
+			grid[i] = append(grid[i], gridCell{span: 1})
+		}
+	}
+	return grid
+}
+
+// writeTable renders table in place of its cells' text, in the table style
+func (e *textExtractor) writeTable(table *tableState) {
+	grid := layoutGrid(table.rows)
+	if len(grid) == 0 || len(grid[0]) == 0 {
+		return
+	}
+	headers := 0
+	for headers < len(table.rows) && table.rows[headers].header {
+		headers++
+	}
+
+	var lines []string
+	if e.opts.Tables == TablesMarkdown {
+		lines = markdownTable(grid, headers)
+	} else {
+		lines = asciiTable(grid, headers)
+	}
+	e.newline()
+	for _, line := range lines {
+		if e.opts.hasLayout() {
+			e.text.WriteString(tableMarker)
+		}
+		e.text.WriteString(line + "\n")
+	}
+}
+
+// columnWidths returns the display width of each column of grid, at least
+// minWidth, widening the last column a spanning cell covers if it needs more
+// room than its columns and the separators between them give it
+func columnWidths(grid [][]gridCell, minWidth, separator int) []int {
+	widths := make([]int, len(grid[0]))
+	for i := range widths {
+		widths[i] = minWidth
+	}
+	for _, line := range grid {
+		for col, cell := range line {
+			if !cell.covered && cell.span == 1 {
+				widths[col] = max(widths[col], displayWidth(cell.text))
+			}
+		}
+	}
+	for _, line := range grid {
+		for col, cell := range line {
+			if cell.covered || cell.span == 1 {
+				continue
+			}
+			last := min(col+cell.span, len(widths)) - 1
+			room := separator * (last - col)
+			for i := col; i <= last; i++ {
+				room += widths[i]
+			}
+			if need := displayWidth(cell.text); need > room {
+				widths[last] += need - room
+			}
+		}
+	}
+	return widths
+}
+
+// pad pads s with spaces to width display columns
+func pad(s string, width int) string {
+	return s + strings.Repeat(" ", max(width-displayWidth(s), 0))
+}
+
+// asciiTable renders grid as aligned ASCII columns, with its leading
+// header rows ruled off with "="
+func asciiTable(grid [][]gridCell, headers int) []string {
+	widths := columnWidths(grid, 1, 3)
+	rule := func(c string) string {
+		var b strings.Builder
+		b.WriteString("+")
+		for _, w := range widths {
+			b.WriteString(strings.Repeat(c, w+2) + "+")
+		}
+		return b.String()
+	}
+
+	lines := []string{rule("-")}
+	for i, line := range grid {
+		var b strings.Builder
+		b.WriteString("|")
+		for col, cell := range line {
+			if cell.covered {
+				continue
+			}
+			width := widths[col]
+			for i := col + 1; i < col+cell.span && i < len(widths); i++ {
+				width += 3 + widths[i]
+			}
+			b.WriteString(" " + pad(cell.text, width) + " |")
+		}
+		lines = append(lines, b.String())
+		if i == headers-1 && headers < len(grid) {
+			lines = append(lines, rule("="))
+		}
+	}
+	return append(lines, rule("-"))
+}
+
+// markdownTable renders grid as a GitHub Flavored Markdown table. Its first
+// header row is the table's header, or an empty one if it has none, and a
+// spanning cell's text goes in the first of its columns.
+func markdownTable(grid [][]gridCell, headers int) []string {
+	cells := make([][]string, len(grid))
+	for i, line := range grid {
+		for _, cell := range line {
+			cells[i] = append(cells[i], strings.ReplaceAll(cell.text, "|", `\|`))
+		}
+	}
+	if headers == 0 {
+		cells = append([][]string{make([]string, len(grid[0]))}, cells...)
+	}
+
+	widths := make([]int, len(grid[0]))
+	for i := range widths {
+		widths[i] = 3
+		for _, line := range cells {
+			widths[i] = max(widths[i], displayWidth(line[i]))
+		}
+	}
+	row := func(line []string) string {
+		var b strings.Builder
+		b.WriteString("|")
+		for i, text := range line {
+			b.WriteString(" " + pad(text, widths[i]) + " |")
+		}
+		return b.String()
+	}
+
+	lines := []string{row(cells[0])}
+	var b strings.Builder
+	b.WriteString("|")
+	for _, w := range widths {
+		b.WriteString(" " + strings.Repeat("-", w) + " |")
+	}
+	lines = append(lines, b.String())
+	for _, line := range cells[1:] {
+		lines = append(lines, row(line))
+	}
+	return lines
+}